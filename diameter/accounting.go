@@ -0,0 +1,257 @@
+package diameter
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Accounting-Record-Type，RFC 6733 9.8.1
+const (
+	AcctRecordEvent   = 1
+	AcctRecordStart   = 2
+	AcctRecordInterim = 3
+	AcctRecordStop    = 4
+)
+
+var acctRecordTypeNames = map[uint32]string{
+	AcctRecordEvent:   "EVENT",
+	AcctRecordStart:   "START",
+	AcctRecordInterim: "INTERIM",
+	AcctRecordStop:    "STOP",
+}
+
+// 计费会话状态
+const (
+	AcctStateOpen    = "open"
+	AcctStateStopped = "stopped"
+	AcctStateEvent   = "event"
+)
+
+const defaultAcctRetention = 3600 // 秒
+
+// AccountingConfig 计费配置
+type AccountingConfig struct {
+	InterimInterval int `json:"interim_interval"` // 大于0时在ACA中带Acct-Interim-Interval，要求客户端按此间隔上报，秒
+	Retention       int `json:"retention"`        // 已结束的计费会话保留时间，秒，默认3600
+}
+
+func (c *AccountingConfig) retention() time.Duration {
+	if c.Retention <= 0 {
+		return defaultAcctRetention * time.Second
+	}
+	return time.Duration(c.Retention) * time.Second
+}
+
+// AccountingSession 一个计费会话累计的用量，用量取最近一次上报的值(START/INTERIM/STOP中的用量都是从会话开始累计的)
+type AccountingSession struct {
+	SessionID        string    `json:"session_id"`
+	SubSessionID     uint64    `json:"sub_session_id,omitempty"`
+	OriginHost       string    `json:"origin_host"`
+	UserName         string    `json:"user_name,omitempty"`
+	State            string    `json:"state"`
+	StartedAt        time.Time `json:"started_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+	StoppedAt        time.Time `json:"stopped_at,omitempty"`
+	LastRecordNumber uint32    `json:"last_record_number"`
+	Records          int       `json:"records"`
+	InputOctets      uint64    `json:"input_octets"`
+	OutputOctets     uint64    `json:"output_octets"`
+	InputPackets     uint64    `json:"input_packets"`
+	OutputPackets    uint64    `json:"output_packets"`
+	SessionTime      uint32    `json:"session_time"` // 秒
+}
+
+// accountingStore 内存中的计费记录，按Session-Id(和Accounting-Sub-Session-Id)索引
+type accountingStore struct {
+	mu       sync.Mutex
+	sessions map[string]*AccountingSession
+}
+
+var acctStore = &accountingStore{sessions: make(map[string]*AccountingSession)}
+
+func acctKey(sessionID string, subSessionID uint64) string {
+	if subSessionID == 0 {
+		return sessionID
+	}
+	return fmt.Sprintf("%s/%d", sessionID, subSessionID)
+}
+
+// 记录一条计费记录，按记录类型和Accounting-Record-Number检查顺序，返回非0结果码表示拒绝
+// duplicate为true表示记录号与上一条相同，是重传，不重复累计
+func (s *accountingStore) record(msg *DiameterMsg, peerHost string) (resultCode uint32, duplicate bool, err error) {
+	sessionID := msg.GetSessionID()
+	recordType := avpIntData(msg, AVP_AccountingRecordType)
+	recordNumber := avpIntData(msg, AVP_AccountingRecordNumber)
+	var subSessionID uint64
+	if avp, _ := msg.FindAVPByCode(AVP_AccountingSubSessionId); avp != nil {
+		subSessionID = avp.GetInt64Data()
+	}
+	key := acctKey(sessionID, subSessionID)
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(now)
+	session, ok := s.sessions[key]
+
+	switch recordType {
+	case AcctRecordStart:
+		if ok && session.State == AcctStateOpen {
+			if recordNumber == session.LastRecordNumber {
+				return 0, true, nil
+			}
+			return ResultCode_InvalidAVPValue, false, fmt.Errorf("accounting session %v already started", key)
+		}
+		session = &AccountingSession{SessionID: sessionID, SubSessionID: subSessionID, State: AcctStateOpen, StartedAt: now}
+		s.sessions[key] = session
+	case AcctRecordInterim, AcctRecordStop:
+		if !ok || session.State == AcctStateEvent {
+			return ResultCode_UnknownSessionID, false, fmt.Errorf("accounting session %v not started", key)
+		}
+		if session.State == AcctStateStopped {
+			if recordType == AcctRecordStop && recordNumber == session.LastRecordNumber {
+				return 0, true, nil
+			}
+			return ResultCode_UnknownSessionID, false, fmt.Errorf("accounting session %v already stopped", key)
+		}
+		if recordNumber == session.LastRecordNumber {
+			return 0, true, nil
+		}
+		if recordNumber < session.LastRecordNumber {
+			return ResultCode_InvalidAVPValue, false, fmt.Errorf("Accounting-Record-Number %d out of order, last %d", recordNumber, session.LastRecordNumber)
+		}
+	case AcctRecordEvent:
+		if ok {
+			if session.State != AcctStateEvent {
+				return ResultCode_InvalidAVPValue, false, fmt.Errorf("EVENT record for session %v in progress", key)
+			}
+			if recordNumber == session.LastRecordNumber {
+				return 0, true, nil
+			}
+			if recordNumber < session.LastRecordNumber {
+				return ResultCode_InvalidAVPValue, false, fmt.Errorf("Accounting-Record-Number %d out of order, last %d", recordNumber, session.LastRecordNumber)
+			}
+		} else {
+			session = &AccountingSession{SessionID: sessionID, SubSessionID: subSessionID, State: AcctStateEvent, StartedAt: now}
+			s.sessions[key] = session
+		}
+	default:
+		return ResultCode_InvalidAVPValue, false, fmt.Errorf("invalid Accounting-Record-Type %d", recordType)
+	}
+
+	session.OriginHost = peerHost
+	if userAVP, _ := msg.FindAVPByCode(AVP_UserName); userAVP != nil {
+		session.UserName = userAVP.GetStringData()
+	}
+	session.LastRecordNumber = recordNumber
+	session.Records++
+	session.UpdatedAt = now
+	if avp, _ := msg.FindAVPByCode(AVP_AccountingInputOctets); avp != nil {
+		session.InputOctets = avp.GetInt64Data()
+	}
+	if avp, _ := msg.FindAVPByCode(AVP_AccountingOutputOctets); avp != nil {
+		session.OutputOctets = avp.GetInt64Data()
+	}
+	if avp, _ := msg.FindAVPByCode(AVP_AccountingInputPackets); avp != nil {
+		session.InputPackets = avp.GetInt64Data()
+	}
+	if avp, _ := msg.FindAVPByCode(AVP_AccountingOutputPackets); avp != nil {
+		session.OutputPackets = avp.GetInt64Data()
+	}
+	if avp, _ := msg.FindAVPByCode(AVP_AcctSessionTime); avp != nil && avp.GetDataLength() >= 4 {
+		session.SessionTime = avp.GetIntData()
+	}
+	if recordType == AcctRecordStop {
+		session.State = AcctStateStopped
+		session.StoppedAt = now
+	}
+	return 0, false, nil
+}
+
+// 清理超过保留时间的已结束会话，调用方持有锁
+func (s *accountingStore) expire(now time.Time) {
+	retention := config.Accounting.retention()
+	for key, session := range s.sessions {
+		if session.State != AcctStateOpen && now.Sub(session.UpdatedAt) > retention {
+			delete(s.sessions, key)
+		}
+	}
+}
+
+// AccountingSessions 返回所有计费会话的快照，按开始时间排序
+func AccountingSessions() []AccountingSession {
+	acctStore.mu.Lock()
+	defer acctStore.mu.Unlock()
+	sessions := make([]AccountingSession, 0, len(acctStore.sessions))
+	for _, session := range acctStore.sessions {
+		sessions = append(sessions, *session)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].StartedAt.Before(sessions[j].StartedAt) })
+	return sessions
+}
+
+// GetAccountingSession 按Session-Id查询计费会话，有子会话时返回所有子会话
+func GetAccountingSession(sessionID string) []AccountingSession {
+	acctStore.mu.Lock()
+	defer acctStore.mu.Unlock()
+	sessions := make([]AccountingSession, 0)
+	for _, session := range acctStore.sessions {
+		if session.SessionID == sessionID {
+			sessions = append(sessions, *session)
+		}
+	}
+	return sessions
+}
+
+// 处理ACR，记录计费信息并回复ACA
+func handleACR(session *Session, msg *DiameterMsg) (*DiameterMsg, error) {
+	recordType := avpIntData(msg, AVP_AccountingRecordType)
+	recordNumber := avpIntData(msg, AVP_AccountingRecordNumber)
+	log.Printf("主机%v 计费请求 Session-Id: %v 类型: %v 记录号: %v", session.PeerHost, msg.GetSessionID(), acctRecordTypeNames[recordType], recordNumber)
+
+	builder := newAnswerBuilder(msg).
+		AddAVP(NewAVPBuilder(AVP_AccountingRecordType, AVPFlag_Mandatory).SetIntData(recordType).Build()).
+		AddAVP(NewAVPBuilder(AVP_AccountingRecordNumber, AVPFlag_Mandatory).SetIntData(recordNumber).Build())
+	for _, code := range []uint32{AVP_AcctApplicationId, AVP_AccountingSubSessionId, AVP_AcctSessionId, AVP_AcctMultiSessionId, AVP_UserName} {
+		if avp, _ := msg.FindAVPByCode(code); avp != nil {
+			builder.AddAVP(avp)
+		}
+	}
+
+	if session.State() != StateEstablished {
+		return builder.
+			AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(ResultCode_UnableToDeliver).Build()).
+			AddAVP(NewAVPBuilder(AVP_ErrorMessage, 0).SetStringData("session not established, send CER first").Build()).
+			Build(), nil
+	}
+
+	resultCode, duplicate, err := acctStore.record(msg, session.PeerHost)
+	if err != nil {
+		log.Printf("主机%v 计费记录不通过: %v", session.PeerHost, err)
+		return builder.
+			AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(resultCode).Build()).
+			AddAVP(NewAVPBuilder(AVP_ErrorMessage, 0).SetStringData(err.Error()).Build()).
+			Build(), nil
+	}
+	if duplicate {
+		log.Printf("主机%v 重复的计费记录 Session-Id: %v 记录号: %v，不重复累计", session.PeerHost, msg.GetSessionID(), recordNumber)
+	}
+	builder.AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(ResultCode_Success).Build())
+	if interval := config.Accounting.InterimInterval; interval > 0 && recordType != AcctRecordStop && recordType != AcctRecordEvent {
+		builder.AddAVP(NewAVPBuilder(AVP_AcctInterimInterval, AVPFlag_Mandatory).SetIntData(uint32(interval)).Build())
+	}
+	builder.AddAVP(NewAVPBuilder(AVP_EventTimestamp, AVPFlag_Mandatory).SetTimeData(time.Now()).Build())
+	return builder.Build(), nil
+}
+
+// 取Unsigned32/Enumerated类型AVP的值，没有时返回0
+func avpIntData(msg *DiameterMsg, code uint32) uint32 {
+	avp, _ := msg.FindAVPByCode(code)
+	if avp == nil || avp.GetDataLength() < 4 {
+		return 0
+	}
+	return avp.GetIntData()
+}
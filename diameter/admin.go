@@ -0,0 +1,290 @@
+package diameter
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// 管理接口，查看对端连接状态、运行指标等信息
+func startAdmin(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/peers", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, PeerStatuses())
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, Metrics())
+	})
+	// 计费用量，带session_id参数时只查该会话
+	mux.HandleFunc("/accounting", func(w http.ResponseWriter, r *http.Request) {
+		sessionID := r.URL.Query().Get("session_id")
+		if sessionID == "" {
+			writeJSON(w, http.StatusOK, AccountingSessions())
+			return
+		}
+		sessions := GetAccountingSession(sessionID)
+		if len(sessions) == 0 {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "accounting session not found"})
+			return
+		}
+		writeJSON(w, http.StatusOK, sessions)
+	})
+	// 向会话所属的对端发出RAR，type为Re-Auth-Request-Type，默认0(AUTHORIZE_ONLY)
+	mux.HandleFunc("/sessions/reauth", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "POST only"})
+			return
+		}
+		reAuthType := uint64(ReAuthAuthorizeOnly)
+		if t := r.URL.Query().Get("type"); t != "" {
+			var err error
+			if reAuthType, err = strconv.ParseUint(t, 10, 32); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid type"})
+				return
+			}
+		}
+		resultCode, err := SendReAuth(r.URL.Query().Get("session_id"), uint32(reAuthType))
+		writeSessionRequestResult(w, resultCode, err)
+	})
+	// 向会话所属的对端发出ASR
+	mux.HandleFunc("/sessions/abort", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "POST only"})
+			return
+		}
+		resultCode, err := SendAbortSession(r.URL.Query().Get("session_id"))
+		writeSessionRequestResult(w, resultCode, err)
+	})
+	mux.HandleFunc("/balances", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, CreditAccounts())
+	})
+	// 用户会话，带session_id参数时只查该会话
+	mux.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		sessionID := r.URL.Query().Get("session_id")
+		if sessionID == "" {
+			writeJSON(w, http.StatusOK, UserSessions())
+			return
+		}
+		session, ok := GetUserSession(sessionID)
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "session not found"})
+			return
+		}
+		writeJSON(w, http.StatusOK, session)
+	})
+	// HSS用户的SQN和MME/SGSN登记
+	mux.HandleFunc("/s6a/subscribers", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, HSSSubscribers())
+	})
+	// 向用户登记的MME/SGSN发出CLR，type为Cancellation-Type，默认2(SUBSCRIPTION_WITHDRAWAL)
+	mux.HandleFunc("/s6a/cancel", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "POST only"})
+			return
+		}
+		cancellationType := uint64(CancellationSubscriptionWithdrawal)
+		if t := r.URL.Query().Get("type"); t != "" {
+			var err error
+			if cancellationType, err = strconv.ParseUint(t, 10, 32); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid type"})
+				return
+			}
+		}
+		results, err := SendCancelLocation(r.URL.Query().Get("imsi"), uint32(cancellationType))
+		writeRequestResult(w, results, err)
+	})
+	// 向用户登记的MME/SGSN发出IDR，下发当前签约数据
+	mux.HandleFunc("/s6a/insert", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "POST only"})
+			return
+		}
+		results, err := SendInsertSubscriberData(r.URL.Query().Get("imsi"))
+		writeRequestResult(w, results, err)
+	})
+	// 向用户登记的MME/SGSN发出DSR，context_id逗号分隔，不带时删除全部APN签约
+	mux.HandleFunc("/s6a/delete", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "POST only"})
+			return
+		}
+		var contextIDs []uint32
+		if ids := r.URL.Query().Get("context_id"); ids != "" {
+			for _, id := range strings.Split(ids, ",") {
+				contextID, err := strconv.ParseUint(strings.TrimSpace(id), 10, 32)
+				if err != nil {
+					writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid context_id"})
+					return
+				}
+				contextIDs = append(contextIDs, uint32(contextID))
+			}
+		}
+		results, err := SendDeleteSubscriberData(r.URL.Query().Get("imsi"), contextIDs)
+		writeRequestResult(w, results, err)
+	})
+	// Gx会话当前生效的规则和QoS
+	mux.HandleFunc("/gx/sessions", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, GxSessions())
+	})
+	// 重新读取策略文件，向PCEF发出RAR下发变化，带session_id时只推送该会话，带subscriber时推送该用户的所有会话
+	mux.HandleFunc("/gx/push", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "POST only"})
+			return
+		}
+		if subscriber := r.URL.Query().Get("subscriber"); subscriber != "" {
+			results, err := PushGxSubscriberPolicy(subscriber)
+			writeRequestResult(w, results, err)
+			return
+		}
+		resultCode, err := PushGxPolicy(r.URL.Query().Get("session_id"))
+		if err == nil && resultCode == 0 {
+			writeJSON(w, http.StatusOK, map[string]string{"result": "policy not changed, no RAR sent"})
+			return
+		}
+		writeSessionRequestResult(w, resultCode, err)
+	})
+	// 本端作为PCRF时的Rx会话
+	mux.HandleFunc("/rx/sessions", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, RxSessions())
+	})
+	// 向AF发出RAR通知，action为Specific-Action，默认2(INDICATION_OF_LOSS_OF_BEARER)，component逗号分隔
+	mux.HandleFunc("/rx/notify", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "POST only"})
+			return
+		}
+		action := uint64(SpecificActionLossOfBearer)
+		if a := r.URL.Query().Get("action"); a != "" {
+			var err error
+			if action, err = strconv.ParseUint(a, 10, 32); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid action"})
+				return
+			}
+		}
+		var components []uint32
+		if numbers := r.URL.Query().Get("component"); numbers != "" {
+			for _, number := range strings.Split(numbers, ",") {
+				component, err := strconv.ParseUint(strings.TrimSpace(number), 10, 32)
+				if err != nil {
+					writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid component"})
+					return
+				}
+				components = append(components, uint32(component))
+			}
+		}
+		resultCode, err := SendRxNotification(r.URL.Query().Get("session_id"), uint32(action), components)
+		writeSessionRequestResult(w, resultCode, err)
+	})
+	// 向AF发出ASR，cause为Abort-Cause，默认0(BEARER_RELEASED)
+	mux.HandleFunc("/rx/abort", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "POST only"})
+			return
+		}
+		cause := uint64(AbortCauseBearerReleased)
+		if c := r.URL.Query().Get("cause"); c != "" {
+			var err error
+			if cause, err = strconv.ParseUint(c, 10, 32); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid cause"})
+				return
+			}
+		}
+		resultCode, err := SendRxAbort(r.URL.Query().Get("session_id"), uint32(cause))
+		writeSessionRequestResult(w, resultCode, err)
+	})
+	// 本端作为AF时的Rx会话和收到的通知
+	mux.HandleFunc("/rx/af/sessions", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, AFSessions())
+	})
+	// 作为AF执行场景目录下的场景文件，执行完成后返回
+	mux.HandleFunc("/rx/af/run", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "POST only"})
+			return
+		}
+		results, err := RunRxScenario(r.URL.Query().Get("file"))
+		if err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]interface{}{"error": err.Error(), "steps": results})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"steps": results})
+	})
+	// IMS HSS用户的注册状态和S-CSCF
+	mux.HandleFunc("/cx/subscribers", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, IMSSubscribers())
+	})
+	// 向用户的S-CSCF发出RTR，reason为Reason-Code，默认0(PERMANENT_TERMINATION)，info为Reason-Info
+	mux.HandleFunc("/cx/deregister", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "POST only"})
+			return
+		}
+		reasonCode := uint64(ReasonPermanentTermination)
+		if c := r.URL.Query().Get("reason"); c != "" {
+			var err error
+			if reasonCode, err = strconv.ParseUint(c, 10, 32); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid reason"})
+				return
+			}
+		}
+		resultCode, err := SendRegistrationTermination(r.URL.Query().Get("impi"), uint32(reasonCode), r.URL.Query().Get("info"))
+		writeSessionRequestResult(w, resultCode, err)
+	})
+	// 重新读取用户签约XML，通过PPR下发给用户的S-CSCF
+	mux.HandleFunc("/cx/push", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "POST only"})
+			return
+		}
+		resultCode, err := SendPushProfile(r.URL.Query().Get("impi"))
+		writeSessionRequestResult(w, resultCode, err)
+	})
+	go func() {
+		log.Printf("Admin listening on %v...", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("Admin listen error: %v", err)
+		}
+	}()
+}
+
+// 会话不存在返回404，会话上已有未完成的请求返回409，对端未连接、超时等发送失败返回502
+func writeSessionRequestResult(w http.ResponseWriter, resultCode uint32, err error) {
+	if err != nil {
+		writeJSON(w, requestErrorStatus(err), map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]uint32{"result_code": resultCode})
+}
+
+func writeRequestResult(w http.ResponseWriter, results map[string]uint32, err error) {
+	if err != nil {
+		writeJSON(w, requestErrorStatus(err), map[string]interface{}{"error": err.Error(), "result_codes": results})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]map[string]uint32{"result_codes": results})
+}
+
+func requestErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errSessionNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errSessionPending):
+		return http.StatusConflict
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("admin write response error: %v", err)
+	}
+}
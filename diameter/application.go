@@ -0,0 +1,149 @@
+package diameter
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+const (
+	AppID_Common         uint32 = 0          // Diameter Common Messages，CER/DWR/DPR等基础命令
+	AppID_NASREQ         uint32 = 1          // NASREQ，RFC 7155
+	AppID_EAP            uint32 = 5          // Diameter EAP，RFC 4072
+	AppID_CreditControl  uint32 = 4          // Diameter Credit-Control，RFC 4006
+	AppID_BaseAccounting uint32 = 3          // Diameter Base Accounting
+	AppID_Test           uint32 = 16777238   // test_app.conf中的appli-id
+	AppID_Cx             uint32 = 16777216   // 3GPP Cx/Dx，TS 29.229
+	AppID_S6a            uint32 = 16777251   // 3GPP S6a/S6d，TS 29.272
+	AppID_Gx             uint32 = 16777238   // 3GPP Gx，TS 29.212，与test_app共用应用号
+	AppID_Rx             uint32 = 16777236   // 3GPP Rx，TS 29.214
+	AppID_Relay          uint32 = 0xffffffff // 中继，CER中通告后接受任意应用
+)
+
+// 厂商标识
+const VendorID_3GPP uint32 = 10415
+
+// 厂商定义的应用，能力交换时放在Vendor-Specific-Application-Id中通告
+var vendorSpecificApps = map[uint32]uint32{
+	AppID_Gx:  VendorID_3GPP,
+	AppID_S6a: VendorID_3GPP,
+	AppID_Rx:  VendorID_3GPP,
+	AppID_Cx:  VendorID_3GPP,
+}
+
+// AppIDList command_app_map中的值，可以写单个应用，也可以写数组表示该命令属于多个应用
+type AppIDList []uint32
+
+func (l *AppIDList) UnmarshalJSON(data []byte) error {
+	var single uint32
+	if err := json.Unmarshal(data, &single); err == nil {
+		*l = AppIDList{single}
+		return nil
+	}
+	var list []uint32
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("command_app_map value must be number or array: %w", err)
+	}
+	*l = list
+	return nil
+}
+
+// 命令所属的应用，command_app_map中没有配置时取字典中的application_id
+func (c *DiameterConfig) commandApps(cmdID uint32) []uint32 {
+	if appIDs, ok := c.CommandAppMap[strconv.FormatUint(uint64(cmdID), 10)]; ok {
+		return appIDs
+	}
+	if meta, ok := dict.Commands[cmdID]; ok {
+		return []uint32{meta.ApplicationId}
+	}
+	return nil
+}
+
+// 处理函数按(应用, 命令码)注册，同一命令码在不同应用下可以有不同的处理
+type commandKey struct {
+	AppID       uint32
+	CommandCode uint32
+}
+
+// 查找本地处理请求的函数
+// 命令码没有处理函数返回3001，Application-Id与command_app_map不一致返回3007
+func lookupHandler(msg *DiameterMsg) (DiameterHandler, uint32, error) {
+	appID := msg.GetApplicationID()
+	cmdCode := msg.GetCommandCode()
+	if !containsAppID(config.commandApps(cmdCode), appID) {
+		if !commandHandled(cmdCode) {
+			return nil, ResultCode_CommandUnsupported, fmt.Errorf("unknown or unhandled command %d", cmdCode)
+		}
+		return nil, ResultCode_ApplicationUnsupported, fmt.Errorf("command %d does not belong to application %d, expect %v", cmdCode, appID, config.commandApps(cmdCode))
+	}
+	handler, ok := diameterHandlers[commandKey{appID, cmdCode}]
+	if !ok {
+		return nil, ResultCode_CommandUnsupported, fmt.Errorf("unknown or unhandled command %d in application %d", cmdCode, appID)
+	}
+	return handler, 0, nil
+}
+
+// 命令码在任一应用下有处理函数
+func commandHandled(cmdCode uint32) bool {
+	for key := range diameterHandlers {
+		if key.CommandCode == cmdCode {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAppID(appIDs []uint32, appID uint32) bool {
+	for _, id := range appIDs {
+		if id == appID {
+			return true
+		}
+	}
+	return false
+}
+
+// 请求的应用是否在能力交换时与对端协商过，基础命令总是允许，协商结果中有中继时不做限制
+func (s *Session) supportsApp(appID uint32) bool {
+	if appID == AppID_Common {
+		return true
+	}
+	if containsAppID(s.AuthAppIDs, AppID_Relay) || containsAppID(s.AcctAppIDs, AppID_Relay) {
+		return true
+	}
+	return containsAppID(s.AuthAppIDs, appID) || containsAppID(s.AcctAppIDs, appID)
+}
+
+// CER/CEA中Vendor-Specific-Application-Id里的认证、计费应用
+func vendorSpecificAppIDs(msg *DiameterMsg) (authAppIDs, acctAppIDs []uint32) {
+	for _, avp := range msg.FindAVPsByCode(AVP_VendorSpecificApplicationId) {
+		if authAVP := avp.FindGroupedAVP(AVP_AuthApplicationId); authAVP != nil && authAVP.GetDataLength() >= 4 {
+			authAppIDs = append(authAppIDs, authAVP.GetIntData())
+		}
+		if acctAVP := avp.FindGroupedAVP(AVP_AcctApplicationId); acctAVP != nil && acctAVP.GetDataLength() >= 4 {
+			acctAppIDs = append(acctAppIDs, acctAVP.GetIntData())
+		}
+	}
+	return authAppIDs, acctAppIDs
+}
+
+// 在CER/CEA中通告本端的应用，厂商定义的应用放在Vendor-Specific-Application-Id中
+func addApplicationIDs(builder *DiameterMsgBuilder, authAppIDs, acctAppIDs []uint32) {
+	add := func(appID uint32, code uint32) {
+		appAVP := NewAVPBuilder(code, AVPFlag_Mandatory).SetIntData(appID).Build()
+		vendorID, ok := vendorSpecificApps[appID]
+		if !ok {
+			builder.AddAVP(appAVP)
+			return
+		}
+		builder.AddAVP(NewAVPBuilder(AVP_VendorSpecificApplicationId, AVPFlag_Mandatory).SetGroupedData(
+			NewAVPBuilder(AVP_VendorId, AVPFlag_Mandatory).SetIntData(vendorID).Build(),
+			appAVP,
+		).Build())
+	}
+	for _, appID := range authAppIDs {
+		add(appID, AVP_AuthApplicationId)
+	}
+	for _, appID := range acctAppIDs {
+		add(appID, AVP_AcctApplicationId)
+	}
+}
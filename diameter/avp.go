@@ -49,14 +49,185 @@ const (
 	AVP_ProxyInfo             = 284
 	AVP_ProxyHost             = 280
 	AVP_AuthorizationLifetime = 291
+	AVP_AuthGracePeriod       = 276
 	AVP_RedirectHost          = 292
+	AVP_RouteRecord           = 282
+	AVP_RedirectHostUsage     = 261
+	AVP_RedirectMaxCacheTime  = 262
 	AVP_FirmwareRevision      = 267
-	AVP_Drmp                  = 278
+	AVP_Drmp                  = 301 // RFC 7944
+	// DOIC，RFC 7683/RFC 8581
+	AVP_OCSupportedFeatures   = 621
+	AVP_OCFeatureVector       = 622
+	AVP_OCOLR                 = 623
+	AVP_OCSequenceNumber      = 624
+	AVP_OCValidityDuration    = 625
+	AVP_OCReportType          = 626
+	AVP_OCReductionPercentage = 627
+	AVP_OCMaximumRate         = 653
 	AVP_UserID                = 16777052
 	AVP_EAPPayload            = 462
 	AVP_SupportedVendorID     = 265
 	AVP_AcctApplicationId     = 259 //IETF 标准定义
-	AVP_DisconnectCause       = 273 //IETF 标准定义
+	// 计费，RFC 6733 9.8、RFC 7155
+	AVP_AccountingRecordType       = 480
+	AVP_AccountingRecordNumber     = 485
+	AVP_AccountingSubSessionId     = 287
+	AVP_AcctSessionId              = 44
+	AVP_AcctMultiSessionId         = 50
+	AVP_AcctInterimInterval        = 85
+	AVP_AccountingRealtimeRequired = 483
+	AVP_EventTimestamp             = 55
+	AVP_AcctSessionTime            = 46
+	AVP_AccountingInputOctets      = 363
+	AVP_AccountingOutputOctets     = 364
+	AVP_AccountingInputPackets     = 365
+	AVP_AccountingOutputPackets    = 366
+	// 信用控制，RFC 4006
+	AVP_CCRequestType                 = 416
+	AVP_CCRequestNumber               = 415
+	AVP_ServiceContextId              = 461
+	AVP_SubscriptionId                = 443
+	AVP_SubscriptionIdType            = 450
+	AVP_SubscriptionIdData            = 444
+	AVP_RequestedServiceUnit          = 437
+	AVP_GrantedServiceUnit            = 431
+	AVP_UsedServiceUnit               = 446
+	AVP_CCTime                        = 420
+	AVP_CCTotalOctets                 = 421
+	AVP_CCInputOctets                 = 412
+	AVP_CCOutputOctets                = 414
+	AVP_CCServiceSpecificUnits        = 417
+	AVP_MultipleServicesCreditControl = 456
+	AVP_MultipleServicesIndicator     = 455
+	AVP_RatingGroup                   = 432
+	AVP_ServiceIdentifier             = 439
+	AVP_ValidityTime                  = 448
+	AVP_FinalUnitIndication           = 430
+	AVP_FinalUnitAction               = 449
+	AVP_RequestedAction               = 436
+	AVP_CheckBalanceResult            = 422
+	// NASREQ，RFC 7155
+	AVP_AuthRequestType   = 274
+	AVP_AuthSessionState  = 277
+	AVP_ReAuthRequestType = 285
+	AVP_CHAPAuth          = 402
+	AVP_CHAPAlgorithm     = 403
+	AVP_CHAPIdent         = 404
+	AVP_CHAPResponse      = 405
+	AVP_CHAPChallenge     = 60
+	AVP_NASIdentifier     = 32
+	// EAP，RFC 4072
+	AVP_EAPReissuedPayload      = 463
+	AVP_EAPMasterSessionKey     = 464
+	AVP_EAPKeyName              = 102
+	AVP_AccountingEAPAuthMethod = 465
+	AVP_MultiRoundTimeOut       = 272
+	AVP_DisconnectCause         = 273 //IETF 标准定义
+	// 厂商定义的应用和结果码，RFC 6733
+	AVP_VendorSpecificApplicationId = 260
+	AVP_ExperimentalResult          = 297
+	AVP_ExperimentalResultCode      = 298
+	// S6a/S6d，3GPP TS 29.272，除Service-Selection外都是3GPP厂商AVP
+	AVP_SubscriptionData                      = 1400
+	AVP_ULRFlags                              = 1405
+	AVP_ULAFlags                              = 1406
+	AVP_VisitedPLMNId                         = 1407
+	AVP_RequestedEUTRANAuthenticationInfo     = 1408
+	AVP_NumberOfRequestedVectors              = 1410
+	AVP_ReSynchronizationInfo                 = 1411
+	AVP_ImmediateResponsePreferred            = 1412
+	AVP_AuthenticationInfo                    = 1413
+	AVP_EUTRANVector                          = 1414
+	AVP_NetworkAccessMode                     = 1417
+	AVP_ItemNumber                            = 1419
+	AVP_CancellationType                      = 1420
+	AVP_DSRFlags                              = 1421
+	AVP_ContextIdentifier                     = 1423
+	AVP_SubscriberStatus                      = 1424
+	AVP_AllAPNConfigurationsIncludedIndicator = 1428
+	AVP_APNConfigurationProfile               = 1429
+	AVP_APNConfiguration                      = 1430
+	AVP_EPSSubscribedQoSProfile               = 1431
+	AVP_AMBR                                  = 1435
+	AVP_PUAFlags                              = 1442
+	AVP_RAND                                  = 1447
+	AVP_XRES                                  = 1448
+	AVP_AUTN                                  = 1449
+	AVP_KASME                                 = 1450
+	AVP_PDNType                               = 1456
+	AVP_PURFlags                              = 1635
+	AVP_RATType                               = 1032
+	AVP_QoSClassIdentifier                    = 1028
+	AVP_AllocationRetentionPriority           = 1034
+	AVP_PriorityLevel                         = 1046
+	AVP_PreemptionCapability                  = 1047
+	AVP_PreemptionVulnerability               = 1048
+	AVP_MaxRequestedBandwidthUL               = 516
+	AVP_MaxRequestedBandwidthDL               = 515
+	AVP_MSISDN                                = 701
+	AVP_ServiceSelection                      = 493
+	// Gx，3GPP TS 29.212，都是3GPP厂商AVP
+	AVP_FlowDescription          = 507
+	AVP_FlowStatus               = 511
+	AVP_ChargingRuleInstall      = 1001
+	AVP_ChargingRuleRemove       = 1002
+	AVP_ChargingRuleDefinition   = 1003
+	AVP_ChargingRuleName         = 1005
+	AVP_EventTrigger             = 1006
+	AVP_Precedence               = 1010
+	AVP_QoSInformation           = 1016
+	AVP_ChargingRuleReport       = 1018
+	AVP_PCCRuleStatus            = 1019
+	AVP_GuaranteedBitrateDL      = 1025
+	AVP_GuaranteedBitrateUL      = 1026
+	AVP_RuleFailureCode          = 1031
+	AVP_APNAggregateMaxBitrateDL = 1040
+	AVP_APNAggregateMaxBitrateUL = 1041
+	AVP_DefaultEPSBearerQoS      = 1049
+	AVP_FlowInformation          = 1058
+	AVP_FlowDirection            = 1080
+	// Rx，3GPP TS 29.214，都是3GPP厂商AVP
+	AVP_AbortCause                = 500
+	AVP_AFApplicationIdentifier   = 504
+	AVP_FlowNumber                = 509
+	AVP_Flows                     = 510
+	AVP_FlowUsage                 = 512
+	AVP_SpecificAction            = 513
+	AVP_MediaComponentDescription = 517
+	AVP_MediaComponentNumber      = 518
+	AVP_MediaSubComponent         = 519
+	AVP_MediaType                 = 520
+	AVP_RxRequestType             = 533
+	// Cx/Dx，3GPP TS 29.229，都是3GPP厂商AVP，623-626与DOIC的AVP代码相同
+	AVP_VisitedNetworkIdentifier = 600
+	AVP_PublicIdentity           = 601
+	AVP_ServerName               = 602
+	AVP_ServerCapabilities       = 603
+	AVP_MandatoryCapability      = 604
+	AVP_OptionalCapability       = 605
+	AVP_UserData                 = 606
+	AVP_SIPNumberAuthItems       = 607
+	AVP_SIPAuthenticationScheme  = 608
+	AVP_SIPAuthenticate          = 609
+	AVP_SIPAuthorization         = 610
+	AVP_SIPAuthDataItem          = 612
+	AVP_SIPItemNumber            = 613
+	AVP_ServerAssignmentType     = 614
+	AVP_DeregistrationReason     = 615
+	AVP_ReasonCode               = 616
+	AVP_ReasonInfo               = 617
+	AVP_UserAuthorizationType    = 623
+	AVP_UserDataAlreadyAvailable = 624
+	AVP_ConfidentialityKey       = 625
+	AVP_IntegrityKey             = 626
+	AVP_OriginatingRequest       = 633
+	AVP_SIPDigestAuthenticate    = 635
+	// SIP Digest，RFC 4590，SIP-Digest-Authenticate中使用
+	AVP_DigestRealm     = 104
+	AVP_DigestQoP       = 110
+	AVP_DigestAlgorithm = 111
+	AVP_DigestHA1       = 121
 	// ...根据需要继续添加
 )
 
@@ -103,6 +274,11 @@ func NewAVPBuilder(code uint32, flags byte) *AVPBuilder {
 	}
 }
 
+// New3GPPAVPBuilder 3GPP厂商AVP，置V标志并填写Vendor-ID 10415
+func New3GPPAVPBuilder(code uint32, flags byte) *AVPBuilder {
+	return NewAVPBuilder(code, flags|AVPFlag_VendorSpecific).SetVendorID(VendorID_3GPP)
+}
+
 func (b *AVPBuilder) SetVendorID(id uint32) *AVPBuilder {
 	if b.flags&AVPFlag_VendorSpecific == 0 {
 		panic("SetVendorID called, but V-bit not set in flags")
@@ -160,15 +336,34 @@ func (b *AVPBuilder) SetIntData(i uint32) *AVPBuilder {
 	return b
 }
 
+func (b *AVPBuilder) SetInt64Data(i uint64) *AVPBuilder {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, i)
+	b.SetData(buf)
+	return b
+}
+
+// SetGroupedData 将子AVP依次编码为Grouped类型的数据
+func (b *AVPBuilder) SetGroupedData(avps ...*AVPMsg) *AVPBuilder {
+	data := make([]byte, 0)
+	for _, avp := range avps {
+		data = append(data, avp.ToBytes()...)
+	}
+	b.SetData(data)
+	return b
+}
+
 func (b *AVPBuilder) SetIpData(ip net.IP) *AVPBuilder {
 	b.SetData(append([]byte{0x00, 0x01}, ip.To4()...)) // 只支持IPv4，或者根据长度判断IPv6
 	return b
 }
 
+// Time类型是NTP时间戳的秒数部分，从1900年1月1日起算，比Unix时间多ntpEpochOffset秒，RFC 6733 4.3.1
+const ntpEpochOffset = 2208988800
+
 func (b *AVPBuilder) SetTimeData(t time.Time) *AVPBuilder {
 	buf := make([]byte, 4)
-	// Diameter时间戳一般是秒数，取Unix时间戳即可
-	binary.BigEndian.PutUint32(buf, uint32(t.Unix()))
+	binary.BigEndian.PutUint32(buf, uint32(t.Unix()+ntpEpochOffset))
 	b.SetData(buf)
 	return b
 }
@@ -197,7 +392,7 @@ func GetTimeData(data []byte) time.Time {
 		return time.Time{}
 	}
 	sec := binary.BigEndian.Uint32(data)
-	return time.Unix(int64(sec), 0)
+	return time.Unix(int64(sec)-ntpEpochOffset, 0)
 }
 
 // ///////////////////////////////////////////////////////////////////////////////////////
@@ -231,6 +426,14 @@ func (a *AVPMsg) HasVendorID() bool {
 	return a.head[4]&AVPFlag_VendorSpecific != 0
 }
 
+// GetVendorID 返回AVP的Vendor-Id，没有V位时为0
+func (a *AVPMsg) GetVendorID() uint32 {
+	if !a.HasVendorID() || len(a.other) < 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(a.other[:4])
+}
+
 func (a *AVPMsg) getOffset() int {
 	if a.HasVendorID() {
 		return 4 // 有 Vendor-ID，占 4 字节（Vendor-ID 是 uint32）
@@ -255,19 +458,72 @@ func (a *AVPMsg) GetIntData() uint32 {
 	return binary.BigEndian.Uint32(data[:4])
 }
 
+// GetInt64Data 将有效数据视为 uint64（大端）
+func (a *AVPMsg) GetInt64Data() uint64 {
+	data := a.GetRawData()
+	if len(data) < 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(data[:8])
+}
+
+// GetGroupedAVPs 将有效数据解析为Grouped类型的子AVP
+func (a *AVPMsg) GetGroupedAVPs() ([]*AVPMsg, error) {
+	data := a.GetRawData()
+	avps := make([]*AVPMsg, 0)
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, fmt.Errorf("grouped AVP %d truncated", a.GetCode())
+		}
+		var avp AVPMsg
+		copy(avp.head[:], data[:8])
+		if err := avp.Validate(); err != nil {
+			return nil, fmt.Errorf("grouped AVP %d: %w", a.GetCode(), err)
+		}
+		otherLen := avp.GetOtherLen()
+		// 最后一个子AVP的padding不计入外层长度
+		end := 8 + otherLen
+		if end > len(data) {
+			end = len(data)
+			if int(avp.GetLength()) > end {
+				return nil, fmt.Errorf("grouped AVP %d truncated", a.GetCode())
+			}
+		}
+		avp.other = make([]byte, otherLen)
+		copy(avp.other, data[8:end])
+		avps = append(avps, &avp)
+		data = data[end:]
+	}
+	return avps, nil
+}
+
+// FindGroupedAVP 在Grouped类型AVP中查找第一个指定Code的子AVP
+func (a *AVPMsg) FindGroupedAVP(code uint32) *AVPMsg {
+	avps, err := a.GetGroupedAVPs()
+	if err != nil {
+		return nil
+	}
+	for _, avp := range avps {
+		if avp.GetCode() == code {
+			return avp
+		}
+	}
+	return nil
+}
+
 // GetStringData 将有效数据视为 UTF-8 字符串
 func (a *AVPMsg) GetStringData() string {
 	return string(a.GetRawData())
 }
 
-// GetTimeData 解析时间戳（4 字节秒数）
+// GetTimeData 解析时间戳（4 字节NTP秒数）
 func (a *AVPMsg) GetTimeData() time.Time {
 	data := a.GetRawData()
 	if len(data) < 4 {
 		return time.Time{} // 返回零时间
 	}
 	seconds := binary.BigEndian.Uint32(data[:4])
-	return time.Unix(int64(seconds), 0)
+	return time.Unix(int64(seconds)-ntpEpochOffset, 0)
 }
 
 func (a *AVPMsg) GetIPAddrData() net.IP {
@@ -294,6 +550,17 @@ func (a *AVPMsg) GetTotalLen() int {
 	return a.GetOtherLen() + len(a.head)
 }
 
+// AVP的字典定义，带V位且字典中有同代码的厂商定义时用厂商定义
+// 校验时只读了AVP头，还拿不到Vendor-ID，只能按V位区分
+func (a *AVPMsg) meta() AVPMeta {
+	if a.HasVendorID() {
+		if avpMeta, ok := dict.VendorAVPs[a.GetCode()]; ok {
+			return avpMeta
+		}
+	}
+	return dict.AVPs[a.GetCode()]
+}
+
 // Validate 校验AVP头是否合法
 func (a *AVPMsg) Validate() error {
 	length := a.GetLength()
@@ -303,7 +570,7 @@ func (a *AVPMsg) Validate() error {
 	if a.HasVendorID() && length < 12 {
 		return fmt.Errorf("invalid AVP length %d, with Vendor-ID must be >= 12", length)
 	}
-	avpMeta := dict.AVPs[a.GetCode()]
+	avpMeta := a.meta()
 	minDataLen := DataTypeMinLen[avpMeta.Type]
 	if a.GetDataLength() < minDataLen {
 		return fmt.Errorf("invalid AVP data length %d type:%v minlen:%d", length, avpMeta.Type, minDataLen)
@@ -319,15 +586,17 @@ func (avp *AVPMsg) ToBytes() []byte {
 
 func (avp *AVPMsg) ToString() string {
 	var sb strings.Builder
-	avpMeta := dict.AVPs[avp.GetCode()]
+	avpMeta := avp.meta()
 	fmt.Fprintf(&sb, "AVP: %v(%v)  ", avpMeta.Name, avp.GetCode())
 	fmt.Fprintf(&sb, "AVP-Flags: %v  ", avp.GetFlags())
 	fmt.Fprintf(&sb, "AVP-Length: %v  ", avp.GetLength())
 	typeStr := avpMeta.Type
-	if typeStr == "UTF8String" || typeStr == "DiameterIdentity" || typeStr == "OctetString" {
+	if typeStr == "UTF8String" || typeStr == "DiameterIdentity" || typeStr == "DiameterURI" || typeStr == "OctetString" {
 		fmt.Fprintf(&sb, "AVP-Value: %v", avp.GetStringData())
-	} else if typeStr == "Unsigned32" {
+	} else if typeStr == "Unsigned32" || typeStr == "Enumerated" {
 		fmt.Fprintf(&sb, "AVP-Value: %v", avp.GetIntData())
+	} else if typeStr == "Unsigned64" {
+		fmt.Fprintf(&sb, "AVP-Value: %v", avp.GetInt64Data())
 	} else if typeStr == "Address" {
 		fmt.Fprintf(&sb, "AVP-Value: %v", avp.GetIPAddrData())
 	}
@@ -0,0 +1,279 @@
+package diameter
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// 对端连接状态，参考RFC 6733 5.6 对端状态机
+const (
+	PeerStateClosed      = "Closed"
+	PeerStateWaitConnAck = "Wait-Conn-Ack"
+	PeerStateWaitICEA    = "Wait-I-CEA"
+	PeerStateIOpen       = "I-Open" // 本端发起的连接已建立
+	PeerStateROpen       = "R-Open" // 对端发起的连接已建立
+)
+
+// peerConnector 负责主动连接一个对端，断开后按Tc和指数退避重连
+type peerConnector struct {
+	peer *PeerConfig
+
+	mu      sync.Mutex
+	state   string
+	since   time.Time
+	retries int
+	lastErr string
+	session *Session
+}
+
+var connectors []*peerConnector
+
+func startConnectors() {
+	for i := range config.Peers {
+		peer := &config.Peers[i]
+		if peer.ConnectTo == "" {
+			continue
+		}
+		c := &peerConnector{peer: peer, state: PeerStateClosed, since: time.Now()}
+		connectors = append(connectors, c)
+		go c.run()
+	}
+}
+
+func (c *peerConnector) setState(state string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != state {
+		log.Printf("主机%v 连接状态 %v -> %v", c.peer.OriginHost, c.state, state)
+		c.state = state
+		c.since = time.Now()
+	}
+}
+
+func (c *peerConnector) run() {
+	backoff := c.peer.tc()
+	for {
+		// 对端已经主动连上来，不再重复建连，等下一个Tc再看
+		if existing := peerTable.get(c.peer.OriginHost); existing != nil && !existing.Initiator {
+			time.Sleep(c.peer.tc())
+			continue
+		}
+
+		opened, err := c.connect()
+		c.mu.Lock()
+		c.session = nil
+		if err != nil {
+			c.lastErr = err.Error()
+			c.retries++
+		}
+		c.mu.Unlock()
+		c.setState(PeerStateClosed)
+		if err != nil {
+			log.Printf("主机%v 连接失败: %v，%v后重连", c.peer.OriginHost, err, backoff)
+		}
+
+		// 成功建立过连接则重新从Tc开始退避
+		if opened {
+			backoff = c.peer.tc()
+		}
+		time.Sleep(backoff)
+		if !opened {
+			backoff *= 2
+			if backoff > c.peer.maxBackoff() {
+				backoff = c.peer.maxBackoff()
+			}
+		}
+	}
+}
+
+// 建立连接并完成能力交换，连接断开后返回，opened表示是否进入过Open状态
+func (c *peerConnector) connect() (opened bool, err error) {
+	peer := c.peer
+	c.setState(PeerStateWaitConnAck)
+	conn, err := net.DialTimeout("tcp", peer.ConnectTo, peer.tc())
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	session := newSession(conn)
+	session.Initiator = true
+	session.Peer = peer
+	session.PeerHost = peer.OriginHost
+	session.PeerRealm = peer.OriginRealm
+	// 先登记，等待CEA期间对端发来CER时进行选举
+	if resultCode := peerTable.register(session, peer.OriginHost); resultCode != 0 {
+		return false, fmt.Errorf("peer already connected, result code %d", resultCode)
+	}
+	defer peerTable.unregister(session)
+
+	go serveSession(session)
+
+	c.setState(PeerStateWaitICEA)
+	cea, err := session.SendRequest(newCER(peer), peer.tc())
+	if err != nil {
+		return false, err
+	}
+	if err := checkCEA(session, cea); err != nil {
+		return false, err
+	}
+	session.OpenedAt = time.Now()
+	session.setState(StateEstablished)
+	c.mu.Lock()
+	c.session = session
+	c.retries = 0
+	c.lastErr = ""
+	c.mu.Unlock()
+	c.setState(PeerStateIOpen)
+
+	if err := runWatchdog(session, peer.tw()); err != nil {
+		<-session.done
+		return true, err
+	}
+	return true, fmt.Errorf("connection closed")
+}
+
+// 按Tw发送DWR，超时未收到DWA认为连接已失效，关闭连接，等待中的请求随之切换到其他对端
+// 连接正常关闭时返回nil
+func runWatchdog(session *Session, tw time.Duration) error {
+	ticker := time.NewTicker(tw)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-session.done:
+			return nil
+		case <-ticker.C:
+			if _, err := session.SendRequest(newDWR(), tw); err != nil {
+				log.Printf("主机%v 保活失败: %v，关闭连接", session.PeerHost, err)
+				metrics.inc(MetricWatchdogFailures)
+				session.Close()
+				return err
+			}
+		}
+	}
+}
+
+// 校验CEA，记录对端的Origin-State-Id
+func checkCEA(session *Session, cea *DiameterMsg) error {
+	resultAVP, _ := cea.FindAVPByCode(AVP_ResultCode)
+	if resultAVP == nil {
+		return fmt.Errorf("CEA without Result-Code")
+	}
+	if resultCode := resultAVP.GetIntData(); resultCode != ResultCode_Success {
+		return fmt.Errorf("CEA Result-Code %d", resultCode)
+	}
+	hostAVP, _ := cea.FindAVPByCode(AVP_OriginHost)
+	if hostAVP == nil || hostAVP.GetStringData() != session.PeerHost {
+		return fmt.Errorf("CEA Origin-Host mismatch, expect %v", session.PeerHost)
+	}
+
+	authAppIDs := []uint32{}
+	for _, avp := range cea.FindAVPsByCode(AVP_AuthApplicationId) {
+		authAppIDs = append(authAppIDs, avp.GetIntData())
+	}
+	acctAppIDs := []uint32{}
+	for _, avp := range cea.FindAVPsByCode(AVP_AcctApplicationId) {
+		acctAppIDs = append(acctAppIDs, avp.GetIntData())
+	}
+	vendorAuthAppIDs, vendorAcctAppIDs := vendorSpecificAppIDs(cea)
+	authAppIDs = append(authAppIDs, vendorAuthAppIDs...)
+	acctAppIDs = append(acctAppIDs, vendorAcctAppIDs...)
+	shareAuthAppIDs := intersect(authAppIDs, session.Peer.authAppIDs())
+	shareAcctAppIDs := intersect(acctAppIDs, session.Peer.acctAppIDs())
+	if len(shareAuthAppIDs) == 0 && len(shareAcctAppIDs) == 0 {
+		return fmt.Errorf("no common application")
+	}
+	log.Printf("主机%v 能力交换完成，共同支持的认证应用: %v 计费应用: %v", session.PeerHost,
+		id2name(shareAuthAppIDs, dict.AuthAppMeta), id2name(shareAcctAppIDs, dict.AcctAppMeta))
+	session.AuthAppIDs = shareAuthAppIDs
+	session.AcctAppIDs = shareAcctAppIDs
+
+	if stateAVP, _ := cea.FindAVPByCode(AVP_OriginStateId); stateAVP != nil && stateAVP.GetDataLength() >= 4 {
+		peerTable.checkStateID(session.PeerHost, stateAVP.GetIntData())
+	}
+	return nil
+}
+
+func newCER(peer *PeerConfig) *DiameterMsg {
+	builder := NewDiameterMsgBuilder().
+		SetCommandCode(Cmd_CE).
+		SetAppID(0).
+		SetFlags(FlagRequest).
+		SetHopByHopID(nextHopByHopID()).
+		SetEndToEndID(nextEndToEndID()).
+		AddAVP(NewAVPBuilder(AVP_OriginHost, AVPFlag_Mandatory).SetStringData(config.OriginHost).Build()).
+		AddAVP(NewAVPBuilder(AVP_OriginRealm, AVPFlag_Mandatory).SetStringData(config.OriginRealm).Build()).
+		AddAVP(NewAVPBuilder(AVP_HostIPAddress, AVPFlag_Mandatory).SetIpData(net.ParseIP(config.HostIPAddress)).Build()).
+		AddAVP(NewAVPBuilder(AVP_VendorId, AVPFlag_Mandatory).SetIntData(config.VendorID).Build()).
+		AddAVP(NewAVPBuilder(AVP_ProductName, 0).SetStringData(config.ProductName).Build()).
+		AddAVP(NewAVPBuilder(AVP_OriginStateId, AVPFlag_Mandatory).SetIntData(originStateID).Build())
+	addApplicationIDs(builder, peer.authAppIDs(), peer.acctAppIDs())
+	return builder.Build()
+}
+
+func newDWR() *DiameterMsg {
+	return NewDiameterMsgBuilder().
+		SetCommandCode(Cmd_DW).
+		SetAppID(0).
+		SetFlags(FlagRequest).
+		SetHopByHopID(nextHopByHopID()).
+		SetEndToEndID(nextEndToEndID()).
+		AddAVP(NewAVPBuilder(AVP_OriginHost, AVPFlag_Mandatory).SetStringData(config.OriginHost).Build()).
+		AddAVP(NewAVPBuilder(AVP_OriginRealm, AVPFlag_Mandatory).SetStringData(config.OriginRealm).Build()).
+		AddAVP(NewAVPBuilder(AVP_OriginStateId, AVPFlag_Mandatory).SetIntData(originStateID).Build()).
+		Build()
+}
+
+// PeerStatus 对端连接状态，管理接口展示用
+type PeerStatus struct {
+	Host       string    `json:"host"`
+	State      string    `json:"state"`
+	Since      time.Time `json:"since"`
+	ConnectTo  string    `json:"connect_to,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Retries    int       `json:"retries"`
+	LastError  string    `json:"last_error,omitempty"`
+}
+
+// PeerStatuses 返回主动连接的对端状态以及对端主动接入的连接
+func PeerStatuses() []PeerStatus {
+	statuses := make([]PeerStatus, 0)
+	seen := make(map[string]struct{})
+	for _, c := range connectors {
+		c.mu.Lock()
+		status := PeerStatus{
+			Host:      c.peer.OriginHost,
+			State:     c.state,
+			Since:     c.since,
+			ConnectTo: c.peer.ConnectTo,
+			Retries:   c.retries,
+			LastError: c.lastErr,
+		}
+		if c.session != nil {
+			status.RemoteAddr = c.session.RemoteAddr.String()
+		}
+		c.mu.Unlock()
+		if session := peerTable.get(status.Host); session != nil && !session.Initiator {
+			status.State = PeerStateROpen
+			status.Since = session.OpenedAt
+			status.RemoteAddr = session.RemoteAddr.String()
+		}
+		seen[status.Host] = struct{}{}
+		statuses = append(statuses, status)
+	}
+	for _, session := range peerTable.list() {
+		if _, ok := seen[session.PeerHost]; ok {
+			continue
+		}
+		statuses = append(statuses, PeerStatus{
+			Host:       session.PeerHost,
+			State:      PeerStateROpen,
+			Since:      session.OpenedAt,
+			RemoteAddr: session.RemoteAddr.String(),
+		})
+	}
+	return statuses
+}
@@ -0,0 +1,501 @@
+package diameter
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CC-Request-Type，RFC 4006 8.3
+const (
+	CCRequestInitial     = 1
+	CCRequestUpdate      = 2
+	CCRequestTermination = 3
+	CCRequestEvent       = 4
+)
+
+var ccRequestTypeNames = map[uint32]string{
+	CCRequestInitial:     "INITIAL",
+	CCRequestUpdate:      "UPDATE",
+	CCRequestTermination: "TERMINATION",
+	CCRequestEvent:       "EVENT",
+}
+
+// Requested-Action，RFC 4006 8.41
+const (
+	RequestedActionDirectDebiting = 0
+	RequestedActionRefundAccount  = 1
+	RequestedActionCheckBalance   = 2
+	RequestedActionPriceEnquiry   = 3
+)
+
+// Check-Balance-Result，RFC 4006 8.6
+const (
+	CheckBalanceEnoughCredit = 0
+	CheckBalanceNoCredit     = 1
+)
+
+// Final-Unit-Action，RFC 4006 8.35
+const (
+	FinalUnitActionTerminate      = 0
+	FinalUnitActionRedirect       = 1
+	FinalUnitActionRestrictAccess = 2
+)
+
+// 不在Multiple-Services-Credit-Control中、直接放在消息顶层的配额，用这个值作为Rating-Group
+const noRatingGroup = ^uint32(0)
+
+// CreditUnits 配额/余额，分别对应CC-Time、CC-Total-Octets、CC-Service-Specific-Units
+type CreditUnits struct {
+	Time   uint64 `json:"time"`   // 秒
+	Octets uint64 `json:"octets"` // 字节
+	Units  uint64 `json:"units"`  // 业务自定义单位
+}
+
+func (u CreditUnits) isZero() bool {
+	return u.Time == 0 && u.Octets == 0 && u.Units == 0
+}
+
+func (u CreditUnits) add(v CreditUnits) CreditUnits {
+	return CreditUnits{u.Time + v.Time, u.Octets + v.Octets, u.Units + v.Units}
+}
+
+// 按字段相减，不够减时为0
+func (u CreditUnits) sub(v CreditUnits) CreditUnits {
+	sub := func(a, b uint64) uint64 {
+		if a < b {
+			return 0
+		}
+		return a - b
+	}
+	return CreditUnits{sub(u.Time, v.Time), sub(u.Octets, v.Octets), sub(u.Units, v.Units)}
+}
+
+func (u CreditUnits) String() string {
+	return fmt.Sprintf("time=%d octets=%d units=%d", u.Time, u.Octets, u.Units)
+}
+
+// 信用控制会话超过Validity-Time再过ccSessionGrace没有收到CCR时清理并释放预留，没有配置Validity-Time时按defaultCCSessionIdle
+const (
+	ccSessionGrace       = 5 * time.Minute
+	defaultCCSessionIdle = time.Hour
+)
+
+// 默认每次授予的配额，RSU中没有指定数量时使用
+var defaultCreditQuota = CreditUnits{Time: 600, Octets: 1 << 20, Units: 100}
+
+// CreditControlConfig 信用控制配置
+type CreditControlConfig struct {
+	ValidityTime uint32      `json:"validity_time"` // 授予配额的有效期，秒，0表示不带Validity-Time
+	DefaultQuota CreditUnits `json:"default_quota"` // 请求没有指定数量时每次授予的配额
+	// 用户初始余额，按Subscription-Id-Data(没有时取User-Name)索引，只对余额不为0的计量方式授予配额
+	Subscribers map[string]CreditUnits `json:"subscribers"`
+}
+
+func (c *CreditControlConfig) sessionIdle() time.Duration {
+	if c.ValidityTime == 0 {
+		return defaultCCSessionIdle
+	}
+	return time.Duration(c.ValidityTime)*time.Second + ccSessionGrace
+}
+
+func (c *CreditControlConfig) defaultQuota() CreditUnits {
+	if c.DefaultQuota.isZero() {
+		return defaultCreditQuota
+	}
+	return c.DefaultQuota
+}
+
+// creditAccount 用户余额以及进行中的会话预留的配额
+type creditAccount struct {
+	balance  CreditUnits
+	reserved CreditUnits
+}
+
+func (a *creditAccount) available() CreditUnits {
+	return a.balance.sub(a.reserved)
+}
+
+// CreditAccount 用户余额，管理接口展示用
+type CreditAccount struct {
+	Subscriber string      `json:"subscriber"`
+	Balance    CreditUnits `json:"balance"`
+	Reserved   CreditUnits `json:"reserved"`
+}
+
+// ccSession 进行中的信用控制会话
+type ccSession struct {
+	subscriber        string
+	lastRequestNumber uint32
+	reserved          map[uint32]CreditUnits // 按Rating-Group记录预留的配额
+	updatedAt         time.Time              // 最近一次收到CCR的时间
+}
+
+// creditStore 内存中的余额和信用控制会话，余额初始值来自配置
+type creditStore struct {
+	mu       sync.Mutex
+	accounts map[string]*creditAccount
+	sessions map[string]*ccSession
+}
+
+var credits = &creditStore{
+	accounts: make(map[string]*creditAccount),
+	sessions: make(map[string]*ccSession),
+}
+
+// 按配置初始化用户余额，加载配置后调用
+func (s *creditStore) load(subscribers map[string]CreditUnits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for subscriber, balance := range subscribers {
+		s.accounts[subscriber] = &creditAccount{balance: balance}
+	}
+}
+
+// 预留配额，requested为0的计量方式不授予；返回授予的配额，final表示已是最后的配额
+// 一种都授予不了时ok为false
+func (s *creditStore) reserve(account *creditAccount, requested CreditUnits) (granted CreditUnits, final bool, ok bool) {
+	available := account.available()
+	grant := func(req, avail uint64) uint64 {
+		if req == 0 {
+			return 0
+		}
+		if req >= avail {
+			final = true
+			return avail
+		}
+		return req
+	}
+	granted = CreditUnits{
+		Time:   grant(requested.Time, available.Time),
+		Octets: grant(requested.Octets, available.Octets),
+		Units:  grant(requested.Units, available.Units),
+	}
+	if granted.isZero() {
+		return granted, true, false
+	}
+	account.reserved = account.reserved.add(granted)
+	return granted, final, true
+}
+
+// 扣除实际使用量并释放之前的预留
+func (s *creditStore) debit(account *creditAccount, used, reserved CreditUnits) {
+	account.balance = account.balance.sub(used)
+	account.reserved = account.reserved.sub(reserved)
+}
+
+// 释放会话预留的配额并删除会话，调用方持有锁
+func (s *creditStore) release(sessionID string, cc *ccSession) {
+	if account, ok := s.accounts[cc.subscriber]; ok {
+		for _, reserved := range cc.reserved {
+			account.reserved = account.reserved.sub(reserved)
+		}
+	}
+	delete(s.sessions, sessionID)
+}
+
+// 清理超过Validity-Time和宽限期没有收到CCR的会话，调用方持有锁
+func (s *creditStore) expire(now time.Time) {
+	idle := config.CreditControl.sessionIdle()
+	for id, cc := range s.sessions {
+		if now.Sub(cc.updatedAt) > idle {
+			s.release(id, cc)
+			log.Printf("用户%v 信用控制会话%v超时，释放预留的配额", cc.subscriber, id)
+		}
+	}
+}
+
+// CreditAccounts 返回所有用户余额的快照
+func CreditAccounts() []CreditAccount {
+	credits.mu.Lock()
+	defer credits.mu.Unlock()
+	credits.expire(time.Now())
+	accounts := make([]CreditAccount, 0, len(credits.accounts))
+	for subscriber, account := range credits.accounts {
+		accounts = append(accounts, CreditAccount{Subscriber: subscriber, Balance: account.balance, Reserved: account.reserved})
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].Subscriber < accounts[j].Subscriber })
+	return accounts
+}
+
+// 解析RSU/GSU/USU中的配额，USU里没有CC-Total-Octets时按上下行之和计算
+func parseCreditUnits(avp *AVPMsg) CreditUnits {
+	var units CreditUnits
+	if avp == nil {
+		return units
+	}
+	subAVPs, err := avp.GetGroupedAVPs()
+	if err != nil {
+		return units
+	}
+	var inputOctets, outputOctets uint64
+	for _, sub := range subAVPs {
+		switch sub.GetCode() {
+		case AVP_CCTime:
+			units.Time = uint64(sub.GetIntData())
+		case AVP_CCTotalOctets:
+			units.Octets = sub.GetInt64Data()
+		case AVP_CCInputOctets:
+			inputOctets = sub.GetInt64Data()
+		case AVP_CCOutputOctets:
+			outputOctets = sub.GetInt64Data()
+		case AVP_CCServiceSpecificUnits:
+			units.Units = sub.GetInt64Data()
+		}
+	}
+	if units.Octets == 0 {
+		units.Octets = inputOctets + outputOctets
+	}
+	return units
+}
+
+// 构造RSU/GSU/USU，只带不为0的计量方式
+func newCreditUnitsAVP(code uint32, units CreditUnits) *AVPMsg {
+	subAVPs := make([]*AVPMsg, 0, 3)
+	if units.Time > 0 {
+		subAVPs = append(subAVPs, NewAVPBuilder(AVP_CCTime, AVPFlag_Mandatory).SetIntData(uint32(units.Time)).Build())
+	}
+	if units.Octets > 0 {
+		subAVPs = append(subAVPs, NewAVPBuilder(AVP_CCTotalOctets, AVPFlag_Mandatory).SetInt64Data(units.Octets).Build())
+	}
+	if units.Units > 0 {
+		subAVPs = append(subAVPs, NewAVPBuilder(AVP_CCServiceSpecificUnits, AVPFlag_Mandatory).SetInt64Data(units.Units).Build())
+	}
+	return NewAVPBuilder(code, AVPFlag_Mandatory).SetGroupedData(subAVPs...).Build()
+}
+
+// 请求的用户标识，取第一个Subscription-Id-Data，没有时取User-Name
+func ccSubscriber(msg *DiameterMsg) string {
+	if avp, _ := msg.FindAVPByCode(AVP_SubscriptionId); avp != nil {
+		if dataAVP := avp.FindGroupedAVP(AVP_SubscriptionIdData); dataAVP != nil {
+			return dataAVP.GetStringData()
+		}
+	}
+	if avp, _ := msg.FindAVPByCode(AVP_UserName); avp != nil {
+		return avp.GetStringData()
+	}
+	return ""
+}
+
+// creditItem 一组配额请求，对应一个Multiple-Services-Credit-Control或消息顶层的RSU/USU
+type creditItem struct {
+	ratingGroup uint32
+	echo        []*AVPMsg // 应答中原样带回的Rating-Group、Service-Identifier
+	requested   *AVPMsg
+	used        *AVPMsg
+}
+
+func ccCreditItems(msg *DiameterMsg) []creditItem {
+	msccAVPs := msg.FindAVPsByCode(AVP_MultipleServicesCreditControl)
+	if len(msccAVPs) == 0 {
+		requested, _ := msg.FindAVPByCode(AVP_RequestedServiceUnit)
+		used, _ := msg.FindAVPByCode(AVP_UsedServiceUnit)
+		return []creditItem{{ratingGroup: noRatingGroup, requested: requested, used: used}}
+	}
+	items := make([]creditItem, 0, len(msccAVPs))
+	for _, mscc := range msccAVPs {
+		item := creditItem{ratingGroup: noRatingGroup}
+		subAVPs, err := mscc.GetGroupedAVPs()
+		if err != nil {
+			continue
+		}
+		for _, sub := range subAVPs {
+			switch sub.GetCode() {
+			case AVP_RatingGroup:
+				item.ratingGroup = sub.GetIntData()
+				item.echo = append(item.echo, sub)
+			case AVP_ServiceIdentifier:
+				item.echo = append(item.echo, sub)
+			case AVP_RequestedServiceUnit:
+				item.requested = sub
+			case AVP_UsedServiceUnit:
+				item.used = sub
+			}
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// 处理CCR，按CC-Request-Type预留、扣减配额
+func handleCCR(session *Session, msg *DiameterMsg) (*DiameterMsg, error) {
+	requestType := avpIntData(msg, AVP_CCRequestType)
+	requestNumber := avpIntData(msg, AVP_CCRequestNumber)
+	sessionID := msg.GetSessionID()
+	subscriber := ccSubscriber(msg)
+	log.Printf("主机%v 信用控制请求 Session-Id: %v 类型: %v 序号: %v 用户: %v", session.PeerHost, sessionID, ccRequestTypeNames[requestType], requestNumber, subscriber)
+
+	builder := newAnswerBuilder(msg).
+		AddAVP(NewAVPBuilder(AVP_AuthApplicationId, AVPFlag_Mandatory).SetIntData(msg.GetApplicationID()).Build()).
+		AddAVP(NewAVPBuilder(AVP_CCRequestType, AVPFlag_Mandatory).SetIntData(requestType).Build()).
+		AddAVP(NewAVPBuilder(AVP_CCRequestNumber, AVPFlag_Mandatory).SetIntData(requestNumber).Build())
+	reject := func(resultCode uint32, err error) (*DiameterMsg, error) {
+		log.Printf("主机%v 信用控制请求不通过: %v", session.PeerHost, err)
+		return builder.
+			AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(resultCode).Build()).
+			AddAVP(NewAVPBuilder(AVP_ErrorMessage, 0).SetStringData(err.Error()).Build()).
+			Build(), nil
+	}
+
+	if session.State() != StateEstablished {
+		return reject(ResultCode_UnableToDeliver, fmt.Errorf("session not established, send CER first"))
+	}
+	// 字典中CCR与Gx共用，Service-Context-Id只在信用控制应用中必须
+	if avp, _ := msg.FindAVPByCode(AVP_ServiceContextId); avp == nil {
+		return reject(ResultCode_MissingAVP, fmt.Errorf("miss avp, need one of [%d]", AVP_ServiceContextId))
+	}
+
+	credits.mu.Lock()
+	defer credits.mu.Unlock()
+	now := time.Now()
+	credits.expire(now)
+
+	if requestType == CCRequestEvent {
+		return handleCCREvent(msg, subscriber, builder, reject)
+	}
+
+	cc, ok := credits.sessions[sessionID]
+	switch requestType {
+	case CCRequestInitial:
+		if ok {
+			return reject(ResultCode_InvalidAVPValue, fmt.Errorf("credit control session %v already exists", sessionID))
+		}
+		if _, ok := credits.accounts[subscriber]; !ok {
+			return reject(ResultCode_UserUnknown, fmt.Errorf("subscriber %q unknown", subscriber))
+		}
+		cc = &ccSession{subscriber: subscriber, lastRequestNumber: requestNumber, reserved: make(map[uint32]CreditUnits), updatedAt: now}
+		credits.sessions[sessionID] = cc
+	case CCRequestUpdate, CCRequestTermination:
+		if !ok {
+			return reject(ResultCode_UnknownSessionID, fmt.Errorf("credit control session %v not found", sessionID))
+		}
+		if requestNumber <= cc.lastRequestNumber {
+			return reject(ResultCode_InvalidAVPValue, fmt.Errorf("CC-Request-Number %d out of order, last %d", requestNumber, cc.lastRequestNumber))
+		}
+		cc.lastRequestNumber = requestNumber
+		cc.updatedAt = now
+	default:
+		return reject(ResultCode_InvalidAVPValue, fmt.Errorf("invalid CC-Request-Type %d", requestType))
+	}
+	account := credits.accounts[cc.subscriber]
+
+	items := ccCreditItems(msg)
+	mscc := len(msg.FindAVPsByCode(AVP_MultipleServicesCreditControl)) > 0
+	resultCode := uint32(ResultCode_Success)
+	for _, item := range items {
+		// 先扣除上次授予后实际使用的量，释放该Rating-Group之前的预留
+		used := parseCreditUnits(item.used)
+		credits.debit(account, used, cc.reserved[item.ratingGroup])
+		delete(cc.reserved, item.ratingGroup)
+		if !used.isZero() {
+			log.Printf("用户%v 扣减 %v，余额 %v", cc.subscriber, used, account.balance)
+		}
+		if requestType == CCRequestTermination {
+			continue
+		}
+		// INITIAL没有RSU时也按默认配额授予，UPDATE只在带RSU时授予
+		if item.requested == nil && requestType != CCRequestInitial {
+			continue
+		}
+
+		requested := parseCreditUnits(item.requested)
+		if requested.isZero() {
+			requested = ccDefaultRequest(account)
+		}
+		granted, final, ok := credits.reserve(account, requested)
+		itemResult := uint32(ResultCode_Success)
+		grantAVPs := make([]*AVPMsg, 0, 4)
+		if ok {
+			cc.reserved[item.ratingGroup] = granted
+			grantAVPs = append(grantAVPs, newCreditUnitsAVP(AVP_GrantedServiceUnit, granted))
+			if config.CreditControl.ValidityTime > 0 {
+				grantAVPs = append(grantAVPs, NewAVPBuilder(AVP_ValidityTime, AVPFlag_Mandatory).SetIntData(config.CreditControl.ValidityTime).Build())
+			}
+			if final {
+				grantAVPs = append(grantAVPs, NewAVPBuilder(AVP_FinalUnitIndication, AVPFlag_Mandatory).SetGroupedData(
+					NewAVPBuilder(AVP_FinalUnitAction, AVPFlag_Mandatory).SetIntData(FinalUnitActionTerminate).Build(),
+				).Build())
+			}
+			log.Printf("用户%v 授予配额 %v，最后配额: %v", cc.subscriber, granted, final)
+		} else {
+			itemResult = ResultCode_CreditLimitReached
+			log.Printf("用户%v 余额不足，请求 %v", cc.subscriber, requested)
+		}
+
+		if mscc {
+			subAVPs := append(append([]*AVPMsg{}, item.echo...), grantAVPs...)
+			subAVPs = append(subAVPs, NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(itemResult).Build())
+			builder.AddAVP(NewAVPBuilder(AVP_MultipleServicesCreditControl, AVPFlag_Mandatory).SetGroupedData(subAVPs...).Build())
+		} else {
+			for _, avp := range grantAVPs {
+				builder.AddAVP(avp)
+			}
+			resultCode = itemResult
+		}
+	}
+	switch {
+	case requestType == CCRequestTermination:
+		delete(credits.sessions, sessionID)
+		log.Printf("用户%v 信用控制会话结束，余额 %v", cc.subscriber, account.balance)
+	case requestType == CCRequestInitial && resultCode != ResultCode_Success:
+		// CCR-I失败时客户端不会再发CCR-T，会话不保留
+		credits.release(sessionID, cc)
+		log.Printf("用户%v 信用控制会话建立失败 Result-Code: %v", cc.subscriber, resultCode)
+	}
+	builder.AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(resultCode).Build())
+	return builder.Build(), nil
+}
+
+// 没有指定数量时的请求，只对用户有余额的计量方式按默认配额申请
+func ccDefaultRequest(account *creditAccount) CreditUnits {
+	quota := config.CreditControl.defaultQuota()
+	var requested CreditUnits
+	if account.balance.Time > 0 {
+		requested.Time = quota.Time
+	}
+	if account.balance.Octets > 0 {
+		requested.Octets = quota.Octets
+	}
+	if account.balance.Units > 0 {
+		requested.Units = quota.Units
+	}
+	return requested
+}
+
+// 一次性事件：直接扣费、退款、查询余额，调用方持有锁
+func handleCCREvent(msg *DiameterMsg, subscriber string, builder *DiameterMsgBuilder, reject func(uint32, error) (*DiameterMsg, error)) (*DiameterMsg, error) {
+	account, ok := credits.accounts[subscriber]
+	if !ok {
+		return reject(ResultCode_UserUnknown, fmt.Errorf("subscriber %q unknown", subscriber))
+	}
+	requestedAVP, _ := msg.FindAVPByCode(AVP_RequestedServiceUnit)
+	requested := parseCreditUnits(requestedAVP)
+	action := avpIntData(msg, AVP_RequestedAction)
+	builder.AddAVP(NewAVPBuilder(AVP_RequestedAction, AVPFlag_Mandatory).SetIntData(action).Build())
+
+	switch action {
+	case RequestedActionDirectDebiting:
+		available := account.available()
+		if requested.isZero() || requested.Time > available.Time || requested.Octets > available.Octets || requested.Units > available.Units {
+			return reject(ResultCode_CreditLimitReached, fmt.Errorf("subscriber %v insufficient balance for %v", subscriber, requested))
+		}
+		account.balance = account.balance.sub(requested)
+		builder.AddAVP(newCreditUnitsAVP(AVP_GrantedServiceUnit, requested))
+		log.Printf("用户%v 直接扣费 %v，余额 %v", subscriber, requested, account.balance)
+	case RequestedActionRefundAccount:
+		account.balance = account.balance.add(requested)
+		log.Printf("用户%v 退款 %v，余额 %v", subscriber, requested, account.balance)
+	case RequestedActionCheckBalance:
+		result := uint32(CheckBalanceNoCredit)
+		if !account.available().isZero() {
+			result = CheckBalanceEnoughCredit
+		}
+		builder.AddAVP(NewAVPBuilder(AVP_CheckBalanceResult, AVPFlag_Mandatory).SetIntData(result).Build())
+	default:
+		return reject(ResultCode_UnableToComply, fmt.Errorf("Requested-Action %d not supported", action))
+	}
+	builder.AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(ResultCode_Success).Build())
+	return builder.Build(), nil
+}
@@ -0,0 +1,115 @@
+package diameter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCreditReserveAndDebit(t *testing.T) {
+	tests := []struct {
+		name      string
+		balance   CreditUnits
+		reserved  CreditUnits
+		requested CreditUnits
+		granted   CreditUnits
+		final     bool
+		ok        bool
+		used      CreditUnits
+		left      CreditUnits // 扣减并释放预留后的余额
+	}{
+		{
+			name:      "余额充足",
+			balance:   CreditUnits{Time: 3600, Octets: 1 << 20},
+			requested: CreditUnits{Time: 600, Octets: 1024},
+			granted:   CreditUnits{Time: 600, Octets: 1024},
+			ok:        true,
+			used:      CreditUnits{Time: 300, Octets: 512},
+			left:      CreditUnits{Time: 3300, Octets: 1<<20 - 512},
+		},
+		{
+			name:      "余额不足时授予剩余部分并标记最后配额",
+			balance:   CreditUnits{Time: 100},
+			requested: CreditUnits{Time: 600},
+			granted:   CreditUnits{Time: 100},
+			final:     true,
+			ok:        true,
+			used:      CreditUnits{Time: 100},
+		},
+		{
+			name:      "其他会话的预留占用余额",
+			balance:   CreditUnits{Units: 100},
+			reserved:  CreditUnits{Units: 80},
+			requested: CreditUnits{Units: 50},
+			granted:   CreditUnits{Units: 20},
+			final:     true,
+			ok:        true,
+			used:      CreditUnits{Units: 10},
+			left:      CreditUnits{Units: 90},
+		},
+		{
+			name:      "余额为0",
+			balance:   CreditUnits{Octets: 1024},
+			requested: CreditUnits{Time: 60},
+			final:     true,
+			left:      CreditUnits{Octets: 1024},
+		},
+		{
+			name:      "使用量超过余额时扣到0",
+			balance:   CreditUnits{Time: 60},
+			requested: CreditUnits{Time: 60},
+			granted:   CreditUnits{Time: 60},
+			final:     true,
+			ok:        true,
+			used:      CreditUnits{Time: 90},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &creditStore{}
+			account := &creditAccount{balance: tt.balance, reserved: tt.reserved}
+			granted, final, ok := s.reserve(account, tt.requested)
+			if granted != tt.granted || final != tt.final || ok != tt.ok {
+				t.Fatalf("reserve = %v %v %v, want %v %v %v", granted, final, ok, tt.granted, tt.final, tt.ok)
+			}
+			if want := tt.reserved.add(tt.granted); account.reserved != want {
+				t.Errorf("reserved = %v, want %v", account.reserved, want)
+			}
+			s.debit(account, tt.used, granted)
+			if account.balance != tt.left {
+				t.Errorf("balance = %v, want %v", account.balance, tt.left)
+			}
+			if account.reserved != tt.reserved {
+				t.Errorf("reserved after debit = %v, want %v", account.reserved, tt.reserved)
+			}
+		})
+	}
+}
+
+func TestCreditSessionExpire(t *testing.T) {
+	saved := config.CreditControl.ValidityTime
+	defer func() { config.CreditControl.ValidityTime = saved }()
+	config.CreditControl.ValidityTime = 60
+
+	now := time.Now()
+	account := &creditAccount{balance: CreditUnits{Time: 1000}, reserved: CreditUnits{Time: 300}}
+	s := &creditStore{
+		accounts: map[string]*creditAccount{"alice": account},
+		sessions: map[string]*ccSession{
+			"idle":   {subscriber: "alice", reserved: map[uint32]CreditUnits{1: {Time: 200}}, updatedAt: now.Add(-60*time.Second - ccSessionGrace - time.Second)},
+			"active": {subscriber: "alice", reserved: map[uint32]CreditUnits{1: {Time: 100}}, updatedAt: now.Add(-60 * time.Second)},
+		},
+	}
+	s.expire(now)
+	if _, ok := s.sessions["idle"]; ok {
+		t.Error("session idle past Validity-Time and grace should be removed")
+	}
+	if _, ok := s.sessions["active"]; !ok {
+		t.Error("session within Validity-Time and grace should be kept")
+	}
+	if want := (CreditUnits{Time: 100}); account.reserved != want {
+		t.Errorf("reserved = %v, want %v", account.reserved, want)
+	}
+	if want := (CreditUnits{Time: 1000}); account.balance != want {
+		t.Errorf("balance = %v, want %v", account.balance, want)
+	}
+}
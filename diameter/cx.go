@@ -0,0 +1,765 @@
+package diameter
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cx/Dx的Experimental-Result-Code，3GPP TS 29.229 6.2
+const (
+	ExperimentalResult_FirstRegistration      = 2001 // DIAMETER_FIRST_REGISTRATION
+	ExperimentalResult_SubsequentRegistration = 2002 // DIAMETER_SUBSEQUENT_REGISTRATION
+	ExperimentalResult_UnregisteredService    = 2003 // DIAMETER_UNREGISTERED_SERVICE
+	ExperimentalResult_IdentitiesDontMatch    = 5002 // DIAMETER_ERROR_IDENTITIES_DONT_MATCH
+	ExperimentalResult_IdentityNotRegistered  = 5003 // DIAMETER_ERROR_IDENTITY_NOT_REGISTERED
+	ExperimentalResult_AuthSchemeNotSupported = 5006 // DIAMETER_ERROR_AUTH_SCHEME_NOT_SUPPORTED
+	ExperimentalResult_ErrorInAssignmentType  = 5007 // DIAMETER_ERROR_IN_ASSIGNMENT_TYPE
+)
+
+// User-Authorization-Type，TS 29.229 6.3.24
+const (
+	UserAuthorizationRegistration                = 0
+	UserAuthorizationDeregistration              = 1
+	UserAuthorizationRegistrationAndCapabilities = 2
+)
+
+// Server-Assignment-Type，TS 29.229 6.3.15
+const (
+	ServerAssignmentNoAssignment                         = 0
+	ServerAssignmentRegistration                         = 1
+	ServerAssignmentReRegistration                       = 2
+	ServerAssignmentUnregisteredUser                     = 3
+	ServerAssignmentTimeoutDeregistration                = 4
+	ServerAssignmentUserDeregistration                   = 5
+	ServerAssignmentTimeoutDeregistrationStoreServerName = 6
+	ServerAssignmentUserDeregistrationStoreServerName    = 7
+	ServerAssignmentAdministrativeDeregistration         = 8
+	ServerAssignmentAuthenticationFailure                = 9
+	ServerAssignmentAuthenticationTimeout                = 10
+	ServerAssignmentDeregistrationTooMuchData            = 11
+)
+
+// Reason-Code，RTR中的注销原因，TS 29.229 6.3.17
+const (
+	ReasonPermanentTermination = 0
+	ReasonNewServerAssigned    = 1
+	ReasonServerChange         = 2
+	ReasonRemoveSCSCF          = 3
+)
+
+// IMS用户的注册状态，TS 29.228 附录B
+const (
+	imsNotRegistered = iota
+	imsRegistered
+	imsUnregistered
+)
+
+var imsStateNames = map[int]string{
+	imsNotRegistered: "NOT_REGISTERED",
+	imsRegistered:    "REGISTERED",
+	imsUnregistered:  "UNREGISTERED",
+}
+
+// SIP-Authentication-Scheme，TS 29.229 6.3.9
+const (
+	SIPAuthSchemeDigestAKA = "Digest-AKAv1-MD5"
+	SIPAuthSchemeDigest    = "SIP Digest"
+	sipAuthSchemeUnknown   = "Unknown"
+)
+
+const (
+	defaultCxSubscriberDir = "ims_subscribers"
+	defaultCxMaxVectors    = 5
+	userDataNotAvailable   = 0 // User-Data-Already-Available为USER_DATA_NOT_AVAILABLE
+)
+
+// CxConfig Cx/Dx IMS HSS配置，Dx与Cx使用相同的应用和命令
+type CxConfig struct {
+	SubscriberDir string `json:"subscriber_dir"` // 用户目录，每个用户一个json文件，默认ims_subscribers
+	MaxVectors    int    `json:"max_vectors"`    // 一次MAR最多返回的Digest-AKA向量个数，默认5
+	// 用户没有分配S-CSCF时UAA/LIA返回的能力，I-CSCF据此选择S-CSCF
+	ServerCapabilities CxServerCapabilities `json:"server_capabilities"`
+}
+
+func (c *CxConfig) subscriberDir() string {
+	if c.SubscriberDir == "" {
+		return defaultCxSubscriberDir
+	}
+	return c.SubscriberDir
+}
+
+func (c *CxConfig) maxVectors() int {
+	if c.MaxVectors <= 0 {
+		return defaultCxMaxVectors
+	}
+	return c.MaxVectors
+}
+
+// CxServerCapabilities Server-Capabilities中的能力和可选的S-CSCF名称
+type CxServerCapabilities struct {
+	Mandatory   []uint32 `json:"mandatory"`
+	Optional    []uint32 `json:"optional"`
+	ServerNames []string `json:"server_names"`
+}
+
+// IMSSubscriber 用户目录中的一个用户，文件名为<名称>.json
+type IMSSubscriber struct {
+	PrivateIdentity  string   `json:"private_identity"`
+	PublicIdentities []string `json:"public_identities"`
+	AuthScheme       string   `json:"auth_scheme"`        // Digest-AKAv1-MD5或SIP Digest，默认Digest-AKAv1-MD5
+	K                string   `json:"k,omitempty"`        // Digest-AKA使用，16字节十六进制
+	OPc              string   `json:"opc,omitempty"`      // Digest-AKA使用，16字节十六进制
+	AMF              string   `json:"amf,omitempty"`      // 默认8000
+	SQN              uint64   `json:"sqn,omitempty"`      // 初始SQN
+	Password         string   `json:"password,omitempty"` // SIP Digest使用
+	Realm            string   `json:"realm,omitempty"`    // SIP Digest的realm，默认为私有标识@之后的域名
+	// 用户签约XML(IMS Subscription)的文件名，在用户目录下，默认<名称>.xml
+	ServiceProfile string `json:"service_profile,omitempty"`
+	// 未注册时是否有服务(如转移到语音信箱)，有时LIR返回DIAMETER_UNREGISTERED_SERVICE
+	UnregisteredServices bool `json:"unregistered_services"`
+}
+
+func (p *IMSSubscriber) authScheme() string {
+	if p.AuthScheme == "" {
+		return SIPAuthSchemeDigestAKA
+	}
+	return p.AuthScheme
+}
+
+func (p *IMSSubscriber) digestRealm() string {
+	if p.Realm != "" {
+		return p.Realm
+	}
+	if i := strings.LastIndex(p.PrivateIdentity, "@"); i >= 0 {
+		return p.PrivateIdentity[i+1:]
+	}
+	return config.OriginRealm
+}
+
+// CxRegistration 为用户服务的S-CSCF
+type CxRegistration struct {
+	ServerName string    `json:"server_name"`
+	Host       string    `json:"host"` // 发出SAR的Origin-Host，RTR/PPR发给它
+	Realm      string    `json:"realm"`
+	AssignedAt time.Time `json:"assigned_at"`
+}
+
+// IMSSubscriberStatus 管理接口中用户的注册状态
+type IMSSubscriberStatus struct {
+	PrivateIdentity  string          `json:"private_identity"`
+	PublicIdentities []string        `json:"public_identities"`
+	AuthScheme       string          `json:"auth_scheme"`
+	SQN              uint64          `json:"sqn,omitempty"`
+	State            string          `json:"state"`
+	SCSCF            *CxRegistration `json:"scscf,omitempty"`
+}
+
+type imsSubscriber struct {
+	profile  IMSSubscriber
+	dataFile string // 用户签约XML的路径
+	milenage *milenage
+	amf      []byte
+	sqn      uint64
+	state    int
+	scscf    *CxRegistration // 注销时可能保留S-CSCF名称
+}
+
+type imsHSSStore struct {
+	mu          sync.Mutex
+	subscribers map[string]*imsSubscriber // 按私有标识索引
+	identities  map[string]string         // 公有标识到私有标识
+}
+
+var imsHSS = &imsHSSStore{subscribers: make(map[string]*imsSubscriber), identities: make(map[string]string)}
+
+// 读取用户目录下的用户，加载配置后调用，目录不存在时没有用户
+func (s *imsHSSStore) load(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	subscribers := make(map[string]*imsSubscriber, len(files))
+	identities := make(map[string]string)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		var profile IMSSubscriber
+		if err := json.Unmarshal(data, &profile); err != nil {
+			return fmt.Errorf("cx subscriber %v: %w", file, err)
+		}
+		sub, err := newIMSSubscriber(dir, strings.TrimSuffix(filepath.Base(file), ".json"), profile)
+		if err != nil {
+			return fmt.Errorf("cx subscriber %v: %w", file, err)
+		}
+		if _, ok := subscribers[profile.PrivateIdentity]; ok {
+			return fmt.Errorf("cx subscriber %v: duplicate private_identity %v", file, profile.PrivateIdentity)
+		}
+		subscribers[profile.PrivateIdentity] = sub
+		for _, impu := range profile.PublicIdentities {
+			if impi, ok := identities[impu]; ok {
+				return fmt.Errorf("cx subscriber %v: public identity %v already used by %v", file, impu, impi)
+			}
+			identities[impu] = profile.PrivateIdentity
+		}
+	}
+	if len(files) == 0 {
+		log.Printf("Cx用户目录%v 没有用户", dir)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscribers = subscribers
+	s.identities = identities
+	return nil
+}
+
+func newIMSSubscriber(dir, name string, profile IMSSubscriber) (*imsSubscriber, error) {
+	if profile.PrivateIdentity == "" {
+		return nil, fmt.Errorf("missing private_identity")
+	}
+	dataFile := profile.ServiceProfile
+	if dataFile == "" {
+		dataFile = name + ".xml"
+	}
+	if filepath.Base(dataFile) != dataFile {
+		return nil, fmt.Errorf("service_profile must be a file name in %v", dir)
+	}
+	sub := &imsSubscriber{profile: profile, dataFile: filepath.Join(dir, dataFile), sqn: profile.SQN & sqnMask}
+	switch profile.authScheme() {
+	case SIPAuthSchemeDigestAKA:
+		k, err := decodeHexKey("k", profile.K, 16)
+		if err != nil {
+			return nil, err
+		}
+		opc, err := decodeHexKey("opc", profile.OPc, 16)
+		if err != nil {
+			return nil, err
+		}
+		amfHex := profile.AMF
+		if amfHex == "" {
+			amfHex = defaultS6aAMF
+		}
+		if sub.amf, err = decodeHexKey("amf", amfHex, 2); err != nil {
+			return nil, err
+		}
+		if sub.milenage, err = newMilenage(k, opc); err != nil {
+			return nil, err
+		}
+	case SIPAuthSchemeDigest:
+		if profile.Password == "" {
+			return nil, fmt.Errorf("SIP Digest needs password")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported auth_scheme %v", profile.AuthScheme)
+	}
+	return sub, nil
+}
+
+// 读取用户签约XML，每次读取文件，修改后由SAR或PPR下发，只检查XML格式是否正确
+func readIMSUserData(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		if _, err := decoder.Token(); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%v: %w", filepath.Base(path), err)
+		}
+	}
+	return data, nil
+}
+
+// 按私有标识和公有标识查找用户，都带时校验公有标识属于该用户，调用时持有锁
+func (s *imsHSSStore) find(impi, impu string) (*imsSubscriber, error) {
+	if impi == "" {
+		if impi = s.identities[impu]; impi == "" {
+			return nil, newExperimentalError(ExperimentalResult_UserUnknown, "public identity %v unknown", impu)
+		}
+	}
+	sub, ok := s.subscribers[impi]
+	if !ok {
+		return nil, newExperimentalError(ExperimentalResult_UserUnknown, "user %v unknown", impi)
+	}
+	if impu != "" && s.identities[impu] != impi {
+		return nil, newExperimentalError(ExperimentalResult_IdentitiesDontMatch, "public identity %v does not belong to %v", impu, impi)
+	}
+	return sub, nil
+}
+
+// UAA/LIA的结果，experimental为false时code放在Result-Code里，serverName为空时返回Server-Capabilities
+type cxServerSelection struct {
+	code         uint32
+	experimental bool
+	serverName   string
+}
+
+// UAR：按注册状态返回已分配的S-CSCF，没有时由I-CSCF按能力选择
+func (s *imsHSSStore) authorize(impi, impu string, authType uint32) (cxServerSelection, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, err := s.find(impi, impu)
+	if err != nil {
+		return cxServerSelection{}, err
+	}
+	switch authType {
+	case UserAuthorizationRegistration:
+		if sub.scscf == nil {
+			return cxServerSelection{code: ExperimentalResult_FirstRegistration, experimental: true}, nil
+		}
+		return cxServerSelection{code: ExperimentalResult_SubsequentRegistration, experimental: true, serverName: sub.scscf.ServerName}, nil
+	case UserAuthorizationDeregistration:
+		if sub.scscf == nil {
+			return cxServerSelection{}, newExperimentalError(ExperimentalResult_IdentityNotRegistered, "user %v not registered", impi)
+		}
+		return cxServerSelection{code: ResultCode_Success, serverName: sub.scscf.ServerName}, nil
+	case UserAuthorizationRegistrationAndCapabilities:
+		return cxServerSelection{code: ExperimentalResult_FirstRegistration, experimental: true}, nil
+	}
+	return cxServerSelection{}, newResultError(ResultCode_InvalidAVPValue, "invalid User-Authorization-Type %d", authType)
+}
+
+// LIR：按公有标识返回为用户服务的S-CSCF，未注册但有未注册服务时由I-CSCF选择S-CSCF
+func (s *imsHSSStore) locate(impu string, authType uint32) (cxServerSelection, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, err := s.find("", impu)
+	if err != nil {
+		return cxServerSelection{}, err
+	}
+	if authType == UserAuthorizationRegistrationAndCapabilities {
+		return cxServerSelection{code: ResultCode_Success}, nil
+	}
+	if sub.scscf != nil {
+		return cxServerSelection{code: ResultCode_Success, serverName: sub.scscf.ServerName}, nil
+	}
+	if sub.profile.UnregisteredServices {
+		return cxServerSelection{code: ExperimentalResult_UnregisteredService, experimental: true}, nil
+	}
+	return cxServerSelection{}, newExperimentalError(ExperimentalResult_IdentityNotRegistered, "public identity %v not registered", impu)
+}
+
+// MAR生成的鉴权数据，Digest-AKA为向量，SIP Digest为H(A1)
+type cxAuthData struct {
+	scheme  string
+	vectors []umtsVector
+	realm   string
+	ha1     string
+}
+
+// MAR：按用户的鉴权方式生成鉴权数据，请求的方式为Unknown时使用用户配置的方式，
+// 带SIP-Authorization(RAND||AUTS)时先按终端的SQN校正
+func (s *imsHSSStore) authenticate(impi, impu, scheme string, n int, resyncInfo []byte) (cxAuthData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, err := s.find(impi, impu)
+	if err != nil {
+		return cxAuthData{}, err
+	}
+	data := cxAuthData{scheme: sub.profile.authScheme()}
+	if scheme != "" && scheme != sipAuthSchemeUnknown && scheme != data.scheme {
+		return cxAuthData{}, newExperimentalError(ExperimentalResult_AuthSchemeNotSupported, "user %v uses %v, not %v", impi, data.scheme, scheme)
+	}
+	if data.scheme == SIPAuthSchemeDigest {
+		data.realm = sub.profile.digestRealm()
+		ha1 := md5.Sum([]byte(impi + ":" + data.realm + ":" + sub.profile.Password))
+		data.ha1 = hex.EncodeToString(ha1[:])
+		return data, nil
+	}
+	if resyncInfo != nil {
+		if len(resyncInfo) != 30 {
+			return cxAuthData{}, newResultError(ResultCode_UnableToComply, "invalid SIP-Authorization length %d", len(resyncInfo))
+		}
+		sqnMS, err := sub.milenage.resync(resyncInfo[:16], resyncInfo[16:])
+		if err != nil {
+			return cxAuthData{}, newResultError(ResultCode_UnableToComply, "re-synchronization failed: %v", err)
+		}
+		log.Printf("IMS用户%v 重同步，SQN %v -> %v", impi, sub.sqn, sqnMS)
+		sub.sqn = sqnMS
+	}
+	data.vectors = make([]umtsVector, 0, n)
+	for i := 0; i < n; i++ {
+		sub.sqn = (sub.sqn + sqnStep) & sqnMask
+		data.vectors = append(data.vectors, sub.milenage.umtsVector(randomBytes(16), sqnBytes(sub.sqn), sub.amf))
+	}
+	return data, nil
+}
+
+// SAR：按Server-Assignment-Type更新注册状态和S-CSCF，withData时返回用户签约XML，
+// 同时返回用户的私有标识(请求可能只带公有标识)
+func (s *imsHSSStore) assign(impi, impu string, assignType uint32, reg CxRegistration, withData bool) (string, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, err := s.find(impi, impu)
+	if err != nil {
+		return "", nil, err
+	}
+	impi = sub.profile.PrivateIdentity
+	var userData []byte
+	if withData {
+		if userData, err = readIMSUserData(sub.dataFile); err != nil {
+			return impi, nil, newResultError(ResultCode_UnableToComply, "user data of %v: %v", impi, err)
+		}
+	}
+	switch assignType {
+	case ServerAssignmentNoAssignment:
+		if sub.scscf == nil || sub.scscf.ServerName != reg.ServerName {
+			return impi, nil, newResultError(ResultCode_UnableToComply, "user %v not served by %v", impi, reg.ServerName)
+		}
+	case ServerAssignmentRegistration, ServerAssignmentReRegistration:
+		if sub.scscf != nil && sub.scscf.ServerName != reg.ServerName {
+			log.Printf("IMS用户%v 的S-CSCF由%v 改为%v", impi, sub.scscf.ServerName, reg.ServerName)
+		}
+		sub.state = imsRegistered
+		sub.scscf = &reg
+	case ServerAssignmentUnregisteredUser:
+		sub.state = imsUnregistered
+		sub.scscf = &reg
+	case ServerAssignmentTimeoutDeregistration, ServerAssignmentUserDeregistration,
+		ServerAssignmentAdministrativeDeregistration, ServerAssignmentDeregistrationTooMuchData:
+		sub.state = imsNotRegistered
+		sub.scscf = nil
+	case ServerAssignmentTimeoutDeregistrationStoreServerName, ServerAssignmentUserDeregistrationStoreServerName:
+		// 保留S-CSCF，之后的UAR/LIR仍返回它
+		sub.state = imsNotRegistered
+	case ServerAssignmentAuthenticationFailure, ServerAssignmentAuthenticationTimeout:
+		// 已注册的用户保持原状态，否则清除鉴权时记录的S-CSCF
+		if sub.state == imsNotRegistered {
+			sub.scscf = nil
+		}
+	default:
+		return impi, nil, newExperimentalError(ExperimentalResult_ErrorInAssignmentType, "invalid Server-Assignment-Type %d", assignType)
+	}
+	return impi, userData, nil
+}
+
+// 用户当前的S-CSCF和签约，RTR/PPR发给它
+func (s *imsHSSStore) serving(impi string) (IMSSubscriber, CxRegistration, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.subscribers[impi]
+	if !ok {
+		return IMSSubscriber{}, CxRegistration{}, "", fmt.Errorf("user %v unknown", impi)
+	}
+	if sub.scscf == nil {
+		return IMSSubscriber{}, CxRegistration{}, "", fmt.Errorf("user %v has no S-CSCF", impi)
+	}
+	return sub.profile, *sub.scscf, sub.dataFile, nil
+}
+
+// RTA成功后清除注册，S-CSCF已经变化时不处理
+func (s *imsHSSStore) deregister(impi, host string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sub, ok := s.subscribers[impi]; ok && sub.scscf != nil && sub.scscf.Host == host {
+		sub.state = imsNotRegistered
+		sub.scscf = nil
+	}
+}
+
+// IMSSubscribers 所有IMS用户的注册状态，按私有标识排序
+func IMSSubscribers() []IMSSubscriberStatus {
+	imsHSS.mu.Lock()
+	defer imsHSS.mu.Unlock()
+	statuses := make([]IMSSubscriberStatus, 0, len(imsHSS.subscribers))
+	for impi, sub := range imsHSS.subscribers {
+		status := IMSSubscriberStatus{
+			PrivateIdentity:  impi,
+			PublicIdentities: sub.profile.PublicIdentities,
+			AuthScheme:       sub.profile.authScheme(),
+			State:            imsStateNames[sub.state],
+		}
+		if sub.milenage != nil {
+			status.SQN = sub.sqn
+		}
+		if sub.scscf != nil {
+			scscf := *sub.scscf
+			status.SCSCF = &scscf
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].PrivateIdentity < statuses[j].PrivateIdentity })
+	return statuses
+}
+
+// Cx应答的公共部分，Auth-Session-State固定为NO_STATE_MAINTAINED
+func newCxAnswerBuilder(req *DiameterMsg) *DiameterMsgBuilder {
+	return newAnswerBuilder(req).
+		AddAVP(vendorApplicationAVP(AppID_Cx)).
+		AddAVP(NewAVPBuilder(AVP_AuthSessionState, AVPFlag_Mandatory).SetIntData(AuthSessionNoStateMaintained).Build())
+}
+
+// Cx错误应答，3GPP定义的错误码放在Experimental-Result中
+func cxReject(session *Session, command, user string, builder *DiameterMsgBuilder, err error) *DiameterMsg {
+	log.Printf("主机%v %v 用户: %v 处理失败: %v", session.PeerHost, command, user, err)
+	return buildErrorAnswer(builder, err)
+}
+
+// 请求中的私有标识(User-Name)和公有标识
+func cxRequestUser(msg *DiameterMsg) (impi, impu string) {
+	if userAVP, _ := msg.FindAVPByCode(AVP_UserName); userAVP != nil {
+		impi = userAVP.GetStringData()
+	}
+	if publicAVP, _ := msg.FindAVPByCode(AVP_PublicIdentity); publicAVP != nil {
+		impu = publicAVP.GetStringData()
+	}
+	return impi, impu
+}
+
+func serverCapabilitiesAVP() *AVPMsg {
+	caps := config.Cx.ServerCapabilities
+	avps := make([]*AVPMsg, 0, len(caps.Mandatory)+len(caps.Optional)+len(caps.ServerNames))
+	for _, capability := range caps.Mandatory {
+		avps = append(avps, New3GPPAVPBuilder(AVP_MandatoryCapability, AVPFlag_Mandatory).SetIntData(capability).Build())
+	}
+	for _, capability := range caps.Optional {
+		avps = append(avps, New3GPPAVPBuilder(AVP_OptionalCapability, AVPFlag_Mandatory).SetIntData(capability).Build())
+	}
+	for _, name := range caps.ServerNames {
+		avps = append(avps, New3GPPAVPBuilder(AVP_ServerName, AVPFlag_Mandatory).SetStringData(name).Build())
+	}
+	return New3GPPAVPBuilder(AVP_ServerCapabilities, AVPFlag_Mandatory).SetGroupedData(avps...).Build()
+}
+
+// UAA/LIA：有S-CSCF时带Server-Name，否则带Server-Capabilities
+func buildServerSelection(builder *DiameterMsgBuilder, selection cxServerSelection) *DiameterMsg {
+	if selection.experimental {
+		builder.AddAVP(experimentalResultAVP(VendorID_3GPP, selection.code))
+	} else {
+		builder.AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(selection.code).Build())
+	}
+	if selection.serverName != "" {
+		builder.AddAVP(New3GPPAVPBuilder(AVP_ServerName, AVPFlag_Mandatory).SetStringData(selection.serverName).Build())
+	} else {
+		builder.AddAVP(serverCapabilitiesAVP())
+	}
+	return builder.Build()
+}
+
+// 处理UAR，I-CSCF在注册时查询为用户服务的S-CSCF，TS 29.228 6.1.1
+func handleUAR(session *Session, msg *DiameterMsg) (*DiameterMsg, error) {
+	impi, impu := cxRequestUser(msg)
+	builder := newCxAnswerBuilder(msg)
+	if session.State() != StateEstablished {
+		return cxReject(session, "UAR", impi, builder, newResultError(ResultCode_UnableToDeliver, "session not established, send CER first")), nil
+	}
+	authType := vendorAVPIntData(msg, AVP_UserAuthorizationType, VendorID_3GPP)
+	log.Printf("主机%v UAR 私有标识: %v 公有标识: %v User-Authorization-Type: %v", session.PeerHost, impi, impu, authType)
+	selection, err := imsHSS.authorize(impi, impu, authType)
+	if err != nil {
+		return cxReject(session, "UAR", impi, builder, err), nil
+	}
+	return buildServerSelection(builder, selection), nil
+}
+
+// 处理MAR，按用户的鉴权方式返回Digest-AKA向量或SIP Digest的H(A1)，TS 29.228 6.3
+func handleMAR(session *Session, msg *DiameterMsg) (*DiameterMsg, error) {
+	impi, impu := cxRequestUser(msg)
+	builder := newCxAnswerBuilder(msg)
+	if session.State() != StateEstablished {
+		return cxReject(session, "MAR", impi, builder, newResultError(ResultCode_UnableToDeliver, "session not established, send CER first")), nil
+	}
+	n := 1
+	if count := avpIntData(msg, AVP_SIPNumberAuthItems); count > 0 {
+		n = int(count)
+	}
+	if n > config.Cx.maxVectors() {
+		n = config.Cx.maxVectors()
+	}
+	var scheme string
+	var resyncInfo []byte
+	if itemAVP, _ := msg.FindAVPByCode(AVP_SIPAuthDataItem); itemAVP != nil {
+		if schemeAVP := itemAVP.FindGroupedAVP(AVP_SIPAuthenticationScheme); schemeAVP != nil {
+			scheme = schemeAVP.GetStringData()
+		}
+		if authorizationAVP := itemAVP.FindGroupedAVP(AVP_SIPAuthorization); authorizationAVP != nil {
+			resyncInfo = authorizationAVP.GetRawData()
+		}
+	}
+	var serverName string
+	if serverAVP, _ := msg.FindAVPByCode(AVP_ServerName); serverAVP != nil {
+		serverName = serverAVP.GetStringData()
+	}
+	log.Printf("主机%v MAR 私有标识: %v 公有标识: %v 鉴权方式: %v 向量数: %v 重同步: %v S-CSCF: %v",
+		session.PeerHost, impi, impu, scheme, n, resyncInfo != nil, serverName)
+
+	data, err := imsHSS.authenticate(impi, impu, scheme, n, resyncInfo)
+	if err != nil {
+		return cxReject(session, "MAR", impi, builder, err), nil
+	}
+	var items []*AVPMsg
+	if data.scheme == SIPAuthSchemeDigest {
+		items = append(items, New3GPPAVPBuilder(AVP_SIPAuthDataItem, AVPFlag_Mandatory).SetGroupedData(
+			New3GPPAVPBuilder(AVP_SIPItemNumber, AVPFlag_Mandatory).SetIntData(1).Build(),
+			New3GPPAVPBuilder(AVP_SIPAuthenticationScheme, AVPFlag_Mandatory).SetStringData(data.scheme).Build(),
+			New3GPPAVPBuilder(AVP_SIPDigestAuthenticate, AVPFlag_Mandatory).SetGroupedData(
+				NewAVPBuilder(AVP_DigestRealm, AVPFlag_Mandatory).SetStringData(data.realm).Build(),
+				NewAVPBuilder(AVP_DigestAlgorithm, AVPFlag_Mandatory).SetStringData("MD5").Build(),
+				NewAVPBuilder(AVP_DigestQoP, AVPFlag_Mandatory).SetStringData("auth").Build(),
+				NewAVPBuilder(AVP_DigestHA1, AVPFlag_Mandatory).SetStringData(data.ha1).Build(),
+			).Build(),
+		).Build())
+	}
+	for i, v := range data.vectors {
+		items = append(items, New3GPPAVPBuilder(AVP_SIPAuthDataItem, AVPFlag_Mandatory).SetGroupedData(
+			New3GPPAVPBuilder(AVP_SIPItemNumber, AVPFlag_Mandatory).SetIntData(uint32(i+1)).Build(),
+			New3GPPAVPBuilder(AVP_SIPAuthenticationScheme, AVPFlag_Mandatory).SetStringData(data.scheme).Build(),
+			New3GPPAVPBuilder(AVP_SIPAuthenticate, AVPFlag_Mandatory).SetData(append(append([]byte{}, v.RAND...), v.AUTN...)).Build(),
+			New3GPPAVPBuilder(AVP_SIPAuthorization, AVPFlag_Mandatory).SetData(v.XRES).Build(),
+			New3GPPAVPBuilder(AVP_ConfidentialityKey, AVPFlag_Mandatory).SetData(v.CK).Build(),
+			New3GPPAVPBuilder(AVP_IntegrityKey, AVPFlag_Mandatory).SetData(v.IK).Build(),
+		).Build())
+	}
+	builder.
+		AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(ResultCode_Success).Build()).
+		AddAVP(NewAVPBuilder(AVP_UserName, AVPFlag_Mandatory).SetStringData(impi).Build()).
+		AddAVP(New3GPPAVPBuilder(AVP_PublicIdentity, AVPFlag_Mandatory).SetStringData(impu).Build()).
+		AddAVP(New3GPPAVPBuilder(AVP_SIPNumberAuthItems, AVPFlag_Mandatory).SetIntData(uint32(len(items))).Build())
+	for _, item := range items {
+		builder.AddAVP(item)
+	}
+	return builder.Build(), nil
+}
+
+// 处理SAR，S-CSCF注册或注销用户，注册时返回用户签约XML，TS 29.228 6.1.2
+func handleSAR(session *Session, msg *DiameterMsg) (*DiameterMsg, error) {
+	impi, impu := cxRequestUser(msg)
+	builder := newCxAnswerBuilder(msg)
+	if session.State() != StateEstablished {
+		return cxReject(session, "SAR", impi, builder, newResultError(ResultCode_UnableToDeliver, "session not established, send CER first")), nil
+	}
+	if impi == "" && impu == "" {
+		return cxReject(session, "SAR", impi, builder, newResultError(ResultCode_MissingAVP, "need User-Name or Public-Identity")), nil
+	}
+	assignType := avpIntData(msg, AVP_ServerAssignmentType)
+	reg := CxRegistration{Host: session.PeerHost, Realm: session.PeerRealm, AssignedAt: time.Now()}
+	if serverAVP, _ := msg.FindAVPByCode(AVP_ServerName); serverAVP != nil {
+		reg.ServerName = serverAVP.GetStringData()
+	}
+	if hostAVP, _ := msg.FindAVPByCode(AVP_OriginHost); hostAVP != nil {
+		reg.Host = hostAVP.GetStringData()
+	}
+	if realmAVP, _ := msg.FindAVPByCode(AVP_OriginRealm); realmAVP != nil {
+		reg.Realm = realmAVP.GetStringData()
+	}
+	withData := false
+	switch assignType {
+	case ServerAssignmentNoAssignment:
+		withData = true
+	case ServerAssignmentRegistration, ServerAssignmentReRegistration, ServerAssignmentUnregisteredUser:
+		withData = vendorAVPIntData(msg, AVP_UserDataAlreadyAvailable, VendorID_3GPP) == userDataNotAvailable
+	}
+	log.Printf("主机%v SAR 私有标识: %v 公有标识: %v Server-Assignment-Type: %v S-CSCF: %v",
+		session.PeerHost, impi, impu, assignType, reg.ServerName)
+
+	impi, userData, err := imsHSS.assign(impi, impu, assignType, reg, withData)
+	if err != nil {
+		return cxReject(session, "SAR", impi, builder, err), nil
+	}
+	builder.
+		AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(ResultCode_Success).Build()).
+		AddAVP(NewAVPBuilder(AVP_UserName, AVPFlag_Mandatory).SetStringData(impi).Build())
+	if userData != nil {
+		builder.AddAVP(New3GPPAVPBuilder(AVP_UserData, AVPFlag_Mandatory).SetData(userData).Build())
+	}
+	return builder.Build(), nil
+}
+
+// 处理LIR，I-CSCF按公有标识查询为用户服务的S-CSCF，TS 29.228 6.1.4
+func handleLIR(session *Session, msg *DiameterMsg) (*DiameterMsg, error) {
+	_, impu := cxRequestUser(msg)
+	builder := newCxAnswerBuilder(msg)
+	if session.State() != StateEstablished {
+		return cxReject(session, "LIR", impu, builder, newResultError(ResultCode_UnableToDeliver, "session not established, send CER first")), nil
+	}
+	authType := vendorAVPIntData(msg, AVP_UserAuthorizationType, VendorID_3GPP)
+	log.Printf("主机%v LIR 公有标识: %v User-Authorization-Type: %v", session.PeerHost, impu, authType)
+	selection, err := imsHSS.locate(impu, authType)
+	if err != nil {
+		return cxReject(session, "LIR", impu, builder, err), nil
+	}
+	return buildServerSelection(builder, selection), nil
+}
+
+// HSS发给S-CSCF的请求，每次新生成Session-Id
+func newCxRequest(command uint32, impi string, node CxRegistration) *DiameterMsgBuilder {
+	return NewDiameterMsgBuilder().
+		SetCommandCode(command).
+		SetAppID(AppID_Cx).
+		SetFlags(FlagRequest | FlagProxiable).
+		SetHopByHopID(nextHopByHopID()).
+		SetEndToEndID(nextEndToEndID()).
+		AddAVP(NewAVPBuilder(AVP_SessionId, AVPFlag_Mandatory).SetStringData(generateSessionID(config.OriginHost)).Build()).
+		AddAVP(vendorApplicationAVP(AppID_Cx)).
+		AddAVP(NewAVPBuilder(AVP_AuthSessionState, AVPFlag_Mandatory).SetIntData(AuthSessionNoStateMaintained).Build()).
+		AddAVP(NewAVPBuilder(AVP_OriginHost, AVPFlag_Mandatory).SetStringData(config.OriginHost).Build()).
+		AddAVP(NewAVPBuilder(AVP_OriginRealm, AVPFlag_Mandatory).SetStringData(config.OriginRealm).Build()).
+		AddAVP(NewAVPBuilder(AVP_DestinationHost, AVPFlag_Mandatory).SetStringData(node.Host).Build()).
+		AddAVP(NewAVPBuilder(AVP_DestinationRealm, AVPFlag_Mandatory).SetStringData(node.Realm).Build()).
+		AddAVP(NewAVPBuilder(AVP_UserName, AVPFlag_Mandatory).SetStringData(impi).Build())
+}
+
+// 经RouteRequest向S-CSCF发出请求并等待应答(没有直连时按Destination-Realm路由)，返回Result-Code或Experimental-Result-Code
+func sendCxRequest(impi, name string, node CxRegistration, req *DiameterMsg) (uint32, error) {
+	log.Printf("主机%v 发出%v 用户: %v End-to-End: %v", node.Host, name, impi, req.GetEndToEndID())
+	rsp, err := RouteRequest(req)
+	if err != nil {
+		return 0, err
+	}
+	resultCode := answerResultCode(rsp)
+	log.Printf("主机%v %v应答 用户: %v Result-Code: %v", node.Host, name, impi, resultCode)
+	return resultCode, nil
+}
+
+// SendRegistrationTermination 向用户的S-CSCF发出RTR注销用户的所有公有标识，成功后清除注册，返回RTA的结果
+func SendRegistrationTermination(impi string, reasonCode uint32, reasonInfo string) (uint32, error) {
+	profile, node, _, err := imsHSS.serving(impi)
+	if err != nil {
+		return 0, err
+	}
+	reason := []*AVPMsg{New3GPPAVPBuilder(AVP_ReasonCode, AVPFlag_Mandatory).SetIntData(reasonCode).Build()}
+	if reasonInfo != "" {
+		reason = append(reason, New3GPPAVPBuilder(AVP_ReasonInfo, AVPFlag_Mandatory).SetStringData(reasonInfo).Build())
+	}
+	builder := newCxRequest(Cmd_RT, impi, node).
+		AddAVP(New3GPPAVPBuilder(AVP_DeregistrationReason, AVPFlag_Mandatory).SetGroupedData(reason...).Build())
+	for _, impu := range profile.PublicIdentities {
+		builder.AddAVP(New3GPPAVPBuilder(AVP_PublicIdentity, AVPFlag_Mandatory).SetStringData(impu).Build())
+	}
+	resultCode, err := sendCxRequest(impi, "RTR", node, builder.Build())
+	if err == nil && resultCode == ResultCode_Success {
+		imsHSS.deregister(impi, node.Host)
+	}
+	return resultCode, err
+}
+
+// SendPushProfile 重新读取用户签约XML，通过PPR下发给用户的S-CSCF，返回PPA的结果
+func SendPushProfile(impi string) (uint32, error) {
+	_, node, dataFile, err := imsHSS.serving(impi)
+	if err != nil {
+		return 0, err
+	}
+	userData, err := readIMSUserData(dataFile)
+	if err != nil {
+		return 0, err
+	}
+	req := newCxRequest(Cmd_PP, impi, node).
+		AddAVP(New3GPPAVPBuilder(AVP_UserData, AVPFlag_Mandatory).SetData(userData).Build()).
+		Build()
+	return sendCxRequest(impi, "PPR", node, req)
+}
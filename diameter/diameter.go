@@ -1,6 +1,7 @@
 package diameter
 
 import (
+	"crypto/hmac"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
@@ -10,10 +11,12 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-func init() {
+// 从工作目录加载配置和字典，启动服务前调用
+func loadFiles() {
 	err := LoadConfig("config.json")
 	if err != nil {
 		log.Fatalf("Load config failed: %v", err)
@@ -39,13 +42,89 @@ func LoadConfig(path string) error {
 		return err
 	}
 
-	return json.Unmarshal(bytes, &config)
+	if err := json.Unmarshal(bytes, &config); err != nil {
+		return err
+	}
+	for i := range config.Peers {
+		if err := config.Peers[i].init(); err != nil {
+			return err
+		}
+	}
+	for i := range config.Routes {
+		config.Routes[i].init()
+	}
+	if err := config.DRMP.validate(); err != nil {
+		return err
+	}
+	credits.load(config.CreditControl.Subscribers)
+	if err := hss.load(config.S6a.Subscribers); err != nil {
+		return err
+	}
+	if err := imsHSS.load(config.Cx.subscriberDir()); err != nil {
+		return err
+	}
+	return nil
 }
 
 type Session struct {
-	ID        string
-	NeedClose bool
-	State     string
+	ID         string
+	RemoteAddr net.Addr
+	PeerHost   string      // CER中对端的Origin-Host
+	PeerRealm  string      // CER中对端的Origin-Realm
+	Peer       *PeerConfig // 对端表中匹配到的配置，对端表为空时为nil
+	Initiator  bool        // 是否本端主动发起的连接，选举时使用
+	OpenedAt   time.Time   // 能力交换完成的时间
+	AuthAppIDs []uint32    // 能力交换协商出的认证应用
+	AcctAppIDs []uint32    // 能力交换协商出的计费应用
+
+	// 读循环处理CER/DPR时修改，处理协程处理业务请求时读取，用stateMu保护
+	stateMu   sync.Mutex
+	state     string
+	needClose bool
+
+	conn      net.Conn
+	writeMu   sync.Mutex
+	pendingMu sync.Mutex
+	pending   map[uint32]*pendingRequest // 本端发出的请求，按Hop-by-Hop ID索引
+	done      chan struct{}              // 读循环退出时关闭
+}
+
+// State 会话当前状态
+func (s *Session) State() string {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	return s.state
+}
+
+func (s *Session) setState(state string) {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	s.state = state
+}
+
+// 处理完当前请求后断开连接
+func (s *Session) setClosing() {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	s.needClose = true
+	s.state = StateClosing
+}
+
+// NeedClose 是否需要断开连接
+func (s *Session) NeedClose() bool {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	return s.needClose
+}
+
+// 关闭底层连接，读循环随之退出
+func (s *Session) Close() {
+	s.stateMu.Lock()
+	s.needClose = true
+	s.stateMu.Unlock()
+	if s.conn != nil {
+		s.conn.Close()
+	}
 }
 
 const (
@@ -58,23 +137,50 @@ const (
 )
 
 type DiameterConfig struct {
-	OriginHost         string            `json:"origin_host"`
-	OriginRealm        string            `json:"origin_realm"`
-	HostIPAddress      string            `json:"host_ip_address"`
-	ProductName        string            `json:"product_name"`
-	CommandAppMap      map[string]uint32 `json:"command_app_map"`
-	UserID2passWD      map[string]string `json:"userid_2_password"`
-	UserID2OauthToken  map[string]string `json:"userid_2_oauthtoken"`
-	VendorID           uint32            `json:"vendor_id"`
-	AuthApplicationIds []uint32          `json:"auth_application_ids"`
-	AcctApplicationIds []uint32          `json:"acct_application_ids"`
+	OriginHost         string                 `json:"origin_host"`
+	OriginRealm        string                 `json:"origin_realm"`
+	HostIPAddress      string                 `json:"host_ip_address"`
+	ProductName        string                 `json:"product_name"`
+	CommandAppMap      map[string]AppIDList   `json:"command_app_map"` // 命令码所属的应用，决定请求交给哪个处理函数
+	UserID2passWD      map[string]string      `json:"userid_2_password"`
+	UserID2OauthToken  map[string]string      `json:"userid_2_oauthtoken"`
+	UserProfiles       map[string]UserProfile `json:"user_profiles"` // 用户的授权信息，NASREQ认证通过后返回
+	VendorID           uint32                 `json:"vendor_id"`
+	AuthApplicationIds []uint32               `json:"auth_application_ids"`
+	AcctApplicationIds []uint32               `json:"acct_application_ids"`
+	Peers              []PeerConfig           `json:"peers"` // 对端表，为空时接受任意对端
+	// 同一对端重复连接时的处理策略：reject(5012)、election_lost(4003)、replace，默认reject
+	DuplicatePeerPolicy string `json:"duplicate_peer_policy"`
+	AdminAddr           string `json:"admin_addr"` // 管理接口监听地址，如127.0.0.1:8868，为空不开启
+	// 重复请求检测：应答缓存的时间窗口(秒)和最大条数
+	DuplicateWindow    int                 `json:"duplicate_window"`
+	DuplicateCacheSize int                 `json:"duplicate_cache_size"`
+	Limits             LimitsConfig        `json:"limits"`
+	Routes             []RouteConfig       `json:"routes"` // 路由表，没有匹配项的请求本地处理
+	DRMP               DRMPConfig          `json:"drmp"`   // 按DRMP优先级排队处理请求
+	DOIC               DOICConfig          `json:"doic"`   // 过载控制
+	Accounting         AccountingConfig    `json:"accounting"`
+	CreditControl      CreditControlConfig `json:"credit_control"`
+	EAP                EAPConfig           `json:"eap"`
+	TestAuth           TestAuthConfig      `json:"test_auth"` // TESTR二阶段挑战认证
+	Sessions           SessionConfig       `json:"sessions"`  // 用户会话表
+	S6a                S6aConfig           `json:"s6a"`       // S6a/S6d HSS
+	Gx                 GxConfig            `json:"gx"`        // Gx PCRF
+	Rx                 RxConfig            `json:"rx"`        // Rx PCRF侧和AF场景
+	Cx                 CxConfig            `json:"cx"`        // Cx/Dx IMS HSS
+	// 经中继转来的请求最后一个Route-Record与直连对端不一致时回复5012，默认只记日志。
+	// RFC 6733 6.7.1中继追加的是它收到请求的对端标识(freeDiameter即如此)，开启后经这类中继转来的请求都会被拒绝
+	StrictRouteRecord bool `json:"strict_route_record"`
 }
 
 func (c *DiameterConfig) GetAppID(cmdID uint32) uint32 {
 	key := strconv.FormatUint(uint64(cmdID), 10) // uint32转string
-	appID := c.CommandAppMap[key]
-	// 默认返回0
-	return appID
+	appIDs := c.CommandAppMap[key]
+	// 默认返回0，属于多个应用时返回第一个
+	if len(appIDs) == 0 {
+		return 0
+	}
+	return appIDs[0]
 }
 
 type DiameterMsgBuilder struct {
@@ -82,8 +188,11 @@ type DiameterMsgBuilder struct {
 }
 
 const (
-	FlagRequest  = 0x80
-	FlagResponse = 0x00
+	FlagRequest       = 0x80
+	FlagProxiable     = 0x40
+	FlagResponse      = 0x00
+	FlagError         = 0x20 // 协议错误（3xxx）时设置
+	FlagRetransmitted = 0x10 // T标志，故障切换后的重传
 )
 
 type DiameterHandler func(session *Session, msg *DiameterMsg) (*DiameterMsg, error)
@@ -92,13 +201,31 @@ const (
 	Cmd_CE   uint32 = 257    // Capabilities Exchange (CER/CEA)
 	Cmd_DW   uint32 = 280    // Device Watchdog (DWR/DWA)
 	Cmd_DP   uint32 = 282    // Disconnect Peer (DPR/DPA)
-	Cmd_AC   uint32 = 265    // Accounting (ACR/ACA)
+	Cmd_AC   uint32 = 271    // Accounting (ACR/ACA)
 	Cmd_RA   uint32 = 258    // Re-Auth (RAR/RAA)
 	Cmd_AS   uint32 = 274    // Abort Session (ASR/ASA)
 	Cmd_CC   uint32 = 272    // Credit Control (CCR/CCA)
+	Cmd_AA   uint32 = 265    // AA-Request (AAR/AAA)，NASREQ
+	Cmd_DE   uint32 = 268    // Diameter-EAP (DER/DEA)
+	Cmd_ST   uint32 = 275    // Session-Termination (STR/STA)
+	Cmd_UL   uint32 = 316    // Update-Location (ULR/ULA)，S6a
+	Cmd_CL   uint32 = 317    // Cancel-Location (CLR/CLA)，S6a，HSS发起
+	Cmd_AI   uint32 = 318    // Authentication-Information (AIR/AIA)，S6a
+	Cmd_ID   uint32 = 319    // Insert-Subscriber-Data (IDR/IDA)，S6a，HSS发起
+	Cmd_DS   uint32 = 320    // Delete-Subscriber-Data (DSR/DSA)，S6a，HSS发起
+	Cmd_PU   uint32 = 321    // Purge-UE (PUR/PUA)，S6a
+	Cmd_UA   uint32 = 300    // User-Authorization (UAR/UAA)，Cx
+	Cmd_SA   uint32 = 301    // Server-Assignment (SAR/SAA)，Cx
+	Cmd_LI   uint32 = 302    // Location-Info (LIR/LIA)，Cx
+	Cmd_MA   uint32 = 303    // Multimedia-Auth (MAR/MAA)，Cx
+	Cmd_RT   uint32 = 304    // Registration-Termination (RTR/RTA)，Cx，HSS发起
+	Cmd_PP   uint32 = 305    // Push-Profile (PPR/PPA)，Cx，HSS发起
 	Cmd_TEST uint32 = 234567 // Credit Control (CCR/CCA)
 )
 const (
+	// 信息类
+	ResultCode_MultiRoundAuth = 1001 // 多轮认证未结束，请求方需带State继续
+
 	// 成功类
 	ResultCode_Success = 2001 // 请求成功完成
 
@@ -106,27 +233,55 @@ const (
 	ResultCode_MissingAVP             = 5005 // 缺少必须的 AVP
 	ResultCode_AVPUnsupported         = 5001 // 不支持的 AVP
 	ResultCode_UnknownSessionID       = 5002 // 会话 ID 未知
+	ResultCode_InvalidAVPValue        = 5004 // AVP 取值非法
 	ResultCode_AuthenticationRejected = 4001 // 拒绝认证（常用于 AAA）
+	ResultCode_AuthorizationRejected  = 5003 // 用户无权使用请求的服务
+	ResultCode_ElectionLost           = 4003 // 连接选举失败
+	ResultCode_CreditLimitReached     = 4012 // 余额不足，RFC 4006
+	ResultCode_UserUnknown            = 5030 // 用户未知，RFC 4006
 	ResultCode_NoCommonApplication    = 5010 // 没有公共的认证、计费应用
 
 	// 应用错误类（Transient Failures 4xxx）
-	ResultCode_UnableToComply = 5012 // 无法满足请求
+	ResultCode_UnableToComply       = 5012 // 无法满足请求
+	ResultCode_InvalidMessageLength = 5015 // 消息长度非法，超出限制
 
 	// 路由错误类
-	ResultCode_UnableToDeliver            = 3002 // 无法路由此消息
-	ResultCode_RealmNotServed             = 3003 // 域不受支持
-	ResultCode_DestinationHostUnsupported = 3004
+	ResultCode_UnableToDeliver = 3002 // 无法路由此消息
+	ResultCode_RealmNotServed  = 3003 // 域不受支持
+	ResultCode_TooBusy         = 3004 // DIAMETER_TOO_BUSY，本端忙，请求方应换其他对端
+	ResultCode_UnknownPeer     = 3010 // 对端不在对端表中
 
 	// 命令类错误
 	ResultCode_CommandUnsupported     = 3001 // 不支持的命令码
+	ResultCode_LoopDetected           = 3005 // 检测到路由环路
+	ResultCode_RedirectIndication     = 3006 // 重定向，请求方需直接联系Redirect-Host
 	ResultCode_ApplicationUnsupported = 3007 // 不支持的应用
 )
 
-var diameterHandlers = map[uint32]DiameterHandler{
-	Cmd_CE:   handleCER,  // Capability Exchange Request
-	Cmd_DW:   handleDWR,  // Device-Watchdog-Request
-	Cmd_DP:   handleDPR,  // Disconnect-Peer-Request
-	Cmd_TEST: handleTest, // 测试认证
+var diameterHandlers = map[commandKey]DiameterHandler{
+	{AppID_Common, Cmd_CE}:         handleCER,  // Capability Exchange Request
+	{AppID_Common, Cmd_DW}:         handleDWR,  // Device-Watchdog-Request
+	{AppID_Common, Cmd_DP}:         handleDPR,  // Disconnect-Peer-Request
+	{AppID_Test, Cmd_TEST}:         handleTest, // 测试认证
+	{AppID_BaseAccounting, Cmd_AC}: handleACR,  // Accounting-Request
+	{AppID_CreditControl, Cmd_CC}:  handleCCR,  // Credit-Control-Request
+	{AppID_NASREQ, Cmd_AA}:         handleAAR,  // AA-Request
+	{AppID_EAP, Cmd_DE}:            handleDER,  // Diameter-EAP-Request
+	{AppID_NASREQ, Cmd_ST}:         handleSTR,  // Session-Termination-Request
+	{AppID_EAP, Cmd_ST}:            handleSTR,
+	{AppID_Test, Cmd_ST}:           handleSTR,
+	{AppID_S6a, Cmd_AI}:            handleAIR,   // Authentication-Information-Request
+	{AppID_S6a, Cmd_UL}:            handleULR,   // Update-Location-Request
+	{AppID_S6a, Cmd_PU}:            handlePUR,   // Purge-UE-Request
+	{AppID_Gx, Cmd_CC}:             handleGxCCR, // Gx Credit-Control-Request
+	{AppID_Rx, Cmd_AA}:             handleRxAAR, // Rx AA-Request，本端作为PCRF
+	{AppID_Rx, Cmd_ST}:             handleRxSTR,
+	{AppID_Rx, Cmd_RA}:             handleRxRAR, // Rx Re-Auth-Request，本端作为AF
+	{AppID_Rx, Cmd_AS}:             handleRxASR,
+	{AppID_Cx, Cmd_UA}:             handleUAR, // User-Authorization-Request
+	{AppID_Cx, Cmd_SA}:             handleSAR, // Server-Assignment-Request
+	{AppID_Cx, Cmd_LI}:             handleLIR, // Location-Info-Request
+	{AppID_Cx, Cmd_MA}:             handleMAR, // Multimedia-Auth-Request
 }
 
 func handleDiameter(session *Session, msg *DiameterMsg) (*DiameterMsg, error) {
@@ -145,6 +300,40 @@ func handleDiameter(session *Session, msg *DiameterMsg) (*DiameterMsg, error) {
 		AddAVP(NewAVPBuilder(AVP_OriginRealm, AVPFlag_Mandatory).SetStringData(config.OriginRealm).Build()).
 		AddAVP(NewAVPBuilder(AVP_HostIPAddress, AVPFlag_Mandatory).SetIpData(net.ParseIP(config.HostIPAddress)).Build())
 
+	// 直连对端发来的Origin-State-Id变化说明对端重启过，会话关联到对端，重启时一并清理
+	if session.State() == StateEstablished {
+		if hostAVP, _ := msg.FindAVPByCode(AVP_OriginHost); hostAVP != nil && hostAVP.GetStringData() == session.PeerHost {
+			if stateAVP, _ := msg.FindAVPByCode(AVP_OriginStateId); stateAVP != nil && stateAVP.GetDataLength() >= 4 {
+				peerTable.checkStateID(session.PeerHost, stateAVP.GetIntData())
+			}
+		}
+		if idAVP, _ := msg.FindAVPByCode(AVP_SessionId); idAVP != nil {
+			if msg.GetCommandCode() == Cmd_ST {
+				peerTable.unbindSession(session.PeerHost, idAVP.GetStringData())
+			} else {
+				peerTable.bindSession(session.PeerHost, idAVP.GetStringData())
+			}
+		}
+	}
+
+	// 不在本地处理的请求按路由表转发或重定向，应答异步返回
+	if session.State() == StateEstablished {
+		if appID := msg.GetApplicationID(); !session.supportsApp(appID) {
+			log.Printf("主机%v 请求的应用%v未在能力交换中协商，Command: %v", session.PeerHost, appID, msg.GetCommandCode())
+			return newErrorAnswer(msg, ResultCode_ApplicationUnsupported, fmt.Sprintf("application %d not negotiated in CER", appID)), nil
+		}
+		if resultCode, err := checkRouteRecord(session, msg); err != nil {
+			log.Printf("主机%v Route-Record检查不通过: %v", session.PeerHost, err)
+			return newErrorAnswer(msg, resultCode, err.Error()), nil
+		}
+		if rsp, handled := routeRequest(session, msg); handled {
+			return rsp, nil
+		}
+		if rsp, handled := checkLocalDelivery(session, msg); handled {
+			return rsp, nil
+		}
+	}
+
 	if err := msg.ValidateAVP(); err != nil {
 		log.Printf("handleDiameter error for AVP missing: %v", err)
 		rspBuilder.
@@ -153,15 +342,16 @@ func handleDiameter(session *Session, msg *DiameterMsg) (*DiameterMsg, error) {
 		return rspBuilder.Build(), nil
 	}
 
-	cmdCode := msg.GetCommandCode()
-	handler, exists := diameterHandlers[cmdCode]
-	if !exists {
-		log.Printf("unknown or unhandled command code: %d", cmdCode)
-		err := fmt.Errorf("unknown or unhandled command %d: %d", ResultCode_CommandUnsupported, cmdCode)
-		rspBuilder.
-			AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(ResultCode_MissingAVP).Build()).
-			AddAVP(NewAVPBuilder(AVP_ErrorMessage, AVPFlag_Mandatory).SetStringData(err.Error()).Build())
-		return rspBuilder.Build(), err
+	// 按(Application-Id, 命令码)查找处理函数，应用与command_app_map不一致的回复3007
+	handler, resultCode, err := lookupHandler(msg)
+	if err != nil {
+		log.Printf("handleDiameter error for command: %v", err)
+		return newErrorAnswer(msg, resultCode, err.Error()), nil
+	}
+	// 授权过期或超过Session-Timeout的会话只能重新认证
+	if !sessionAuthCommands[msg.GetCommandCode()] && userSessions.expired(msg.GetSessionID()) {
+		log.Printf("主机%v 会话%v已过期，拒绝请求 Command: %v", session.PeerHost, msg.GetSessionID(), msg.GetCommandCode())
+		return newErrorAnswer(msg, ResultCode_UnknownSessionID, "session expired"), nil
 	}
 	return handler(session, msg)
 }
@@ -174,6 +364,23 @@ func handleCER(session *Session, msg *DiameterMsg) (*DiameterMsg, error) {
 	realmAVP, _ := msg.FindAVPByCode(AVP_OriginRealm)
 	log.Printf("%v域的主机%v 发起能力交换请求", realmAVP.GetStringData(), hostAVP.GetStringData())
 
+	peer, err := config.matchPeer(hostAVP.GetStringData(), realmAVP.GetStringData(), session.RemoteAddr)
+	if err != nil {
+		log.Printf("%v域的主机%v 不是已知对端，拒绝接入: %v", realmAVP.GetStringData(), hostAVP.GetStringData(), err)
+		session.setClosing()
+		return NewDiameterMsgBuilder().
+			SetCommandCode(msg.GetCommandCode()).
+			SetAppID(msg.GetApplicationID()).
+			SetHopByHopID(msg.GetHopByHopID()).
+			SetEndToEndID(msg.GetEndToEndID()).
+			SetFlags(FlagResponse | FlagError).
+			AddAVP(NewAVPBuilder(AVP_OriginHost, AVPFlag_Mandatory).SetStringData(config.OriginHost).Build()).
+			AddAVP(NewAVPBuilder(AVP_OriginRealm, AVPFlag_Mandatory).SetStringData(config.OriginRealm).Build()).
+			AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(ResultCode_UnknownPeer).Build()).
+			AddAVP(NewAVPBuilder(AVP_ErrorMessage, AVPFlag_Mandatory).SetStringData(err.Error()).Build()).
+			Build(), nil
+	}
+
 	ipAVP, _ := msg.FindAVPByCode(AVP_HostIPAddress)
 	log.Printf("%v域的主机%v ip地址为：%v", realmAVP.GetStringData(), hostAVP.GetStringData(), ipAVP.GetIPAddrData())
 	vendorAVP, _ := msg.FindAVPByCode(AVP_VendorId)
@@ -199,6 +406,8 @@ func handleCER(session *Session, msg *DiameterMsg) (*DiameterMsg, error) {
 	for _, appIDavp := range clientAuthAppAVPs {
 		clientAuthAppIDs = append(clientAuthAppIDs, appIDavp.GetIntData())
 	}
+	vendorAuthAppIDs, vendorAcctAppIDs := vendorSpecificAppIDs(msg)
+	clientAuthAppIDs = append(clientAuthAppIDs, vendorAuthAppIDs...)
 	log.Printf("%v域的主机%v 支持的认证应用为：%v",
 		realmAVP.GetStringData(),
 		hostAVP.GetStringData(),
@@ -208,14 +417,17 @@ func handleCER(session *Session, msg *DiameterMsg) (*DiameterMsg, error) {
 	for _, appIDavp := range clientAcctAppAVPs {
 		clientAcctAppIDs = append(clientAcctAppIDs, appIDavp.GetIntData())
 	}
+	clientAcctAppIDs = append(clientAcctAppIDs, vendorAcctAppIDs...)
 	log.Printf("%v域的主机%v 支持的计费应用为：%v",
 		realmAVP.GetStringData(),
 		hostAVP.GetStringData(),
 		id2name(clientAcctAppIDs, dict.AcctAppMeta))
 
-	shareAuthAppIDs := intersect(clientAuthAppIDs, config.AuthApplicationIds)
+	localAuthAppIDs := peer.authAppIDs()
+	localAcctAppIDs := peer.acctAppIDs()
+	shareAuthAppIDs := intersect(clientAuthAppIDs, localAuthAppIDs)
 	shareAuthAppNames := id2name(shareAuthAppIDs, dict.AuthAppMeta)
-	shareAcctAppIDs := intersect(clientAcctAppIDs, config.AcctApplicationIds)
+	shareAcctAppIDs := intersect(clientAcctAppIDs, localAcctAppIDs)
 	shareAcctAppNames := id2name(shareAcctAppIDs, dict.AcctAppMeta)
 
 	if len(shareAuthAppIDs) > 0 {
@@ -237,17 +449,31 @@ func handleCER(session *Session, msg *DiameterMsg) (*DiameterMsg, error) {
 		AddAVP(NewAVPBuilder(AVP_HostIPAddress, AVPFlag_Mandatory).SetIpData(net.ParseIP(config.HostIPAddress)).Build()).
 		AddAVP(NewAVPBuilder(AVP_VendorId, AVPFlag_Mandatory).SetIntData(config.VendorID).Build()).
 		AddAVP(NewAVPBuilder(AVP_ProductName, AVPFlag_Mandatory).SetStringData(config.ProductName).Build())
-	for _, appID := range config.AuthApplicationIds {
-		builder.
-			AddAVP(NewAVPBuilder(AVP_AuthApplicationId, AVPFlag_Mandatory).SetIntData(appID).Build())
-	}
-	for _, appID := range config.AcctApplicationIds {
-		builder.
-			AddAVP(NewAVPBuilder(AVP_AcctApplicationId, AVPFlag_Mandatory).SetIntData(appID).Build())
-	}
+	addApplicationIDs(builder, localAuthAppIDs, localAcctAppIDs)
 
 	if len(shareAuthAppIDs) > 0 || len(shareAcctAppIDs) > 0 {
-		session.State = StateEstablished
+		if resultCode := peerTable.register(session, hostAVP.GetStringData()); resultCode != 0 {
+			session.setClosing()
+			builder.
+				AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(resultCode).Build())
+			log.Printf("%v域的主机%v 结束能力交换请求,对端已有连接，拒绝本次连接", realmAVP.GetStringData(), hostAVP.GetStringData())
+			return builder.Build(), nil
+		}
+		if originStateAVP != nil {
+			peerTable.checkStateID(hostAVP.GetStringData(), originStateAVP.GetIntData())
+		}
+		// 对端表中配置了tw的对端，本端也对其发送DWR，保活失败时切换到其他对端
+		if peer != nil && peer.Tw > 0 {
+			go runWatchdog(session, peer.tw())
+		}
+		session.OpenedAt = time.Now()
+		session.PeerHost = hostAVP.GetStringData()
+		session.PeerRealm = realmAVP.GetStringData()
+		session.Peer = peer
+		session.AuthAppIDs = shareAuthAppIDs
+		session.AcctAppIDs = shareAcctAppIDs
+		// 最后设置状态，处理协程看到Established时对端信息已经填好
+		session.setState(StateEstablished)
 		builder.
 			AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(ResultCode_Success).Build())
 		log.Printf("%v域的主机%v 结束能力交换请求,与本端有共同支持的应用，接受对端，会话已建立", realmAVP.GetStringData(), hostAVP.GetStringData())
@@ -280,7 +506,7 @@ func handleDWR(session *Session, msg *DiameterMsg) (*DiameterMsg, error) {
 		AddAVP(NewAVPBuilder(AVP_ProductName, AVPFlag_Mandatory).SetStringData(config.ProductName).Build()).
 		AddAVP(NewAVPBuilder(AVP_AuthApplicationId, AVPFlag_Mandatory).SetIntData(msg.GetApplicationID()).Build())
 
-	if session.State != StateEstablished {
+	if session.State() != StateEstablished {
 		log.Printf("%v域的主机%v 当前未建立会话，保活失败", realmAVP.GetStringData(), hostAVP.GetStringData())
 		rspBuilder.AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(ResultCode_UnableToDeliver).Build())
 		rspBuilder.AddAVP(NewAVPBuilder(AVP_ErrorMessage, AVPFlag_Mandatory).SetStringData("session not established, send CER first").Build())
@@ -312,8 +538,7 @@ func handleDPR(session *Session, msg *DiameterMsg) (*DiameterMsg, error) {
 		AddAVP(NewAVPBuilder(AVP_ProductName, AVPFlag_Mandatory).SetStringData(config.ProductName).Build()).
 		AddAVP(NewAVPBuilder(AVP_AuthApplicationId, AVPFlag_Mandatory).SetIntData(msg.GetApplicationID()).Build()).
 		Build()
-	session.NeedClose = true
-	session.State = StateClosing
+	session.setClosing()
 	log.Printf("%v域的主机%v 会话已关闭", realmAVP.GetStringData(), hostAVP.GetStringData())
 	return rsp, nil
 }
@@ -337,7 +562,7 @@ func handleTest(session *Session, msg *DiameterMsg) (*DiameterMsg, error) {
 		AddAVP(NewAVPBuilder(AVP_OriginRealm, AVPFlag_Mandatory).SetStringData(config.OriginRealm).Build()).
 		AddAVP(NewAVPBuilder(AVP_HostIPAddress, AVPFlag_Mandatory).SetIpData(net.ParseIP(config.HostIPAddress)).Build())
 
-	if session.State != StateEstablished {
+	if session.State() != StateEstablished {
 		rspBuilder.AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(ResultCode_UnableToDeliver).Build())
 		rspBuilder.AddAVP(NewAVPBuilder(AVP_ErrorMessage, AVPFlag_Mandatory).SetStringData("session not established, send CER first").Build())
 		return rspBuilder.Build(), nil
@@ -353,15 +578,57 @@ func handleTest(session *Session, msg *DiameterMsg) (*DiameterMsg, error) {
 		return rspBuilder.Build(), nil
 	}
 	userID := avpUserID.GetIntData()
-	reqPasswd := avpPassWD.GetStringData()
-
+	sessionID := msg.GetSessionID()
+	passwd, userExist := config.UserID2passWD[strconv.Itoa(int(userID))]
 	log.Printf("%v域的主机%v 申请认证用户名:%v", realmAVP.GetStringData(), hostAVP.GetStringData(), userID)
-	log.Printf("%v域的主机%v 申请认证密码:%v", realmAVP.GetStringData(), hostAVP.GetStringData(), reqPasswd)
-	rspBuilder.AddAVP(avpUserID).AddAVP(avpPassWD)
 
-	if passwd, ok := config.UserID2passWD[strconv.Itoa(int(userID))]; ok && reqPasswd == passwd {
+	stateAVP, _ := msg.FindAVPByCode(AVP_State)
+	var authErr error
+	authMethod := "password"
+	switch {
+	case stateAVP != nil:
+		// 第二轮：带回第一轮的State，Test-Payload-AVP是HMAC-SHA256(密码, Session-Id + 挑战)
+		rspBuilder.AddAVP(avpUserID)
+		authMethod = "challenge"
+		challenge, err := testChallenges.take(sessionID, session.PeerHost, userID, stateAVP.GetRawData())
+		if err != nil {
+			authErr = err
+		} else if !userExist || avpPassWD == nil || !hmac.Equal(avpPassWD.GetRawData(), testChallengeResponse(passwd, sessionID, challenge)) {
+			authErr = fmt.Errorf("challenge response mismatch")
+		}
+	case avpPassWD == nil || avpPassWD.GetDataLength() == 0 || config.TestAuth.RequireChallenge:
+		// 第一轮：不带密码(或要求挑战认证)时下发挑战，用户不存在时也下发，不暴露用户是否存在
+		challenge := testChallenges.issue(sessionID, session.PeerHost, userID)
+		log.Printf("%v域的主机%v 下发挑战，有效期%v", realmAVP.GetStringData(), hostAVP.GetStringData(), config.TestAuth.challengeTimeout())
+		return rspBuilder.
+			AddAVP(avpUserID).
+			AddAVP(NewAVPBuilder(AVP_State, AVPFlag_Mandatory).SetData(challenge).Build()).
+			AddAVP(NewAVPBuilder(AVP_MultiRoundTimeOut, AVPFlag_Mandatory).SetIntData(uint32(config.TestAuth.challengeTimeout() / time.Second)).Build()).
+			AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(ResultCode_MultiRoundAuth).Build()).
+			Build(), nil
+	default:
+		// 兼容一轮明文密码认证
+		reqPasswd := avpPassWD.GetStringData()
+		log.Printf("%v域的主机%v 申请认证密码:%v", realmAVP.GetStringData(), hostAVP.GetStringData(), reqPasswd)
+		rspBuilder.AddAVP(avpUserID).AddAVP(avpPassWD)
+		if !userExist || reqPasswd != passwd {
+			authErr = fmt.Errorf("password mismatch")
+		}
+	}
+
+	if authErr == nil {
 		//验证通过，返回令牌
 		authToken := config.UserID2OauthToken[strconv.Itoa(int(userID))]
+		limits := sessionLimits(msg.GetApplicationID(), strconv.Itoa(int(userID)))
+		userSessions.open(UserSession{
+			SessionID:  sessionID,
+			UserName:   strconv.Itoa(int(userID)),
+			PeerHost:   session.PeerHost,
+			AppID:      msg.GetApplicationID(),
+			AuthMethod: authMethod,
+			Token:      authToken,
+		}, limits)
+		addSessionLimitAVPs(rspBuilder, limits)
 		rspBuilder.
 			AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(ResultCode_Success).Build()).
 			AddAVP(NewAVPBuilder(AVP_EAPPayload, AVPFlag_Mandatory).SetStringData(authToken).Build())
@@ -371,11 +638,39 @@ func handleTest(session *Session, msg *DiameterMsg) (*DiameterMsg, error) {
 		rspBuilder.
 			AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(ResultCode_AuthenticationRejected).Build()).
 			AddAVP(NewAVPBuilder(AVP_ErrorMessage, AVPFlag_Mandatory).SetStringData("userID or passWD wrong").Build())
-		log.Printf("%v域的主机%v 认证不通过，用户名或密码错误", realmAVP.GetStringData(), hostAVP.GetStringData())
+		log.Printf("%v域的主机%v 认证不通过: %v", realmAVP.GetStringData(), hostAVP.GetStringData(), authErr)
 		return rspBuilder.Build(), nil
 	}
 }
 
+// 按请求构造应答的公共部分：Session-Id、命令码、应用、Hop-by-Hop、End-to-End、本端标识
+func newAnswerBuilder(req *DiameterMsg) *DiameterMsgBuilder {
+	builder := NewDiameterMsgBuilder()
+	if sessionAVP, _ := req.FindAVPByCode(AVP_SessionId); sessionAVP != nil {
+		builder.AddAVP(sessionAVP)
+	}
+	return builder.
+		SetCommandCode(req.GetCommandCode()).
+		SetAppID(req.GetApplicationID()).
+		SetFlags(FlagResponse).
+		SetHopByHopID(req.GetHopByHopID()).
+		SetEndToEndID(req.GetEndToEndID()).
+		AddAVP(NewAVPBuilder(AVP_OriginHost, AVPFlag_Mandatory).SetStringData(config.OriginHost).Build()).
+		AddAVP(NewAVPBuilder(AVP_OriginRealm, AVPFlag_Mandatory).SetStringData(config.OriginRealm).Build())
+}
+
+// 错误应答，3xxx协议错误设置E标志
+func newErrorAnswer(req *DiameterMsg, resultCode uint32, errMsg string) *DiameterMsg {
+	builder := newAnswerBuilder(req)
+	if resultCode >= 3000 && resultCode < 4000 {
+		builder.SetFlags(FlagResponse | FlagError)
+	}
+	return builder.
+		AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(resultCode).Build()).
+		AddAVP(NewAVPBuilder(AVP_ErrorMessage, 0).SetStringData(errMsg).Build()).
+		Build()
+}
+
 func NewDiameterMsgBuilder() *DiameterMsgBuilder {
 	return &DiameterMsgBuilder{
 		msg: &DiameterMsg{
@@ -403,7 +698,7 @@ func (b *DiameterMsgBuilder) AddAVP(avp *AVPMsg) *DiameterMsgBuilder {
 }
 
 func (b *DiameterMsgBuilder) SetHopByHopID(id uint32) *DiameterMsgBuilder {
-	binary.BigEndian.PutUint32(b.msg.head[12:16], id)
+	b.msg.setHopByHopID(id)
 	return b
 }
 
@@ -468,6 +763,26 @@ func (m *DiameterMsg) FindAVPByCode(code uint32) (*AVPMsg, int) {
 	return nil, -1
 }
 
+// FindVendorAVP 按Code和Vendor-Id查找AVP，vendorID为0时只匹配不带V位的AVP。
+// 3GPP AVP与IETF AVP的Code可能相同(如Cx的User-Authorization-Type与DOIC的OC-OLR都是623)，需要按厂商区分
+func (m *DiameterMsg) FindVendorAVP(code, vendorID uint32) *AVPMsg {
+	for _, avp := range m.body {
+		if avp.GetCode() == code && avp.GetVendorID() == vendorID {
+			return avp
+		}
+	}
+	return nil
+}
+
+// 取厂商AVP的整数值，Code与IETF AVP相同时用它区分，没有时返回0
+func vendorAVPIntData(msg *DiameterMsg, code, vendorID uint32) uint32 {
+	avp := msg.FindVendorAVP(code, vendorID)
+	if avp == nil || avp.GetDataLength() < 4 {
+		return 0
+	}
+	return avp.GetIntData()
+}
+
 func (m *DiameterMsg) FindAVPsByCode(code uint32) []*AVPMsg {
 	var result []*AVPMsg
 	for _, avp := range m.body {
@@ -483,14 +798,12 @@ func (d *DiameterMsg) Validate() error {
 	if d.GetVersion() != 1 {
 		return fmt.Errorf("invalid Diameter version: %d", d.GetVersion())
 	}
+	// 超出上限的消息在读取时单独处理，回复5015
 	length := d.GetMessageLength()
-	if length < 20 || length > 10000 {
-		return fmt.Errorf("invalid message length: %d, must be >= 20 <=10000", length)
-	}
-	// R-bit 检查：必须是请求
-	if d.head[4]&FlagRequest == 0 {
-		return fmt.Errorf("not a request message (R-bit not set)")
+	if length < 20 {
+		return fmt.Errorf("invalid message length: %d, must be >= 20", length)
 	}
+	// 不再要求R-bit，本端主动发出请求后会收到应答
 	return nil
 }
 
@@ -563,6 +876,48 @@ func (m *DiameterMsg) GetEndToEndID() uint32 {
 	return binary.BigEndian.Uint32(m.head[16:20])
 }
 
+// Session-Id AVP的值，没有时返回空
+func (m *DiameterMsg) GetSessionID() string {
+	if avp, _ := m.FindAVPByCode(AVP_SessionId); avp != nil {
+		return avp.GetStringData()
+	}
+	return ""
+}
+
+// 取Result-Code，没有时返回0
+func getResultCode(msg *DiameterMsg) uint32 {
+	avp, _ := msg.FindAVPByCode(AVP_ResultCode)
+	if avp == nil || avp.GetDataLength() < 4 {
+		return 0
+	}
+	return avp.GetIntData()
+}
+
+// 在消息末尾追加AVP并更新消息长度
+func (m *DiameterMsg) appendAVP(avp *AVPMsg) {
+	m.body = append(m.body, avp)
+	totalLen := int(m.GetMessageLength()) + avp.GetTotalLen()
+	m.head[1] = byte(totalLen >> 16)
+	m.head[2] = byte(totalLen >> 8)
+	m.head[3] = byte(totalLen)
+}
+
+// 设置T标志，故障切换后重传的请求
+func (m *DiameterMsg) setRetransmitted() {
+	m.head[4] |= FlagRetransmitted
+}
+
+func (m *DiameterMsg) setHopByHopID(id uint32) {
+	binary.BigEndian.PutUint32(m.head[12:16], id)
+}
+
+// 复制消息头和AVP列表，AVP本身不会被修改，共用即可
+func (m *DiameterMsg) clone() *DiameterMsg {
+	c := &DiameterMsg{head: m.head}
+	c.body = append(make([]*AVPMsg, 0, len(m.body)), m.body...)
+	return c
+}
+
 // 获取消息体长度
 func (d *DiameterMsg) GetBodyLength() int {
 	totalLen := d.GetMessageLength()
@@ -590,6 +945,8 @@ type AVPMeta struct {
 	Code   uint32 `json:"code"`
 	Type   string `json:"type"`
 	FixPos uint32 `json:"fixPos"` // 新增字段，0 表示无固定位置
+	// 厂商AVP与IETF AVP代码冲突时填写，只用于带V位的AVP
+	VendorID uint32 `json:"vendor_id,omitempty"`
 }
 
 type CommandMeta struct {
@@ -603,6 +960,7 @@ type CommandMeta struct {
 type DiameterMetaDict struct {
 	Commands    map[uint32]CommandMeta `json:"commands"`
 	AVPs        map[uint32]AVPMeta     `json:"avps"`
+	VendorAVPs  map[uint32]AVPMeta     `json:"-"` // 带vendor_id的AVP，按代码索引
 	AuthAppMeta map[string]string      `json:"auth_app_meta"`
 	AcctAppMeta map[string]string      `json:"acct_app_meta"`
 	VendorMeta  map[string]string      `json:"vendor_meta"`
@@ -634,6 +992,7 @@ func LoadDiameterMetaDictFromFile(filename string) (*DiameterMetaDict, error) {
 	dict := &DiameterMetaDict{
 		Commands:    make(map[uint32]CommandMeta),
 		AVPs:        make(map[uint32]AVPMeta),
+		VendorAVPs:  make(map[uint32]AVPMeta),
 		AuthAppMeta: raw.AuthAppMeta,
 		AcctAppMeta: raw.AcctAppMeta,
 		VendorMeta:  raw.VendorMeta,
@@ -641,6 +1000,10 @@ func LoadDiameterMetaDictFromFile(filename string) (*DiameterMetaDict, error) {
 	}
 
 	for _, avp := range raw.AVPs {
+		if avp.VendorID != 0 {
+			dict.VendorAVPs[avp.Code] = avp
+			continue
+		}
 		dict.AVPs[avp.Code] = avp
 	}
 
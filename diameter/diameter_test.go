@@ -0,0 +1,31 @@
+package diameter
+
+import (
+	"os"
+	"testing"
+)
+
+// 测试在包目录下运行，字典从上一级目录加载，配置按用例直接设置
+func TestMain(m *testing.M) {
+	var err error
+	dict, err = LoadDiameterMetaDictFromFile("../dict.json")
+	if err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// 测试用的请求，只带Origin-Host
+func newTestRequest(command uint32, originHost string, hopByHop, endToEnd uint32, avps ...*AVPMsg) *DiameterMsg {
+	builder := NewDiameterMsgBuilder().
+		SetCommandCode(command).
+		SetAppID(AppID_Test).
+		SetFlags(FlagRequest | FlagProxiable).
+		SetHopByHopID(hopByHop).
+		SetEndToEndID(endToEnd).
+		AddAVP(NewAVPBuilder(AVP_OriginHost, AVPFlag_Mandatory).SetStringData(originHost).Build())
+	for _, avp := range avps {
+		builder.AddAVP(avp)
+	}
+	return builder.Build()
+}
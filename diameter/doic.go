@@ -0,0 +1,356 @@
+package diameter
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	rtmetrics "runtime/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DOIC(RFC 7683)过载控制算法，OC-Feature-Vector中的比特位
+const (
+	OCFeatureLoss uint64 = 0x1 // OLR_DEFAULT_ALGO，按比例丢弃
+	OCFeatureRate uint64 = 0x4 // OLR_RATE_ALGORITHM，RFC 8581，限制每秒请求数
+)
+
+// OC-Report-Type
+const (
+	OCReportTypeHost  = 0
+	OCReportTypeRealm = 1
+)
+
+const (
+	DOICAlgorithmLoss = "loss"
+	DOICAlgorithmRate = "rate"
+
+	defaultOCValidityDuration    = 30 // 秒
+	defaultOCReductionPercentage = 50
+	defaultOCMaximumRate         = 10 // 每秒请求数
+	overloadSampleInterval       = time.Second
+)
+
+// 上游过载，本端作为反应节点丢弃了请求
+var errThrottled = errors.New("request throttled by overload report")
+
+// DOICConfig 过载控制配置，开启后本端作为报告节点在应答中通告过载，
+// 作为反应节点(客户端/中继)在发往上游的请求中通告支持DOIC，并按收到的OC-OLR限流
+type DOICConfig struct {
+	Enabled   bool   `json:"enabled"`
+	Algorithm string `json:"algorithm"` // 对端两种算法都支持时选用的算法，loss或rate，默认loss
+	// 过载判定：所有连接上排队的请求数、进程CPU占用百分比(相对全部核)，0表示不检测该项
+	QueueThreshold int `json:"queue_threshold"`
+	CPUThreshold   int `json:"cpu_threshold"`
+	// 过载时通告的内容
+	ReductionPercentage uint32 `json:"reduction_percentage"` // loss算法要求减少的流量百分比
+	MaxRate             uint32 `json:"max_rate"`             // rate算法允许的每秒请求数
+	ValidityDuration    uint32 `json:"validity_duration"`    // OC-OLR有效期，秒
+	ReportType          string `json:"report_type"`          // host或realm，默认host
+}
+
+func (c *DOICConfig) reductionPercentage() uint32 {
+	if c.ReductionPercentage == 0 || c.ReductionPercentage > 100 {
+		return defaultOCReductionPercentage
+	}
+	return c.ReductionPercentage
+}
+
+func (c *DOICConfig) maxRate() uint32 {
+	if c.MaxRate == 0 {
+		return defaultOCMaximumRate
+	}
+	return c.MaxRate
+}
+
+func (c *DOICConfig) validityDuration() uint32 {
+	if c.ValidityDuration == 0 || c.ValidityDuration > 86400 {
+		return defaultOCValidityDuration
+	}
+	return c.ValidityDuration
+}
+
+func (c *DOICConfig) reportType() uint32 {
+	if c.ReportType == "realm" {
+		return OCReportTypeRealm
+	}
+	return OCReportTypeHost
+}
+
+// 所有连接上排队等待处理的请求数，过载判定用
+var queuedRequests int64
+
+// overloadMonitor 报告节点的过载状态，定时按排队请求数和CPU占用判定
+type overloadMonitor struct {
+	mu         sync.Mutex
+	overloaded bool
+	sequence   uint64
+	endedAt    time.Time // 过载结束的时间，之后一个有效期内通告有效期为0的OLR
+}
+
+// 序列号从启动时间开始，重启后对端仍能认出是新的报告
+var overload = &overloadMonitor{sequence: uint64(time.Now().Unix())}
+
+func startOverloadMonitor() {
+	go func() {
+		samples := []rtmetrics.Sample{
+			{Name: "/cpu/classes/total:cpu-seconds"},
+			{Name: "/cpu/classes/idle:cpu-seconds"},
+		}
+		rtmetrics.Read(samples)
+		lastTotal, lastIdle := samples[0].Value.Float64(), samples[1].Value.Float64()
+		ticker := time.NewTicker(overloadSampleInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			rtmetrics.Read(samples)
+			total, idle := samples[0].Value.Float64(), samples[1].Value.Float64()
+			cpuPercent := 0
+			if total > lastTotal {
+				cpuPercent = int(100 * (1 - (idle-lastIdle)/(total-lastTotal)))
+			}
+			lastTotal, lastIdle = total, idle
+			overload.update(int(atomic.LoadInt64(&queuedRequests)), cpuPercent)
+		}
+	}()
+}
+
+func (m *overloadMonitor) update(queued, cpuPercent int) {
+	cfg := &config.DOIC
+	overloaded := (cfg.QueueThreshold > 0 && queued >= cfg.QueueThreshold) ||
+		(cfg.CPUThreshold > 0 && cpuPercent >= cfg.CPUThreshold)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if overloaded == m.overloaded {
+		return
+	}
+	m.overloaded = overloaded
+	m.sequence++
+	if overloaded {
+		log.Printf("进入过载状态，排队请求数: %v CPU: %v%%，应答中开始通告OC-OLR", queued, cpuPercent)
+	} else {
+		m.endedAt = time.Now()
+		log.Printf("退出过载状态，排队请求数: %v CPU: %v%%", queued, cpuPercent)
+	}
+}
+
+// 当前需要通告的过载报告，ok为false表示不需要带OC-OLR
+func (m *overloadMonitor) report() (sequence uint64, overloaded bool, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.overloaded {
+		return m.sequence, true, true
+	}
+	// 过载结束后的一个有效期内，用有效期为0的OLR通知对端提前结束限流
+	validity := time.Duration(config.DOIC.validityDuration()) * time.Second
+	if !m.endedAt.IsZero() && time.Since(m.endedAt) < validity {
+		return m.sequence, false, true
+	}
+	return 0, false, false
+}
+
+// 报告节点：请求带OC-Supported-Features时，应答中带上选用的算法，过载时带上OC-OLR
+func addOverloadReport(req, rsp *DiameterMsg) {
+	if !config.DOIC.Enabled || req.GetApplicationID() == AppID_Common {
+		return
+	}
+	featuresAVP := req.FindVendorAVP(AVP_OCSupportedFeatures, 0)
+	if featuresAVP == nil {
+		return
+	}
+	if exist := rsp.FindVendorAVP(AVP_OCSupportedFeatures, 0); exist != nil {
+		return
+	}
+	// 没有OC-Feature-Vector表示只支持默认的loss算法
+	vector := OCFeatureLoss
+	if vectorAVP := featuresAVP.FindGroupedAVP(AVP_OCFeatureVector); vectorAVP != nil {
+		vector = vectorAVP.GetInt64Data()
+	}
+	algorithm := OCFeatureLoss
+	if config.DOIC.Algorithm == DOICAlgorithmRate && vector&OCFeatureRate != 0 {
+		algorithm = OCFeatureRate
+	}
+	rsp.appendAVP(NewAVPBuilder(AVP_OCSupportedFeatures, 0).SetGroupedData(
+		NewAVPBuilder(AVP_OCFeatureVector, 0).SetInt64Data(algorithm).Build(),
+	).Build())
+
+	sequence, overloaded, ok := overload.report()
+	if !ok {
+		return
+	}
+	validity := config.DOIC.validityDuration()
+	if !overloaded {
+		validity = 0
+	}
+	olr := []*AVPMsg{
+		NewAVPBuilder(AVP_OCSequenceNumber, 0).SetInt64Data(sequence).Build(),
+		NewAVPBuilder(AVP_OCReportType, 0).SetIntData(config.DOIC.reportType()).Build(),
+		NewAVPBuilder(AVP_OCValidityDuration, 0).SetIntData(validity).Build(),
+	}
+	if algorithm == OCFeatureRate {
+		olr = append(olr, NewAVPBuilder(AVP_OCMaximumRate, 0).SetIntData(config.DOIC.maxRate()).Build())
+	} else {
+		olr = append(olr, NewAVPBuilder(AVP_OCReductionPercentage, 0).SetIntData(config.DOIC.reductionPercentage()).Build())
+	}
+	rsp.appendAVP(NewAVPBuilder(AVP_OCOLR, 0).SetGroupedData(olr...).Build())
+}
+
+// 反应节点：发往上游的请求没有OC-Supported-Features时，代替请求方通告支持两种算法
+func addSupportedFeatures(req *DiameterMsg) {
+	if !config.DOIC.Enabled || req.GetApplicationID() == AppID_Common {
+		return
+	}
+	if exist := req.FindVendorAVP(AVP_OCSupportedFeatures, 0); exist != nil {
+		return
+	}
+	req.appendAVP(NewAVPBuilder(AVP_OCSupportedFeatures, 0).SetGroupedData(
+		NewAVPBuilder(AVP_OCFeatureVector, 0).SetInt64Data(OCFeatureLoss | OCFeatureRate).Build(),
+	).Build())
+}
+
+// overloadReport 收到的一条过载报告
+type overloadReport struct {
+	algorithm  uint64
+	sequence   uint64
+	reduction  uint32
+	maxRate    uint32
+	expireAt   time.Time
+	tokens     float64 // rate算法的令牌桶
+	lastRefill time.Time
+}
+
+// overloadTable 反应节点记录的上游过载报告，按主机或域索引
+type overloadTable struct {
+	mu      sync.Mutex
+	reports map[string]*overloadReport
+}
+
+var overloads = &overloadTable{reports: make(map[string]*overloadReport)}
+
+func overloadKey(reportType uint32, name string) string {
+	if reportType == OCReportTypeRealm {
+		return "realm:" + name
+	}
+	return "host:" + name
+}
+
+// 记录应答中的OC-OLR，序列号不比已有报告大的忽略，有效期为0表示过载结束
+func (t *overloadTable) learn(rsp *DiameterMsg) {
+	if !config.DOIC.Enabled {
+		return
+	}
+	olrAVP := rsp.FindVendorAVP(AVP_OCOLR, 0)
+	if olrAVP == nil {
+		return
+	}
+	report := &overloadReport{algorithm: OCFeatureLoss}
+	if featuresAVP := rsp.FindVendorAVP(AVP_OCSupportedFeatures, 0); featuresAVP != nil {
+		if vectorAVP := featuresAVP.FindGroupedAVP(AVP_OCFeatureVector); vectorAVP != nil && vectorAVP.GetInt64Data()&OCFeatureRate != 0 {
+			report.algorithm = OCFeatureRate
+		}
+	}
+	sequenceAVP := olrAVP.FindGroupedAVP(AVP_OCSequenceNumber)
+	typeAVP := olrAVP.FindGroupedAVP(AVP_OCReportType)
+	if sequenceAVP == nil || typeAVP == nil {
+		log.Printf("OC-OLR缺少OC-Sequence-Number或OC-Report-Type，忽略")
+		return
+	}
+	report.sequence = sequenceAVP.GetInt64Data()
+	validity := uint32(defaultOCValidityDuration)
+	if avp := olrAVP.FindGroupedAVP(AVP_OCValidityDuration); avp != nil {
+		validity = avp.GetIntData()
+	}
+	if avp := olrAVP.FindGroupedAVP(AVP_OCReductionPercentage); avp != nil {
+		report.reduction = avp.GetIntData()
+	}
+	if avp := olrAVP.FindGroupedAVP(AVP_OCMaximumRate); avp != nil {
+		report.maxRate = avp.GetIntData()
+	}
+	report.expireAt = time.Now().Add(time.Duration(validity) * time.Second)
+	report.lastRefill = time.Now()
+	report.tokens = float64(report.maxRate)
+
+	var name string
+	reportType := typeAVP.GetIntData()
+	if reportType == OCReportTypeRealm {
+		if realmAVP, _ := rsp.FindAVPByCode(AVP_OriginRealm); realmAVP != nil {
+			name = realmAVP.GetStringData()
+		}
+	} else if hostAVP, _ := rsp.FindAVPByCode(AVP_OriginHost); hostAVP != nil {
+		name = hostAVP.GetStringData()
+	}
+	key := overloadKey(reportType, name)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if old, ok := t.reports[key]; ok && report.sequence <= old.sequence {
+		return
+	}
+	if validity == 0 {
+		delete(t.reports, key)
+		log.Printf("%v 过载结束", key)
+		return
+	}
+	t.reports[key] = report
+	if report.algorithm == OCFeatureRate {
+		log.Printf("%v 过载，%v秒内限制为每秒%v个请求", key, validity, report.maxRate)
+	} else {
+		log.Printf("%v 过载，%v秒内减少%v%%的请求", key, validity, report.reduction)
+	}
+}
+
+// 发往host、目的域为realm的请求是否需要按过载报告丢弃
+func (t *overloadTable) throttle(host, realm string) bool {
+	if !config.DOIC.Enabled {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	for _, key := range []string{overloadKey(OCReportTypeHost, host), overloadKey(OCReportTypeRealm, realm)} {
+		report, ok := t.reports[key]
+		if !ok {
+			continue
+		}
+		if now.After(report.expireAt) {
+			delete(t.reports, key)
+			continue
+		}
+		if report.algorithm == OCFeatureRate {
+			report.tokens += now.Sub(report.lastRefill).Seconds() * float64(report.maxRate)
+			if report.tokens > float64(report.maxRate) {
+				report.tokens = float64(report.maxRate)
+			}
+			report.lastRefill = now
+			if report.tokens < 1 {
+				return true
+			}
+			report.tokens--
+		} else if rand.Intn(100) < int(report.reduction) {
+			return true
+		}
+	}
+	return false
+}
+
+// 转发失败时回复给请求方的结果码，被过载控制丢弃的回复3004
+func forwardErrorCode(err error) uint32 {
+	if errors.Is(err, errThrottled) {
+		return ResultCode_TooBusy
+	}
+	return ResultCode_UnableToDeliver
+}
+
+func requestRealm(req *DiameterMsg) string {
+	if realmAVP, _ := req.FindAVPByCode(AVP_DestinationRealm); realmAVP != nil {
+		return realmAVP.GetStringData()
+	}
+	return ""
+}
+
+// 请求因上游过载被丢弃
+func throttledError(upstream *Session) error {
+	metrics.inc(MetricDOICThrottled)
+	return fmt.Errorf("upstream peer %v overloaded: %w", upstream.PeerHost, errThrottled)
+}
@@ -0,0 +1,134 @@
+package diameter
+
+import (
+	"testing"
+	"time"
+)
+
+// 上游up1回复的带OC-OLR的应答，validity为0表示过载结束
+func newOverloadAnswer(algorithm, sequence uint64, reportType, validity, value uint32) *DiameterMsg {
+	olr := []*AVPMsg{
+		NewAVPBuilder(AVP_OCSequenceNumber, 0).SetInt64Data(sequence).Build(),
+		NewAVPBuilder(AVP_OCReportType, 0).SetIntData(reportType).Build(),
+		NewAVPBuilder(AVP_OCValidityDuration, 0).SetIntData(validity).Build(),
+	}
+	if algorithm == OCFeatureRate {
+		olr = append(olr, NewAVPBuilder(AVP_OCMaximumRate, 0).SetIntData(value).Build())
+	} else {
+		olr = append(olr, NewAVPBuilder(AVP_OCReductionPercentage, 0).SetIntData(value).Build())
+	}
+	return newTestRequest(Cmd_TEST, "up1", 1, 1,
+		NewAVPBuilder(AVP_OriginRealm, AVPFlag_Mandatory).SetStringData("up.local").Build(),
+		NewAVPBuilder(AVP_OCSupportedFeatures, 0).SetGroupedData(
+			NewAVPBuilder(AVP_OCFeatureVector, 0).SetInt64Data(algorithm).Build(),
+		).Build(),
+		NewAVPBuilder(AVP_OCOLR, 0).SetGroupedData(olr...).Build())
+}
+
+func TestOverloadLearn(t *testing.T) {
+	saved := config.DOIC.Enabled
+	defer func() { config.DOIC.Enabled = saved }()
+	config.DOIC.Enabled = true
+
+	tests := []struct {
+		name    string
+		answers []*DiameterMsg
+		key     string
+		want    *overloadReport // nil表示没有记录
+	}{
+		{
+			name:    "loss算法按主机记录",
+			answers: []*DiameterMsg{newOverloadAnswer(OCFeatureLoss, 5, OCReportTypeHost, 30, 40)},
+			key:     "host:up1",
+			want:    &overloadReport{algorithm: OCFeatureLoss, sequence: 5, reduction: 40},
+		},
+		{
+			name:    "rate算法按域记录",
+			answers: []*DiameterMsg{newOverloadAnswer(OCFeatureRate, 5, OCReportTypeRealm, 30, 20)},
+			key:     "realm:up.local",
+			want:    &overloadReport{algorithm: OCFeatureRate, sequence: 5, maxRate: 20},
+		},
+		{
+			name: "序列号更大的报告覆盖",
+			answers: []*DiameterMsg{
+				newOverloadAnswer(OCFeatureLoss, 5, OCReportTypeHost, 30, 40),
+				newOverloadAnswer(OCFeatureLoss, 6, OCReportTypeHost, 30, 80),
+			},
+			key:  "host:up1",
+			want: &overloadReport{algorithm: OCFeatureLoss, sequence: 6, reduction: 80},
+		},
+		{
+			name: "序列号不比已有报告大的忽略",
+			answers: []*DiameterMsg{
+				newOverloadAnswer(OCFeatureLoss, 5, OCReportTypeHost, 30, 40),
+				newOverloadAnswer(OCFeatureLoss, 5, OCReportTypeHost, 30, 80),
+				newOverloadAnswer(OCFeatureLoss, 4, OCReportTypeHost, 0, 80),
+			},
+			key:  "host:up1",
+			want: &overloadReport{algorithm: OCFeatureLoss, sequence: 5, reduction: 40},
+		},
+		{
+			name: "有效期为0表示过载结束",
+			answers: []*DiameterMsg{
+				newOverloadAnswer(OCFeatureLoss, 5, OCReportTypeHost, 30, 40),
+				newOverloadAnswer(OCFeatureLoss, 6, OCReportTypeHost, 0, 40),
+			},
+			key: "host:up1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := &overloadTable{reports: make(map[string]*overloadReport)}
+			for _, rsp := range tt.answers {
+				table.learn(rsp)
+			}
+			got, ok := table.reports[tt.key]
+			if ok != (tt.want != nil) {
+				t.Fatalf("report %v = %+v, want %+v", tt.key, got, tt.want)
+			}
+			if got == nil {
+				return
+			}
+			if got.algorithm != tt.want.algorithm || got.sequence != tt.want.sequence ||
+				got.reduction != tt.want.reduction || got.maxRate != tt.want.maxRate {
+				t.Errorf("report = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOverloadThrottle(t *testing.T) {
+	saved := config.DOIC.Enabled
+	defer func() { config.DOIC.Enabled = saved }()
+
+	now := time.Now()
+	validUntil := now.Add(time.Minute)
+	tests := []struct {
+		name     string
+		disabled bool
+		key      string
+		report   overloadReport
+		want     []bool // 发往up1、目的域up.local的请求依次是否被丢弃
+	}{
+		{"没有过载报告", false, "host:up2", overloadReport{algorithm: OCFeatureLoss, reduction: 100, expireAt: validUntil}, []bool{false, false}},
+		{"loss算法减少100%", false, "host:up1", overloadReport{algorithm: OCFeatureLoss, reduction: 100, expireAt: validUntil}, []bool{true, true}},
+		{"loss算法减少0%", false, "host:up1", overloadReport{algorithm: OCFeatureLoss, reduction: 0, expireAt: validUntil}, []bool{false, false}},
+		{"按域的过载报告", false, "realm:up.local", overloadReport{algorithm: OCFeatureLoss, reduction: 100, expireAt: validUntil}, []bool{true}},
+		{"rate算法令牌用完后丢弃", false, "host:up1", overloadReport{algorithm: OCFeatureRate, maxRate: 2, tokens: 2, lastRefill: now, expireAt: validUntil}, []bool{false, false, true}},
+		{"rate算法按时间补充令牌", false, "host:up1", overloadReport{algorithm: OCFeatureRate, maxRate: 2, lastRefill: now.Add(-time.Second), expireAt: validUntil}, []bool{false, false, true}},
+		{"过期的报告不再限流", false, "host:up1", overloadReport{algorithm: OCFeatureLoss, reduction: 100, expireAt: now.Add(-time.Second)}, []bool{false}},
+		{"未开启DOIC", true, "host:up1", overloadReport{algorithm: OCFeatureLoss, reduction: 100, expireAt: validUntil}, []bool{false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.DOIC.Enabled = !tt.disabled
+			report := tt.report
+			table := &overloadTable{reports: map[string]*overloadReport{tt.key: &report}}
+			for i, want := range tt.want {
+				if got := table.throttle("up1", "up.local"); got != want {
+					t.Errorf("request %v throttled = %v, want %v", i, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package diameter
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// DRMP(RFC 7944)优先级，PRIORITY_0最高，PRIORITY_15最低
+const (
+	DRMPPriorityHighest = 0
+	DRMPPriorityLowest  = 15
+
+	defaultDRMPPriority  = 10 // 请求不带DRMP时的优先级，RFC 7944建议PRIORITY_10
+	defaultRequestQueue  = 100
+	drmpPriorityLevelNum = DRMPPriorityLowest + 1
+)
+
+// DRMPConfig 按DRMP优先级排队处理请求的配置
+type DRMPConfig struct {
+	// 请求不带DRMP时使用的优先级(0-15)，本端发起的请求也按此优先级填写DRMP，不配置时使用默认值10
+	DefaultPriority *int `json:"default_priority"`
+	// 单个连接上排队等待处理的请求上限，超出即认为过载，优先级最低的请求回复3004
+	QueueSize int `json:"queue_size"`
+}
+
+func (c *DRMPConfig) defaultPriority() uint32 {
+	if c.DefaultPriority == nil {
+		return defaultDRMPPriority
+	}
+	return uint32(*c.DefaultPriority)
+}
+
+func (c *DRMPConfig) validate() error {
+	if p := c.DefaultPriority; p != nil && (*p < DRMPPriorityHighest || *p > DRMPPriorityLowest) {
+		return fmt.Errorf("drmp.default_priority %d out of range %d-%d", *p, DRMPPriorityHighest, DRMPPriorityLowest)
+	}
+	return nil
+}
+
+func (c *DRMPConfig) queueSize() int {
+	if c.QueueSize <= 0 {
+		return defaultRequestQueue
+	}
+	return c.QueueSize
+}
+
+// 请求的DRMP优先级，没有或取值非法时使用默认优先级
+func requestPriority(msg *DiameterMsg) uint32 {
+	avp, _ := msg.FindAVPByCode(AVP_Drmp)
+	if avp == nil || avp.GetDataLength() < 4 || avp.GetIntData() > DRMPPriorityLowest {
+		return config.DRMP.defaultPriority()
+	}
+	return avp.GetIntData()
+}
+
+// 本端发起的请求没有DRMP时按默认优先级填写
+func assignDRMP(req *DiameterMsg) {
+	if avp, _ := req.FindAVPByCode(AVP_Drmp); avp != nil {
+		return
+	}
+	req.appendAVP(NewAVPBuilder(AVP_Drmp, 0).SetIntData(config.DRMP.defaultPriority()).Build())
+}
+
+// 应答与请求使用相同的优先级，RFC 7944 9.2
+func copyDRMP(req, rsp *DiameterMsg) {
+	avp, _ := req.FindAVPByCode(AVP_Drmp)
+	if avp == nil {
+		return
+	}
+	if exist, _ := rsp.FindAVPByCode(AVP_Drmp); exist != nil {
+		return
+	}
+	rsp.appendAVP(NewAVPBuilder(AVP_Drmp, 0).SetIntData(avp.GetIntData()).Build())
+}
+
+// requestQueue 连接上等待处理的请求，每个优先级一个先进先出队列
+type requestQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	levels [drmpPriorityLevelNum][]*DiameterMsg
+	size   int
+	limit  int
+	closed bool
+}
+
+func newRequestQueue(limit int) *requestQueue {
+	q := &requestQueue{limit: limit}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// 请求入队，队列已满时淘汰优先级最低的请求(可能就是本次入队的请求)，返回被淘汰的请求
+func (q *requestQueue) push(msg *DiameterMsg) *DiameterMsg {
+	priority := requestPriority(msg)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil
+	}
+	if q.size >= q.limit {
+		lowest := q.lowestLevel()
+		if lowest < 0 || uint32(lowest) <= priority {
+			return msg
+		}
+		// 淘汰最低优先级中最后到达的请求，给优先级更高的请求腾出位置
+		n := len(q.levels[lowest])
+		dropped := q.levels[lowest][n-1]
+		q.levels[lowest] = q.levels[lowest][:n-1]
+		q.levels[priority] = append(q.levels[priority], msg)
+		q.cond.Signal()
+		return dropped
+	}
+	q.levels[priority] = append(q.levels[priority], msg)
+	q.size++
+	atomic.AddInt64(&queuedRequests, 1)
+	q.cond.Signal()
+	return nil
+}
+
+// 取出优先级最高的请求，队列关闭后返回nil
+func (q *requestQueue) pop() *DiameterMsg {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.size == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return nil
+	}
+	for level := range q.levels {
+		if len(q.levels[level]) > 0 {
+			msg := q.levels[level][0]
+			q.levels[level] = q.levels[level][1:]
+			q.size--
+			atomic.AddInt64(&queuedRequests, -1)
+			return msg
+		}
+	}
+	return nil
+}
+
+// 非空队列中优先级最低的一级，全部为空时返回-1
+func (q *requestQueue) lowestLevel() int {
+	for level := len(q.levels) - 1; level >= 0; level-- {
+		if len(q.levels[level]) > 0 {
+			return level
+		}
+	}
+	return -1
+}
+
+// 连接断开，丢弃未处理的请求
+func (q *requestQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.size > 0 {
+		log.Printf("连接关闭，丢弃%v个未处理的请求", q.size)
+	}
+	q.closed = true
+	atomic.AddInt64(&queuedRequests, -int64(q.size))
+	q.size = 0
+	// 请求方切换到其他连接重传时按新请求处理
+	for level := range q.levels {
+		for _, msg := range q.levels[level] {
+			requestCache.release(msg, nil)
+		}
+		q.levels[level] = nil
+	}
+	q.cond.Broadcast()
+}
+
+// 过载时拒绝的请求，回复3004让请求方换其他对端
+func newTooBusyAnswer(msg *DiameterMsg) *DiameterMsg {
+	log.Printf("请求过载，拒绝优先级%v的请求 Command: %v End-to-End: %v", requestPriority(msg), msg.GetCommandCode(), msg.GetEndToEndID())
+	metrics.inc(MetricDRMPRejected)
+	rsp := newErrorAnswer(msg, ResultCode_TooBusy, "too busy, request priority too low")
+	copyDRMP(msg, rsp)
+	addOverloadReport(msg, rsp)
+	return rsp
+}
@@ -0,0 +1,122 @@
+package diameter
+
+import "testing"
+
+func newDRMPRequest(endToEnd uint32, priority int) *DiameterMsg {
+	if priority < 0 {
+		return newTestRequest(Cmd_TEST, "client.local", endToEnd, endToEnd)
+	}
+	return newTestRequest(Cmd_TEST, "client.local", endToEnd, endToEnd, NewAVPBuilder(AVP_Drmp, 0).SetIntData(uint32(priority)).Build())
+}
+
+func TestRequestPriority(t *testing.T) {
+	tests := []struct {
+		name     string
+		priority int // -1表示不带DRMP
+		want     uint32
+	}{
+		{"PRIORITY_0", 0, 0},
+		{"PRIORITY_15", 15, 15},
+		{"不带DRMP按默认优先级", -1, defaultDRMPPriority},
+		{"取值非法按默认优先级", 16, defaultDRMPPriority},
+	}
+	for _, tt := range tests {
+		if got := requestPriority(newDRMPRequest(1, tt.priority)); got != tt.want {
+			t.Errorf("%v: priority = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRequestQueue(t *testing.T) {
+	tests := []struct {
+		name       string
+		limit      int
+		priorities []int    // 依次入队的请求优先级，End-to-End从1开始编号
+		dropped    []uint32 // 每次入队被淘汰的请求，0表示没有
+		popped     []uint32 // 出队顺序
+	}{
+		{
+			name:       "按优先级出队，同优先级先进先出",
+			limit:      10,
+			priorities: []int{10, 2, 10, 0, 2},
+			dropped:    []uint32{0, 0, 0, 0, 0},
+			popped:     []uint32{4, 2, 5, 1, 3},
+		},
+		{
+			name:       "队列满时淘汰最低优先级中最后到达的请求",
+			limit:      3,
+			priorities: []int{10, 12, 12, 1},
+			dropped:    []uint32{0, 0, 0, 3},
+			popped:     []uint32{4, 1, 2},
+		},
+		{
+			name:       "队列满且本次请求优先级不高于已有请求时淘汰本次请求",
+			limit:      2,
+			priorities: []int{3, 5, 5, 9},
+			dropped:    []uint32{0, 0, 3, 4},
+			popped:     []uint32{1, 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newRequestQueue(tt.limit)
+			defer q.close()
+			for i, priority := range tt.priorities {
+				dropped := q.push(newDRMPRequest(uint32(i+1), priority))
+				var got uint32
+				if dropped != nil {
+					got = dropped.GetEndToEndID()
+				}
+				if got != tt.dropped[i] {
+					t.Errorf("push #%v dropped %v, want %v", i+1, got, tt.dropped[i])
+				}
+			}
+			for _, want := range tt.popped {
+				if got := q.pop().GetEndToEndID(); got != want {
+					t.Errorf("pop = %v, want %v", got, want)
+				}
+			}
+			if q.size != 0 {
+				t.Errorf("queue size = %v after popping all", q.size)
+			}
+		})
+	}
+}
+
+func TestRequestQueueClose(t *testing.T) {
+	q := newRequestQueue(4)
+	q.push(newDRMPRequest(1, 5))
+	q.close()
+	if msg := q.pop(); msg != nil {
+		t.Errorf("pop after close = %v, want nil", msg.GetEndToEndID())
+	}
+	if dropped := q.push(newDRMPRequest(2, 5)); dropped != nil {
+		t.Errorf("push after close dropped %v", dropped.GetEndToEndID())
+	}
+}
+
+func TestDRMPDefaultPriority(t *testing.T) {
+	priority := func(p int) *int { return &p }
+	tests := []struct {
+		name    string
+		config  *int
+		want    uint32
+		invalid bool
+	}{
+		{"不配置", nil, defaultDRMPPriority, false},
+		{"配置为PRIORITY_0", priority(0), 0, false},
+		{"配置为PRIORITY_15", priority(15), 15, false},
+		{"小于0", priority(-1), 0, true},
+		{"大于15", priority(16), 0, true},
+	}
+	for _, tt := range tests {
+		c := DRMPConfig{DefaultPriority: tt.config}
+		if err := c.validate(); (err != nil) != tt.invalid {
+			t.Errorf("%v: validate error = %v, want invalid %v", tt.name, err, tt.invalid)
+			continue
+		}
+		if !tt.invalid && c.defaultPriority() != tt.want {
+			t.Errorf("%v: defaultPriority = %v, want %v", tt.name, c.defaultPriority(), tt.want)
+		}
+	}
+}
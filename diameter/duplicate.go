@@ -0,0 +1,167 @@
+package diameter
+
+import (
+	"container/list"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDuplicateWindow    = 60 * time.Second
+	defaultDuplicateCacheSize = 10000
+)
+
+// 按RFC 6733 6.1.5，同一Origin-Host的End-to-End ID在一段时间内唯一，
+// 以此识别故障切换后重传(T标志)的请求，直接重放之前的应答，避免重复处理。
+// 请求收到时就登记，原请求还在排队或处理中时重复的请求等原请求的应答，不再处理一次
+type duplicateCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // 按插入时间排序，超出容量或过期时从头部淘汰
+}
+
+type duplicateEntry struct {
+	key      string
+	answer   *DiameterMsg // 为nil表示原请求还在处理中
+	waiters  []duplicateWaiter
+	storedAt time.Time
+}
+
+// 原请求处理中收到的重复请求，应答按各自的Hop-by-Hop ID发回收到它的连接
+type duplicateWaiter struct {
+	session  *Session
+	hopByHop uint32
+}
+
+var requestCache = &duplicateCache{
+	entries: make(map[string]*list.Element),
+	order:   list.New(),
+}
+
+// 基础协议消息逐跳处理，不参与重复检测
+func duplicateKey(msg *DiameterMsg) (string, bool) {
+	switch msg.GetCommandCode() {
+	case Cmd_CE, Cmd_DW, Cmd_DP:
+		return "", false
+	}
+	hostAVP, _ := msg.FindAVPByCode(AVP_OriginHost)
+	if hostAVP == nil {
+		return "", false
+	}
+	return fmt.Sprintf("%s/%d", hostAVP.GetStringData(), msg.GetEndToEndID()), true
+}
+
+// 查找重复请求：已有应答时返回替换为本次Hop-by-Hop ID的应答；原请求还在处理中时登记为等待，
+// 应答由store发回，duplicate为true；都不是时登记为处理中，调用方按新请求处理
+func (c *duplicateCache) lookup(session *Session, req *DiameterMsg) (answer *DiameterMsg, duplicate bool) {
+	key, ok := duplicateKey(req)
+	if !ok {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expire()
+	elem, ok := c.entries[key]
+	if !ok {
+		if req.GetFlags()&FlagRetransmitted != 0 {
+			log.Printf("收到重传请求 %v，之前未处理过，按新请求处理", key)
+		}
+		c.add(&duplicateEntry{key: key, storedAt: time.Now()})
+		return nil, false
+	}
+	entry := elem.Value.(*duplicateEntry)
+	if entry.answer == nil {
+		entry.waiters = append(entry.waiters, duplicateWaiter{session: session, hopByHop: req.GetHopByHopID()})
+		return nil, true
+	}
+	answer = entry.answer.clone()
+	answer.setHopByHopID(req.GetHopByHopID())
+	return answer, true
+}
+
+// 记录请求的应答，并发给原请求处理中收到的重复请求
+func (c *duplicateCache) store(req, answer *DiameterMsg) {
+	key, ok := duplicateKey(req)
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	var waiters []duplicateWaiter
+	if elem, ok := c.entries[key]; ok {
+		waiters = elem.Value.(*duplicateEntry).waiters
+		c.remove(elem)
+	}
+	c.add(&duplicateEntry{key: key, answer: answer, storedAt: time.Now()})
+	c.mu.Unlock()
+	notifyDuplicates(waiters, answer)
+}
+
+// 原请求没有可缓存的应答(过载拒绝、转发失败等)，删除登记，等待的重复请求收到同样的应答；
+// answer为nil时等待的请求不回复，请求方之后重传时按新请求处理
+func (c *duplicateCache) release(req, answer *DiameterMsg) {
+	key, ok := duplicateKey(req)
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	var waiters []duplicateWaiter
+	if elem, ok := c.entries[key]; ok && elem.Value.(*duplicateEntry).answer == nil {
+		waiters = elem.Value.(*duplicateEntry).waiters
+		c.remove(elem)
+	}
+	c.mu.Unlock()
+	if answer != nil {
+		notifyDuplicates(waiters, answer)
+	}
+}
+
+func notifyDuplicates(waiters []duplicateWaiter, answer *DiameterMsg) {
+	for _, w := range waiters {
+		rsp := answer.clone()
+		rsp.setHopByHopID(w.hopByHop)
+		log.Printf("主机%v 重复请求，发回原请求的应答 End-to-End: %v", w.session.PeerHost, rsp.GetEndToEndID())
+		if err := w.session.Send(rsp); err != nil {
+			log.Printf("主机%v 发送应答失败: %v", w.session.PeerHost, err)
+		}
+	}
+}
+
+// 登记一条记录，超出容量时从最早的开始淘汰，调用方持有锁
+func (c *duplicateCache) add(entry *duplicateEntry) {
+	c.entries[entry.key] = c.order.PushBack(entry)
+	for c.order.Len() > config.duplicateCacheSize() {
+		c.remove(c.order.Front())
+	}
+}
+
+// 淘汰超出时间窗口的记录，调用方持有锁
+func (c *duplicateCache) expire() {
+	deadline := time.Now().Add(-config.duplicateWindow())
+	for elem := c.order.Front(); elem != nil; elem = c.order.Front() {
+		if elem.Value.(*duplicateEntry).storedAt.After(deadline) {
+			return
+		}
+		c.remove(elem)
+	}
+}
+
+func (c *duplicateCache) remove(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.entries, elem.Value.(*duplicateEntry).key)
+}
+
+func (c *DiameterConfig) duplicateWindow() time.Duration {
+	if c.DuplicateWindow <= 0 {
+		return defaultDuplicateWindow
+	}
+	return time.Duration(c.DuplicateWindow) * time.Second
+}
+
+func (c *DiameterConfig) duplicateCacheSize() int {
+	if c.DuplicateCacheSize <= 0 {
+		return defaultDuplicateCacheSize
+	}
+	return c.DuplicateCacheSize
+}
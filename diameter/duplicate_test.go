@@ -0,0 +1,148 @@
+package diameter
+
+import (
+	"container/list"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestDuplicateCache() *duplicateCache {
+	return &duplicateCache{entries: make(map[string]*list.Element), order: list.New()}
+}
+
+func TestDuplicateCacheLookup(t *testing.T) {
+	answer := newTestRequest(Cmd_TEST, "server.local", 1, 100)
+	tests := []struct {
+		name     string
+		stored   *DiameterMsg
+		req      *DiameterMsg
+		replay   bool
+		hopByHop uint32
+	}{
+		{"重传请求重放应答", newTestRequest(Cmd_TEST, "client.local", 1, 100), newTestRequest(Cmd_TEST, "client.local", 7, 100), true, 7},
+		{"End-to-End不同", newTestRequest(Cmd_TEST, "client.local", 1, 100), newTestRequest(Cmd_TEST, "client.local", 2, 101), false, 0},
+		{"Origin-Host不同", newTestRequest(Cmd_TEST, "client.local", 1, 100), newTestRequest(Cmd_TEST, "other.local", 2, 100), false, 0},
+		{"CER不参与重复检测", newTestRequest(Cmd_CE, "client.local", 1, 100), newTestRequest(Cmd_CE, "client.local", 2, 100), false, 0},
+		{"DWR不参与重复检测", newTestRequest(Cmd_DW, "client.local", 1, 100), newTestRequest(Cmd_DW, "client.local", 2, 100), false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestDuplicateCache()
+			c.store(tt.stored, answer)
+			got, duplicate := c.lookup(nil, tt.req)
+			if duplicate != tt.replay || (got != nil) != tt.replay {
+				t.Fatalf("lookup = %v %v, want replay %v", got, duplicate, tt.replay)
+			}
+			if got == nil {
+				return
+			}
+			if got.GetHopByHopID() != tt.hopByHop {
+				t.Errorf("Hop-by-Hop = %v, want %v", got.GetHopByHopID(), tt.hopByHop)
+			}
+			if answer.GetHopByHopID() != 1 {
+				t.Errorf("cached answer modified, Hop-by-Hop = %v", answer.GetHopByHopID())
+			}
+		})
+	}
+}
+
+// 原请求还在处理中时收到的重传，不再处理，等原请求的应答按自己的Hop-by-Hop ID发回
+func TestDuplicateCacheInFlight(t *testing.T) {
+	tests := []struct {
+		name     string
+		finish   func(c *duplicateCache, req *DiameterMsg)
+		answered bool
+		result   uint32 // 重传请求收到的应答的Result-Code
+		cached   bool   // 之后的重传是否直接重放
+	}{
+		{"原请求处理完成", func(c *duplicateCache, req *DiameterMsg) {
+			c.store(req, newErrorAnswer(req, ResultCode_Success, ""))
+		}, true, ResultCode_Success, true},
+		{"原请求过载被拒绝", func(c *duplicateCache, req *DiameterMsg) {
+			c.release(req, newTooBusyAnswer(req))
+		}, true, ResultCode_TooBusy, false},
+		{"原请求没有应答", func(c *duplicateCache, req *DiameterMsg) {
+			c.release(req, nil)
+		}, false, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestDuplicateCache()
+			original := newTestRequest(Cmd_TEST, "client.local", 1, 100)
+			if rsp, duplicate := c.lookup(nil, original); rsp != nil || duplicate {
+				t.Fatalf("first lookup = %v %v, want new request", rsp, duplicate)
+			}
+
+			local, remote := net.Pipe()
+			defer local.Close()
+			defer remote.Close()
+			session := newSession(local)
+			retransmit := newTestRequest(Cmd_TEST, "client.local", 9, 100)
+			if rsp, duplicate := c.lookup(session, retransmit); rsp != nil || !duplicate {
+				t.Fatalf("lookup while in flight = %v %v, want waiting duplicate", rsp, duplicate)
+			}
+
+			received := make(chan *DiameterMsg, 1)
+			go func() {
+				msg, err := readDiameterMsg(remote)
+				if err != nil {
+					msg = nil
+				}
+				received <- msg
+			}()
+			tt.finish(c, original)
+			if !tt.answered {
+				local.Close()
+			}
+			msg := <-received
+			if (msg != nil) != tt.answered {
+				t.Fatalf("retransmission answered = %v, want %v", msg != nil, tt.answered)
+			}
+			if msg != nil {
+				if msg.GetHopByHopID() != 9 {
+					t.Errorf("Hop-by-Hop = %v, want 9", msg.GetHopByHopID())
+				}
+				if got := avpIntData(msg, AVP_ResultCode); got != tt.result {
+					t.Errorf("Result-Code = %v, want %v", got, tt.result)
+				}
+			}
+
+			rsp, duplicate := c.lookup(nil, newTestRequest(Cmd_TEST, "client.local", 10, 100))
+			if (rsp != nil && duplicate) != tt.cached {
+				t.Errorf("later retransmission replayed = %v, want %v", rsp != nil, tt.cached)
+			}
+		})
+	}
+}
+
+func TestDuplicateCacheEviction(t *testing.T) {
+	saved := config.DuplicateCacheSize
+	defer func() { config.DuplicateCacheSize = saved }()
+	config.DuplicateCacheSize = 2
+
+	c := newTestDuplicateCache()
+	answer := newTestRequest(Cmd_TEST, "server.local", 1, 1)
+	for e2e := uint32(1); e2e <= 3; e2e++ {
+		c.store(newTestRequest(Cmd_TEST, "client.local", e2e, e2e), answer)
+	}
+	if len(c.entries) != 2 || c.order.Len() != 2 {
+		t.Fatalf("cache size = %v/%v, want 2", len(c.entries), c.order.Len())
+	}
+	key, _ := duplicateKey(newTestRequest(Cmd_TEST, "client.local", 1, 1))
+	if _, ok := c.entries[key]; ok {
+		t.Error("oldest entry should be evicted")
+	}
+	if rsp, _ := c.lookup(nil, newTestRequest(Cmd_TEST, "client.local", 9, 3)); rsp == nil {
+		t.Error("newest entry should be kept")
+	}
+
+	// 超出时间窗口的记录在查找时淘汰
+	c.order.Front().Value.(*duplicateEntry).storedAt = time.Now().Add(-2 * config.duplicateWindow())
+	if rsp, _ := c.lookup(nil, newTestRequest(Cmd_TEST, "client.local", 9, 3)); rsp == nil {
+		t.Error("entry inside window should be replayed")
+	}
+	if len(c.entries) != 1 || c.order.Len() != 1 {
+		t.Errorf("cache size after expire = %v/%v, want 1", len(c.entries), c.order.Len())
+	}
+}
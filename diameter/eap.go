@@ -0,0 +1,363 @@
+package diameter
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// EAP报文Code，RFC 3748 4
+const (
+	EAPCodeRequest  = 1
+	EAPCodeResponse = 2
+	EAPCodeSuccess  = 3
+	EAPCodeFailure  = 4
+)
+
+// EAP Type，RFC 3748 5
+const (
+	EAPTypeIdentity = 1
+	EAPTypeNak      = 3
+	EAPTypeMD5      = 4
+)
+
+const defaultEAPTimeout = 60 // 秒
+
+// EAPConfig EAP认证配置
+type EAPConfig struct {
+	// 按优先顺序使用的EAP方法名，如["md5"]，为空时使用所有已注册的方法
+	Methods []string `json:"methods"`
+	// 多轮认证中等待对端下一个DER的时间，秒，默认60，超时后认证状态作废
+	Timeout int `json:"timeout"`
+}
+
+func (c *EAPConfig) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return defaultEAPTimeout * time.Second
+	}
+	return time.Duration(c.Timeout) * time.Second
+}
+
+// EAPPacket EAP报文，Success/Failure没有Type
+type EAPPacket struct {
+	Code       byte
+	Identifier byte
+	Type       byte
+	Data       []byte // Type-Data
+}
+
+func parseEAPPacket(b []byte) (*EAPPacket, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("EAP packet too short: %d", len(b))
+	}
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	if length < 4 || length > len(b) {
+		return nil, fmt.Errorf("invalid EAP length %d", length)
+	}
+	p := &EAPPacket{Code: b[0], Identifier: b[1]}
+	if p.Code == EAPCodeRequest || p.Code == EAPCodeResponse {
+		if length < 5 {
+			return nil, fmt.Errorf("EAP %d packet without Type", p.Code)
+		}
+		p.Type = b[4]
+		p.Data = b[5:length]
+	}
+	return p, nil
+}
+
+func (p *EAPPacket) Bytes() []byte {
+	length := 4
+	if p.Code == EAPCodeRequest || p.Code == EAPCodeResponse {
+		length += 1 + len(p.Data)
+	}
+	b := make([]byte, length)
+	b[0] = p.Code
+	b[1] = p.Identifier
+	binary.BigEndian.PutUint16(b[2:4], uint16(length))
+	if length > 4 {
+		b[4] = p.Type
+		copy(b[5:], p.Data)
+	}
+	return b
+}
+
+// EAPMethod 一种EAP认证方法，由认证服务器一侧实现
+type EAPMethod interface {
+	Type() byte
+	Name() string
+	// 开始认证，返回第一个EAP-Request的Type-Data，方法自己的状态保存在conv.MethodData中
+	Start(conv *EAPConversation) ([]byte, error)
+	// 处理对端的EAP-Response，next不为nil时继续下一轮；结束时success表示是否认证通过，
+	// 通过时可以在conv.MSK中给出导出的密钥
+	Process(conv *EAPConversation, data []byte) (next []byte, success bool, err error)
+}
+
+var eapMethods = make(map[byte]EAPMethod)
+
+// RegisterEAPMethod 注册EAP方法，同一Type后注册的覆盖先注册的
+func RegisterEAPMethod(m EAPMethod) {
+	eapMethods[m.Type()] = m
+}
+
+// 按配置的顺序返回可用的EAP方法
+func enabledEAPMethods() []EAPMethod {
+	var methods []EAPMethod
+	if len(config.EAP.Methods) == 0 {
+		for t := 0; t < 256; t++ {
+			if m, ok := eapMethods[byte(t)]; ok {
+				methods = append(methods, m)
+			}
+		}
+		return methods
+	}
+	for _, name := range config.EAP.Methods {
+		for _, m := range eapMethods {
+			if m.Name() == name {
+				methods = append(methods, m)
+			}
+		}
+	}
+	return methods
+}
+
+// 在可用的方法中选择，desired不为空时只选对端Nak中希望的方法
+func selectEAPMethod(desired []byte) EAPMethod {
+	for _, m := range enabledEAPMethods() {
+		if len(desired) == 0 {
+			return m
+		}
+		for _, t := range desired {
+			if t == m.Type() {
+				return m
+			}
+		}
+	}
+	return nil
+}
+
+// EAPConversation 一个Session-Id上进行中的EAP认证
+type EAPConversation struct {
+	SessionID  string
+	PeerHost   string
+	Identity   string
+	Method     EAPMethod
+	MethodData interface{} // 方法自己的状态
+	MSK        []byte      // 认证通过后方法导出的Master Session Key
+	identifier byte        // 最近一次发出的EAP-Request的Identifier
+	state      string      // 应答中State AVP的值，下一个DER须原样带回
+	expireAt   time.Time
+}
+
+// Password 取当前用户的密码，没有配置时返回空
+func (c *EAPConversation) Password() string {
+	return config.UserID2passWD[c.Identity]
+}
+
+type eapStore struct {
+	mu            sync.Mutex
+	conversations map[string]*EAPConversation
+}
+
+var eapConversations = &eapStore{conversations: make(map[string]*EAPConversation)}
+
+func (s *eapStore) get(sessionID string) *EAPConversation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for id, conv := range s.conversations {
+		if now.After(conv.expireAt) {
+			delete(s.conversations, id)
+		}
+	}
+	return s.conversations[sessionID]
+}
+
+func (s *eapStore) put(conv *EAPConversation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conv.expireAt = time.Now().Add(config.EAP.timeout())
+	s.conversations[conv.SessionID] = conv
+}
+
+func (s *eapStore) remove(sessionID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conversations, sessionID)
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// 处理DER，RFC 4072：EAP-Payload为空或是Identity时开始认证，之后每轮带State，
+// 未结束时回复1001(DIAMETER_MULTI_ROUND_AUTH)，结束时回复EAP-Success/Failure
+func handleDER(session *Session, msg *DiameterMsg) (*DiameterMsg, error) {
+	sessionID := msg.GetSessionID()
+	requestType := avpIntData(msg, AVP_AuthRequestType)
+	builder := newAnswerBuilder(msg).
+		AddAVP(NewAVPBuilder(AVP_AuthApplicationId, AVPFlag_Mandatory).SetIntData(msg.GetApplicationID()).Build()).
+		AddAVP(NewAVPBuilder(AVP_AuthRequestType, AVPFlag_Mandatory).SetIntData(requestType).Build())
+
+	var identifier byte
+	// 结束认证，conv为nil时(如State不匹配)不影响已有的认证过程
+	finish := func(resultCode uint32, conv *EAPConversation, err error) (*DiameterMsg, error) {
+		if conv != nil {
+			eapConversations.remove(sessionID)
+		}
+		code := byte(EAPCodeSuccess)
+		if resultCode != ResultCode_Success {
+			code = EAPCodeFailure
+			log.Printf("主机%v EAP认证不通过 Session-Id: %v: %v", session.PeerHost, sessionID, err)
+		}
+		if conv != nil && conv.Identity != "" {
+			builder.AddAVP(NewAVPBuilder(AVP_UserName, AVPFlag_Mandatory).SetStringData(conv.Identity).Build())
+		}
+		builder.AddAVP(NewAVPBuilder(AVP_EAPPayload, AVPFlag_Mandatory).SetData((&EAPPacket{Code: code, Identifier: identifier}).Bytes()).Build())
+		builder.AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(resultCode).Build())
+		if err != nil {
+			builder.AddAVP(NewAVPBuilder(AVP_ErrorMessage, 0).SetStringData(err.Error()).Build())
+		}
+		return builder.Build(), nil
+	}
+	// 继续下一轮，发出EAP-Request并用新的State标识本轮
+	challenge := func(conv *EAPConversation, eapType byte, data []byte) (*DiameterMsg, error) {
+		conv.identifier++
+		conv.state = hex.EncodeToString(randomBytes(16))
+		eapConversations.put(conv)
+		request := &EAPPacket{Code: EAPCodeRequest, Identifier: conv.identifier, Type: eapType, Data: data}
+		if conv.Identity != "" {
+			builder.AddAVP(NewAVPBuilder(AVP_UserName, AVPFlag_Mandatory).SetStringData(conv.Identity).Build())
+		}
+		return builder.
+			AddAVP(NewAVPBuilder(AVP_EAPPayload, AVPFlag_Mandatory).SetData(request.Bytes()).Build()).
+			AddAVP(NewAVPBuilder(AVP_State, AVPFlag_Mandatory).SetStringData(conv.state).Build()).
+			AddAVP(NewAVPBuilder(AVP_MultiRoundTimeOut, AVPFlag_Mandatory).SetIntData(uint32(config.EAP.timeout() / time.Second)).Build()).
+			AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(ResultCode_MultiRoundAuth).Build()).
+			Build(), nil
+	}
+	startMethod := func(conv *EAPConversation, method EAPMethod) (*DiameterMsg, error) {
+		conv.Method = method
+		data, err := method.Start(conv)
+		if err != nil {
+			return finish(ResultCode_AuthenticationRejected, conv, err)
+		}
+		log.Printf("主机%v 用户%v 开始EAP-%v认证", session.PeerHost, conv.Identity, method.Name())
+		return challenge(conv, method.Type(), data)
+	}
+
+	if session.State() != StateEstablished {
+		return builder.
+			AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(ResultCode_UnableToDeliver).Build()).
+			AddAVP(NewAVPBuilder(AVP_ErrorMessage, 0).SetStringData("session not established, send CER first").Build()).
+			Build(), nil
+	}
+	payloadAVP, _ := msg.FindAVPByCode(AVP_EAPPayload)
+	if payloadAVP == nil {
+		return builder.
+			AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(ResultCode_MissingAVP).Build()).
+			AddAVP(NewAVPBuilder(AVP_ErrorMessage, 0).SetStringData("missing EAP-Payload").Build()).
+			Build(), nil
+	}
+
+	conv := eapConversations.get(sessionID)
+	if conv != nil {
+		stateAVP, _ := msg.FindAVPByCode(AVP_State)
+		if stateAVP == nil || stateAVP.GetStringData() != conv.state || conv.PeerHost != session.PeerHost {
+			// 不是上一轮应答的延续，只有EAP-Response/Identity可以重新开始认证
+			conv = nil
+		}
+	}
+
+	// EAP-Payload为空时由服务器先发EAP-Request/Identity，RFC 4072 2.1
+	if payloadAVP.GetDataLength() == 0 {
+		return challenge(&EAPConversation{SessionID: sessionID, PeerHost: session.PeerHost}, EAPTypeIdentity, nil)
+	}
+	response, err := parseEAPPacket(payloadAVP.GetRawData())
+	if err != nil {
+		return finish(ResultCode_InvalidAVPValue, conv, err)
+	}
+	identifier = response.Identifier
+	if response.Code != EAPCodeResponse {
+		return finish(ResultCode_AuthenticationRejected, conv, fmt.Errorf("unexpected EAP code %d", response.Code))
+	}
+	if conv == nil {
+		// 新的认证只能以EAP-Response/Identity开始
+		if response.Type != EAPTypeIdentity {
+			return finish(ResultCode_AuthenticationRejected, nil, fmt.Errorf("no EAP conversation for Session-Id %v, expect EAP-Response/Identity", sessionID))
+		}
+		conv = &EAPConversation{SessionID: sessionID, PeerHost: session.PeerHost, identifier: response.Identifier}
+	} else if response.Identifier != conv.identifier {
+		return finish(ResultCode_AuthenticationRejected, conv, fmt.Errorf("EAP Identifier %d mismatch, expect %d", response.Identifier, conv.identifier))
+	}
+
+	switch {
+	case response.Type == EAPTypeIdentity:
+		conv.Identity = string(response.Data)
+		if conv.Identity == "" {
+			if userAVP, _ := msg.FindAVPByCode(AVP_UserName); userAVP != nil {
+				conv.Identity = userAVP.GetStringData()
+			}
+		}
+		method := selectEAPMethod(nil)
+		if method == nil {
+			return finish(ResultCode_AuthenticationRejected, conv, fmt.Errorf("no EAP method enabled"))
+		}
+		return startMethod(conv, method)
+	case response.Type == EAPTypeNak:
+		// 对端不接受当前方法，Nak中列出希望的方法
+		if conv.Method == nil {
+			return finish(ResultCode_AuthenticationRejected, conv, fmt.Errorf("unexpected EAP Nak"))
+		}
+		method := selectEAPMethod(response.Data)
+		if method == nil || method.Type() == conv.Method.Type() {
+			return finish(ResultCode_AuthenticationRejected, conv, fmt.Errorf("no acceptable EAP method in Nak %v", response.Data))
+		}
+		return startMethod(conv, method)
+	case conv.Method == nil || response.Type != conv.Method.Type():
+		return finish(ResultCode_AuthenticationRejected, conv, fmt.Errorf("unexpected EAP type %d", response.Type))
+	}
+
+	next, success, err := conv.Method.Process(conv, response.Data)
+	if err != nil {
+		return finish(ResultCode_AuthenticationRejected, conv, err)
+	}
+	if next != nil {
+		return challenge(conv, conv.Method.Type(), next)
+	}
+	if !success {
+		return finish(ResultCode_AuthenticationRejected, conv, fmt.Errorf("EAP-%v authentication failed", conv.Method.Name()))
+	}
+
+	log.Printf("主机%v 用户%v EAP-%v认证通过", session.PeerHost, conv.Identity, conv.Method.Name())
+	if len(conv.MSK) > 0 {
+		builder.AddAVP(NewAVPBuilder(AVP_EAPMasterSessionKey, AVPFlag_Mandatory).SetData(conv.MSK).Build())
+	}
+	builder.AddAVP(NewAVPBuilder(AVP_AccountingEAPAuthMethod, AVPFlag_Mandatory).SetInt64Data(uint64(conv.Method.Type())).Build())
+	var limits SessionLimits
+	if requestType != AuthRequestAuthenticateOnly {
+		addAuthorizationAVPs(builder, config.UserProfiles[conv.Identity])
+		limits = sessionLimits(msg.GetApplicationID(), conv.Identity)
+		addSessionLimitAVPs(builder, limits)
+	}
+	sessionState := requestAuthSessionState(msg)
+	builder.AddAVP(NewAVPBuilder(AVP_AuthSessionState, AVPFlag_Mandatory).SetIntData(sessionState).Build())
+	if sessionState == AuthSessionStateMaintained {
+		userSessions.open(UserSession{
+			SessionID:   sessionID,
+			UserName:    conv.Identity,
+			PeerHost:    session.PeerHost,
+			AppID:       msg.GetApplicationID(),
+			AuthMethod:  "eap-" + conv.Method.Name(),
+			RequestType: requestType,
+		}, limits)
+	}
+	return finish(ResultCode_Success, conv, nil)
+}
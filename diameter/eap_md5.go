@@ -0,0 +1,68 @@
+package diameter
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+)
+
+const eapMSKLen = 64
+
+// EAP-MD5-Challenge，RFC 3748 5.4，与CHAP相同：Response = MD5(Identifier + 密码 + Challenge)
+type eapMD5Method struct{}
+
+type eapMD5State struct {
+	challenge  []byte
+	identifier byte // 发出Challenge的EAP Identifier
+}
+
+func init() {
+	RegisterEAPMethod(eapMD5Method{})
+}
+
+func (eapMD5Method) Type() byte   { return EAPTypeMD5 }
+func (eapMD5Method) Name() string { return "md5" }
+
+// Type-Data = Value-Size + Value(Challenge) + Name
+func (eapMD5Method) Start(conv *EAPConversation) ([]byte, error) {
+	if conv.Password() == "" {
+		return nil, fmt.Errorf("user %v unknown", conv.Identity)
+	}
+	challenge := randomBytes(md5.Size)
+	// challenge发出时Identifier会加1
+	conv.MethodData = &eapMD5State{challenge: challenge, identifier: conv.identifier + 1}
+	data := append([]byte{byte(len(challenge))}, challenge...)
+	return append(data, config.OriginHost...), nil
+}
+
+func (eapMD5Method) Process(conv *EAPConversation, data []byte) ([]byte, bool, error) {
+	state, ok := conv.MethodData.(*eapMD5State)
+	if !ok {
+		return nil, false, fmt.Errorf("EAP-MD5 not started")
+	}
+	if len(data) < 1 || int(data[0]) != md5.Size || len(data) < 1+md5.Size {
+		return nil, false, fmt.Errorf("invalid EAP-MD5 response")
+	}
+	response := data[1 : 1+md5.Size]
+	if !verifyCHAP(conv.Password(), state.identifier, state.challenge, response) {
+		return nil, false, nil
+	}
+	conv.MSK = deriveEAPMD5MSK(conv.Password(), state.challenge, response)
+	return nil, true, nil
+}
+
+// EAP-MD5本身不生成密钥(RFC 3748 5.4)，这里用密码对Challenge和Response做HMAC-SHA256展开出64字节，
+// 只是为了测试EAP-Master-Session-Key的下发，不能用于实际加密
+func deriveEAPMD5MSK(password string, challenge, response []byte) []byte {
+	var msk bytes.Buffer
+	for counter := byte(1); msk.Len() < eapMSKLen; counter++ {
+		mac := hmac.New(sha256.New, []byte(password))
+		mac.Write(challenge)
+		mac.Write(response)
+		mac.Write([]byte{counter})
+		msk.Write(mac.Sum(nil))
+	}
+	return msk.Bytes()[:eapMSKLen]
+}
@@ -0,0 +1,74 @@
+package diameter
+
+import (
+	"crypto/md5"
+	"testing"
+)
+
+func TestEAPMD5(t *testing.T) {
+	saved := config.UserID2passWD
+	defer func() { config.UserID2passWD = saved }()
+	config.UserID2passWD = map[string]string{"alice": "secret"}
+
+	// Response = MD5(Identifier + 密码 + Challenge)，RFC 1994
+	chapResponse := func(identifier byte, password string, challenge []byte) []byte {
+		h := md5.New()
+		h.Write([]byte{identifier})
+		h.Write([]byte(password))
+		h.Write(challenge)
+		return h.Sum(nil)
+	}
+	tests := []struct {
+		name    string
+		respond func(identifier byte, challenge []byte) []byte
+		success bool
+		wantErr bool
+	}{
+		{"密码正确", func(id byte, c []byte) []byte { return append([]byte{md5.Size}, chapResponse(id, "secret", c)...) }, true, false},
+		{"密码错误", func(id byte, c []byte) []byte { return append([]byte{md5.Size}, chapResponse(id, "wrong", c)...) }, false, false},
+		{"Identifier不对", func(id byte, c []byte) []byte { return append([]byte{md5.Size}, chapResponse(id+1, "secret", c)...) }, false, false},
+		{"Value-Size不对", func(id byte, c []byte) []byte { return append([]byte{8}, chapResponse(id, "secret", c)[:8]...) }, false, true},
+		{"Response过短", func(id byte, c []byte) []byte { return []byte{md5.Size, 1, 2, 3} }, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conv := &EAPConversation{Identity: "alice", identifier: 4}
+			method := eapMD5Method{}
+			data, err := method.Start(conv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(data) < 1+md5.Size || data[0] != md5.Size {
+				t.Fatalf("invalid challenge %x", data)
+			}
+			challenge := data[1 : 1+md5.Size]
+
+			_, success, err := method.Process(conv, tt.respond(conv.identifier+1, challenge))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Process error = %v, want error %v", err, tt.wantErr)
+			}
+			if success != tt.success {
+				t.Errorf("success = %v, want %v", success, tt.success)
+			}
+			if tt.success && len(conv.MSK) != eapMSKLen {
+				t.Errorf("MSK length = %v, want %v", len(conv.MSK), eapMSKLen)
+			}
+			if !tt.success && conv.MSK != nil {
+				t.Error("MSK set on failure")
+			}
+		})
+	}
+}
+
+func TestEAPMD5UnknownUser(t *testing.T) {
+	saved := config.UserID2passWD
+	defer func() { config.UserID2passWD = saved }()
+	config.UserID2passWD = map[string]string{}
+
+	if _, err := (eapMD5Method{}).Start(&EAPConversation{Identity: "nobody"}); err == nil {
+		t.Error("Start for unknown user should fail")
+	}
+	if _, _, err := (eapMD5Method{}).Process(&EAPConversation{Identity: "nobody"}, nil); err == nil {
+		t.Error("Process before Start should fail")
+	}
+}
@@ -0,0 +1,842 @@
+package diameter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event-Trigger，3GPP TS 29.212 5.3.7，只列出常用的
+const (
+	EventTriggerSGSNChange          = 0
+	EventTriggerQoSChange           = 1
+	EventTriggerRATChange           = 2
+	EventTriggerTFTChange           = 3
+	EventTriggerPLMNChange          = 4
+	EventTriggerLossOfBearer        = 5
+	EventTriggerRecoveryOfBearer    = 6
+	EventTriggerIPCANChange         = 7
+	EventTriggerUserLocationChange  = 13
+	EventTriggerNoEventTriggers     = 14 // PCRF下发时表示取消订阅的全部事件
+	EventTriggerRevalidationTimeout = 17
+	EventTriggerDefaultQoSChange    = 20
+	EventTriggerResourceAllocation  = 22 // SUCCESSFUL_RESOURCE_ALLOCATION
+	EventTriggerTAIChange           = 26
+	EventTriggerECGIChange          = 27
+	EventTriggerUsageReport         = 33
+)
+
+var eventTriggerNames = map[uint32]string{
+	EventTriggerSGSNChange:          "SGSN_CHANGE",
+	EventTriggerQoSChange:           "QOS_CHANGE",
+	EventTriggerRATChange:           "RAT_CHANGE",
+	EventTriggerTFTChange:           "TFT_CHANGE",
+	EventTriggerPLMNChange:          "PLMN_CHANGE",
+	EventTriggerLossOfBearer:        "LOSS_OF_BEARER",
+	EventTriggerRecoveryOfBearer:    "RECOVERY_OF_BEARER",
+	EventTriggerIPCANChange:         "IP-CAN_CHANGE",
+	EventTriggerUserLocationChange:  "USER_LOCATION_CHANGE",
+	EventTriggerNoEventTriggers:     "NO_EVENT_TRIGGERS",
+	EventTriggerRevalidationTimeout: "REVALIDATION_TIMEOUT",
+	EventTriggerDefaultQoSChange:    "DEFAULT_EPS_BEARER_QOS_CHANGE",
+	EventTriggerResourceAllocation:  "SUCCESSFUL_RESOURCE_ALLOCATION",
+	EventTriggerTAIChange:           "TAI_CHANGE",
+	EventTriggerECGIChange:          "ECGI_CHANGE",
+	EventTriggerUsageReport:         "USAGE_REPORT",
+}
+
+// PCC-Rule-Status，TS 29.212 5.3.19
+const (
+	PCCRuleActive              = 0
+	PCCRuleInactive            = 1
+	PCCRuleTemporarilyInactive = 2
+)
+
+const (
+	flowStatusEnabled   = 2 // Flow-Status ENABLED
+	defaultGxPolicyDir  = "policies"
+	defaultGxPolicyFile = "default"
+)
+
+// GxConfig Gx PCRF配置
+type GxConfig struct {
+	// 用户策略文件目录，文件名为<Subscription-Id-Data或User-Name>.json，都没有时用default.json
+	PolicyDir string `json:"policy_dir"`
+}
+
+func (c *GxConfig) policyDir() string {
+	if c.PolicyDir == "" {
+		return defaultGxPolicyDir
+	}
+	return c.PolicyDir
+}
+
+// GxQoS QoS参数，带宽单位bps，为0的不下发；APN级只用QCI、ARP和APN-AMBR，规则级不用APN-AMBR
+type GxQoS struct {
+	QCI         uint32 `json:"qci,omitempty"`
+	ARPPriority uint32 `json:"arp_priority,omitempty"`
+	MBRUL       uint32 `json:"mbr_ul,omitempty"`
+	MBRDL       uint32 `json:"mbr_dl,omitempty"`
+	GBRUL       uint32 `json:"gbr_ul,omitempty"`
+	GBRDL       uint32 `json:"gbr_dl,omitempty"`
+	APNAMBRUL   uint32 `json:"apn_ambr_ul,omitempty"`
+	APNAMBRDL   uint32 `json:"apn_ambr_dl,omitempty"`
+}
+
+// GxFlow 规则的一个业务流
+type GxFlow struct {
+	Description string `json:"description"`         // IPFilterRule，如permit out ip from 10.0.0.1 80 to assigned
+	Direction   uint32 `json:"direction,omitempty"` // Flow-Direction：1下行，2上行，3双向，0不带
+}
+
+// GxRule 动态PCC规则，下发为Charging-Rule-Definition
+type GxRule struct {
+	Name        string   `json:"name"`
+	Precedence  uint32   `json:"precedence,omitempty"`
+	RatingGroup uint32   `json:"rating_group,omitempty"`
+	ServiceID   uint32   `json:"service_id,omitempty"`
+	Flows       []GxFlow `json:"flows,omitempty"`
+	QoS         *GxQoS   `json:"qos,omitempty"`
+}
+
+// GxPolicyChange 收到某个Event-Trigger后在基础策略上做的变化
+type GxPolicyChange struct {
+	QoS               *GxQoS   `json:"qos,omitempty"`                // 替换APN级QoS
+	Install           []GxRule `json:"install,omitempty"`            // 增加动态规则，同名的替换
+	InstallPredefined []string `json:"install_predefined,omitempty"` // 增加预定义规则
+	Remove            []string `json:"remove,omitempty"`             // 去掉动态或预定义规则
+}
+
+// GxPolicy 用户的策略文件
+type GxPolicy struct {
+	QoS             GxQoS                     `json:"qos"`              // APN级QoS，下发为Default-EPS-Bearer-QoS和APN-AMBR
+	Rules           []GxRule                  `json:"rules"`            // 动态规则
+	PredefinedRules []string                  `json:"predefined_rules"` // PCEF上预定义的规则，只下发Charging-Rule-Name
+	EventTriggers   []uint32                  `json:"event_triggers"`   // 向PCEF订阅的事件
+	OnEvent         map[string]GxPolicyChange `json:"on_event"`         // 按Event-Trigger值索引，PCEF上报后叠加的变化
+}
+
+// 用户没有策略文件，也没有default.json
+var errGxNoPolicy = errors.New("no policy")
+
+// 按用户标识依次查找策略文件，都没有时用default.json，返回策略和命中的用户标识
+func loadGxPolicy(ids []string) (*GxPolicy, string, error) {
+	dir := config.Gx.policyDir()
+	candidates := append(append([]string{}, ids...), defaultGxPolicyFile)
+	for _, id := range candidates {
+		// 用户标识作为文件名，不允许带路径
+		if id == "" || filepath.Base(id) != id {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, id+".json"))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		var policy GxPolicy
+		if err := json.Unmarshal(data, &policy); err != nil {
+			return nil, "", fmt.Errorf("policy %v.json: %w", id, err)
+		}
+		return &policy, id, nil
+	}
+	return nil, "", errGxNoPolicy
+}
+
+// gxRuleSet 会话上生效的策略
+type gxRuleSet struct {
+	qos        GxQoS
+	rules      map[string]GxRule
+	predefined map[string]bool
+	triggers   []uint32
+}
+
+// 按会话已上报的事件依次叠加on_event中的变化，去掉PCEF报告不能生效的规则
+func (p *GxPolicy) evaluate(events []uint32, failed map[string]bool) gxRuleSet {
+	set := gxRuleSet{
+		qos:        p.QoS,
+		rules:      make(map[string]GxRule, len(p.Rules)),
+		predefined: make(map[string]bool, len(p.PredefinedRules)),
+		triggers:   p.EventTriggers,
+	}
+	for _, rule := range p.Rules {
+		set.rules[rule.Name] = rule
+	}
+	for _, name := range p.PredefinedRules {
+		set.predefined[name] = true
+	}
+	for _, event := range events {
+		change, ok := p.OnEvent[strconv.FormatUint(uint64(event), 10)]
+		if !ok {
+			continue
+		}
+		if change.QoS != nil {
+			set.qos = *change.QoS
+		}
+		for _, name := range change.Remove {
+			delete(set.rules, name)
+			delete(set.predefined, name)
+		}
+		for _, rule := range change.Install {
+			set.rules[rule.Name] = rule
+		}
+		for _, name := range change.InstallPredefined {
+			set.predefined[name] = true
+		}
+	}
+	for name := range failed {
+		delete(set.rules, name)
+		delete(set.predefined, name)
+	}
+	return set
+}
+
+// gxChange 需要下发给PCEF的变化
+type gxChange struct {
+	qos               *GxQoS
+	install           []GxRule
+	installPredefined []string
+	remove            []string
+	triggers          []uint32
+	triggersChanged   bool
+}
+
+// 比较已生效的策略和新策略，新增或内容变化的规则重新安装，不再有的规则删除
+func diffGxRuleSet(old, new gxRuleSet) gxChange {
+	var change gxChange
+	if old.qos != new.qos {
+		qos := new.qos
+		change.qos = &qos
+	}
+	for name, rule := range new.rules {
+		if oldRule, ok := old.rules[name]; !ok || !reflect.DeepEqual(oldRule, rule) {
+			change.install = append(change.install, rule)
+		}
+	}
+	for name := range new.predefined {
+		if !old.predefined[name] {
+			change.installPredefined = append(change.installPredefined, name)
+		}
+	}
+	for name := range old.rules {
+		if _, ok := new.rules[name]; !ok {
+			change.remove = append(change.remove, name)
+		}
+	}
+	for name := range old.predefined {
+		if !new.predefined[name] {
+			change.remove = append(change.remove, name)
+		}
+	}
+	sort.Slice(change.install, func(i, j int) bool { return change.install[i].Name < change.install[j].Name })
+	sort.Strings(change.installPredefined)
+	sort.Strings(change.remove)
+	if !reflect.DeepEqual(old.triggers, new.triggers) && (len(old.triggers) > 0 || len(new.triggers) > 0) {
+		change.triggers = new.triggers
+		change.triggersChanged = true
+	}
+	return change
+}
+
+func (c gxChange) empty() bool {
+	return c.qos == nil && len(c.install) == 0 && len(c.installPredefined) == 0 && len(c.remove) == 0 && !c.triggersChanged
+}
+
+// 把变化应用到会话已生效的策略上
+func (s *gxRuleSet) apply(c gxChange) {
+	if s.rules == nil {
+		s.rules = make(map[string]GxRule)
+		s.predefined = make(map[string]bool)
+	}
+	if c.qos != nil {
+		s.qos = *c.qos
+	}
+	for _, name := range c.remove {
+		delete(s.rules, name)
+		delete(s.predefined, name)
+	}
+	for _, rule := range c.install {
+		s.rules[rule.Name] = rule
+	}
+	for _, name := range c.installPredefined {
+		s.predefined[name] = true
+	}
+	if c.triggersChanged {
+		s.triggers = c.triggers
+	}
+}
+
+// 把变化写入CCA/RAR：Event-Trigger、Charging-Rule-Remove、Charging-Rule-Install、APN级QoS
+func (c gxChange) addAVPs(builder *DiameterMsgBuilder) {
+	if c.triggersChanged {
+		triggers := c.triggers
+		if len(triggers) == 0 {
+			triggers = []uint32{EventTriggerNoEventTriggers}
+		}
+		for _, trigger := range triggers {
+			builder.AddAVP(New3GPPAVPBuilder(AVP_EventTrigger, AVPFlag_Mandatory).SetIntData(trigger).Build())
+		}
+	}
+	if len(c.remove) > 0 {
+		names := make([]*AVPMsg, 0, len(c.remove))
+		for _, name := range c.remove {
+			names = append(names, New3GPPAVPBuilder(AVP_ChargingRuleName, AVPFlag_Mandatory).SetStringData(name).Build())
+		}
+		builder.AddAVP(New3GPPAVPBuilder(AVP_ChargingRuleRemove, AVPFlag_Mandatory).SetGroupedData(names...).Build())
+	}
+	if len(c.install) > 0 || len(c.installPredefined) > 0 {
+		avps := make([]*AVPMsg, 0, len(c.install)+len(c.installPredefined))
+		for _, rule := range c.install {
+			avps = append(avps, chargingRuleDefinitionAVP(rule))
+		}
+		for _, name := range c.installPredefined {
+			avps = append(avps, New3GPPAVPBuilder(AVP_ChargingRuleName, AVPFlag_Mandatory).SetStringData(name).Build())
+		}
+		builder.AddAVP(New3GPPAVPBuilder(AVP_ChargingRuleInstall, AVPFlag_Mandatory).SetGroupedData(avps...).Build())
+	}
+	if c.qos != nil {
+		if c.qos.QCI > 0 {
+			arp := c.qos.ARPPriority
+			if arp == 0 {
+				arp = defaultS6aARP
+			}
+			builder.AddAVP(New3GPPAVPBuilder(AVP_DefaultEPSBearerQoS, AVPFlag_Mandatory).SetGroupedData(
+				New3GPPAVPBuilder(AVP_QoSClassIdentifier, AVPFlag_Mandatory).SetIntData(c.qos.QCI).Build(),
+				allocationRetentionPriorityAVP(arp),
+			).Build())
+		}
+		if c.qos.APNAMBRUL > 0 || c.qos.APNAMBRDL > 0 {
+			builder.AddAVP(New3GPPAVPBuilder(AVP_QoSInformation, AVPFlag_Mandatory).SetGroupedData(
+				New3GPPAVPBuilder(AVP_APNAggregateMaxBitrateUL, AVPFlag_Mandatory).SetIntData(c.qos.APNAMBRUL).Build(),
+				New3GPPAVPBuilder(AVP_APNAggregateMaxBitrateDL, AVPFlag_Mandatory).SetIntData(c.qos.APNAMBRDL).Build(),
+			).Build())
+		}
+	}
+}
+
+// 规则级QoS-Information
+func ruleQoSInformationAVP(qos GxQoS) *AVPMsg {
+	avps := make([]*AVPMsg, 0, 6)
+	if qos.QCI > 0 {
+		avps = append(avps, New3GPPAVPBuilder(AVP_QoSClassIdentifier, AVPFlag_Mandatory).SetIntData(qos.QCI).Build())
+	}
+	for _, item := range []struct {
+		code  uint32
+		value uint32
+	}{
+		{AVP_MaxRequestedBandwidthUL, qos.MBRUL},
+		{AVP_MaxRequestedBandwidthDL, qos.MBRDL},
+		{AVP_GuaranteedBitrateUL, qos.GBRUL},
+		{AVP_GuaranteedBitrateDL, qos.GBRDL},
+	} {
+		if item.value > 0 {
+			avps = append(avps, New3GPPAVPBuilder(item.code, AVPFlag_Mandatory).SetIntData(item.value).Build())
+		}
+	}
+	if qos.ARPPriority > 0 {
+		avps = append(avps, allocationRetentionPriorityAVP(qos.ARPPriority))
+	}
+	return New3GPPAVPBuilder(AVP_QoSInformation, AVPFlag_Mandatory).SetGroupedData(avps...).Build()
+}
+
+func chargingRuleDefinitionAVP(rule GxRule) *AVPMsg {
+	avps := []*AVPMsg{New3GPPAVPBuilder(AVP_ChargingRuleName, AVPFlag_Mandatory).SetStringData(rule.Name).Build()}
+	if rule.ServiceID > 0 {
+		avps = append(avps, NewAVPBuilder(AVP_ServiceIdentifier, AVPFlag_Mandatory).SetIntData(rule.ServiceID).Build())
+	}
+	if rule.RatingGroup > 0 {
+		avps = append(avps, NewAVPBuilder(AVP_RatingGroup, AVPFlag_Mandatory).SetIntData(rule.RatingGroup).Build())
+	}
+	for _, flow := range rule.Flows {
+		flowAVPs := []*AVPMsg{New3GPPAVPBuilder(AVP_FlowDescription, AVPFlag_Mandatory).SetStringData(flow.Description).Build()}
+		if flow.Direction > 0 {
+			flowAVPs = append(flowAVPs, New3GPPAVPBuilder(AVP_FlowDirection, 0).SetIntData(flow.Direction).Build())
+		}
+		avps = append(avps, New3GPPAVPBuilder(AVP_FlowInformation, AVPFlag_Mandatory).SetGroupedData(flowAVPs...).Build())
+	}
+	if len(rule.Flows) > 0 {
+		avps = append(avps, New3GPPAVPBuilder(AVP_FlowStatus, AVPFlag_Mandatory).SetIntData(flowStatusEnabled).Build())
+	}
+	if rule.QoS != nil {
+		avps = append(avps, ruleQoSInformationAVP(*rule.QoS))
+	}
+	if rule.Precedence > 0 {
+		avps = append(avps, New3GPPAVPBuilder(AVP_Precedence, AVPFlag_Mandatory).SetIntData(rule.Precedence).Build())
+	}
+	return New3GPPAVPBuilder(AVP_ChargingRuleDefinition, AVPFlag_Mandatory).SetGroupedData(avps...).Build()
+}
+
+// gxSession 一个IP-CAN会话
+type gxSession struct {
+	subscriber        string
+	peerHost          string
+	framedIP          string // CCR-I中的UE地址，Rx会话按此绑定
+	lastRequestNumber uint32
+	events            []uint32          // 已上报且策略中有on_event的Event-Trigger，按上报顺序
+	failed            map[string]bool   // PCEF报告不能生效的规则，不再下发
+	afRules           map[string]GxRule // Rx会话按媒体描述生成的规则，与策略文件的规则一起下发
+	applied           gxRuleSet
+	pushing           bool // 有未完成的RAR
+	dirty             bool // RAR未完成期间规则有变化，RAR的变化是之前算的，应答后需要再下发一次
+	createdAt         time.Time
+	updatedAt         time.Time
+}
+
+// GxSessionStatus Gx会话的快照，供管理接口查看
+type GxSessionStatus struct {
+	SessionID       string    `json:"session_id"`
+	Subscriber      string    `json:"subscriber"`
+	PeerHost        string    `json:"peer_host"`
+	FramedIP        string    `json:"framed_ip,omitempty"`
+	RequestNumber   uint32    `json:"request_number"`
+	Events          []uint32  `json:"events,omitempty"`
+	EventTriggers   []uint32  `json:"event_triggers,omitempty"`
+	QoS             GxQoS     `json:"qos"`
+	Rules           []string  `json:"rules"`
+	PredefinedRules []string  `json:"predefined_rules"`
+	FailedRules     []string  `json:"failed_rules,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+type gxSessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*gxSession
+}
+
+var gxSessions = &gxSessionStore{sessions: make(map[string]*gxSession)}
+
+func sortedNames(m map[string]bool) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// 已生效的动态规则名
+func (s gxRuleSet) ruleNames() []string {
+	names := make([]string, 0, len(s.rules))
+	for name := range s.rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GxSessions 返回所有Gx会话的快照
+func GxSessions() []GxSessionStatus {
+	gxSessions.mu.Lock()
+	defer gxSessions.mu.Unlock()
+	statuses := make([]GxSessionStatus, 0, len(gxSessions.sessions))
+	for sessionID, s := range gxSessions.sessions {
+		statuses = append(statuses, GxSessionStatus{
+			SessionID:       sessionID,
+			Subscriber:      s.subscriber,
+			PeerHost:        s.peerHost,
+			FramedIP:        s.framedIP,
+			RequestNumber:   s.lastRequestNumber,
+			Events:          s.events,
+			EventTriggers:   s.applied.triggers,
+			QoS:             s.applied.qos,
+			Rules:           s.applied.ruleNames(),
+			PredefinedRules: sortedNames(s.applied.predefined),
+			FailedRules:     sortedNames(s.failed),
+			CreatedAt:       s.createdAt,
+			UpdatedAt:       s.updatedAt,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].SessionID < statuses[j].SessionID })
+	return statuses
+}
+
+// 删除对端的所有Gx会话，返回删除的个数
+func (s *gxSessionStore) removePeer(peerHost string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for sessionID, session := range s.sessions {
+		if session.peerHost == peerHost {
+			delete(s.sessions, sessionID)
+			count++
+		}
+	}
+	return count
+}
+
+// 会话应生效的策略：策略文件的规则加上Rx会话的规则，去掉PCEF报告不能生效的
+func (s *gxSession) desired(policy *GxPolicy) gxRuleSet {
+	set := policy.evaluate(s.events, s.failed)
+	for name, rule := range s.afRules {
+		if !s.failed[name] {
+			set.rules[name] = rule
+		}
+	}
+	return set
+}
+
+// 按UE地址查找Gx会话，没有地址时按用户标识，用于Rx会话绑定，找不到返回空
+func (s *gxSessionStore) bind(framedIP string, subscribers []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sessionID, session := range s.sessions {
+		if framedIP != "" && session.framedIP == framedIP {
+			return sessionID
+		}
+	}
+	if framedIP != "" {
+		return ""
+	}
+	for sessionID, session := range s.sessions {
+		for _, subscriber := range subscribers {
+			if session.subscriber == subscriber {
+				return sessionID
+			}
+		}
+	}
+	return ""
+}
+
+// 替换Gx会话上某个Rx会话的规则：去掉prefix开头的旧规则，加入rules，之后由RAR下发
+func (s *gxSessionStore) setAFRules(sessionID, prefix string, rules []GxRule) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	gs, ok := s.sessions[sessionID]
+	if !ok {
+		return false
+	}
+	for name := range gs.afRules {
+		if strings.HasPrefix(name, prefix) {
+			delete(gs.afRules, name)
+		}
+	}
+	if gs.afRules == nil {
+		gs.afRules = make(map[string]GxRule)
+	}
+	for _, rule := range rules {
+		gs.afRules[rule.Name] = rule
+		// AF重新下发的规则不再按之前的失败报告屏蔽
+		delete(gs.failed, rule.Name)
+	}
+	if gs.pushing {
+		gs.dirty = true
+	}
+	return true
+}
+
+// 请求中的用户标识，依次为各Subscription-Id-Data和User-Name
+func gxSubscriberIDs(msg *DiameterMsg) []string {
+	var ids []string
+	for _, avp := range msg.FindAVPsByCode(AVP_SubscriptionId) {
+		if dataAVP := avp.FindGroupedAVP(AVP_SubscriptionIdData); dataAVP != nil {
+			ids = append(ids, dataAVP.GetStringData())
+		}
+	}
+	if avp, _ := msg.FindAVPByCode(AVP_UserName); avp != nil {
+		ids = append(ids, avp.GetStringData())
+	}
+	return ids
+}
+
+// gxRuleReport PCEF在Charging-Rule-Report中报告的规则状态
+type gxRuleReport struct {
+	names       []string
+	status      uint32
+	failureCode uint32
+}
+
+// 处理CCR中的Charging-Rule-Report，不能生效的规则从会话中去掉，之后不再下发
+func (s *gxSession) handleRuleReports(msg *DiameterMsg) []gxRuleReport {
+	var reports []gxRuleReport
+	for _, report := range msg.FindAVPsByCode(AVP_ChargingRuleReport) {
+		subAVPs, err := report.GetGroupedAVPs()
+		if err != nil {
+			continue
+		}
+		var names []string
+		status, failureCode := uint32(PCCRuleActive), uint32(0)
+		for _, sub := range subAVPs {
+			switch sub.GetCode() {
+			case AVP_ChargingRuleName:
+				names = append(names, sub.GetStringData())
+			case AVP_PCCRuleStatus:
+				status = sub.GetIntData()
+			case AVP_RuleFailureCode:
+				failureCode = sub.GetIntData()
+			}
+		}
+		log.Printf("用户%v 规则%v 状态: %v Rule-Failure-Code: %v", s.subscriber, names, status, failureCode)
+		reports = append(reports, gxRuleReport{names: names, status: status, failureCode: failureCode})
+		if status != PCCRuleInactive {
+			continue
+		}
+		if s.failed == nil {
+			s.failed = make(map[string]bool)
+		}
+		for _, name := range names {
+			s.failed[name] = true
+			delete(s.applied.rules, name)
+			delete(s.applied.predefined, name)
+		}
+	}
+	return reports
+}
+
+// CCR中上报的Event-Trigger
+func (s *gxSession) reportedEvents(msg *DiameterMsg) []uint32 {
+	var events []uint32
+	for _, avp := range msg.FindAVPsByCode(AVP_EventTrigger) {
+		event := avp.GetIntData()
+		log.Printf("用户%v 上报事件 %v(%v)", s.subscriber, eventTriggerNames[event], event)
+		events = append(events, event)
+	}
+	return events
+}
+
+// 记录上报的Event-Trigger，策略中有对应on_event的才会改变策略
+func (s *gxSession) recordEvents(events []uint32, policy *GxPolicy) {
+	for _, event := range events {
+		if _, ok := policy.OnEvent[strconv.FormatUint(uint64(event), 10)]; !ok {
+			continue
+		}
+		seen := false
+		for _, e := range s.events {
+			if e == event {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			s.events = append(s.events, event)
+		}
+	}
+}
+
+// 处理Gx的CCR：CCR-I按用户策略文件下发规则和QoS，CCR-U处理事件和规则报告并下发策略的变化，CCR-T结束会话
+func handleGxCCR(session *Session, msg *DiameterMsg) (*DiameterMsg, error) {
+	requestType := avpIntData(msg, AVP_CCRequestType)
+	requestNumber := avpIntData(msg, AVP_CCRequestNumber)
+	sessionID := msg.GetSessionID()
+	ids := gxSubscriberIDs(msg)
+	log.Printf("主机%v Gx请求 Session-Id: %v 类型: %v 序号: %v 用户: %v", session.PeerHost, sessionID, ccRequestTypeNames[requestType], requestNumber, ids)
+
+	builder := newAnswerBuilder(msg).
+		AddAVP(NewAVPBuilder(AVP_AuthApplicationId, AVPFlag_Mandatory).SetIntData(AppID_Gx).Build()).
+		AddAVP(NewAVPBuilder(AVP_CCRequestType, AVPFlag_Mandatory).SetIntData(requestType).Build()).
+		AddAVP(NewAVPBuilder(AVP_CCRequestNumber, AVPFlag_Mandatory).SetIntData(requestNumber).Build())
+	reject := func(resultCode uint32, err error) (*DiameterMsg, error) {
+		log.Printf("主机%v Gx请求不通过: %v", session.PeerHost, err)
+		return builder.
+			AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(resultCode).Build()).
+			AddAVP(NewAVPBuilder(AVP_ErrorMessage, 0).SetStringData(err.Error()).Build()).
+			Build(), nil
+	}
+
+	if session.State() != StateEstablished {
+		return reject(ResultCode_UnableToDeliver, fmt.Errorf("session not established, send CER first"))
+	}
+
+	gxSessions.mu.Lock()
+	defer gxSessions.mu.Unlock()
+
+	now := time.Now()
+	gs, ok := gxSessions.sessions[sessionID]
+	switch requestType {
+	case CCRequestInitial:
+		if ok {
+			return reject(ResultCode_InvalidAVPValue, fmt.Errorf("Gx session %v already exists", sessionID))
+		}
+		policy, subscriber, err := loadGxPolicy(ids)
+		if errors.Is(err, errGxNoPolicy) {
+			return reject(ResultCode_UserUnknown, fmt.Errorf("no policy for subscriber %v", ids))
+		}
+		if err != nil {
+			return reject(ResultCode_UnableToComply, err)
+		}
+		// 用default.json时以第一个用户标识记录会话
+		if subscriber == defaultGxPolicyFile && len(ids) > 0 {
+			subscriber = ids[0]
+		}
+		gs = &gxSession{subscriber: subscriber, peerHost: session.PeerHost, lastRequestNumber: requestNumber, createdAt: now, updatedAt: now}
+		// Gx中Framed-IP-Address是OctetString，4字节地址
+		if avp, _ := msg.FindAVPByCode(AVP_FramedIPAddress); avp != nil && avp.GetDataLength() == net.IPv4len {
+			gs.framedIP = net.IP(avp.GetRawData()).String()
+		}
+		change := diffGxRuleSet(gxRuleSet{}, policy.evaluate(nil, nil))
+		change.addAVPs(builder)
+		gs.applied.apply(change)
+		gxSessions.sessions[sessionID] = gs
+		log.Printf("用户%v Gx会话建立，安装规则 %v", subscriber, append(gs.applied.ruleNames(), sortedNames(gs.applied.predefined)...))
+	case CCRequestUpdate, CCRequestTermination:
+		if !ok {
+			return reject(ResultCode_UnknownSessionID, fmt.Errorf("Gx session %v not found", sessionID))
+		}
+		if requestNumber <= gs.lastRequestNumber {
+			return reject(ResultCode_InvalidAVPValue, fmt.Errorf("CC-Request-Number %d out of order, last %d", requestNumber, gs.lastRequestNumber))
+		}
+		gs.lastRequestNumber = requestNumber
+		gs.updatedAt = now
+		reports := gs.handleRuleReports(msg)
+		events := gs.reportedEvents(msg)
+		if requestType == CCRequestTermination {
+			delete(gxSessions.sessions, sessionID)
+			log.Printf("用户%v Gx会话结束", gs.subscriber)
+			go rxOnGxTerminated(sessionID)
+			break
+		}
+		if len(reports) > 0 || len(events) > 0 {
+			go rxOnGxReport(sessionID, events, reports)
+		}
+		// 每次CCR-U都重新读取策略文件，文件的修改随之下发
+		policy, _, err := loadGxPolicy([]string{gs.subscriber})
+		if err != nil {
+			log.Printf("用户%v 读取策略失败，保持当前规则: %v", gs.subscriber, err)
+			break
+		}
+		gs.recordEvents(events, policy)
+		// RAR未完成时变化在RAA后再推送一次，这里不再重复
+		if gs.pushing {
+			gs.dirty = true
+			break
+		}
+		change := diffGxRuleSet(gs.applied, gs.desired(policy))
+		change.addAVPs(builder)
+		gs.applied.apply(change)
+		if !change.empty() {
+			log.Printf("用户%v 策略变化，安装 %v 个规则，删除 %v", gs.subscriber, len(change.install)+len(change.installPredefined), change.remove)
+		}
+	default:
+		return reject(ResultCode_InvalidAVPValue, fmt.Errorf("invalid CC-Request-Type %d", requestType))
+	}
+	builder.AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(ResultCode_Success).Build())
+	return builder.Build(), nil
+}
+
+// 重新读取会话用户的策略，计算要下发的变化并标记RAR未完成
+func (s *gxSessionStore) beginPush(sessionID string) (*gxSession, gxChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	gs, ok := s.sessions[sessionID]
+	if !ok {
+		return nil, gxChange{}, fmt.Errorf("Gx %w: %v", errSessionNotFound, sessionID)
+	}
+	if gs.pushing {
+		return nil, gxChange{}, fmt.Errorf("Gx %w: %v RAR", errSessionPending, sessionID)
+	}
+	policy, _, err := loadGxPolicy([]string{gs.subscriber})
+	if err != nil {
+		return nil, gxChange{}, err
+	}
+	gs.pushing = true
+	return gs, diffGxRuleSet(gs.applied, gs.desired(policy)), nil
+}
+
+// RAA成功时把变化应用到会话，5002时删除会话；RAR未完成期间规则有变化时返回true，需要再推送一次
+func (s *gxSessionStore) endPush(sessionID string, change gxChange, resultCode uint32) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	gs, ok := s.sessions[sessionID]
+	if !ok {
+		return false
+	}
+	gs.pushing = false
+	switch resultCode {
+	case ResultCode_Success:
+		gs.applied.apply(change)
+		gs.updatedAt = time.Now()
+	case ResultCode_UnknownSessionID:
+		delete(s.sessions, sessionID)
+		return false
+	}
+	again := gs.dirty
+	gs.dirty = false
+	return again
+}
+
+// 结束RAR，期间规则有变化时在后台再推送一次
+func finishGxPush(sessionID string, change gxChange, resultCode uint32) {
+	if gxSessions.endPush(sessionID, change, resultCode) {
+		go func() {
+			if _, err := PushGxPolicy(sessionID); err != nil {
+				log.Printf("Gx会话%v 重新下发策略失败: %v", sessionID, err)
+			}
+		}()
+	}
+}
+
+// PushGxPolicy 重新读取会话用户的策略文件，向PCEF发出RAR下发规则和QoS的变化，返回RAA的Result-Code，
+// 策略没有变化时不发RAR，返回0
+func PushGxPolicy(sessionID string) (uint32, error) {
+	gs, change, err := gxSessions.beginPush(sessionID)
+	if err != nil {
+		return 0, err
+	}
+	if change.empty() {
+		finishGxPush(sessionID, change, 0)
+		log.Printf("用户%v 策略没有变化，不发RAR", gs.subscriber)
+		return 0, nil
+	}
+	peer := peerTable.get(gs.peerHost)
+	if peer == nil {
+		finishGxPush(sessionID, change, 0)
+		return 0, fmt.Errorf("peer %v of session %v not connected", gs.peerHost, sessionID)
+	}
+	builder := newSessionRequest(Cmd_RA, UserSession{SessionID: sessionID, AppID: AppID_Gx}, peer).
+		AddAVP(NewAVPBuilder(AVP_ReAuthRequestType, AVPFlag_Mandatory).SetIntData(ReAuthAuthorizeOnly).Build())
+	change.addAVPs(builder)
+	req := builder.Build()
+	log.Printf("主机%v 发出Gx RAR Session-Id: %v End-to-End: %v 安装 %v 个规则，删除 %v", peer.PeerHost, sessionID, req.GetEndToEndID(), len(change.install)+len(change.installPredefined), change.remove)
+	rsp, err := RouteRequest(req)
+	if err != nil {
+		finishGxPush(sessionID, change, 0)
+		return 0, err
+	}
+	resultCode := answerResultCode(rsp)
+	log.Printf("主机%v Gx RAA Session-Id: %v Result-Code: %v", peer.PeerHost, sessionID, resultCode)
+	finishGxPush(sessionID, change, resultCode)
+	return resultCode, nil
+}
+
+// PushGxSubscriberPolicy 对用户的每个Gx会话发出RAR，返回各会话的应答结果(策略没有变化的会话不在其中)，有会话失败时同时返回错误
+func PushGxSubscriberPolicy(subscriber string) (map[string]uint32, error) {
+	gxSessions.mu.Lock()
+	var sessionIDs []string
+	for sessionID, gs := range gxSessions.sessions {
+		if gs.subscriber == subscriber {
+			sessionIDs = append(sessionIDs, sessionID)
+		}
+	}
+	gxSessions.mu.Unlock()
+	if len(sessionIDs) == 0 {
+		return nil, fmt.Errorf("%w: subscriber %v has no Gx session", errSessionNotFound, subscriber)
+	}
+	sort.Strings(sessionIDs)
+	results := make(map[string]uint32, len(sessionIDs))
+	var firstErr error
+	for _, sessionID := range sessionIDs {
+		resultCode, err := PushGxPolicy(sessionID)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%v: %w", sessionID, err)
+			}
+			continue
+		}
+		if resultCode != 0 {
+			results[sessionID] = resultCode
+		}
+	}
+	return results, firstErr
+}
@@ -0,0 +1,188 @@
+package diameter
+
+import (
+	"reflect"
+	"testing"
+)
+
+func newTestGxRuleSet(qci uint32, rules []GxRule, predefined []string, triggers []uint32) gxRuleSet {
+	set := gxRuleSet{
+		qos:        GxQoS{QCI: qci},
+		rules:      make(map[string]GxRule),
+		predefined: make(map[string]bool),
+		triggers:   triggers,
+	}
+	for _, rule := range rules {
+		set.rules[rule.Name] = rule
+	}
+	for _, name := range predefined {
+		set.predefined[name] = true
+	}
+	return set
+}
+
+func TestGxPolicyEvaluate(t *testing.T) {
+	policy := &GxPolicy{
+		QoS:             GxQoS{QCI: 9},
+		Rules:           []GxRule{{Name: "web", Precedence: 100}, {Name: "video", Precedence: 50}},
+		PredefinedRules: []string{"dns"},
+		EventTriggers:   []uint32{EventTriggerRATChange, EventTriggerUsageReport},
+		OnEvent: map[string]GxPolicyChange{
+			"2":  {QoS: &GxQoS{QCI: 8}, Remove: []string{"video"}, InstallPredefined: []string{"rat"}},
+			"33": {Install: []GxRule{{Name: "web", Precedence: 200}, {Name: "throttle"}}, Remove: []string{"dns"}},
+		},
+	}
+	tests := []struct {
+		name       string
+		events     []uint32
+		failed     map[string]bool
+		qci        uint32
+		rules      map[string]uint32 // 规则名到Precedence
+		predefined []string
+	}{
+		{"基础策略", nil, nil, 9, map[string]uint32{"web": 100, "video": 50}, []string{"dns"}},
+		{"没有on_event的事件不变", []uint32{EventTriggerQoSChange}, nil, 9, map[string]uint32{"web": 100, "video": 50}, []string{"dns"}},
+		{"替换QoS并增删规则", []uint32{EventTriggerRATChange}, nil, 8, map[string]uint32{"web": 100}, []string{"dns", "rat"}},
+		{"按上报顺序叠加，同名规则替换", []uint32{EventTriggerRATChange, EventTriggerUsageReport}, nil, 8, map[string]uint32{"web": 200, "throttle": 0}, []string{"rat"}},
+		{"去掉不能生效的规则", nil, map[string]bool{"video": true, "dns": true}, 9, map[string]uint32{"web": 100}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			set := policy.evaluate(tt.events, tt.failed)
+			if set.qos.QCI != tt.qci {
+				t.Errorf("QCI = %v, want %v", set.qos.QCI, tt.qci)
+			}
+			rules := make(map[string]uint32, len(set.rules))
+			for name, rule := range set.rules {
+				rules[name] = rule.Precedence
+			}
+			if !reflect.DeepEqual(rules, tt.rules) {
+				t.Errorf("rules = %v, want %v", rules, tt.rules)
+			}
+			if got := sortedNames(set.predefined); !reflect.DeepEqual(got, tt.predefined) {
+				t.Errorf("predefined = %v, want %v", got, tt.predefined)
+			}
+			if !reflect.DeepEqual(set.triggers, policy.EventTriggers) {
+				t.Errorf("triggers = %v, want %v", set.triggers, policy.EventTriggers)
+			}
+		})
+	}
+}
+
+func TestDiffGxRuleSet(t *testing.T) {
+	web := GxRule{Name: "web", Precedence: 100}
+	video := GxRule{Name: "video", Precedence: 50}
+	tests := []struct {
+		name string
+		old  gxRuleSet
+		new  gxRuleSet
+		want gxChange
+	}{
+		{
+			name: "没有变化",
+			old:  newTestGxRuleSet(9, []GxRule{web}, []string{"dns"}, []uint32{EventTriggerRATChange}),
+			new:  newTestGxRuleSet(9, []GxRule{web}, []string{"dns"}, []uint32{EventTriggerRATChange}),
+		},
+		{
+			name: "首次下发",
+			old:  gxRuleSet{},
+			new:  newTestGxRuleSet(9, []GxRule{web, video}, []string{"dns"}, []uint32{EventTriggerRATChange}),
+			want: gxChange{qos: &GxQoS{QCI: 9}, install: []GxRule{video, web}, installPredefined: []string{"dns"},
+				triggers: []uint32{EventTriggerRATChange}, triggersChanged: true},
+		},
+		{
+			name: "内容变化的规则重新安装，不再有的删除",
+			old:  newTestGxRuleSet(9, []GxRule{web, video}, []string{"dns"}, nil),
+			new:  newTestGxRuleSet(9, []GxRule{{Name: "web", Precedence: 200}}, []string{"rat"}, nil),
+			want: gxChange{install: []GxRule{{Name: "web", Precedence: 200}}, installPredefined: []string{"rat"}, remove: []string{"dns", "video"}},
+		},
+		{
+			name: "只有QoS变化",
+			old:  newTestGxRuleSet(9, []GxRule{web}, nil, nil),
+			new:  newTestGxRuleSet(8, []GxRule{web}, nil, nil),
+			want: gxChange{qos: &GxQoS{QCI: 8}},
+		},
+		{
+			name: "取消全部事件订阅",
+			old:  newTestGxRuleSet(9, nil, nil, []uint32{EventTriggerRATChange}),
+			new:  newTestGxRuleSet(9, nil, nil, nil),
+			want: gxChange{triggersChanged: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := diffGxRuleSet(tt.old, tt.new)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("diffGxRuleSet = %+v, want %+v", got, tt.want)
+			}
+			if got.empty() != reflect.DeepEqual(tt.want, gxChange{}) {
+				t.Errorf("empty = %v", got.empty())
+			}
+			// 把变化应用到旧策略上应得到新策略
+			applied := tt.old
+			applied.rules = make(map[string]GxRule)
+			applied.predefined = make(map[string]bool)
+			for name, rule := range tt.old.rules {
+				applied.rules[name] = rule
+			}
+			for name := range tt.old.predefined {
+				applied.predefined[name] = true
+			}
+			applied.apply(got)
+			if !reflect.DeepEqual(applied.rules, tt.new.rules) || !reflect.DeepEqual(applied.predefined, tt.new.predefined) ||
+				applied.qos != tt.new.qos || !reflect.DeepEqual(applied.triggers, tt.new.triggers) {
+				t.Errorf("applied = %+v, want %+v", applied, tt.new)
+			}
+		})
+	}
+}
+
+// RAR未完成期间规则有变化时，RAA后需要再推送一次
+func TestGxEndPush(t *testing.T) {
+	tests := []struct {
+		name       string
+		duringPush func(s *gxSessionStore)
+		resultCode uint32
+		again      bool
+		applied    bool // 变化是否应用到会话
+		removed    bool // 会话是否被删除
+	}{
+		{"RAA成功", nil, ResultCode_Success, false, true, false},
+		{"RAR期间AF规则变化", func(s *gxSessionStore) {
+			s.setAFRules("gx;1", "rx;1_", []GxRule{{Name: "rx;1_audio"}})
+		}, ResultCode_Success, true, true, false},
+		{"RAR失败也要再推送", func(s *gxSessionStore) {
+			s.setAFRules("gx;1", "rx;1_", []GxRule{{Name: "rx;1_audio"}})
+		}, ResultCode_UnableToComply, true, false, false},
+		{"会话已不存在", func(s *gxSessionStore) {
+			s.setAFRules("gx;1", "rx;1_", nil)
+		}, ResultCode_UnknownSessionID, false, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &gxSessionStore{sessions: map[string]*gxSession{
+				"gx;1": {subscriber: "alice", peerHost: "pcef.local", pushing: true},
+			}}
+			if tt.duringPush != nil {
+				tt.duringPush(s)
+			}
+			change := gxChange{install: []GxRule{{Name: "web"}}}
+			if got := s.endPush("gx;1", change, tt.resultCode); got != tt.again {
+				t.Errorf("endPush = %v, want %v", got, tt.again)
+			}
+			gs, ok := s.sessions["gx;1"]
+			if ok == tt.removed {
+				t.Fatalf("session removed = %v, want %v", !ok, tt.removed)
+			}
+			if !ok {
+				return
+			}
+			if gs.pushing || gs.dirty {
+				t.Errorf("pushing = %v dirty = %v after RAA", gs.pushing, gs.dirty)
+			}
+			if _, got := gs.applied.rules["web"]; got != tt.applied {
+				t.Errorf("change applied = %v, want %v", got, tt.applied)
+			}
+		})
+	}
+}
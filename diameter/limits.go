@@ -0,0 +1,154 @@
+package diameter
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxMessageSize = 10000
+	defaultMaxAVPs        = 256
+	// 默认空闲超时，客户端30s发一次保活，这里设置40s超时时间
+	defaultIdleTimeout = 40 * time.Second
+	// 已经收到报头的情况下，1s内收不完剩余数据，不属于正常情况
+	defaultBodyTimeout    = 1 * time.Second
+	defaultRequestTimeout = 10 * time.Second
+)
+
+// LimitsConfig 消息、连接相关的限制，0表示使用默认值或不限制
+type LimitsConfig struct {
+	MaxMessageSize      int `json:"max_message_size"`       // 单条消息最大字节数
+	MaxAVPs             int `json:"max_avps"`               // 单条消息最多AVP个数(只计顶层)
+	IdleTimeout         int `json:"idle_timeout"`           // 空闲超时，秒，可在对端表中按对端覆盖
+	BodyTimeout         int `json:"body_timeout"`           // 收到报头后收完消息体的超时，秒
+	MaxConnections      int `json:"max_connections"`        // 最大并发连接数，0不限制
+	MaxConnectionsPerIP int `json:"max_connections_per_ip"` // 单个源ip最大并发连接数，0不限制
+	RequestTimeout      int `json:"request_timeout"`        // 本端发出或转发的请求等待应答的超时，秒
+}
+
+func (l *LimitsConfig) maxMessageSize() int {
+	if l.MaxMessageSize <= 0 {
+		return defaultMaxMessageSize
+	}
+	return l.MaxMessageSize
+}
+
+func (l *LimitsConfig) maxAVPs() int {
+	if l.MaxAVPs <= 0 {
+		return defaultMaxAVPs
+	}
+	return l.MaxAVPs
+}
+
+func (l *LimitsConfig) idleTimeout() time.Duration {
+	if l.IdleTimeout <= 0 {
+		return defaultIdleTimeout
+	}
+	return time.Duration(l.IdleTimeout) * time.Second
+}
+
+func (l *LimitsConfig) bodyTimeout() time.Duration {
+	if l.BodyTimeout <= 0 {
+		return defaultBodyTimeout
+	}
+	return time.Duration(l.BodyTimeout) * time.Second
+}
+
+func (l *LimitsConfig) requestTimeout() time.Duration {
+	if l.RequestTimeout <= 0 {
+		return defaultRequestTimeout
+	}
+	return time.Duration(l.RequestTimeout) * time.Second
+}
+
+// limitError 消息超出限制，消息体已丢弃，需要按报头回复错误应答
+// fatal表示剩余数据没能读完，连接上的消息边界已经乱了，只能断开
+type limitError struct {
+	head       [20]byte
+	resultCode uint32
+	reason     string
+	fatal      bool
+}
+
+func (e *limitError) Error() string {
+	return e.reason
+}
+
+// 丢弃消息剩余的字节
+func discardBody(conn net.Conn, e *limitError, n int) *limitError {
+	if _, err := io.CopyN(io.Discard, conn, int64(n)); err != nil {
+		e.fatal = true
+		e.reason = fmt.Sprintf("%s, discard body error: %v", e.reason, err)
+	}
+	return e
+}
+
+// 按报头构造错误应答，此时消息体还没解析，不带Session-Id
+func newLimitErrorAnswer(e *limitError) *DiameterMsg {
+	req := &DiameterMsg{head: e.head}
+	return NewDiameterMsgBuilder().
+		SetCommandCode(req.GetCommandCode()).
+		SetAppID(req.GetApplicationID()).
+		SetFlags(FlagResponse).
+		SetHopByHopID(req.GetHopByHopID()).
+		SetEndToEndID(req.GetEndToEndID()).
+		AddAVP(NewAVPBuilder(AVP_OriginHost, AVPFlag_Mandatory).SetStringData(config.OriginHost).Build()).
+		AddAVP(NewAVPBuilder(AVP_OriginRealm, AVPFlag_Mandatory).SetStringData(config.OriginRealm).Build()).
+		AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(e.resultCode).Build()).
+		AddAVP(NewAVPBuilder(AVP_ErrorMessage, AVPFlag_Mandatory).SetStringData(e.reason).Build()).
+		Build()
+}
+
+// connLimiter 统计并发连接数，超出限制的新连接直接关闭
+type connLimiter struct {
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+var connections = &connLimiter{perIP: make(map[string]int)}
+
+func remoteIP(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	return addr.String()
+}
+
+// 占用一个连接名额，超出限制时返回错误
+func (l *connLimiter) acquire(addr net.Addr) error {
+	limits := &config.Limits
+	ip := remoteIP(addr)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if limits.MaxConnections > 0 && l.total >= limits.MaxConnections {
+		return fmt.Errorf("too many connections: %d", l.total)
+	}
+	if limits.MaxConnectionsPerIP > 0 && l.perIP[ip] >= limits.MaxConnectionsPerIP {
+		return fmt.Errorf("too many connections from %v: %d", ip, l.perIP[ip])
+	}
+	l.total++
+	l.perIP[ip]++
+	return nil
+}
+
+func (l *connLimiter) release(addr net.Addr) {
+	ip := remoteIP(addr)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+// 超出连接数限制时直接关闭新连接
+func shedConnection(conn net.Conn, err error) {
+	log.Printf("Reject connection from %v: %v", conn.RemoteAddr(), err)
+	metrics.inc(MetricConnectionsShed)
+	conn.Close()
+}
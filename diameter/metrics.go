@@ -0,0 +1,41 @@
+package diameter
+
+import "sync"
+
+// 指标名
+const (
+	MetricDuplicateSuppressed = "duplicate_requests_suppressed" // 重复请求直接重放应答的次数
+	MetricConnectionsShed     = "connections_shed"              // 超出连接数限制被关闭的连接
+	MetricOversizedMessages   = "oversized_messages"            // 超出消息大小或AVP个数限制的消息
+	MetricRelayedRequests     = "relayed_requests"              // 按路由表转发给上游的请求
+	MetricUpstreamRequests    = "upstream_requests/"            // 按上游对端统计发出的请求，后接对端Origin-Host
+	MetricFailoverRequests    = "failover_requests"             // 上游断开后切换到其他对端重传的请求
+	MetricWatchdogFailures    = "watchdog_failures"             // 保活失败次数
+	MetricDRMPRejected        = "drmp_rejected_requests"        // 过载时按DRMP优先级拒绝(3004)的请求
+	MetricDOICThrottled       = "doic_throttled_requests"       // 上游通告过载，按OC-OLR丢弃的请求
+)
+
+// 运行指标计数，管理接口/metrics展示
+type metricsRegistry struct {
+	mu       sync.Mutex
+	counters map[string]uint64
+}
+
+var metrics = &metricsRegistry{counters: make(map[string]uint64)}
+
+func (m *metricsRegistry) inc(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[name]++
+}
+
+// Metrics 返回当前所有指标的快照
+func Metrics() map[string]uint64 {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	snapshot := make(map[string]uint64, len(metrics.counters))
+	for name, value := range metrics.counters {
+		snapshot[name] = value
+	}
+	return snapshot
+}
@@ -0,0 +1,149 @@
+package diameter
+
+import (
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// Milenage算法，3GPP TS 35.206，K、OPc、RAND都是16字节，SQN 6字节，AMF 2字节
+type milenage struct {
+	k   []byte
+	opc []byte
+}
+
+func newMilenage(k, opc []byte) (*milenage, error) {
+	if len(k) != 16 || len(opc) != 16 {
+		return nil, fmt.Errorf("K and OPc must be 16 bytes")
+	}
+	return &milenage{k: k, opc: opc}, nil
+}
+
+// 用K做AES-128加密
+func (m *milenage) encrypt(in []byte) []byte {
+	block, _ := aes.NewCipher(m.k) // K的长度已经在newMilenage中校验
+	out := make([]byte, 16)
+	block.Encrypt(out, in)
+	return out
+}
+
+func xor16(a, b []byte) []byte {
+	out := make([]byte, 16)
+	for i := range out {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
+
+// 循环左移r位，r是8的倍数
+func rotate16(x []byte, r int) []byte {
+	out := make([]byte, 16)
+	for i := range out {
+		out[i] = x[(i+r/8)%16]
+	}
+	return out
+}
+
+// f1/f1*，返回MAC-A和MAC-S
+func (m *milenage) f1(rand, sqn, amf []byte) (macA, macS []byte) {
+	temp := m.encrypt(xor16(rand, m.opc))
+	in1 := make([]byte, 16)
+	copy(in1[0:6], sqn)
+	copy(in1[6:8], amf)
+	copy(in1[8:14], sqn)
+	copy(in1[14:16], amf)
+	out1 := xor16(m.encrypt(xor16(temp, rotate16(xor16(in1, m.opc), 64))), m.opc)
+	return out1[0:8], out1[8:16]
+}
+
+// f2-f5/f5*，返回RES、CK、IK、AK和重同步用的AK*
+func (m *milenage) f2345(rand []byte) (res, ck, ik, ak, akS []byte) {
+	temp := xor16(m.encrypt(xor16(rand, m.opc)), m.opc)
+	out := func(r int, c byte) []byte {
+		in := rotate16(temp, r)
+		in[15] ^= c
+		return xor16(m.encrypt(in), m.opc)
+	}
+	out2 := out(0, 1)
+	out5 := out(96, 8)
+	return out2[8:16], out(32, 2), out(64, 4), out2[0:6], out5[0:6]
+}
+
+// UMTS鉴权向量，IMS AKA使用，TS 33.203
+type umtsVector struct {
+	RAND []byte
+	XRES []byte
+	AUTN []byte
+	CK   []byte
+	IK   []byte
+}
+
+// 按SQN生成一个UMTS鉴权向量，AUTN = SQN⊕AK || AMF || MAC-A
+func (m *milenage) umtsVector(rand, sqn, amf []byte) umtsVector {
+	macA, _ := m.f1(rand, sqn, amf)
+	res, ck, ik, ak, _ := m.f2345(rand)
+	autn := make([]byte, 0, 16)
+	for i := 0; i < 6; i++ {
+		autn = append(autn, sqn[i]^ak[i])
+	}
+	autn = append(autn, amf...)
+	autn = append(autn, macA...)
+	return umtsVector{RAND: rand, XRES: res, AUTN: autn, CK: ck, IK: ik}
+}
+
+// E-UTRAN鉴权向量
+type eutranVector struct {
+	RAND  []byte
+	XRES  []byte
+	AUTN  []byte
+	KASME []byte
+}
+
+// 按SQN生成一个E-UTRAN鉴权向量，plmn是服务网络的Visited-PLMN-Id(3字节)
+func (m *milenage) eutranVector(rand, sqn, amf, plmn []byte) eutranVector {
+	v := m.umtsVector(rand, sqn, amf)
+	return eutranVector{RAND: rand, XRES: v.XRES, AUTN: v.AUTN, KASME: kasme(v.CK, v.IK, plmn, v.AUTN[:6])}
+}
+
+// KASME = KDF(CK||IK, S)，TS 33.401 A.2，FC=0x10，P0为服务网络标识，P1为SQN⊕AK
+func kasme(ck, ik, plmn, sqnAK []byte) []byte {
+	mac := hmac.New(sha256.New, append(append([]byte{}, ck...), ik...))
+	mac.Write([]byte{0x10})
+	mac.Write(plmn)
+	mac.Write([]byte{0x00, byte(len(plmn))})
+	mac.Write(sqnAK)
+	mac.Write([]byte{0x00, byte(len(sqnAK))})
+	return mac.Sum(nil)
+}
+
+// 处理重同步：AUTS = (SQN_MS ⊕ AK*) || MAC-S，校验MAC-S后返回终端的SQN，TS 33.102 6.3.5
+func (m *milenage) resync(rand, auts []byte) (uint64, error) {
+	if len(rand) != 16 || len(auts) != 14 {
+		return 0, fmt.Errorf("invalid RAND or AUTS length")
+	}
+	_, _, _, _, akS := m.f2345(rand)
+	sqnMS := make([]byte, 6)
+	for i := range sqnMS {
+		sqnMS[i] = auts[i] ^ akS[i]
+	}
+	// 重同步时MAC-S用的AMF固定为0
+	_, macS := m.f1(rand, sqnMS, []byte{0, 0})
+	if !hmac.Equal(macS, auts[6:14]) {
+		return 0, fmt.Errorf("AUTS MAC-S mismatch")
+	}
+	return sqnFromBytes(sqnMS), nil
+}
+
+func sqnBytes(sqn uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, sqn)
+	return buf[2:8]
+}
+
+func sqnFromBytes(b []byte) uint64 {
+	buf := make([]byte, 8)
+	copy(buf[2:], b)
+	return binary.BigEndian.Uint64(buf)
+}
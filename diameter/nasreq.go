@@ -0,0 +1,209 @@
+package diameter
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"log"
+	"net"
+)
+
+// Auth-Request-Type，RFC 6733 8.7
+const (
+	AuthRequestAuthenticateOnly      = 1
+	AuthRequestAuthorizeOnly         = 2
+	AuthRequestAuthorizeAuthenticate = 3
+)
+
+// Auth-Session-State，RFC 6733 8.11
+const (
+	AuthSessionStateMaintained   = 0
+	AuthSessionNoStateMaintained = 1
+)
+
+// CHAP-Algorithm，RFC 7155 4.2.8
+const CHAPAlgorithmMD5 = 5
+
+// UserProfile 用户的授权信息，认证通过后在应答中返回
+type UserProfile struct {
+	ServiceType     uint32 `json:"service_type"`      // Service-Type，如2 Framed
+	FramedProtocol  uint32 `json:"framed_protocol"`   // Framed-Protocol，如1 PPP
+	FramedIPAddress string `json:"framed_ip_address"` // 分配给用户的地址
+	Class           string `json:"class"`             // 原样带回给NAS，计费时使用
+	// 按用户覆盖sessions中的会话限制，秒，0表示使用按应用或全局的配置
+	AuthorizationLifetime uint32 `json:"authorization_lifetime"`
+	AuthGracePeriod       uint32 `json:"auth_grace_period"`
+	SessionTimeout        uint32 `json:"session_timeout"` // 会话最长时间
+}
+
+// 认证方式，记录在用户会话中
+const (
+	AuthMethodNone = "none"
+	AuthMethodPAP  = "pap"
+	AuthMethodCHAP = "chap"
+)
+
+// 请求的Auth-Session-State，没有时按STATE_MAINTAINED
+func requestAuthSessionState(msg *DiameterMsg) uint32 {
+	if avp, _ := msg.FindAVPByCode(AVP_AuthSessionState); avp != nil && avp.GetDataLength() >= 4 {
+		return avp.GetIntData()
+	}
+	return AuthSessionStateMaintained
+}
+
+// 校验PAP，User-Password在Diameter中是明文，由传输层加密保护
+func verifyPAP(password string, userPassword []byte) bool {
+	return password != "" && string(userPassword) == password
+}
+
+// 校验CHAP，Response = MD5(Ident + Password + Challenge)，RFC 1994
+func verifyCHAP(password string, ident byte, challenge, response []byte) bool {
+	if password == "" || len(response) != md5.Size {
+		return false
+	}
+	h := md5.New()
+	h.Write([]byte{ident})
+	h.Write([]byte(password))
+	h.Write(challenge)
+	return bytes.Equal(h.Sum(nil), response)
+}
+
+// 按请求中的CHAP-Auth或PAP的User-Password认证用户，返回认证方式
+// CHAP-Auth没有时兼容RADIUS转换来的CHAP-Password(1字节Ident + 16字节Response)
+func authenticateNAS(msg *DiameterMsg, userName string) (string, error) {
+	password := config.UserID2passWD[userName]
+	challengeAVP, _ := msg.FindAVPByCode(AVP_CHAPChallenge)
+
+	if chapAVP, _ := msg.FindAVPByCode(AVP_CHAPAuth); chapAVP != nil {
+		algorithmAVP := chapAVP.FindGroupedAVP(AVP_CHAPAlgorithm)
+		identAVP := chapAVP.FindGroupedAVP(AVP_CHAPIdent)
+		responseAVP := chapAVP.FindGroupedAVP(AVP_CHAPResponse)
+		if algorithmAVP == nil || algorithmAVP.GetIntData() != CHAPAlgorithmMD5 {
+			return AuthMethodCHAP, fmt.Errorf("unsupported CHAP-Algorithm")
+		}
+		if identAVP == nil || identAVP.GetDataLength() != 1 || responseAVP == nil || challengeAVP == nil {
+			return AuthMethodCHAP, fmt.Errorf("CHAP-Auth missing CHAP-Ident, CHAP-Response or CHAP-Challenge")
+		}
+		if !verifyCHAP(password, identAVP.GetRawData()[0], challengeAVP.GetRawData(), responseAVP.GetRawData()) {
+			return AuthMethodCHAP, fmt.Errorf("CHAP response mismatch")
+		}
+		return AuthMethodCHAP, nil
+	}
+	if chapAVP, _ := msg.FindAVPByCode(AVP_CHAPPassword); chapAVP != nil {
+		data := chapAVP.GetRawData()
+		if len(data) != 1+md5.Size || challengeAVP == nil {
+			return AuthMethodCHAP, fmt.Errorf("invalid CHAP-Password or missing CHAP-Challenge")
+		}
+		if !verifyCHAP(password, data[0], challengeAVP.GetRawData(), data[1:]) {
+			return AuthMethodCHAP, fmt.Errorf("CHAP response mismatch")
+		}
+		return AuthMethodCHAP, nil
+	}
+	if passwordAVP, _ := msg.FindAVPByCode(AVP_UserPassword); passwordAVP != nil {
+		if !verifyPAP(password, passwordAVP.GetRawData()) {
+			return AuthMethodPAP, fmt.Errorf("password mismatch")
+		}
+		return AuthMethodPAP, nil
+	}
+	return AuthMethodNone, fmt.Errorf("no User-Password, CHAP-Auth or CHAP-Password")
+}
+
+// 按用户的授权信息添加授权AVP
+func addAuthorizationAVPs(builder *DiameterMsgBuilder, profile UserProfile) {
+	if profile.ServiceType > 0 {
+		builder.AddAVP(NewAVPBuilder(AVP_ServiceType, AVPFlag_Mandatory).SetIntData(profile.ServiceType).Build())
+	}
+	if profile.FramedProtocol > 0 {
+		builder.AddAVP(NewAVPBuilder(AVP_FramedProtocol, AVPFlag_Mandatory).SetIntData(profile.FramedProtocol).Build())
+	}
+	if ip := net.ParseIP(profile.FramedIPAddress).To4(); ip != nil {
+		// NASREQ中Framed-IP-Address是OctetString，直接放4字节地址
+		builder.AddAVP(NewAVPBuilder(AVP_FramedIPAddress, AVPFlag_Mandatory).SetData(ip).Build())
+	}
+	if profile.Class != "" {
+		builder.AddAVP(NewAVPBuilder(AVP_Class, AVPFlag_Mandatory).SetStringData(profile.Class).Build())
+	}
+}
+
+// 处理AAR，按Auth-Request-Type认证和/或授权，RFC 7155
+func handleAAR(session *Session, msg *DiameterMsg) (*DiameterMsg, error) {
+	requestType := avpIntData(msg, AVP_AuthRequestType)
+	var userName string
+	if userAVP, _ := msg.FindAVPByCode(AVP_UserName); userAVP != nil {
+		userName = userAVP.GetStringData()
+	}
+	log.Printf("主机%v NASREQ请求 Session-Id: %v 用户: %v Auth-Request-Type: %v", session.PeerHost, msg.GetSessionID(), userName, requestType)
+
+	builder := newAnswerBuilder(msg).
+		AddAVP(NewAVPBuilder(AVP_AuthApplicationId, AVPFlag_Mandatory).SetIntData(msg.GetApplicationID()).Build()).
+		AddAVP(NewAVPBuilder(AVP_AuthRequestType, AVPFlag_Mandatory).SetIntData(requestType).Build())
+	if userName != "" {
+		builder.AddAVP(NewAVPBuilder(AVP_UserName, AVPFlag_Mandatory).SetStringData(userName).Build())
+	}
+	reject := func(resultCode uint32, err error) (*DiameterMsg, error) {
+		log.Printf("主机%v 用户%v NASREQ认证不通过: %v", session.PeerHost, userName, err)
+		return builder.
+			AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(resultCode).Build()).
+			AddAVP(NewAVPBuilder(AVP_ErrorMessage, 0).SetStringData(err.Error()).Build()).
+			Build(), nil
+	}
+
+	if session.State() != StateEstablished {
+		return reject(ResultCode_UnableToDeliver, fmt.Errorf("session not established, send CER first"))
+	}
+	// 字典中AAR与Rx共用，Auth-Request-Type只在NASREQ中必须
+	if avp, _ := msg.FindAVPByCode(AVP_AuthRequestType); avp == nil {
+		return reject(ResultCode_MissingAVP, fmt.Errorf("miss avp, need one of [%d]", AVP_AuthRequestType))
+	}
+	if userName == "" {
+		return reject(ResultCode_MissingAVP, fmt.Errorf("missing User-Name"))
+	}
+
+	method := AuthMethodNone
+	switch requestType {
+	case AuthRequestAuthenticateOnly, AuthRequestAuthorizeAuthenticate:
+		var err error
+		if method, err = authenticateNAS(msg, userName); err != nil {
+			builder.AddAVP(NewAVPBuilder(AVP_ReplyMessage, AVPFlag_Mandatory).SetStringData("authentication failed").Build())
+			return reject(ResultCode_AuthenticationRejected, err)
+		}
+	case AuthRequestAuthorizeOnly:
+		// 只授权时认证已经在别处完成，这里只要求用户存在，或者会话之前认证过
+		if _, ok := config.UserID2passWD[userName]; !ok {
+			if previous := userSessions.get(msg.GetSessionID()); previous == nil || previous.UserName != userName {
+				return reject(ResultCode_AuthorizationRejected, fmt.Errorf("user %v unknown", userName))
+			}
+		}
+	default:
+		return reject(ResultCode_InvalidAVPValue, fmt.Errorf("invalid Auth-Request-Type %d", requestType))
+	}
+
+	// 授权时返回授权信息和会话限制，只认证时不限制会话
+	var limits SessionLimits
+	if requestType != AuthRequestAuthenticateOnly {
+		addAuthorizationAVPs(builder, config.UserProfiles[userName])
+		limits = sessionLimits(msg.GetApplicationID(), userName)
+		addSessionLimitAVPs(builder, limits)
+	}
+	for _, avp := range msg.FindAVPsByCode(AVP_State) {
+		builder.AddAVP(avp)
+	}
+
+	// 客户端声明不维护状态时不记录会话
+	sessionState := requestAuthSessionState(msg)
+	builder.AddAVP(NewAVPBuilder(AVP_AuthSessionState, AVPFlag_Mandatory).SetIntData(sessionState).Build())
+	if sessionState == AuthSessionStateMaintained {
+		userSessions.open(UserSession{
+			SessionID:   msg.GetSessionID(),
+			UserName:    userName,
+			PeerHost:    session.PeerHost,
+			AppID:       msg.GetApplicationID(),
+			AuthMethod:  method,
+			RequestType: requestType,
+		}, limits)
+	}
+
+	log.Printf("主机%v 用户%v NASREQ认证通过，认证方式: %v", session.PeerHost, userName, method)
+	builder.AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(ResultCode_Success).Build())
+	return builder.Build(), nil
+}
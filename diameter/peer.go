@@ -0,0 +1,279 @@
+package diameter
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTc         = 30 * time.Second // 重连定时器
+	defaultTw         = 30 * time.Second // 保活定时器
+	defaultMaxBackoff = 5 * time.Minute  // 重连退避上限
+
+	maxPeerSessionIDs = 100000    // 每个对端最多记录的Session-Id个数
+	peerSessionIdle   = time.Hour // 超过这么久没有消息的Session-Id在记录满时先清理
+)
+
+// PeerConfig 对端表中的一项，描述允许接入的对端以及针对该对端的定时器、能力覆盖
+type PeerConfig struct {
+	OriginHost  string   `json:"origin_host"`
+	OriginRealm string   `json:"origin_realm"`
+	IPRanges    []string `json:"ip_ranges"` // 允许的源地址段，CIDR格式，为空表示不限制
+	// 允许该对端使用的应用，非空时覆盖全局的auth/acct_application_ids，CEA中也只通告这些应用
+	AuthApplicationIds []uint32 `json:"auth_application_ids"`
+	AcctApplicationIds []uint32 `json:"acct_application_ids"`
+	// 定时器覆盖，单位秒，0表示使用全局默认值
+	IdleTimeout int `json:"idle_timeout"`
+	Tc          int `json:"tc"`          // 重连定时器，连接失败后首次重试的间隔，之后指数退避
+	Tw          int `json:"tw"`          // 保活定时器，主动连接的对端按此间隔发送DWR
+	MaxBackoff  int `json:"max_backoff"` // 重连退避上限
+
+	// 非空时由本端主动连接，如127.0.0.1:3869
+	ConnectTo string `json:"connect_to"`
+
+	ipNets []*net.IPNet
+}
+
+// 解析对端表中的地址段，加载配置后调用一次
+func (p *PeerConfig) init() error {
+	p.ipNets = p.ipNets[:0]
+	for _, cidr := range p.IPRanges {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			// 兼容直接写单个ip的情况
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return fmt.Errorf("peer %v invalid ip range %v: %w", p.OriginHost, cidr, err)
+			}
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 8 * net.IPv6len
+			}
+			ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		p.ipNets = append(p.ipNets, ipNet)
+	}
+	return nil
+}
+
+// 源地址是否在允许的地址段内
+func (p *PeerConfig) allowIP(addr net.Addr) bool {
+	if len(p.ipNets) == 0 {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range p.ipNets {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// 该对端可用的认证应用，没有单独配置时使用全局配置
+func (p *PeerConfig) authAppIDs() []uint32 {
+	if p == nil || len(p.AuthApplicationIds) == 0 {
+		return config.AuthApplicationIds
+	}
+	return p.AuthApplicationIds
+}
+
+// 该对端可用的计费应用，没有单独配置时使用全局配置
+func (p *PeerConfig) acctAppIDs() []uint32 {
+	if p == nil || len(p.AcctApplicationIds) == 0 {
+		return config.AcctApplicationIds
+	}
+	return p.AcctApplicationIds
+}
+
+func (p *PeerConfig) idleTimeout() time.Duration {
+	if p == nil || p.IdleTimeout <= 0 {
+		return config.Limits.idleTimeout()
+	}
+	return time.Duration(p.IdleTimeout) * time.Second
+}
+
+func (p *PeerConfig) tc() time.Duration {
+	if p.Tc <= 0 {
+		return defaultTc
+	}
+	return time.Duration(p.Tc) * time.Second
+}
+
+func (p *PeerConfig) tw() time.Duration {
+	if p.Tw <= 0 {
+		return defaultTw
+	}
+	return time.Duration(p.Tw) * time.Second
+}
+
+func (p *PeerConfig) maxBackoff() time.Duration {
+	if p.MaxBackoff <= 0 {
+		return defaultMaxBackoff
+	}
+	return time.Duration(p.MaxBackoff) * time.Second
+}
+
+// 在对端表中查找对端，对端表为空时不做限制，返回 nil, nil
+func (c *DiameterConfig) matchPeer(host, realm string, addr net.Addr) (*PeerConfig, error) {
+	if len(c.Peers) == 0 {
+		return nil, nil
+	}
+	for i := range c.Peers {
+		peer := &c.Peers[i]
+		if peer.OriginHost != host {
+			continue
+		}
+		if peer.OriginRealm != "" && peer.OriginRealm != realm {
+			return nil, fmt.Errorf("peer %v realm mismatch: %v, expect %v", host, realm, peer.OriginRealm)
+		}
+		if !peer.allowIP(addr) {
+			return nil, fmt.Errorf("peer %v source address %v not allowed", host, addr)
+		}
+		return peer, nil
+	}
+	return nil, fmt.Errorf("peer %v not in peer table", host)
+}
+
+// 重复连接的处理策略
+const (
+	DuplicatePolicyReject       = "reject"        // 拒绝新连接，返回5012
+	DuplicatePolicyElectionLost = "election_lost" // 拒绝新连接，返回4003
+	DuplicatePolicyReplace      = "replace"       // 关闭旧连接，接受新连接
+)
+
+// peerRegistry 按Origin-Host记录已建立的连接、对端的Origin-State-Id以及对端上的会话
+type peerRegistry struct {
+	mu       sync.Mutex
+	conns    map[string]*Session
+	stateIDs map[string]uint32
+	sessions map[string]map[string]time.Time // Session-Id到最近一次收到消息的时间
+}
+
+var peerTable = &peerRegistry{
+	conns:    make(map[string]*Session),
+	stateIDs: make(map[string]uint32),
+	sessions: make(map[string]map[string]time.Time),
+}
+
+// 登记新建立的连接，同一对端已有连接时按RFC 6733 5.6.4选举或按配置策略处理
+// 返回非0结果码表示拒绝本次CER
+func (r *peerRegistry) register(session *Session, host string) uint32 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old, ok := r.conns[host]
+	if ok && old != session {
+		if old.Initiator {
+			// 双方同时发起连接，Origin-Host大的一方获胜，获胜方保留自己发起的连接
+			if config.OriginHost > host {
+				log.Printf("主机%v 选举：本端获胜，保留本端发起的连接，拒绝对端发起的连接", host)
+				return ResultCode_ElectionLost
+			}
+			log.Printf("主机%v 选举：本端落败，关闭本端发起的连接", host)
+			old.Close()
+		} else {
+			switch config.DuplicatePeerPolicy {
+			case DuplicatePolicyReplace:
+				log.Printf("主机%v 重复连接，关闭旧连接%v", host, old.RemoteAddr)
+				old.Close()
+			case DuplicatePolicyElectionLost:
+				log.Printf("主机%v 重复连接，已有连接%v，拒绝新连接", host, old.RemoteAddr)
+				return ResultCode_ElectionLost
+			default: // DuplicatePolicyReject
+				log.Printf("主机%v 重复连接，已有连接%v，拒绝新连接", host, old.RemoteAddr)
+				return ResultCode_UnableToComply
+			}
+		}
+	}
+	r.conns[host] = session
+	return 0
+}
+
+// 连接关闭时注销，只注销自己，避免误删替换后的新连接
+func (r *peerRegistry) unregister(session *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if session.PeerHost != "" && r.conns[session.PeerHost] == session {
+		delete(r.conns, session.PeerHost)
+	}
+}
+
+// 获取对端当前已建立的连接
+func (r *peerRegistry) get(host string) *Session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.conns[host]
+}
+
+// 记录对端的Origin-State-Id，发生变化说明对端重启过，清理该对端的会话
+func (r *peerRegistry) checkStateID(host string, stateID uint32) {
+	r.mu.Lock()
+	old, ok := r.stateIDs[host]
+	r.stateIDs[host] = stateID
+	if !ok || old == stateID {
+		r.mu.Unlock()
+		return
+	}
+	sessionCount := len(r.sessions[host])
+	delete(r.sessions, host)
+	r.mu.Unlock()
+
+	userSessionCount := userSessions.terminatePeer(host, TerminationCauseLinkBroken)
+	gxSessionCount := gxSessions.removePeer(host)
+	log.Printf("主机%v Origin-State-Id由%v变为%v，对端已重启，清理%v个会话，结束%v个用户会话、%v个Gx会话", host, old, stateID, sessionCount, userSessionCount, gxSessionCount)
+}
+
+// 将Session-Id关联到对端，记录满时先清理空闲的Session-Id，仍然满就去掉最久没有消息的一个
+func (r *peerRegistry) bindSession(host, sessionID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ids, ok := r.sessions[host]
+	if !ok {
+		ids = make(map[string]time.Time)
+		r.sessions[host] = ids
+	}
+	now := time.Now()
+	if _, ok := ids[sessionID]; !ok && len(ids) >= maxPeerSessionIDs {
+		oldestID, oldest := "", now
+		for id, seen := range ids {
+			if now.Sub(seen) > peerSessionIdle {
+				delete(ids, id)
+			} else if seen.Before(oldest) {
+				oldestID, oldest = id, seen
+			}
+		}
+		if len(ids) >= maxPeerSessionIDs {
+			delete(ids, oldestID)
+		}
+	}
+	ids[sessionID] = now
+}
+
+// 会话结束(STR、ASA成功或过期)后解除Session-Id和对端的关联
+func (r *peerRegistry) unbindSession(host, sessionID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ids, ok := r.sessions[host]; ok {
+		delete(ids, sessionID)
+		if len(ids) == 0 {
+			delete(r.sessions, host)
+		}
+	}
+}
+
+// 当前所有已建立的连接
+func (r *peerRegistry) list() []*Session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sessions := make([]*Session, 0, len(r.conns))
+	for _, session := range r.conns {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
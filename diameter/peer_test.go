@@ -0,0 +1,165 @@
+package diameter
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newTestPeerRegistry() *peerRegistry {
+	return &peerRegistry{
+		conns:    make(map[string]*Session),
+		stateIDs: make(map[string]uint32),
+		sessions: make(map[string]map[string]time.Time),
+	}
+}
+
+func TestPeerRegistryRegister(t *testing.T) {
+	savedHost, savedPolicy := config.OriginHost, config.DuplicatePeerPolicy
+	defer func() { config.OriginHost, config.DuplicatePeerPolicy = savedHost, savedPolicy }()
+
+	tests := []struct {
+		name         string
+		localHost    string
+		policy       string
+		oldInitiator bool // 已有连接是否本端发起
+		noOld        bool // 没有已有连接
+		want         uint32
+		oldClosed    bool
+		replaced     bool // 登记后是否为新连接
+	}{
+		{name: "没有已有连接", localHost: "b.local", noOld: true, want: 0, replaced: true},
+		{name: "选举：本端Origin-Host大，保留本端发起的连接", localHost: "z.local", oldInitiator: true, want: ResultCode_ElectionLost},
+		{name: "选举：本端Origin-Host小，关闭本端发起的连接", localHost: "a.local", oldInitiator: true, want: 0, oldClosed: true, replaced: true},
+		{name: "默认策略拒绝新连接", localHost: "b.local", want: ResultCode_UnableToComply},
+		{name: "reject拒绝新连接", localHost: "b.local", policy: DuplicatePolicyReject, want: ResultCode_UnableToComply},
+		{name: "election_lost拒绝新连接", localHost: "b.local", policy: DuplicatePolicyElectionLost, want: ResultCode_ElectionLost},
+		{name: "replace关闭旧连接", localHost: "b.local", policy: DuplicatePolicyReplace, want: 0, oldClosed: true, replaced: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.OriginHost, config.DuplicatePeerPolicy = tt.localHost, tt.policy
+			r := newTestPeerRegistry()
+			old := &Session{PeerHost: "m.local", Initiator: tt.oldInitiator}
+			if !tt.noOld {
+				r.conns["m.local"] = old
+			}
+			session := &Session{PeerHost: "m.local"}
+			if got := r.register(session, "m.local"); got != tt.want {
+				t.Errorf("register = %v, want %v", got, tt.want)
+			}
+			if old.NeedClose() != tt.oldClosed {
+				t.Errorf("old connection closed = %v, want %v", old.NeedClose(), tt.oldClosed)
+			}
+			if got := r.get("m.local") == session; got != tt.replaced {
+				t.Errorf("new connection registered = %v, want %v", got, tt.replaced)
+			}
+		})
+	}
+}
+
+// 只注销自己，不影响替换后的新连接
+func TestPeerRegistryUnregister(t *testing.T) {
+	r := newTestPeerRegistry()
+	old := &Session{PeerHost: "m.local"}
+	session := &Session{PeerHost: "m.local"}
+	r.conns["m.local"] = session
+	r.unregister(old)
+	if r.get("m.local") != session {
+		t.Error("unregister of replaced connection removed the new one")
+	}
+	r.unregister(session)
+	if r.get("m.local") != nil {
+		t.Error("unregister should remove the registered connection")
+	}
+}
+
+func TestPeerRegistryCheckStateID(t *testing.T) {
+	tests := []struct {
+		name     string
+		stateIDs []uint32 // 依次收到的Origin-State-Id
+		kept     bool     // 之后对端的会话是否还在
+	}{
+		{"首次连接", []uint32{1}, true},
+		{"Origin-State-Id不变", []uint32{1, 1}, true},
+		{"Origin-State-Id变化，对端重启", []uint32{1, 2}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestPeerRegistry()
+			r.checkStateID("m.local", tt.stateIDs[0])
+			r.bindSession("m.local", "m.local;1;1")
+			for _, stateID := range tt.stateIDs[1:] {
+				r.checkStateID("m.local", stateID)
+			}
+			if _, ok := r.sessions["m.local"]["m.local;1;1"]; ok != tt.kept {
+				t.Errorf("session kept = %v, want %v", ok, tt.kept)
+			}
+			if got := r.stateIDs["m.local"]; got != tt.stateIDs[len(tt.stateIDs)-1] {
+				t.Errorf("state id = %v, want %v", got, tt.stateIDs[len(tt.stateIDs)-1])
+			}
+		})
+	}
+}
+
+func TestPeerRegistryBindSession(t *testing.T) {
+	r := newTestPeerRegistry()
+	r.bindSession("m.local", "s1")
+	r.bindSession("m.local", "s2")
+	r.bindSession("n.local", "s3")
+	if len(r.sessions["m.local"]) != 2 || len(r.sessions["n.local"]) != 1 {
+		t.Fatalf("bound sessions = %v/%v, want 2/1", len(r.sessions["m.local"]), len(r.sessions["n.local"]))
+	}
+	r.unbindSession("m.local", "s1")
+	if _, ok := r.sessions["m.local"]["s1"]; ok {
+		t.Error("s1 should be unbound")
+	}
+	// 最后一个会话解除后去掉对端的记录
+	r.unbindSession("n.local", "s3")
+	if _, ok := r.sessions["n.local"]; ok {
+		t.Error("peer without sessions should be removed")
+	}
+	r.unbindSession("x.local", "s4")
+}
+
+func TestPeerRegistryBindSessionFull(t *testing.T) {
+	tests := []struct {
+		name    string
+		idle    int // 记录满时空闲超时的Session-Id个数
+		want    int
+		evicted string
+	}{
+		{"先清理空闲的Session-Id", 10, maxPeerSessionIDs - 9, "s0"},
+		{"没有空闲的去掉最久没有消息的一个", 0, maxPeerSessionIDs, "s0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestPeerRegistry()
+			ids := make(map[string]time.Time, maxPeerSessionIDs)
+			now := time.Now()
+			for i := 0; i < maxPeerSessionIDs; i++ {
+				seen := now.Add(-time.Minute + time.Duration(i)*time.Microsecond)
+				if i < tt.idle {
+					seen = now.Add(-2 * peerSessionIdle)
+				}
+				ids[fmt.Sprintf("s%d", i)] = seen
+			}
+			r.sessions["m.local"] = ids
+			r.bindSession("m.local", "new")
+			if len(ids) != tt.want {
+				t.Errorf("sessions = %v, want %v", len(ids), tt.want)
+			}
+			if _, ok := ids[tt.evicted]; ok {
+				t.Errorf("%v should be evicted", tt.evicted)
+			}
+			if _, ok := ids["new"]; !ok {
+				t.Error("new session should be bound")
+			}
+			// 已记录的Session-Id刷新时间，不淘汰其他会话
+			r.bindSession("m.local", "new")
+			if len(ids) != tt.want {
+				t.Errorf("sessions after refresh = %v, want %v", len(ids), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package diameter
+
+import (
+	"fmt"
+	"log"
+)
+
+// Re-Auth-Request-Type，RFC 6733 8.12
+const (
+	ReAuthAuthorizeOnly         = 0
+	ReAuthAuthorizeAuthenticate = 1
+)
+
+// 本端发给会话所属对端的请求，带Session-Id、Destination-Host/Realm和会话的Auth-Application-Id
+func newSessionRequest(command uint32, userSession UserSession, peer *Session) *DiameterMsgBuilder {
+	builder := NewDiameterMsgBuilder().
+		SetCommandCode(command).
+		SetAppID(userSession.AppID).
+		SetFlags(FlagRequest | FlagProxiable).
+		SetHopByHopID(nextHopByHopID()).
+		SetEndToEndID(nextEndToEndID()).
+		AddAVP(NewAVPBuilder(AVP_SessionId, AVPFlag_Mandatory).SetStringData(userSession.SessionID).Build()).
+		AddAVP(NewAVPBuilder(AVP_OriginHost, AVPFlag_Mandatory).SetStringData(config.OriginHost).Build()).
+		AddAVP(NewAVPBuilder(AVP_OriginRealm, AVPFlag_Mandatory).SetStringData(config.OriginRealm).Build()).
+		AddAVP(NewAVPBuilder(AVP_DestinationRealm, AVPFlag_Mandatory).SetStringData(peer.PeerRealm).Build()).
+		AddAVP(NewAVPBuilder(AVP_DestinationHost, AVPFlag_Mandatory).SetStringData(peer.PeerHost).Build()).
+		AddAVP(NewAVPBuilder(AVP_AuthApplicationId, AVPFlag_Mandatory).SetIntData(userSession.AppID).Build())
+	if userSession.UserName != "" {
+		builder.AddAVP(NewAVPBuilder(AVP_UserName, AVPFlag_Mandatory).SetStringData(userSession.UserName).Build())
+	}
+	return builder
+}
+
+// 向会话所属的对端发出RAR/ASR并等待应答，按应答结果更新会话，返回应答的Result-Code
+func sendSessionRequest(sessionID, name string, build func(userSession UserSession, peer *Session) *DiameterMsg) (uint32, error) {
+	userSession, err := userSessions.beginRequest(sessionID, name)
+	if err != nil {
+		return 0, err
+	}
+	peer := peerTable.get(userSession.PeerHost)
+	if peer == nil {
+		userSessions.endRequest(sessionID, 0)
+		return 0, fmt.Errorf("peer %v of session %v not connected", userSession.PeerHost, sessionID)
+	}
+
+	req := build(userSession, peer)
+	log.Printf("主机%v 发出%v Session-Id: %v End-to-End: %v", peer.PeerHost, name, sessionID, req.GetEndToEndID())
+	rsp, err := RouteRequest(req)
+	if err != nil {
+		userSessions.endRequest(sessionID, 0)
+		return 0, err
+	}
+	if rsp.GetSessionID() != sessionID {
+		userSessions.endRequest(sessionID, 0)
+		return 0, fmt.Errorf("answer Session-Id %v mismatch", rsp.GetSessionID())
+	}
+	resultCode := avpIntData(rsp, AVP_ResultCode)
+	log.Printf("主机%v %v应答 Session-Id: %v Result-Code: %v", peer.PeerHost, name, sessionID, resultCode)
+	userSessions.endRequest(sessionID, resultCode)
+	return resultCode, nil
+}
+
+// SendReAuth 向会话所属的对端发出RAR，要求对端重新认证/授权，返回RAA的Result-Code
+func SendReAuth(sessionID string, reAuthType uint32) (uint32, error) {
+	return sendSessionRequest(sessionID, "RAR", func(userSession UserSession, peer *Session) *DiameterMsg {
+		return newSessionRequest(Cmd_RA, userSession, peer).
+			AddAVP(NewAVPBuilder(AVP_ReAuthRequestType, AVPFlag_Mandatory).SetIntData(reAuthType).Build()).
+			Build()
+	})
+}
+
+// SendAbortSession 向会话所属的对端发出ASR，要求对端结束会话，返回ASA的Result-Code
+func SendAbortSession(sessionID string) (uint32, error) {
+	return sendSessionRequest(sessionID, "ASR", func(userSession UserSession, peer *Session) *DiameterMsg {
+		return newSessionRequest(Cmd_AS, userSession, peer).Build()
+	})
+}
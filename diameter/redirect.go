@@ -0,0 +1,191 @@
+package diameter
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Redirect-Host-Usage，RFC 6733 6.13
+const (
+	RedirectUsageDontCache           = 0
+	RedirectUsageAllSession          = 1
+	RedirectUsageAllRealm            = 2
+	RedirectUsageRealmAndApplication = 3
+	RedirectUsageAllApplication      = 4
+	RedirectUsageAllHost             = 5
+	RedirectUsageAllUser             = 6
+)
+
+const (
+	defaultRedirectMaxCacheTime = 300 // 秒
+	maxRedirects                = 3   // 最多跟随重定向的次数，防止来回重定向
+)
+
+// 重定向应答，带上可直接联系的上游对端及缓存方式
+func newRedirectAnswer(msg *DiameterMsg, route *RouteConfig) *DiameterMsg {
+	builder := newAnswerBuilder(msg).SetFlags(FlagResponse | FlagError).
+		AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(ResultCode_RedirectIndication).Build())
+	for _, host := range route.Peers {
+		builder.AddAVP(NewAVPBuilder(AVP_RedirectHost, AVPFlag_Mandatory).SetStringData("aaa://" + host).Build())
+	}
+	maxCacheTime := route.RedirectMaxCacheTime
+	if maxCacheTime == 0 {
+		maxCacheTime = defaultRedirectMaxCacheTime
+	}
+	builder.
+		AddAVP(NewAVPBuilder(AVP_RedirectHostUsage, AVPFlag_Mandatory).SetIntData(route.RedirectUsage).Build()).
+		AddAVP(NewAVPBuilder(AVP_RedirectMaxCacheTime, AVPFlag_Mandatory).SetIntData(maxCacheTime).Build())
+	log.Printf("请求(Command: %v End-to-End: %v)重定向到%v", msg.GetCommandCode(), msg.GetEndToEndID(), route.Peers)
+	return builder.Build()
+}
+
+// 从DiameterURI中取出主机名，如aaa://host.example.com:3868;transport=tcp
+func redirectURIHost(uri string) string {
+	host := uri
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	if i := strings.IndexAny(host, ":;"); i >= 0 {
+		host = host[:i]
+	}
+	return host
+}
+
+// redirectCache 按Redirect-Host-Usage缓存收到的重定向，之后同类请求直接发往重定向的主机
+type redirectCache struct {
+	mu      sync.Mutex
+	entries map[string]*redirectEntry
+}
+
+type redirectEntry struct {
+	hosts    []string
+	expireAt time.Time
+}
+
+var redirects = &redirectCache{entries: make(map[string]*redirectEntry)}
+
+// 按缓存方式生成请求的缓存key，请求里缺少对应AVP时返回空
+func redirectKey(usage uint32, req *DiameterMsg) string {
+	avpString := func(code uint32) string {
+		if avp, _ := req.FindAVPByCode(code); avp != nil {
+			return avp.GetStringData()
+		}
+		return ""
+	}
+	var value string
+	switch usage {
+	case RedirectUsageAllSession:
+		value = avpString(AVP_SessionId)
+	case RedirectUsageAllRealm:
+		value = avpString(AVP_DestinationRealm)
+	case RedirectUsageRealmAndApplication:
+		if realm := avpString(AVP_DestinationRealm); realm != "" {
+			value = fmt.Sprintf("%s/%d", realm, req.GetApplicationID())
+		}
+	case RedirectUsageAllApplication:
+		value = fmt.Sprint(req.GetApplicationID())
+	case RedirectUsageAllHost:
+		value = avpString(AVP_DestinationHost)
+	case RedirectUsageAllUser:
+		value = avpString(AVP_UserName)
+	}
+	if value == "" {
+		return ""
+	}
+	return fmt.Sprintf("%d:%s", usage, value)
+}
+
+// 记录重定向应答
+func (c *redirectCache) learn(req, answer *DiameterMsg) []string {
+	hosts := []string{}
+	for _, avp := range answer.FindAVPsByCode(AVP_RedirectHost) {
+		hosts = append(hosts, redirectURIHost(avp.GetStringData()))
+	}
+	usage := uint32(RedirectUsageDontCache)
+	if avp, _ := answer.FindAVPByCode(AVP_RedirectHostUsage); avp != nil && avp.GetDataLength() >= 4 {
+		usage = avp.GetIntData()
+	}
+	maxCacheTime := uint32(defaultRedirectMaxCacheTime)
+	if avp, _ := answer.FindAVPByCode(AVP_RedirectMaxCacheTime); avp != nil && avp.GetDataLength() >= 4 {
+		maxCacheTime = avp.GetIntData()
+	}
+	if usage == RedirectUsageDontCache || len(hosts) == 0 {
+		return hosts
+	}
+	key := redirectKey(usage, req)
+	if key == "" {
+		return hosts
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = &redirectEntry{hosts: hosts, expireAt: time.Now().Add(time.Duration(maxCacheTime) * time.Second)}
+	log.Printf("缓存重定向 %v -> %v，%v秒", key, hosts, maxCacheTime)
+	return hosts
+}
+
+// 查找请求命中的重定向缓存，按RFC 6733 6.13的顺序匹配，越具体的优先
+func (c *redirectCache) lookup(req *DiameterMsg) []string {
+	usages := []uint32{
+		RedirectUsageAllSession,
+		RedirectUsageAllUser,
+		RedirectUsageRealmAndApplication,
+		RedirectUsageAllRealm,
+		RedirectUsageAllApplication,
+		RedirectUsageAllHost,
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for _, usage := range usages {
+		key := redirectKey(usage, req)
+		if key == "" {
+			continue
+		}
+		entry, ok := c.entries[key]
+		if !ok {
+			continue
+		}
+		if now.After(entry.expireAt) {
+			delete(c.entries, key)
+			continue
+		}
+		return entry.hosts
+	}
+	return nil
+}
+
+// 从主机列表中选一个已建立连接的对端
+func openPeer(hosts []string) *Session {
+	for _, host := range hosts {
+		if session := peerTable.get(host); session != nil && session.State() == StateEstablished {
+			return session
+		}
+	}
+	return nil
+}
+
+// RouteRequest 按重定向缓存和路由表选择上游对端发送本端发起的请求，收到3006时按Redirect-Host重发
+func RouteRequest(req *DiameterMsg) (*DiameterMsg, error) {
+	realmAVP, _ := req.FindAVPByCode(AVP_DestinationRealm)
+	if realmAVP == nil {
+		return nil, fmt.Errorf("request without Destination-Realm")
+	}
+	assignDRMP(req)
+	route := config.lookupRoute(realmAVP.GetStringData(), req.GetApplicationID())
+	if route == nil {
+		route = &RouteConfig{}
+	}
+	type result struct {
+		rsp *DiameterMsg
+		err error
+	}
+	ch := make(chan result, 1)
+	if err := sendRouted(req, route, func(rsp *DiameterMsg, err error) { ch <- result{rsp, err} }); err != nil {
+		return nil, err
+	}
+	r := <-ch
+	return r.rsp, r.err
+}
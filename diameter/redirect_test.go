@@ -0,0 +1,131 @@
+package diameter
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// 重定向测试用的请求，字段为空时不带对应AVP
+type redirectTestRequest struct {
+	appID     uint32
+	sessionID string
+	realm     string
+	host      string
+	user      string
+}
+
+func (r redirectTestRequest) build() *DiameterMsg {
+	builder := NewDiameterMsgBuilder().
+		SetCommandCode(Cmd_TEST).
+		SetAppID(r.appID).
+		SetFlags(FlagRequest | FlagProxiable).
+		AddAVP(NewAVPBuilder(AVP_OriginHost, AVPFlag_Mandatory).SetStringData("client.local").Build())
+	avps := []struct {
+		code  uint32
+		value string
+	}{
+		{AVP_SessionId, r.sessionID},
+		{AVP_DestinationRealm, r.realm},
+		{AVP_DestinationHost, r.host},
+		{AVP_UserName, r.user},
+	}
+	for _, avp := range avps {
+		if avp.value != "" {
+			builder.AddAVP(NewAVPBuilder(avp.code, AVPFlag_Mandatory).SetStringData(avp.value).Build())
+		}
+	}
+	return builder.Build()
+}
+
+func TestRedirectURIHost(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want string
+	}{
+		{"aaa://hss.local", "hss.local"},
+		{"aaa://hss.local:3868;transport=tcp", "hss.local"},
+		{"aaas://hss.local;transport=sctp", "hss.local"},
+		{"hss.local", "hss.local"},
+	}
+	for _, tt := range tests {
+		if got := redirectURIHost(tt.uri); got != tt.want {
+			t.Errorf("redirectURIHost(%q) = %q, want %q", tt.uri, got, tt.want)
+		}
+	}
+}
+
+func TestRedirectCache(t *testing.T) {
+	learned := redirectTestRequest{AppID_Test, "client.local;1;1", "hss.local", "hss1.local", "alice"}
+	tests := []struct {
+		name   string
+		usage  uint32
+		lookup redirectTestRequest
+		hit    bool
+	}{
+		{"DONT_CACHE不缓存", RedirectUsageDontCache, learned, false},
+		{"ALL_SESSION同一会话命中", RedirectUsageAllSession, redirectTestRequest{sessionID: "client.local;1;1"}, true},
+		{"ALL_SESSION其他会话不命中", RedirectUsageAllSession, redirectTestRequest{sessionID: "client.local;1;2", realm: "hss.local"}, false},
+		{"ALL_REALM同一域命中", RedirectUsageAllRealm, redirectTestRequest{appID: AppID_S6a, realm: "hss.local"}, true},
+		{"ALL_REALM其他域不命中", RedirectUsageAllRealm, redirectTestRequest{realm: "other.local"}, false},
+		{"REALM_AND_APPLICATION同域同应用命中", RedirectUsageRealmAndApplication, redirectTestRequest{appID: AppID_Test, realm: "hss.local"}, true},
+		{"REALM_AND_APPLICATION其他应用不命中", RedirectUsageRealmAndApplication, redirectTestRequest{appID: AppID_S6a, realm: "hss.local"}, false},
+		{"ALL_APPLICATION同一应用命中", RedirectUsageAllApplication, redirectTestRequest{appID: AppID_Test}, true},
+		{"ALL_HOST同一目的主机命中", RedirectUsageAllHost, redirectTestRequest{host: "hss1.local"}, true},
+		{"ALL_USER同一用户命中", RedirectUsageAllUser, redirectTestRequest{user: "alice"}, true},
+		{"ALL_USER其他用户不命中", RedirectUsageAllUser, redirectTestRequest{user: "bob"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &redirectCache{entries: make(map[string]*redirectEntry)}
+			route := &RouteConfig{Peers: []string{"hss2.local", "hss3.local"}, RedirectUsage: tt.usage}
+			req := learned.build()
+			hosts := c.learn(req, newRedirectAnswer(req, route))
+			if !reflect.DeepEqual(hosts, route.Peers) {
+				t.Errorf("learn = %v, want %v", hosts, route.Peers)
+			}
+			got := c.lookup(tt.lookup.build())
+			if (got != nil) != tt.hit {
+				t.Fatalf("lookup = %v, want hit %v", got, tt.hit)
+			}
+			if got != nil && !reflect.DeepEqual(got, route.Peers) {
+				t.Errorf("lookup = %v, want %v", got, route.Peers)
+			}
+		})
+	}
+}
+
+// 多种缓存方式同时命中时越具体的优先，过期的记录不再使用
+func TestRedirectCacheLookupOrder(t *testing.T) {
+	c := &redirectCache{entries: make(map[string]*redirectEntry)}
+	req := redirectTestRequest{AppID_Test, "client.local;1;1", "hss.local", "", "alice"}.build()
+	for usage, host := range map[uint32]string{
+		RedirectUsageAllRealm:   "realm.local",
+		RedirectUsageAllUser:    "user.local",
+		RedirectUsageAllSession: "session.local",
+	} {
+		c.learn(req, newRedirectAnswer(req, &RouteConfig{Peers: []string{host}, RedirectUsage: usage}))
+	}
+
+	for _, want := range []string{"session.local", "user.local", "realm.local", ""} {
+		got := c.lookup(req)
+		if want == "" {
+			if got != nil {
+				t.Errorf("lookup = %v, want nil", got)
+			}
+			break
+		}
+		if len(got) != 1 || got[0] != want {
+			t.Fatalf("lookup = %v, want %v", got, want)
+		}
+		// 让命中的记录过期，下一次查找取下一种缓存方式
+		for _, entry := range c.entries {
+			if entry.hosts[0] == want {
+				entry.expireAt = time.Now().Add(-time.Second)
+			}
+		}
+	}
+	if len(c.entries) != 0 {
+		t.Errorf("expired entries = %v, want removed", len(c.entries))
+	}
+}
@@ -0,0 +1,350 @@
+package diameter
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// 路由动作
+const (
+	RouteActionLocal    = "local"    // 本地处理
+	RouteActionRelay    = "relay"    // 中继，原样转发给上游对端
+	RouteActionProxy    = "proxy"    // 代理，转发给上游对端
+	RouteActionRedirect = "redirect" // 重定向，告诉请求方直接找上游对端
+)
+
+// RouteConfig 路由表中的一项，按Destination-Realm和Application-Id匹配，按配置顺序取第一个匹配项
+type RouteConfig struct {
+	Realm          string   `json:"realm"`           // 目的域，为空或*匹配任意域
+	ApplicationIds []uint32 `json:"application_ids"` // 为空匹配任意应用
+	Action         string   `json:"action"`
+	Peers          []string `json:"peers"` // 上游对端的Origin-Host，重定向时作为Redirect-Host
+	// 重定向时的Redirect-Host-Usage和Redirect-Max-Cache-Time(秒，默认300)
+	RedirectUsage        uint32 `json:"redirect_usage"`
+	RedirectMaxCacheTime uint32 `json:"redirect_max_cache_time"`
+	// 多个上游对端间的负载均衡：round_robin(按权重轮询，默认)、least_outstanding(等待应答最少)
+	Balance string         `json:"balance"`
+	Weights map[string]int `json:"weights"` // 各上游对端的权重，默认1
+
+	balancer *routeBalancer
+}
+
+// 负载均衡策略
+const (
+	BalanceRoundRobin       = "round_robin"
+	BalanceLeastOutstanding = "least_outstanding"
+)
+
+// 平滑加权轮询的状态
+type routeBalancer struct {
+	mu      sync.Mutex
+	current map[string]int
+}
+
+func (r *RouteConfig) init() {
+	r.balancer = &routeBalancer{current: make(map[string]int)}
+}
+
+func (r *RouteConfig) weight(host string) int {
+	if w, ok := r.Weights[host]; ok && w > 0 {
+		return w
+	}
+	return 1
+}
+
+func (r *RouteConfig) match(realm string, appID uint32) bool {
+	if r.Realm != "" && r.Realm != "*" && r.Realm != realm {
+		return false
+	}
+	if len(r.ApplicationIds) == 0 {
+		return true
+	}
+	for _, id := range r.ApplicationIds {
+		if id == appID {
+			return true
+		}
+	}
+	return false
+}
+
+// 查找路由，没有匹配项时返回nil，按本地处理
+func (c *DiameterConfig) lookupRoute(realm string, appID uint32) *RouteConfig {
+	for i := range c.Routes {
+		if c.Routes[i].match(realm, appID) {
+			return &c.Routes[i]
+		}
+	}
+	return nil
+}
+
+// 按路由表处理请求，handled为false表示需要本地处理
+func routeRequest(session *Session, msg *DiameterMsg) (rsp *DiameterMsg, handled bool) {
+	switch msg.GetCommandCode() {
+	case Cmd_CE, Cmd_DW, Cmd_DP:
+		// 基础协议消息只在相邻对端之间交互
+		return nil, false
+	}
+	// 不可代理的请求只能本地处理
+	if msg.GetFlags()&FlagProxiable == 0 {
+		return nil, false
+	}
+	realmAVP, _ := msg.FindAVPByCode(AVP_DestinationRealm)
+	if realmAVP == nil {
+		return nil, false
+	}
+	route := config.lookupRoute(realmAVP.GetStringData(), msg.GetApplicationID())
+	if route == nil {
+		return nil, false
+	}
+
+	switch route.Action {
+	case RouteActionRelay, RouteActionProxy:
+		if err := forwardRequest(session, msg, route); err != nil {
+			log.Printf("主机%v 转发请求失败: %v", session.PeerHost, err)
+			return newErrorAnswer(msg, forwardErrorCode(err), err.Error()), true
+		}
+		return nil, true
+	case RouteActionRedirect:
+		return newRedirectAnswer(msg, route), true
+	default:
+		return nil, false
+	}
+}
+
+// 本端服务的域：本端所在域以及路由表中动作为local的域
+func isLocalRealm(realm string) bool {
+	if realm == config.OriginRealm {
+		return true
+	}
+	for i := range config.Routes {
+		route := &config.Routes[i]
+		if route.Action == RouteActionLocal && route.Realm == realm {
+			return true
+		}
+	}
+	return false
+}
+
+// 路由表没有转发的请求，检查是否确实应由本端处理：
+// 目的域不是本端服务的域回复3003，指定的目的主机不是本端时转给该对端，不是直连对端则回复3002
+func checkLocalDelivery(session *Session, msg *DiameterMsg) (rsp *DiameterMsg, handled bool) {
+	switch msg.GetCommandCode() {
+	case Cmd_CE, Cmd_DW, Cmd_DP:
+		return nil, false
+	}
+	realmAVP, _ := msg.FindAVPByCode(AVP_DestinationRealm)
+	if realmAVP != nil {
+		realm := realmAVP.GetStringData()
+		route := config.lookupRoute(realm, msg.GetApplicationID())
+		if (route == nil || route.Action != RouteActionLocal) && !isLocalRealm(realm) {
+			log.Printf("主机%v 请求的目的域%v 不由本端服务", session.PeerHost, realm)
+			return newErrorAnswer(msg, ResultCode_RealmNotServed, fmt.Sprintf("realm %v not served", realm)), true
+		}
+	}
+
+	hostAVP, _ := msg.FindAVPByCode(AVP_DestinationHost)
+	if hostAVP == nil || hostAVP.GetStringData() == config.OriginHost {
+		return nil, false
+	}
+	host := hostAVP.GetStringData()
+	if msg.GetFlags()&FlagProxiable != 0 && openPeer([]string{host}) != nil {
+		route := &RouteConfig{Action: RouteActionRelay, Peers: []string{host}}
+		if err := forwardRequest(session, msg, route); err == nil {
+			return nil, true
+		}
+	}
+	log.Printf("主机%v 请求的目的主机%v 不是本端也不是已连接的对端", session.PeerHost, host)
+	return newErrorAnswer(msg, ResultCode_UnableToDeliver, fmt.Sprintf("destination host %v unreachable", host)), true
+}
+
+// 检查Route-Record：出现本端标识说明请求绕回来了；
+// 请求经过中继时，最后一个Route-Record与直连对端不一致只记日志，开启strict_route_record时拒绝
+func checkRouteRecord(session *Session, msg *DiameterMsg) (uint32, error) {
+	switch msg.GetCommandCode() {
+	case Cmd_CE, Cmd_DW, Cmd_DP:
+		return 0, nil
+	}
+	records := msg.FindAVPsByCode(AVP_RouteRecord)
+	for _, record := range records {
+		if record.GetStringData() == config.OriginHost {
+			return ResultCode_LoopDetected, fmt.Errorf("loop detected, %v already in Route-Record", config.OriginHost)
+		}
+	}
+	hostAVP, _ := msg.FindAVPByCode(AVP_OriginHost)
+	if hostAVP == nil || hostAVP.GetStringData() == session.PeerHost {
+		return 0, nil
+	}
+	if len(records) == 0 {
+		log.Printf("主机%v 转发来自%v的请求，但没有携带Route-Record", session.PeerHost, hostAVP.GetStringData())
+		return 0, nil
+	}
+	if last := records[len(records)-1].GetStringData(); last != session.PeerHost {
+		if config.StrictRouteRecord {
+			return ResultCode_UnableToComply, fmt.Errorf("last Route-Record %v does not match peer %v", last, session.PeerHost)
+		}
+		log.Printf("主机%v 转发来自%v的请求，最后一个Route-Record是%v", session.PeerHost, hostAVP.GetStringData(), last)
+	}
+	return 0, nil
+}
+
+// 按负载均衡策略选择一个已建立连接的上游对端，exclude中是已经失败过的对端
+func selectUpstream(route *RouteConfig, exclude map[string]bool) *Session {
+	candidates := make([]*Session, 0, len(route.Peers))
+	for _, host := range route.Peers {
+		if exclude[host] {
+			continue
+		}
+		if session := openPeer([]string{host}); session != nil {
+			candidates = append(candidates, session)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	if len(candidates) == 1 || route.balancer == nil {
+		return candidates[0]
+	}
+
+	if route.Balance == BalanceLeastOutstanding {
+		best := candidates[0]
+		for _, session := range candidates[1:] {
+			if session.outstanding() < best.outstanding() {
+				best = session
+			}
+		}
+		return best
+	}
+
+	// 平滑加权轮询：每轮各对端加上自身权重，选当前值最大的，选中后减去总权重
+	b := route.balancer
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var best *Session
+	total := 0
+	for _, session := range candidates {
+		w := route.weight(session.PeerHost)
+		total += w
+		b.current[session.PeerHost] += w
+		if best == nil || b.current[session.PeerHost] > b.current[best.PeerHost] {
+			best = session
+		}
+	}
+	b.current[best.PeerHost] -= total
+	return best
+}
+
+// 转发请求给上游对端，换成新的Hop-by-Hop ID，应答回来后还原并发回请求方
+func forwardRequest(session *Session, msg *DiameterMsg, route *RouteConfig) error {
+	originHopByHopID := msg.GetHopByHopID()
+	forwarded := msg.clone()
+	// 转发前追加本端标识，下游据此检测环路
+	forwarded.appendAVP(NewAVPBuilder(AVP_RouteRecord, AVPFlag_Mandatory).SetStringData(config.OriginHost).Build())
+
+	err := sendRouted(forwarded, route, func(rsp *DiameterMsg, err error) {
+		if err != nil {
+			log.Printf("主机%v 转发请求失败: %v", session.PeerHost, err)
+			rsp := newErrorAnswer(msg, forwardErrorCode(err), err.Error())
+			requestCache.release(msg, rsp)
+			session.Send(rsp)
+			return
+		}
+		answer := rsp.clone()
+		answer.setHopByHopID(originHopByHopID)
+		requestCache.store(msg, answer)
+		if err := session.Send(answer); err != nil {
+			log.Printf("主机%v 转发应答失败: %v", session.PeerHost, err)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	metrics.inc(MetricRelayedRequests)
+	log.Printf("主机%v 请求(Command: %v End-to-End: %v)%v给上游", session.PeerHost, msg.GetCommandCode(), msg.GetEndToEndID(), route.Action)
+	return nil
+}
+
+// 按重定向缓存或路由选择上游对端发送请求，每次发送使用新的Hop-by-Hop ID；
+// 上游回复3006时记录重定向并改发给Redirect-Host，callback收到最终应答或错误
+func sendRouted(req *DiameterMsg, route *RouteConfig, callback func(rsp *DiameterMsg, err error)) error {
+	// 指定了目的主机且与其直连时直接发给它
+	var upstream *Session
+	if hostAVP, _ := req.FindAVPByCode(AVP_DestinationHost); hostAVP != nil {
+		upstream = openPeer([]string{hostAVP.GetStringData()})
+	}
+	if upstream == nil {
+		upstream = openPeer(redirects.lookup(req))
+	}
+	if upstream == nil {
+		upstream = selectUpstream(route, nil)
+	}
+	if upstream == nil {
+		return fmt.Errorf("no open upstream peer for realm %v", route.Realm)
+	}
+	return sendUpstream(upstream, req, route, map[string]bool{}, 0, callback)
+}
+
+// tried记录已经发送过的上游对端，上游连接断开(包括保活失败)时，
+// 带上T标志切换到路由中其他对端重传
+func sendUpstream(upstream *Session, req *DiameterMsg, route *RouteConfig, tried map[string]bool, redirected int, callback func(rsp *DiameterMsg, err error)) error {
+	tried[upstream.PeerHost] = true
+	// 上游通告了过载，按过载报告丢弃的请求优先改发给路由中其他对端
+	if overloads.throttle(upstream.PeerHost, requestRealm(req)) {
+		if alternate := selectUpstream(route, tried); alternate != nil {
+			return sendUpstream(alternate, req, route, tried, redirected, callback)
+		}
+		return throttledError(upstream)
+	}
+	forwarded := req.clone()
+	forwarded.setHopByHopID(nextHopByHopID())
+	addSupportedFeatures(forwarded)
+
+	var answered int32
+	onAnswer := func(rsp *DiameterMsg) {
+		if !markAnswered(&answered) {
+			return
+		}
+		if rsp == nil {
+			if alternate := selectUpstream(route, tried); alternate != nil {
+				log.Printf("上游对端%v 连接断开，请求(End-to-End: %v)切换到%v重传", upstream.PeerHost, req.GetEndToEndID(), alternate.PeerHost)
+				metrics.inc(MetricFailoverRequests)
+				retransmitted := req.clone()
+				retransmitted.setRetransmitted()
+				if err := sendUpstream(alternate, retransmitted, route, tried, redirected, callback); err == nil {
+					return
+				}
+			}
+			callback(nil, fmt.Errorf("upstream peer %v connection closed", upstream.PeerHost))
+			return
+		}
+		overloads.learn(rsp)
+		if getResultCode(rsp) == ResultCode_RedirectIndication && redirected < maxRedirects {
+			hosts := redirects.learn(req, rsp)
+			next := openPeer(hosts)
+			if next == nil {
+				callback(nil, fmt.Errorf("no open peer in Redirect-Host %v", hosts))
+				return
+			}
+			log.Printf("上游对端%v 重定向到%v", upstream.PeerHost, next.PeerHost)
+			if err := sendUpstream(next, req, route, tried, redirected+1, callback); err != nil {
+				callback(nil, err)
+			}
+			return
+		}
+		callback(rsp, nil)
+	}
+	if err := upstream.SendRequestAsync(forwarded, onAnswer); err != nil {
+		return err
+	}
+	metrics.inc(MetricUpstreamRequests + upstream.PeerHost)
+
+	// 上游一直不回应答，超时后按无法送达处理
+	hopByHopID := forwarded.GetHopByHopID()
+	time.AfterFunc(config.Limits.requestTimeout(), func() {
+		if upstream.cancelPending(hopByHopID) && markAnswered(&answered) {
+			callback(nil, fmt.Errorf("upstream peer %v answer timeout", upstream.PeerHost))
+		}
+	})
+	return nil
+}
@@ -0,0 +1,168 @@
+package diameter
+
+import (
+	"net"
+	"testing"
+)
+
+func TestLookupRoute(t *testing.T) {
+	saved := config.Routes
+	defer func() { config.Routes = saved }()
+	config.Routes = []RouteConfig{
+		{Realm: "hss.local", ApplicationIds: []uint32{AppID_S6a}, Action: RouteActionRelay, Peers: []string{"hss1"}},
+		{Realm: "hss.local", Action: RouteActionProxy, Peers: []string{"hss2"}},
+		{Realm: "redirect.local", Action: RouteActionRedirect, Peers: []string{"hss3"}},
+		{Realm: "*", ApplicationIds: []uint32{AppID_Gx}, Action: RouteActionLocal},
+	}
+
+	tests := []struct {
+		name  string
+		realm string
+		appID uint32
+		want  int // 匹配到的路由下标，-1表示没有匹配项
+	}{
+		{"域和应用都匹配", "hss.local", AppID_S6a, 0},
+		{"按配置顺序取第一个匹配项", "hss.local", AppID_Gx, 1},
+		{"不限应用的路由", "hss.local", AppID_Test, 1},
+		{"重定向路由", "redirect.local", AppID_S6a, 2},
+		{"*匹配任意域", "other.local", AppID_Gx, 3},
+		{"应用不匹配", "other.local", AppID_S6a, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := config.lookupRoute(tt.realm, tt.appID)
+			if tt.want < 0 {
+				if got != nil {
+					t.Errorf("lookupRoute = %+v, want nil", got)
+				}
+				return
+			}
+			if got != &config.Routes[tt.want] {
+				t.Errorf("lookupRoute = %+v, want route %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// 已建立连接的上游对端，对端收到的消息写入返回的channel，用例结束时注销并关闭连接
+func newTestUpstream(t *testing.T, host string) (*Session, <-chan *DiameterMsg) {
+	local, remote := net.Pipe()
+	session := newSession(local)
+	session.PeerHost = host
+	session.setState(StateEstablished)
+	peerTable.register(session, host)
+	received := make(chan *DiameterMsg, 16)
+	go func() {
+		for {
+			msg, err := readDiameterMsg(remote)
+			if err != nil {
+				return
+			}
+			received <- msg
+		}
+	}()
+	t.Cleanup(func() {
+		peerTable.unregister(session)
+		local.Close()
+		remote.Close()
+	})
+	return session, received
+}
+
+func TestSelectUpstream(t *testing.T) {
+	tests := []struct {
+		name    string
+		balance string
+		weights map[string]int
+		pending map[string]int // 各对端等待应答的请求数
+		exclude map[string]bool
+		want    []string // 依次选中的对端
+	}{
+		{"默认权重轮询", "", nil, nil, nil, []string{"up1", "up2", "up3", "up1", "up2", "up3"}},
+		{"平滑加权轮询", BalanceRoundRobin, map[string]int{"up1": 4, "up2": 2}, nil, nil, []string{"up1", "up2", "up1", "up3", "up1", "up2", "up1"}},
+		{"跳过已失败的对端", BalanceRoundRobin, nil, nil, map[string]bool{"up2": true}, []string{"up1", "up3", "up1", "up3"}},
+		{"等待应答最少", BalanceLeastOutstanding, nil, map[string]int{"up1": 2, "up2": 1, "up3": 3}, nil, []string{"up2", "up2"}},
+		{"等待应答相同时取第一个", BalanceLeastOutstanding, nil, map[string]int{"up1": 1, "up2": 1, "up3": 1}, nil, []string{"up1"}},
+		{"只剩一个可用对端", BalanceLeastOutstanding, nil, nil, map[string]bool{"up1": true, "up3": true}, []string{"up2", "up2"}},
+		{"没有可用对端", "", nil, nil, map[string]bool{"up1": true, "up2": true, "up3": true}, []string{""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, host := range []string{"up1", "up2", "up3"} {
+				session, _ := newTestUpstream(t, host)
+				for i := 0; i < tt.pending[host]; i++ {
+					session.pending[uint32(i)] = &pendingRequest{}
+				}
+			}
+			route := &RouteConfig{Peers: []string{"up1", "up2", "up3"}, Balance: tt.balance, Weights: tt.weights}
+			route.init()
+			for i, want := range tt.want {
+				got := ""
+				if session := selectUpstream(route, tt.exclude); session != nil {
+					got = session.PeerHost
+				}
+				if got != want {
+					t.Errorf("selection %v = %q, want %q", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+// 上游连接断开时带T标志切换到路由中其他对端重传，全部失败时回调错误
+func TestSendUpstreamFailover(t *testing.T) {
+	tests := []struct {
+		name     string
+		peers    []string
+		answered bool
+	}{
+		{"切换到其他对端", []string{"up1", "up2"}, true},
+		{"没有其他对端", []string{"up1"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sessions := make(map[string]*Session)
+			received := make(map[string]<-chan *DiameterMsg)
+			for _, host := range tt.peers {
+				sessions[host], received[host] = newTestUpstream(t, host)
+			}
+			route := &RouteConfig{Peers: tt.peers}
+			route.init()
+
+			type result struct {
+				rsp *DiameterMsg
+				err error
+			}
+			results := make(chan result, 1)
+			req := newTestRequest(Cmd_TEST, "client.local", 1, 100)
+			err := sendUpstream(sessions["up1"], req, route, map[string]bool{}, 0, func(rsp *DiameterMsg, err error) {
+				results <- result{rsp, err}
+			})
+			if err != nil {
+				t.Fatalf("sendUpstream: %v", err)
+			}
+			if msg := <-received["up1"]; msg.GetFlags()&FlagRetransmitted != 0 {
+				t.Error("first attempt should not carry T flag")
+			}
+			sessions["up1"].closePending()
+
+			if tt.answered {
+				msg := <-received["up2"]
+				if msg.GetFlags()&FlagRetransmitted == 0 {
+					t.Error("retransmission should carry T flag")
+				}
+				if msg.GetEndToEndID() != req.GetEndToEndID() {
+					t.Errorf("End-to-End = %v, want %v", msg.GetEndToEndID(), req.GetEndToEndID())
+				}
+				sessions["up2"].dispatchAnswer(newErrorAnswer(msg, ResultCode_Success, ""))
+			}
+			got := <-results
+			if (got.err == nil) != tt.answered {
+				t.Fatalf("callback err = %v, want answered %v", got.err, tt.answered)
+			}
+			if got.rsp != nil && getResultCode(got.rsp) != ResultCode_Success {
+				t.Errorf("Result-Code = %v, want %v", getResultCode(got.rsp), ResultCode_Success)
+			}
+		})
+	}
+}
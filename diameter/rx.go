@@ -0,0 +1,590 @@
+package diameter
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rx的Experimental-Result-Code，3GPP TS 29.214 5.5
+const (
+	ExperimentalResult_IPCANSessionNotAvailable = 5065 // IP-CAN_SESSION_NOT_AVAILABLE
+)
+
+// Specific-Action，TS 29.214 5.3.13，只列出常用的
+const (
+	SpecificActionChargingCorrelationExchange   = 1
+	SpecificActionLossOfBearer                  = 2
+	SpecificActionRecoveryOfBearer              = 3
+	SpecificActionReleaseOfBearer               = 4
+	SpecificActionIPCANChange                   = 6
+	SpecificActionOutOfCredit                   = 7
+	SpecificActionSuccessfulResourcesAllocation = 8
+	SpecificActionFailedResourcesAllocation     = 9
+)
+
+var specificActionNames = map[uint32]string{
+	SpecificActionChargingCorrelationExchange:   "CHARGING_CORRELATION_EXCHANGE",
+	SpecificActionLossOfBearer:                  "INDICATION_OF_LOSS_OF_BEARER",
+	SpecificActionRecoveryOfBearer:              "INDICATION_OF_RECOVERY_OF_BEARER",
+	SpecificActionReleaseOfBearer:               "INDICATION_OF_RELEASE_OF_BEARER",
+	SpecificActionIPCANChange:                   "IP-CAN_CHANGE",
+	SpecificActionOutOfCredit:                   "INDICATION_OF_OUT_OF_CREDIT",
+	SpecificActionSuccessfulResourcesAllocation: "INDICATION_OF_SUCCESSFUL_RESOURCES_ALLOCATION",
+	SpecificActionFailedResourcesAllocation:     "INDICATION_OF_FAILED_RESOURCES_ALLOCATION",
+}
+
+// Abort-Cause，TS 29.214 5.3.1
+const (
+	AbortCauseBearerReleased              = 0
+	AbortCauseInsufficientServerResources = 1
+	AbortCauseInsufficientBearerResources = 2
+	AbortCausePSToCSHandover              = 3
+)
+
+// Media-Type，TS 29.214 5.3.19
+const (
+	MediaTypeAudio       = 0
+	MediaTypeVideo       = 1
+	MediaTypeData        = 2
+	MediaTypeApplication = 3
+	MediaTypeControl     = 4
+)
+
+const (
+	rxRequestUpdate               = 1  // Rx-Request-Type UPDATE_REQUEST
+	flowUsageAFSignalling         = 2  // Flow-Usage AF_SIGNALLING
+	flowStatusDisabled            = 3  // Flow-Status DISABLED
+	flowStatusRemoved             = 4  // Flow-Status REMOVED
+	ruleFailureResourceAllocation = 10 // Rule-Failure-Code RESOURCE_ALLOCATION_FAILURE
+	rxRulePrecedence              = 10
+	rxRuleARP                     = 2
+	defaultRxScenarioDir          = "scenarios"
+)
+
+// 媒体类型对应的QCI，TS 23.203 6.1.7，音视频为GBR承载
+var rxMediaQCI = map[uint32]uint32{
+	MediaTypeAudio: 1,
+	MediaTypeVideo: 2,
+}
+
+// Gx上报的Event-Trigger对应通知AF的Specific-Action，TS 29.213
+var rxEventActions = map[uint32]uint32{
+	EventTriggerLossOfBearer:       SpecificActionLossOfBearer,
+	EventTriggerRecoveryOfBearer:   SpecificActionRecoveryOfBearer,
+	EventTriggerIPCANChange:        SpecificActionIPCANChange,
+	EventTriggerResourceAllocation: SpecificActionSuccessfulResourcesAllocation,
+}
+
+// RxConfig Rx配置
+type RxConfig struct {
+	RequireGxSession bool   `json:"require_gx_session"` // AAR找不到绑定的Gx会话时回复5065，否则只记录会话
+	ScenarioDir      string `json:"scenario_dir"`       // 作为AF时的场景文件目录，默认scenarios
+}
+
+func (c *RxConfig) scenarioDir() string {
+	if c.ScenarioDir == "" {
+		return defaultRxScenarioDir
+	}
+	return c.ScenarioDir
+}
+
+// RxMediaSubComponent 媒体子组件，即一个IP流
+type RxMediaSubComponent struct {
+	FlowNumber   uint32   `json:"flow_number"`
+	Descriptions []string `json:"descriptions,omitempty"` // Flow-Description，permit out为下行，permit in为上行
+	Usage        uint32   `json:"usage,omitempty"`        // Flow-Usage：0 NO_INFORMATION，1 RTCP，2 AF_SIGNALLING
+}
+
+// RxMediaComponent 媒体组件，对应Media-Component-Description，带宽单位bps
+type RxMediaComponent struct {
+	Number        uint32                `json:"number"`
+	Type          uint32                `json:"type"` // Media-Type：0 AUDIO，1 VIDEO，2 DATA...
+	MBRUL         uint32                `json:"mbr_ul,omitempty"`
+	MBRDL         uint32                `json:"mbr_dl,omitempty"`
+	FlowStatus    *uint32               `json:"flow_status,omitempty"` // 不带时按ENABLED处理
+	SubComponents []RxMediaSubComponent `json:"sub_components,omitempty"`
+}
+
+func parseMediaComponent(avp *AVPMsg) RxMediaComponent {
+	var mc RxMediaComponent
+	subAVPs, err := avp.GetGroupedAVPs()
+	if err != nil {
+		return mc
+	}
+	for _, sub := range subAVPs {
+		switch sub.GetCode() {
+		case AVP_MediaComponentNumber:
+			mc.Number = sub.GetIntData()
+		case AVP_MediaType:
+			mc.Type = sub.GetIntData()
+		case AVP_MaxRequestedBandwidthUL:
+			mc.MBRUL = sub.GetIntData()
+		case AVP_MaxRequestedBandwidthDL:
+			mc.MBRDL = sub.GetIntData()
+		case AVP_FlowStatus:
+			status := sub.GetIntData()
+			mc.FlowStatus = &status
+		case AVP_MediaSubComponent:
+			var msc RxMediaSubComponent
+			flowAVPs, err := sub.GetGroupedAVPs()
+			if err != nil {
+				continue
+			}
+			for _, flowAVP := range flowAVPs {
+				switch flowAVP.GetCode() {
+				case AVP_FlowNumber:
+					msc.FlowNumber = flowAVP.GetIntData()
+				case AVP_FlowDescription:
+					msc.Descriptions = append(msc.Descriptions, flowAVP.GetStringData())
+				case AVP_FlowUsage:
+					msc.Usage = flowAVP.GetIntData()
+				}
+			}
+			mc.SubComponents = append(mc.SubComponents, msc)
+		}
+	}
+	return mc
+}
+
+func mediaComponentAVP(mc RxMediaComponent) *AVPMsg {
+	avps := []*AVPMsg{
+		New3GPPAVPBuilder(AVP_MediaComponentNumber, AVPFlag_Mandatory).SetIntData(mc.Number).Build(),
+		New3GPPAVPBuilder(AVP_MediaType, AVPFlag_Mandatory).SetIntData(mc.Type).Build(),
+	}
+	for _, msc := range mc.SubComponents {
+		flowAVPs := []*AVPMsg{New3GPPAVPBuilder(AVP_FlowNumber, AVPFlag_Mandatory).SetIntData(msc.FlowNumber).Build()}
+		for _, description := range msc.Descriptions {
+			flowAVPs = append(flowAVPs, New3GPPAVPBuilder(AVP_FlowDescription, AVPFlag_Mandatory).SetStringData(description).Build())
+		}
+		if msc.Usage > 0 {
+			flowAVPs = append(flowAVPs, New3GPPAVPBuilder(AVP_FlowUsage, AVPFlag_Mandatory).SetIntData(msc.Usage).Build())
+		}
+		avps = append(avps, New3GPPAVPBuilder(AVP_MediaSubComponent, AVPFlag_Mandatory).SetGroupedData(flowAVPs...).Build())
+	}
+	if mc.MBRUL > 0 {
+		avps = append(avps, New3GPPAVPBuilder(AVP_MaxRequestedBandwidthUL, AVPFlag_Mandatory).SetIntData(mc.MBRUL).Build())
+	}
+	if mc.MBRDL > 0 {
+		avps = append(avps, New3GPPAVPBuilder(AVP_MaxRequestedBandwidthDL, AVPFlag_Mandatory).SetIntData(mc.MBRDL).Build())
+	}
+	if mc.FlowStatus != nil {
+		avps = append(avps, New3GPPAVPBuilder(AVP_FlowStatus, AVPFlag_Mandatory).SetIntData(*mc.FlowStatus).Build())
+	}
+	return New3GPPAVPBuilder(AVP_MediaComponentDescription, AVPFlag_Mandatory).SetGroupedData(avps...).Build()
+}
+
+// Flows，只带Media-Component-Number表示该媒体组件的所有流
+func flowsAVP(component uint32) *AVPMsg {
+	return New3GPPAVPBuilder(AVP_Flows, AVPFlag_Mandatory).SetGroupedData(
+		New3GPPAVPBuilder(AVP_MediaComponentNumber, AVPFlag_Mandatory).SetIntData(component).Build(),
+	).Build()
+}
+
+// rxSession PCRF侧的一个AF会话
+type rxSession struct {
+	id              int // 生成的规则名为af<id>-<媒体组件号>
+	afHost          string
+	framedIP        string
+	subscribers     []string
+	afAppID         string
+	gxSessionID     string // 绑定的Gx会话，没有绑定时为空
+	specificActions map[uint32]bool
+	media           map[uint32]RxMediaComponent
+	pending         bool // 有未完成的RAR/ASR
+	createdAt       time.Time
+	updatedAt       time.Time
+}
+
+func (s *rxSession) rulePrefix() string {
+	return fmt.Sprintf("af%d-", s.id)
+}
+
+// 规则名对应的媒体组件号，不是本会话的规则时ok为false
+func (s *rxSession) ruleComponent(name string) (uint32, bool) {
+	if !strings.HasPrefix(name, s.rulePrefix()) {
+		return 0, false
+	}
+	number, err := strconv.ParseUint(strings.TrimPrefix(name, s.rulePrefix()), 10, 32)
+	return uint32(number), err == nil
+}
+
+// 按媒体组件生成PCC规则，每个组件一条，禁用或没有流描述的组件不生成
+func (s *rxSession) rules() []GxRule {
+	numbers := make([]uint32, 0, len(s.media))
+	for number := range s.media {
+		numbers = append(numbers, number)
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+	rules := make([]GxRule, 0, len(numbers))
+	for _, number := range numbers {
+		mc := s.media[number]
+		if mc.FlowStatus != nil && (*mc.FlowStatus == flowStatusDisabled || *mc.FlowStatus == flowStatusRemoved) {
+			continue
+		}
+		rule := GxRule{Name: fmt.Sprintf("%v%d", s.rulePrefix(), number), Precedence: rxRulePrecedence}
+		signalling := len(mc.SubComponents) > 0
+		for _, msc := range mc.SubComponents {
+			if msc.Usage != flowUsageAFSignalling {
+				signalling = false
+			}
+			for _, description := range msc.Descriptions {
+				flow := GxFlow{Description: description}
+				switch {
+				case strings.HasPrefix(description, "permit out"):
+					flow.Direction = 1
+				case strings.HasPrefix(description, "permit in"):
+					flow.Direction = 2
+				}
+				rule.Flows = append(rule.Flows, flow)
+			}
+		}
+		if len(rule.Flows) == 0 {
+			continue
+		}
+		qos := &GxQoS{QCI: defaultS6aQCI, ARPPriority: rxRuleARP, MBRUL: mc.MBRUL, MBRDL: mc.MBRDL}
+		if qci, ok := rxMediaQCI[mc.Type]; ok {
+			qos.QCI, qos.GBRUL, qos.GBRDL = qci, mc.MBRUL, mc.MBRDL
+		} else if signalling {
+			qos.QCI = 5 // IMS信令
+		}
+		rule.QoS = qos
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// RxSessionStatus PCRF侧Rx会话的快照，供管理接口查看
+type RxSessionStatus struct {
+	SessionID       string             `json:"session_id"`
+	AFHost          string             `json:"af_host"`
+	FramedIP        string             `json:"framed_ip,omitempty"`
+	Subscribers     []string           `json:"subscribers,omitempty"`
+	AFAppID         string             `json:"af_application_id,omitempty"`
+	GxSessionID     string             `json:"gx_session_id,omitempty"`
+	SpecificActions []uint32           `json:"specific_actions,omitempty"`
+	Media           []RxMediaComponent `json:"media"`
+	CreatedAt       time.Time          `json:"created_at"`
+	UpdatedAt       time.Time          `json:"updated_at"`
+}
+
+type rxSessionStore struct {
+	mu       sync.Mutex
+	nextID   int
+	sessions map[string]*rxSession
+}
+
+var rxSessions = &rxSessionStore{sessions: make(map[string]*rxSession)}
+
+// RxSessions 返回PCRF侧所有Rx会话的快照
+func RxSessions() []RxSessionStatus {
+	rxSessions.mu.Lock()
+	defer rxSessions.mu.Unlock()
+	statuses := make([]RxSessionStatus, 0, len(rxSessions.sessions))
+	for sessionID, s := range rxSessions.sessions {
+		status := RxSessionStatus{
+			SessionID:   sessionID,
+			AFHost:      s.afHost,
+			FramedIP:    s.framedIP,
+			Subscribers: s.subscribers,
+			AFAppID:     s.afAppID,
+			GxSessionID: s.gxSessionID,
+			Media:       make([]RxMediaComponent, 0, len(s.media)),
+			CreatedAt:   s.createdAt,
+			UpdatedAt:   s.updatedAt,
+		}
+		for action := range s.specificActions {
+			status.SpecificActions = append(status.SpecificActions, action)
+		}
+		sort.Slice(status.SpecificActions, func(i, j int) bool { return status.SpecificActions[i] < status.SpecificActions[j] })
+		for _, mc := range s.media {
+			status.Media = append(status.Media, mc)
+		}
+		sort.Slice(status.Media, func(i, j int) bool { return status.Media[i].Number < status.Media[j].Number })
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].SessionID < statuses[j].SessionID })
+	return statuses
+}
+
+// 把Rx会话的规则更新到绑定的Gx会话，并向PCEF发出RAR
+func pushRxRules(gxSessionID, prefix string, rules []GxRule) {
+	if gxSessionID == "" {
+		return
+	}
+	if !gxSessions.setAFRules(gxSessionID, prefix, rules) {
+		log.Printf("Gx会话%v已不存在，不下发Rx规则", gxSessionID)
+		return
+	}
+	go func() {
+		_, err := PushGxPolicy(gxSessionID)
+		switch {
+		case errors.Is(err, errSessionPending):
+			// 已有RAR未完成，规则在它的RAA之后再下发
+			log.Printf("Gx会话%v 有未完成的RAR，Rx规则在应答后下发", gxSessionID)
+		case err != nil:
+			log.Printf("Gx会话%v下发Rx规则失败: %v", gxSessionID, err)
+		}
+	}()
+}
+
+// 处理Rx的AAR：记录媒体描述和订阅的Specific-Action，按UE地址绑定Gx会话并下发对应的PCC规则
+func handleRxAAR(session *Session, msg *DiameterMsg) (*DiameterMsg, error) {
+	sessionID := msg.GetSessionID()
+	var framedIP string
+	if avp, _ := msg.FindAVPByCode(AVP_FramedIPAddress); avp != nil && avp.GetDataLength() == net.IPv4len {
+		framedIP = net.IP(avp.GetRawData()).String()
+	}
+	subscribers := gxSubscriberIDs(msg)
+	log.Printf("主机%v Rx请求 Session-Id: %v UE地址: %v 用户: %v", session.PeerHost, sessionID, framedIP, subscribers)
+
+	builder := newAnswerBuilder(msg).
+		AddAVP(NewAVPBuilder(AVP_AuthApplicationId, AVPFlag_Mandatory).SetIntData(AppID_Rx).Build())
+	reject := func(resultCode uint32, experimental bool, err error) (*DiameterMsg, error) {
+		log.Printf("主机%v Rx请求不通过: %v", session.PeerHost, err)
+		if experimental {
+			builder.AddAVP(experimentalResultAVP(VendorID_3GPP, resultCode))
+		} else {
+			builder.AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(resultCode).Build())
+		}
+		return builder.AddAVP(NewAVPBuilder(AVP_ErrorMessage, 0).SetStringData(err.Error()).Build()).Build(), nil
+	}
+
+	if session.State() != StateEstablished {
+		return reject(ResultCode_UnableToDeliver, false, fmt.Errorf("session not established, send CER first"))
+	}
+
+	rxSessions.mu.Lock()
+	defer rxSessions.mu.Unlock()
+
+	now := time.Now()
+	rs, ok := rxSessions.sessions[sessionID]
+	if ok && rs.afHost != session.PeerHost {
+		return reject(ResultCode_UnknownSessionID, false, fmt.Errorf("Rx session %v belongs to %v", sessionID, rs.afHost))
+	}
+	if !ok && avpIntData(msg, AVP_RxRequestType) == rxRequestUpdate {
+		return reject(ResultCode_UnknownSessionID, false, fmt.Errorf("Rx session %v not found", sessionID))
+	}
+	if !ok {
+		gxSessionID := gxSessions.bind(framedIP, subscribers)
+		if gxSessionID == "" && config.Rx.RequireGxSession {
+			return reject(ExperimentalResult_IPCANSessionNotAvailable, true, fmt.Errorf("no Gx session for UE %v %v", framedIP, subscribers))
+		}
+		rxSessions.nextID++
+		rs = &rxSession{
+			id:              rxSessions.nextID,
+			afHost:          session.PeerHost,
+			framedIP:        framedIP,
+			subscribers:     subscribers,
+			gxSessionID:     gxSessionID,
+			specificActions: make(map[uint32]bool),
+			media:           make(map[uint32]RxMediaComponent),
+			createdAt:       now,
+		}
+		rxSessions.sessions[sessionID] = rs
+		log.Printf("Rx会话%v建立，绑定Gx会话: %v", sessionID, gxSessionID)
+	}
+	rs.updatedAt = now
+	if avp, _ := msg.FindAVPByCode(AVP_AFApplicationIdentifier); avp != nil {
+		rs.afAppID = avp.GetStringData()
+	}
+	// 修改时带了Specific-Action就替换之前的订阅
+	if actionAVPs := msg.FindAVPsByCode(AVP_SpecificAction); len(actionAVPs) > 0 {
+		rs.specificActions = make(map[uint32]bool, len(actionAVPs))
+		for _, avp := range actionAVPs {
+			rs.specificActions[avp.GetIntData()] = true
+		}
+	}
+	// 修改时只带变化的媒体组件，按组件号替换
+	for _, avp := range msg.FindAVPsByCode(AVP_MediaComponentDescription) {
+		mc := parseMediaComponent(avp)
+		rs.media[mc.Number] = mc
+	}
+	pushRxRules(rs.gxSessionID, rs.rulePrefix(), rs.rules())
+
+	return builder.
+		AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(ResultCode_Success).Build()).
+		Build(), nil
+}
+
+// 处理Rx的STR：结束Rx会话，从绑定的Gx会话中删除该会话的规则
+func handleRxSTR(session *Session, msg *DiameterMsg) (*DiameterMsg, error) {
+	sessionID := msg.GetSessionID()
+	cause := avpIntData(msg, AVP_TerminationCause)
+	log.Printf("主机%v Rx会话结束请求 Session-Id: %v Termination-Cause: %v", session.PeerHost, sessionID, terminationCauseNames[cause])
+
+	builder := newAnswerBuilder(msg)
+	if session.State() != StateEstablished {
+		return builder.
+			AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(ResultCode_UnableToDeliver).Build()).
+			AddAVP(NewAVPBuilder(AVP_ErrorMessage, 0).SetStringData("session not established, send CER first").Build()).
+			Build(), nil
+	}
+
+	rxSessions.mu.Lock()
+	rs, ok := rxSessions.sessions[sessionID]
+	if ok && rs.afHost == session.PeerHost {
+		delete(rxSessions.sessions, sessionID)
+	}
+	rxSessions.mu.Unlock()
+	if !ok || rs.afHost != session.PeerHost {
+		log.Printf("主机%v Rx会话%v不存在", session.PeerHost, sessionID)
+		return builder.
+			AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(ResultCode_UnknownSessionID).Build()).
+			AddAVP(NewAVPBuilder(AVP_ErrorMessage, 0).SetStringData("unknown session").Build()).
+			Build(), nil
+	}
+	log.Printf("Rx会话%v已结束", sessionID)
+	pushRxRules(rs.gxSessionID, rs.rulePrefix(), nil)
+	return builder.
+		AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(ResultCode_Success).Build()).
+		Build(), nil
+}
+
+// 向Rx会话的AF发出RAR/ASR并等待应答，应答5002时删除会话
+func sendRxRequest(sessionID, name string, build func(peer *Session) *DiameterMsg) (uint32, error) {
+	rxSessions.mu.Lock()
+	rs, ok := rxSessions.sessions[sessionID]
+	if !ok {
+		rxSessions.mu.Unlock()
+		return 0, fmt.Errorf("Rx %w: %v", errSessionNotFound, sessionID)
+	}
+	if rs.pending {
+		rxSessions.mu.Unlock()
+		return 0, fmt.Errorf("Rx %w: %v", errSessionPending, sessionID)
+	}
+	rs.pending = true
+	afHost := rs.afHost
+	rxSessions.mu.Unlock()
+
+	end := func(resultCode uint32) {
+		rxSessions.mu.Lock()
+		defer rxSessions.mu.Unlock()
+		rs.pending = false
+		if resultCode == ResultCode_UnknownSessionID && rxSessions.sessions[sessionID] == rs {
+			delete(rxSessions.sessions, sessionID)
+			pushRxRules(rs.gxSessionID, rs.rulePrefix(), nil)
+		}
+	}
+	peer := peerTable.get(afHost)
+	if peer == nil {
+		end(0)
+		return 0, fmt.Errorf("peer %v of session %v not connected", afHost, sessionID)
+	}
+	req := build(peer)
+	log.Printf("主机%v 发出Rx %v Session-Id: %v End-to-End: %v", afHost, name, sessionID, req.GetEndToEndID())
+	rsp, err := RouteRequest(req)
+	if err != nil {
+		end(0)
+		return 0, err
+	}
+	resultCode := answerResultCode(rsp)
+	log.Printf("主机%v Rx %v应答 Session-Id: %v Result-Code: %v", afHost, name, sessionID, resultCode)
+	end(resultCode)
+	return resultCode, nil
+}
+
+// SendRxNotification 向AF发出RAR通知Specific-Action，components为受影响的媒体组件，为空时不带Flows，返回RAA的Result-Code
+func SendRxNotification(sessionID string, action uint32, components []uint32) (uint32, error) {
+	return sendRxRequest(sessionID, "RAR", func(peer *Session) *DiameterMsg {
+		builder := newSessionRequest(Cmd_RA, UserSession{SessionID: sessionID, AppID: AppID_Rx}, peer).
+			AddAVP(New3GPPAVPBuilder(AVP_SpecificAction, AVPFlag_Mandatory).SetIntData(action).Build())
+		for _, component := range components {
+			builder.AddAVP(flowsAVP(component))
+		}
+		return builder.Build()
+	})
+}
+
+// SendRxAbort 向AF发出ASR，要求结束Rx会话，返回ASA的Result-Code
+func SendRxAbort(sessionID string, cause uint32) (uint32, error) {
+	return sendRxRequest(sessionID, "ASR", func(peer *Session) *DiameterMsg {
+		return newSessionRequest(Cmd_AS, UserSession{SessionID: sessionID, AppID: AppID_Rx}, peer).
+			AddAVP(New3GPPAVPBuilder(AVP_AbortCause, AVPFlag_Mandatory).SetIntData(cause).Build()).
+			Build()
+	})
+}
+
+// 绑定到Gx会话的Rx会话
+func (s *rxSessionStore) boundTo(gxSessionID string) map[string]*rxSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bound := make(map[string]*rxSession)
+	for sessionID, rs := range s.sessions {
+		if rs.gxSessionID == gxSessionID {
+			bound[sessionID] = rs
+		}
+	}
+	return bound
+}
+
+// Gx上报的事件和规则状态转为对AF的通知，只通知AF订阅了的Specific-Action
+func rxOnGxReport(gxSessionID string, events []uint32, reports []gxRuleReport) {
+	for sessionID, rs := range rxSessions.boundTo(gxSessionID) {
+		rxSessions.mu.Lock()
+		subscribed := make(map[uint32]bool, len(rs.specificActions))
+		for action := range rs.specificActions {
+			subscribed[action] = true
+		}
+		rxSessions.mu.Unlock()
+
+		// 规则级的通知带受影响的媒体组件
+		notifications := make(map[uint32][]uint32)
+		var actions []uint32
+		add := func(action uint32, component uint32, withComponent bool) {
+			if !subscribed[action] {
+				return
+			}
+			if _, ok := notifications[action]; !ok {
+				actions = append(actions, action)
+				notifications[action] = nil
+			}
+			if withComponent {
+				notifications[action] = append(notifications[action], component)
+			}
+		}
+		for _, report := range reports {
+			for _, name := range report.names {
+				component, ok := rs.ruleComponent(name)
+				if !ok {
+					continue
+				}
+				switch {
+				case report.status == PCCRuleTemporarilyInactive:
+					add(SpecificActionLossOfBearer, component, true)
+				case report.status == PCCRuleInactive && report.failureCode == ruleFailureResourceAllocation:
+					add(SpecificActionFailedResourcesAllocation, component, true)
+				case report.status == PCCRuleInactive:
+					add(SpecificActionReleaseOfBearer, component, true)
+				}
+			}
+		}
+		for _, event := range events {
+			if action, ok := rxEventActions[event]; ok {
+				add(action, 0, false)
+			}
+		}
+		for _, action := range actions {
+			log.Printf("Rx会话%v 通知AF %v", sessionID, specificActionNames[action])
+			if _, err := SendRxNotification(sessionID, action, notifications[action]); err != nil {
+				log.Printf("Rx会话%v 通知AF失败: %v", sessionID, err)
+			}
+		}
+	}
+}
+
+// Gx会话结束时向绑定的AF发出ASR
+func rxOnGxTerminated(gxSessionID string) {
+	for sessionID := range rxSessions.boundTo(gxSessionID) {
+		log.Printf("Gx会话%v已结束，向AF发出ASR Session-Id: %v", gxSessionID, sessionID)
+		if _, err := SendRxAbort(sessionID, AbortCauseBearerReleased); err != nil {
+			log.Printf("Rx会话%v发出ASR失败: %v", sessionID, err)
+		}
+	}
+}
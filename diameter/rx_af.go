@@ -0,0 +1,379 @@
+package diameter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	rxActionAAR                = "aar"
+	rxActionSTR                = "str"
+	rxActionWait               = "wait"
+	rxActionExpectNotification = "expect_notification"
+	defaultRxExpectTimeout     = 5 * time.Second
+)
+
+// RxNotification AF收到的RAR/ASR
+type RxNotification struct {
+	Command         string    `json:"command"` // RAR或ASR
+	SpecificActions []uint32  `json:"specific_actions,omitempty"`
+	Flows           []uint32  `json:"flows,omitempty"` // 受影响的媒体组件号
+	AbortCause      *uint32   `json:"abort_cause,omitempty"`
+	Time            time.Time `json:"time"`
+}
+
+// afSession 本端作为AF发起的Rx会话
+type afSession struct {
+	id            string
+	label         string
+	peerHost      string
+	notifications []RxNotification
+	notify        chan RxNotification
+	terminated    bool
+}
+
+// AFSessionStatus AF侧Rx会话的快照，供管理接口查看
+type AFSessionStatus struct {
+	SessionID     string           `json:"session_id"`
+	Label         string           `json:"label"`
+	PeerHost      string           `json:"peer_host"`
+	Terminated    bool             `json:"terminated"`
+	Notifications []RxNotification `json:"notifications"`
+}
+
+type afSessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*afSession
+}
+
+var afSessions = &afSessionStore{sessions: make(map[string]*afSession)}
+
+// AFSessions 返回AF侧所有Rx会话的快照
+func AFSessions() []AFSessionStatus {
+	afSessions.mu.Lock()
+	defer afSessions.mu.Unlock()
+	statuses := make([]AFSessionStatus, 0, len(afSessions.sessions))
+	for sessionID, s := range afSessions.sessions {
+		statuses = append(statuses, AFSessionStatus{
+			SessionID:     sessionID,
+			Label:         s.label,
+			PeerHost:      s.peerHost,
+			Terminated:    s.terminated,
+			Notifications: append([]RxNotification{}, s.notifications...),
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].SessionID < statuses[j].SessionID })
+	return statuses
+}
+
+// 记录收到的通知，会话不存在时返回false
+func (s *afSessionStore) record(sessionID string, notification RxNotification) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	as, ok := s.sessions[sessionID]
+	if !ok {
+		return false
+	}
+	as.notifications = append(as.notifications, notification)
+	// 没有场景在等待时丢弃，不阻塞应答
+	select {
+	case as.notify <- notification:
+	default:
+	}
+	return true
+}
+
+// 会话结束后删除
+func (s *afSessionStore) remove(sessionID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, sessionID)
+}
+
+func parseRxNotification(command string, msg *DiameterMsg) RxNotification {
+	notification := RxNotification{Command: command, Time: time.Now()}
+	for _, avp := range msg.FindAVPsByCode(AVP_SpecificAction) {
+		notification.SpecificActions = append(notification.SpecificActions, avp.GetIntData())
+	}
+	for _, avp := range msg.FindAVPsByCode(AVP_Flows) {
+		if numberAVP := avp.FindGroupedAVP(AVP_MediaComponentNumber); numberAVP != nil {
+			notification.Flows = append(notification.Flows, numberAVP.GetIntData())
+		}
+	}
+	if avp, _ := msg.FindAVPByCode(AVP_AbortCause); avp != nil {
+		cause := avp.GetIntData()
+		notification.AbortCause = &cause
+	}
+	return notification
+}
+
+// 处理PCRF发来的Rx RAR，记录通知的Specific-Action
+func handleRxRAR(session *Session, msg *DiameterMsg) (*DiameterMsg, error) {
+	sessionID := msg.GetSessionID()
+	notification := parseRxNotification("RAR", msg)
+	log.Printf("主机%v Rx通知 Session-Id: %v Specific-Action: %v Flows: %v", session.PeerHost, sessionID, notification.SpecificActions, notification.Flows)
+
+	resultCode := uint32(ResultCode_Success)
+	if !afSessions.record(sessionID, notification) {
+		log.Printf("主机%v AF会话%v不存在", session.PeerHost, sessionID)
+		resultCode = ResultCode_UnknownSessionID
+	}
+	return newAnswerBuilder(msg).
+		AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(resultCode).Build()).
+		Build(), nil
+}
+
+// 处理PCRF发来的Rx ASR，应答后发出STR结束会话
+func handleRxASR(session *Session, msg *DiameterMsg) (*DiameterMsg, error) {
+	sessionID := msg.GetSessionID()
+	notification := parseRxNotification("ASR", msg)
+	log.Printf("主机%v Rx会话中止请求 Session-Id: %v Abort-Cause: %v", session.PeerHost, sessionID, avpIntData(msg, AVP_AbortCause))
+
+	resultCode := uint32(ResultCode_Success)
+	if afSessions.record(sessionID, notification) {
+		go func() {
+			if _, err := sendAFSessionTermination(sessionID, TerminationCauseAdministrative); err != nil {
+				log.Printf("AF会话%v发出STR失败: %v", sessionID, err)
+			}
+		}()
+	} else {
+		log.Printf("主机%v AF会话%v不存在", session.PeerHost, sessionID)
+		resultCode = ResultCode_UnknownSessionID
+	}
+	return newAnswerBuilder(msg).
+		AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(resultCode).Build()).
+		Build(), nil
+}
+
+// 经RouteRequest发出AF侧的请求并等待应答，按重定向、DOIC和路由故障切换处理
+func sendAFRequest(peer *Session, name string, req *DiameterMsg) (uint32, error) {
+	log.Printf("主机%v 发出Rx %v Session-Id: %v End-to-End: %v", peer.PeerHost, name, req.GetSessionID(), req.GetEndToEndID())
+	rsp, err := RouteRequest(req)
+	if err != nil {
+		return 0, err
+	}
+	resultCode := answerResultCode(rsp)
+	log.Printf("主机%v Rx %v应答 Session-Id: %v Result-Code: %v", peer.PeerHost, name, req.GetSessionID(), resultCode)
+	return resultCode, nil
+}
+
+// 发出STR结束AF会话，收到STA(或发送失败)后删除会话，已结束的会话不再发送
+func sendAFSessionTermination(sessionID string, cause uint32) (uint32, error) {
+	afSessions.mu.Lock()
+	as, ok := afSessions.sessions[sessionID]
+	if !ok || as.terminated {
+		afSessions.mu.Unlock()
+		return 0, fmt.Errorf("AF session %v not found or terminated", sessionID)
+	}
+	peer := peerTable.get(as.peerHost)
+	if peer == nil {
+		afSessions.mu.Unlock()
+		return 0, fmt.Errorf("peer %v not connected", as.peerHost)
+	}
+	as.terminated = true
+	afSessions.mu.Unlock()
+
+	req := newSessionRequest(Cmd_ST, UserSession{SessionID: sessionID, AppID: AppID_Rx}, peer).
+		AddAVP(NewAVPBuilder(AVP_TerminationCause, AVPFlag_Mandatory).SetIntData(cause).Build()).
+		Build()
+	resultCode, err := sendAFRequest(peer, "STR", req)
+	afSessions.remove(sessionID)
+	return resultCode, err
+}
+
+// RxScenario AF场景文件，按顺序执行各步骤
+type RxScenario struct {
+	Peer  string           `json:"peer"` // PCRF的Origin-Host，须已建立连接
+	Steps []RxScenarioStep `json:"steps"`
+}
+
+// RxScenarioStep 场景中的一步，action为aar、str、wait或expect_notification
+type RxScenarioStep struct {
+	Action             string             `json:"action"`
+	Session            string             `json:"session"` // 场景内的会话标签，同一标签的aar为修改
+	FramedIP           string             `json:"framed_ip,omitempty"`
+	Subscriber         string             `json:"subscriber,omitempty"`
+	SubscriptionIdType uint32             `json:"subscription_id_type,omitempty"` // 默认1(END_USER_IMSI)
+	AFApplicationID    string             `json:"af_application_id,omitempty"`
+	SpecificActions    []uint32           `json:"specific_actions,omitempty"`
+	Media              []RxMediaComponent `json:"media,omitempty"`
+	TerminationCause   uint32             `json:"termination_cause,omitempty"` // 默认1(DIAMETER_LOGOUT)
+	Seconds            float64            `json:"seconds,omitempty"`           // wait的时长，expect_notification的超时，默认5秒
+	Expect             uint32             `json:"expect,omitempty"`            // 期望的Result-Code，默认2001
+	Command            string             `json:"command,omitempty"`           // expect_notification期望的RAR或ASR，不填不检查
+	SpecificAction     uint32             `json:"specific_action,omitempty"`   // expect_notification期望RAR带的Specific-Action，0不检查
+}
+
+// RxStepResult 场景每一步的执行结果
+type RxStepResult struct {
+	Step         int             `json:"step"`
+	Action       string          `json:"action"`
+	SessionID    string          `json:"session_id,omitempty"`
+	ResultCode   uint32          `json:"result_code,omitempty"`
+	Notification *RxNotification `json:"notification,omitempty"`
+	Error        string          `json:"error,omitempty"`
+}
+
+func loadRxScenario(name string) (*RxScenario, error) {
+	// 只允许场景目录下的文件
+	if name == "" || filepath.Base(name) != name {
+		return nil, fmt.Errorf("invalid scenario file %q", name)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(config.Rx.scenarioDir(), name))
+	if err != nil {
+		return nil, err
+	}
+	var scenario RxScenario
+	if err := json.Unmarshal(data, &scenario); err != nil {
+		return nil, fmt.Errorf("scenario %v: %w", name, err)
+	}
+	return &scenario, nil
+}
+
+// RunRxScenario 作为AF执行场景文件，遇到第一个失败的步骤即停止，返回已执行步骤的结果
+func RunRxScenario(name string) ([]RxStepResult, error) {
+	scenario, err := loadRxScenario(name)
+	if err != nil {
+		return nil, err
+	}
+	peer := peerTable.get(scenario.Peer)
+	if peer == nil {
+		return nil, fmt.Errorf("peer %v not connected", scenario.Peer)
+	}
+	log.Printf("开始执行Rx场景%v，对端: %v", name, scenario.Peer)
+
+	sessions := make(map[string]*afSession) // 会话标签到AF会话，会话删除后场景仍可等待它的通知
+	results := make([]RxStepResult, 0, len(scenario.Steps))
+	for i, step := range scenario.Steps {
+		result := RxStepResult{Step: i + 1, Action: step.Action}
+		err := runRxStep(peer, step, sessions, &result)
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+		if err != nil {
+			log.Printf("Rx场景%v第%d步失败: %v", name, i+1, err)
+			return results, fmt.Errorf("step %d (%v): %w", i+1, step.Action, err)
+		}
+	}
+	log.Printf("Rx场景%v执行完成", name)
+	return results, nil
+}
+
+func runRxStep(peer *Session, step RxScenarioStep, sessions map[string]*afSession, result *RxStepResult) error {
+	expect := step.Expect
+	if expect == 0 {
+		expect = ResultCode_Success
+	}
+	timeout := defaultRxExpectTimeout
+	if step.Seconds > 0 {
+		timeout = time.Duration(step.Seconds * float64(time.Second))
+	}
+
+	switch step.Action {
+	case rxActionAAR:
+		as, existing := sessions[step.Session]
+		if !existing {
+			as = &afSession{id: generateSessionID(config.OriginHost), label: step.Session, peerHost: peer.PeerHost, notify: make(chan RxNotification, 16)}
+			afSessions.mu.Lock()
+			afSessions.sessions[as.id] = as
+			afSessions.mu.Unlock()
+			sessions[step.Session] = as
+		}
+		result.SessionID = as.id
+		resultCode, err := sendAFRequest(peer, "AAR", buildAFRequest(peer, as.id, step, existing))
+		// 首个AAR失败时PCRF没有建立会话，不再保留
+		if !existing && (err != nil || resultCode != ResultCode_Success) {
+			afSessions.remove(as.id)
+			delete(sessions, step.Session)
+		}
+		if err != nil {
+			return err
+		}
+		result.ResultCode = resultCode
+		if resultCode != expect {
+			return fmt.Errorf("Result-Code %v, expect %v", resultCode, expect)
+		}
+	case rxActionSTR:
+		as, ok := sessions[step.Session]
+		if !ok {
+			return fmt.Errorf("unknown session %q", step.Session)
+		}
+		result.SessionID = as.id
+		cause := step.TerminationCause
+		if cause == 0 {
+			cause = TerminationCauseLogout
+		}
+		resultCode, err := sendAFSessionTermination(as.id, cause)
+		if err != nil {
+			return err
+		}
+		result.ResultCode = resultCode
+		if resultCode != expect {
+			return fmt.Errorf("Result-Code %v, expect %v", resultCode, expect)
+		}
+	case rxActionWait:
+		time.Sleep(timeout)
+	case rxActionExpectNotification:
+		as, ok := sessions[step.Session]
+		if !ok {
+			return fmt.Errorf("unknown session %q", step.Session)
+		}
+		result.SessionID = as.id
+		select {
+		case notification := <-as.notify:
+			result.Notification = &notification
+			if step.Command != "" && notification.Command != step.Command {
+				return fmt.Errorf("got %v, expect %v", notification.Command, step.Command)
+			}
+			if step.SpecificAction != 0 && !containsAppID(notification.SpecificActions, step.SpecificAction) {
+				return fmt.Errorf("got Specific-Action %v, expect %v", notification.SpecificActions, step.SpecificAction)
+			}
+		case <-time.After(timeout):
+			return fmt.Errorf("no notification in %v", timeout)
+		}
+	default:
+		return fmt.Errorf("unknown action %q", step.Action)
+	}
+	return nil
+}
+
+// 场景步骤对应的AAR，修改已有会话时带Rx-Request-Type UPDATE_REQUEST
+func buildAFRequest(peer *Session, sessionID string, step RxScenarioStep, update bool) *DiameterMsg {
+	requestType := uint32(0)
+	if update {
+		requestType = rxRequestUpdate
+	}
+	builder := newSessionRequest(Cmd_AA, UserSession{SessionID: sessionID, AppID: AppID_Rx}, peer).
+		AddAVP(New3GPPAVPBuilder(AVP_RxRequestType, AVPFlag_Mandatory).SetIntData(requestType).Build())
+	if step.AFApplicationID != "" {
+		builder.AddAVP(New3GPPAVPBuilder(AVP_AFApplicationIdentifier, AVPFlag_Mandatory).SetStringData(step.AFApplicationID).Build())
+	}
+	for _, mc := range step.Media {
+		builder.AddAVP(mediaComponentAVP(mc))
+	}
+	for _, action := range step.SpecificActions {
+		builder.AddAVP(New3GPPAVPBuilder(AVP_SpecificAction, AVPFlag_Mandatory).SetIntData(action).Build())
+	}
+	if step.Subscriber != "" {
+		idType := step.SubscriptionIdType
+		if idType == 0 {
+			idType = 1
+		}
+		builder.AddAVP(NewAVPBuilder(AVP_SubscriptionId, AVPFlag_Mandatory).SetGroupedData(
+			NewAVPBuilder(AVP_SubscriptionIdType, AVPFlag_Mandatory).SetIntData(idType).Build(),
+			NewAVPBuilder(AVP_SubscriptionIdData, AVPFlag_Mandatory).SetStringData(step.Subscriber).Build(),
+		).Build())
+	}
+	if ip := net.ParseIP(step.FramedIP).To4(); ip != nil {
+		builder.AddAVP(NewAVPBuilder(AVP_FramedIPAddress, AVPFlag_Mandatory).SetData(ip).Build())
+	}
+	return builder.Build()
+}
@@ -0,0 +1,744 @@
+package diameter
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// S6a/S6d的Experimental-Result-Code，3GPP TS 29.272 7.4
+const (
+	ExperimentalResult_AuthDataUnavailable    = 4181 // DIAMETER_AUTHENTICATION_DATA_UNAVAILABLE
+	ExperimentalResult_UserUnknown            = 5001 // DIAMETER_ERROR_USER_UNKNOWN
+	ExperimentalResult_UnknownEPSSubscription = 5420 // DIAMETER_ERROR_UNKNOWN_EPS_SUBSCRIPTION
+)
+
+// ULR-Flags，TS 29.272 7.3.7
+const (
+	ULRFlagSingleRegistration = 1 << 0
+	ULRFlagS6aIndicator       = 1 << 1 // 置位时请求来自MME(S6a)，否则来自SGSN(S6d)
+	ULRFlagSkipSubscriberData = 1 << 2
+	ULRFlagInitialAttach      = 1 << 5
+)
+
+// ULA-Flags、PUA-Flags、DSR-Flags，TS 29.272 7.3.8、7.3.48、7.3.25
+const (
+	ULAFlagSeparationIndication  = 1 << 0 // MME和SGSN的登记分开保存
+	PUAFlagFreezeMTMSI           = 1 << 0
+	PUAFlagFreezePTMSI           = 1 << 1
+	DSRFlagCompleteAPNWithdrawal = 1 << 1 // 删除全部APN签约
+	DSRFlagPDNContextsWithdrawal = 1 << 3 // 按Context-Identifier删除APN签约
+)
+
+// Cancellation-Type，TS 29.272 7.3.24
+const (
+	CancellationMMEUpdate              = 0
+	CancellationSGSNUpdate             = 1
+	CancellationSubscriptionWithdrawal = 2
+	CancellationUpdateProcedureIWF     = 3
+	CancellationInitialAttach          = 4
+)
+
+const (
+	defaultS6aMaxVectors         = 5
+	defaultS6aAMF                = "8000"
+	defaultS6aQCI                = 9
+	defaultS6aARP                = 8
+	subscriberStatusGranted      = 0 // SERVICE_GRANTED
+	networkAccessModeOnlyPacket  = 2 // ONLY_PACKET
+	allAPNConfigurationsIncluded = 0 // All_APN_CONFIGURATIONS_INCLUDED
+	preemptionCapabilityDisabled = 1
+	preemptionVulnerableEnabled  = 0
+)
+
+// SQN共48位，每生成一个向量SEQ加1，IND(低5位)固定为0，TS 33.102 C.3.2
+const (
+	sqnMask = 1<<48 - 1
+	sqnStep = 32
+)
+
+// S6aConfig S6a/S6d HSS配置
+type S6aConfig struct {
+	MaxVectors int `json:"max_vectors"` // 一次AIR最多返回的E-UTRAN向量个数，默认5
+	// 用户签约数据，按IMSI索引
+	Subscribers map[string]HSSSubscriber `json:"subscribers"`
+}
+
+func (c *S6aConfig) maxVectors() int {
+	if c.MaxVectors <= 0 {
+		return defaultS6aMaxVectors
+	}
+	return c.MaxVectors
+}
+
+// HSSSubscriber 用户的鉴权参数和EPS签约数据
+type HSSSubscriber struct {
+	K      string   `json:"k"`      // 16字节，十六进制
+	OPc    string   `json:"opc"`    // 16字节，十六进制
+	AMF    string   `json:"amf"`    // 2字节，十六进制，默认8000
+	SQN    uint64   `json:"sqn"`    // 初始SQN，之后每个向量递增，终端重同步时按AUTS校正
+	MSISDN string   `json:"msisdn"` // 为空时不下发
+	AMBR   S6aAMBR  `json:"ambr"`   // 用户级AMBR
+	APNs   []S6aAPN `json:"apns"`   // APN签约，为空时ULR回复DIAMETER_ERROR_UNKNOWN_EPS_SUBSCRIPTION
+	// 默认APN的Context-Identifier，为0时取第一个APN
+	DefaultContextID uint32 `json:"default_context_id"`
+}
+
+// S6aAMBR 上下行最大带宽，bps，为0时不下发
+type S6aAMBR struct {
+	UL uint32 `json:"ul"`
+	DL uint32 `json:"dl"`
+}
+
+// S6aAPN 一个APN的签约
+type S6aAPN struct {
+	ContextID   uint32  `json:"context_id"`
+	Name        string  `json:"name"`         // Service-Selection
+	PDNType     uint32  `json:"pdn_type"`     // 0 IPv4，1 IPv6，2 IPv4v6，3 IPv4_OR_IPv6
+	QCI         uint32  `json:"qci"`          // 默认9
+	ARPPriority uint32  `json:"arp_priority"` // 默认8
+	AMBR        S6aAMBR `json:"ambr"`
+}
+
+// S6aRegistration 为用户服务的MME或SGSN
+type S6aRegistration struct {
+	Host         string    `json:"host"`
+	Realm        string    `json:"realm"`
+	RATType      uint32    `json:"rat_type"`
+	VisitedPLMN  string    `json:"visited_plmn"` // Visited-PLMN-Id，十六进制
+	RegisteredAt time.Time `json:"registered_at"`
+	Purged       bool      `json:"purged"` // 收到该节点的PUR
+}
+
+// HSSSubscriberStatus 用户的SQN和登记状态，管理接口展示用
+type HSSSubscriberStatus struct {
+	IMSI   string           `json:"imsi"`
+	MSISDN string           `json:"msisdn,omitempty"`
+	SQN    uint64           `json:"sqn"`
+	MME    *S6aRegistration `json:"mme,omitempty"`
+	SGSN   *S6aRegistration `json:"sgsn,omitempty"`
+	APNs   []S6aAPN         `json:"apns"`
+}
+
+type hssSubscriber struct {
+	profile  HSSSubscriber // APN签约在DSR成功后删除
+	milenage *milenage
+	amf      []byte
+	sqn      uint64 // 最后一个向量使用的SQN
+	mme      *S6aRegistration
+	sgsn     *S6aRegistration
+}
+
+// hssStore 内存中的用户数据，初始值来自配置
+type hssStore struct {
+	mu          sync.Mutex
+	subscribers map[string]*hssSubscriber
+}
+
+var hss = &hssStore{subscribers: make(map[string]*hssSubscriber)}
+
+// answerError 3GPP应用(S6a、Cx等)的错误，应答中放在Experimental-Result里，experimental为false时放在Result-Code里
+type answerError struct {
+	code         uint32
+	experimental bool
+	msg          string
+}
+
+func (e *answerError) Error() string {
+	return e.msg
+}
+
+func newExperimentalError(code uint32, format string, args ...interface{}) error {
+	return &answerError{code: code, experimental: true, msg: fmt.Sprintf(format, args...)}
+}
+
+func newResultError(code uint32, format string, args ...interface{}) error {
+	return &answerError{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+func decodeHexKey(name, value string, n int) ([]byte, error) {
+	b, err := hex.DecodeString(value)
+	if err != nil || len(b) != n {
+		return nil, fmt.Errorf("%v must be %d bytes hex", name, n)
+	}
+	return b, nil
+}
+
+// 按配置初始化用户数据，加载配置后调用
+func (s *hssStore) load(subscribers map[string]HSSSubscriber) error {
+	loaded := make(map[string]*hssSubscriber, len(subscribers))
+	for imsi, profile := range subscribers {
+		k, err := decodeHexKey("k", profile.K, 16)
+		if err != nil {
+			return fmt.Errorf("s6a subscriber %v: %w", imsi, err)
+		}
+		opc, err := decodeHexKey("opc", profile.OPc, 16)
+		if err != nil {
+			return fmt.Errorf("s6a subscriber %v: %w", imsi, err)
+		}
+		amfHex := profile.AMF
+		if amfHex == "" {
+			amfHex = defaultS6aAMF
+		}
+		amf, err := decodeHexKey("amf", amfHex, 2)
+		if err != nil {
+			return fmt.Errorf("s6a subscriber %v: %w", imsi, err)
+		}
+		m, err := newMilenage(k, opc)
+		if err != nil {
+			return fmt.Errorf("s6a subscriber %v: %w", imsi, err)
+		}
+		loaded[imsi] = &hssSubscriber{profile: profile, milenage: m, amf: amf, sqn: profile.SQN & sqnMask}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscribers = loaded
+	return nil
+}
+
+// 为用户生成n个E-UTRAN鉴权向量，带Re-Synchronization-Info(RAND||AUTS)时先按终端的SQN校正
+func (s *hssStore) vectors(imsi string, plmn []byte, n int, resyncInfo []byte) ([]eutranVector, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.subscribers[imsi]
+	if !ok {
+		return nil, newExperimentalError(ExperimentalResult_UserUnknown, "user %v unknown", imsi)
+	}
+	if resyncInfo != nil {
+		if len(resyncInfo) != 30 {
+			return nil, newExperimentalError(ExperimentalResult_AuthDataUnavailable, "invalid Re-Synchronization-Info length %d", len(resyncInfo))
+		}
+		sqnMS, err := sub.milenage.resync(resyncInfo[:16], resyncInfo[16:])
+		if err != nil {
+			return nil, newExperimentalError(ExperimentalResult_AuthDataUnavailable, "re-synchronization failed: %v", err)
+		}
+		log.Printf("IMSI %v 重同步，SQN %v -> %v", imsi, sub.sqn, sqnMS)
+		sub.sqn = sqnMS
+	}
+	vectors := make([]eutranVector, 0, n)
+	for i := 0; i < n; i++ {
+		sub.sqn = (sub.sqn + sqnStep) & sqnMask
+		vectors = append(vectors, sub.milenage.eutranVector(randomBytes(16), sqnBytes(sub.sqn), sub.amf, plmn))
+	}
+	return vectors, nil
+}
+
+// 需要发CLR注销的旧服务节点
+type s6aCancel struct {
+	node             S6aRegistration
+	cancellationType uint32
+}
+
+// 登记MME或SGSN，返回签约数据和需要注销的旧节点
+func (s *hssStore) update(imsi string, reg S6aRegistration, flags uint32) (HSSSubscriber, []s6aCancel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.subscribers[imsi]
+	if !ok {
+		return HSSSubscriber{}, nil, newExperimentalError(ExperimentalResult_UserUnknown, "user %v unknown", imsi)
+	}
+	if len(sub.profile.APNs) == 0 {
+		return HSSSubscriber{}, nil, newExperimentalError(ExperimentalResult_UnknownEPSSubscription, "user %v has no EPS subscription", imsi)
+	}
+
+	var cancels []s6aCancel
+	current := &sub.sgsn
+	cancellationType := uint32(CancellationSGSNUpdate)
+	if flags&ULRFlagS6aIndicator != 0 {
+		current = &sub.mme
+		cancellationType = CancellationMMEUpdate
+		// 单一登记时MME登记成功后注销SGSN
+		if flags&ULRFlagSingleRegistration != 0 && sub.sgsn != nil {
+			cancels = append(cancels, s6aCancel{*sub.sgsn, CancellationMMEUpdate})
+			sub.sgsn = nil
+		}
+	}
+	if flags&ULRFlagInitialAttach != 0 {
+		cancellationType = CancellationInitialAttach
+	}
+	if old := *current; old != nil && old.Host != reg.Host {
+		cancels = append(cancels, s6aCancel{*old, cancellationType})
+	}
+	*current = &reg
+	return sub.profile, cancels, nil
+}
+
+// 服务节点通知用户已清除，发PUR的是当前登记的节点时返回冻结M-TMSI/P-TMSI的PUA-Flags
+func (s *hssStore) purge(imsi, host string) (uint32, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.subscribers[imsi]
+	if !ok {
+		return 0, newExperimentalError(ExperimentalResult_UserUnknown, "user %v unknown", imsi)
+	}
+	var flags uint32
+	if sub.mme != nil && sub.mme.Host == host {
+		sub.mme.Purged = true
+		flags |= PUAFlagFreezeMTMSI
+	}
+	if sub.sgsn != nil && sub.sgsn.Host == host {
+		sub.sgsn.Purged = true
+		flags |= PUAFlagFreezePTMSI
+	}
+	return flags, nil
+}
+
+// 用户当前登记的服务节点和签约数据
+func (s *hssStore) registrations(imsi string) ([]S6aRegistration, HSSSubscriber, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.subscribers[imsi]
+	if !ok {
+		return nil, HSSSubscriber{}, fmt.Errorf("IMSI %v unknown", imsi)
+	}
+	var nodes []S6aRegistration
+	for _, reg := range []*S6aRegistration{sub.mme, sub.sgsn} {
+		if reg != nil {
+			nodes = append(nodes, *reg)
+		}
+	}
+	if len(nodes) == 0 {
+		return nil, HSSSubscriber{}, fmt.Errorf("IMSI %v not registered", imsi)
+	}
+	return nodes, sub.profile, nil
+}
+
+// CLA成功后删除该节点的登记，节点已经被新的登记替换时不处理
+func (s *hssStore) unregister(imsi, host string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.subscribers[imsi]
+	if !ok {
+		return
+	}
+	if sub.mme != nil && sub.mme.Host == host {
+		sub.mme = nil
+	}
+	if sub.sgsn != nil && sub.sgsn.Host == host {
+		sub.sgsn = nil
+	}
+}
+
+// DSA成功后删除APN签约，contextIDs为空时全部删除
+func (s *hssStore) deleteAPNs(imsi string, contextIDs []uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.subscribers[imsi]
+	if !ok {
+		return
+	}
+	// 签约数据会复制给处理中的请求，这里不修改原来的切片
+	apns := make([]S6aAPN, 0, len(sub.profile.APNs))
+	for _, apn := range sub.profile.APNs {
+		if len(contextIDs) > 0 && !containsAppID(contextIDs, apn.ContextID) {
+			apns = append(apns, apn)
+		}
+	}
+	sub.profile.APNs = apns
+}
+
+// HSSSubscribers 所有用户的SQN和登记状态，按IMSI排序
+func HSSSubscribers() []HSSSubscriberStatus {
+	hss.mu.Lock()
+	defer hss.mu.Unlock()
+	statuses := make([]HSSSubscriberStatus, 0, len(hss.subscribers))
+	for imsi, sub := range hss.subscribers {
+		status := HSSSubscriberStatus{IMSI: imsi, MSISDN: sub.profile.MSISDN, SQN: sub.sqn, APNs: sub.profile.APNs}
+		if sub.mme != nil {
+			mme := *sub.mme
+			status.MME = &mme
+		}
+		if sub.sgsn != nil {
+			sgsn := *sub.sgsn
+			status.SGSN = &sgsn
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].IMSI < statuses[j].IMSI })
+	return statuses
+}
+
+// MSISDN按TBCD编码：每字节低4位是前一位数字，位数为奇数时最后补F
+func tbcdEncode(digits string) []byte {
+	out := make([]byte, 0, (len(digits)+1)/2)
+	for i := 0; i < len(digits); i += 2 {
+		b := digits[i] - '0'
+		if i+1 < len(digits) {
+			b |= (digits[i+1] - '0') << 4
+		} else {
+			b |= 0xf0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// 3GPP应用的Vendor-Specific-Application-Id，S6a和Cx共用
+func vendorApplicationAVP(appID uint32) *AVPMsg {
+	return NewAVPBuilder(AVP_VendorSpecificApplicationId, AVPFlag_Mandatory).SetGroupedData(
+		NewAVPBuilder(AVP_VendorId, AVPFlag_Mandatory).SetIntData(VendorID_3GPP).Build(),
+		NewAVPBuilder(AVP_AuthApplicationId, AVPFlag_Mandatory).SetIntData(appID).Build(),
+	).Build()
+}
+
+func experimentalResultAVP(vendorID, code uint32) *AVPMsg {
+	return NewAVPBuilder(AVP_ExperimentalResult, AVPFlag_Mandatory).SetGroupedData(
+		NewAVPBuilder(AVP_VendorId, AVPFlag_Mandatory).SetIntData(vendorID).Build(),
+		NewAVPBuilder(AVP_ExperimentalResultCode, AVPFlag_Mandatory).SetIntData(code).Build(),
+	).Build()
+}
+
+// 应答的Result-Code，没有时取Experimental-Result中的Experimental-Result-Code
+func answerResultCode(msg *DiameterMsg) uint32 {
+	if resultCode := getResultCode(msg); resultCode != 0 {
+		return resultCode
+	}
+	if avp, _ := msg.FindAVPByCode(AVP_ExperimentalResult); avp != nil {
+		if codeAVP := avp.FindGroupedAVP(AVP_ExperimentalResultCode); codeAVP != nil && codeAVP.GetDataLength() >= 4 {
+			return codeAVP.GetIntData()
+		}
+	}
+	return 0
+}
+
+func ambrAVP(ambr S6aAMBR) *AVPMsg {
+	return New3GPPAVPBuilder(AVP_AMBR, AVPFlag_Mandatory).SetGroupedData(
+		New3GPPAVPBuilder(AVP_MaxRequestedBandwidthUL, AVPFlag_Mandatory).SetIntData(ambr.UL).Build(),
+		New3GPPAVPBuilder(AVP_MaxRequestedBandwidthDL, AVPFlag_Mandatory).SetIntData(ambr.DL).Build(),
+	).Build()
+}
+
+// Allocation-Retention-Priority，不允许抢占其他承载，可被抢占，S6a和Gx共用
+func allocationRetentionPriorityAVP(priority uint32) *AVPMsg {
+	return New3GPPAVPBuilder(AVP_AllocationRetentionPriority, AVPFlag_Mandatory).SetGroupedData(
+		New3GPPAVPBuilder(AVP_PriorityLevel, AVPFlag_Mandatory).SetIntData(priority).Build(),
+		New3GPPAVPBuilder(AVP_PreemptionCapability, AVPFlag_Mandatory).SetIntData(preemptionCapabilityDisabled).Build(),
+		New3GPPAVPBuilder(AVP_PreemptionVulnerability, AVPFlag_Mandatory).SetIntData(preemptionVulnerableEnabled).Build(),
+	).Build()
+}
+
+func apnConfigurationAVP(apn S6aAPN) *AVPMsg {
+	qci, arp := apn.QCI, apn.ARPPriority
+	if qci == 0 {
+		qci = defaultS6aQCI
+	}
+	if arp == 0 {
+		arp = defaultS6aARP
+	}
+	avps := []*AVPMsg{
+		New3GPPAVPBuilder(AVP_ContextIdentifier, AVPFlag_Mandatory).SetIntData(apn.ContextID).Build(),
+		New3GPPAVPBuilder(AVP_PDNType, AVPFlag_Mandatory).SetIntData(apn.PDNType).Build(),
+		NewAVPBuilder(AVP_ServiceSelection, AVPFlag_Mandatory).SetStringData(apn.Name).Build(),
+		New3GPPAVPBuilder(AVP_EPSSubscribedQoSProfile, AVPFlag_Mandatory).SetGroupedData(
+			New3GPPAVPBuilder(AVP_QoSClassIdentifier, AVPFlag_Mandatory).SetIntData(qci).Build(),
+			allocationRetentionPriorityAVP(arp),
+		).Build(),
+	}
+	if apn.AMBR.UL > 0 || apn.AMBR.DL > 0 {
+		avps = append(avps, ambrAVP(apn.AMBR))
+	}
+	return New3GPPAVPBuilder(AVP_APNConfiguration, AVPFlag_Mandatory).SetGroupedData(avps...).Build()
+}
+
+// ULA和IDR中的Subscription-Data
+func subscriptionDataAVP(profile HSSSubscriber) *AVPMsg {
+	avps := make([]*AVPMsg, 0, 5)
+	if profile.MSISDN != "" {
+		avps = append(avps, New3GPPAVPBuilder(AVP_MSISDN, AVPFlag_Mandatory).SetData(tbcdEncode(profile.MSISDN)).Build())
+	}
+	avps = append(avps,
+		New3GPPAVPBuilder(AVP_SubscriberStatus, AVPFlag_Mandatory).SetIntData(subscriberStatusGranted).Build(),
+		New3GPPAVPBuilder(AVP_NetworkAccessMode, AVPFlag_Mandatory).SetIntData(networkAccessModeOnlyPacket).Build(),
+	)
+	if profile.AMBR.UL > 0 || profile.AMBR.DL > 0 {
+		avps = append(avps, ambrAVP(profile.AMBR))
+	}
+	if len(profile.APNs) > 0 {
+		defaultContextID := profile.DefaultContextID
+		if defaultContextID == 0 {
+			defaultContextID = profile.APNs[0].ContextID
+		}
+		apnAVPs := []*AVPMsg{
+			New3GPPAVPBuilder(AVP_ContextIdentifier, AVPFlag_Mandatory).SetIntData(defaultContextID).Build(),
+			New3GPPAVPBuilder(AVP_AllAPNConfigurationsIncludedIndicator, AVPFlag_Mandatory).SetIntData(allAPNConfigurationsIncluded).Build(),
+		}
+		for _, apn := range profile.APNs {
+			apnAVPs = append(apnAVPs, apnConfigurationAVP(apn))
+		}
+		avps = append(avps, New3GPPAVPBuilder(AVP_APNConfigurationProfile, AVPFlag_Mandatory).SetGroupedData(apnAVPs...).Build())
+	}
+	return New3GPPAVPBuilder(AVP_SubscriptionData, AVPFlag_Mandatory).SetGroupedData(avps...).Build()
+}
+
+// S6a应答的公共部分，S6a不维护会话状态，Auth-Session-State固定为NO_STATE_MAINTAINED
+func newS6aAnswerBuilder(req *DiameterMsg) *DiameterMsgBuilder {
+	return newAnswerBuilder(req).
+		AddAVP(vendorApplicationAVP(AppID_S6a)).
+		AddAVP(NewAVPBuilder(AVP_AuthSessionState, AVPFlag_Mandatory).SetIntData(AuthSessionNoStateMaintained).Build())
+}
+
+// S6a错误应答，3GPP定义的错误码放在Experimental-Result中
+func s6aReject(session *Session, command, imsi string, builder *DiameterMsgBuilder, err error) *DiameterMsg {
+	log.Printf("主机%v %v IMSI: %v 处理失败: %v", session.PeerHost, command, imsi, err)
+	return buildErrorAnswer(builder, err)
+}
+
+// 按错误填写应答的Result-Code或Experimental-Result，各3GPP应用共用
+func buildErrorAnswer(builder *DiameterMsgBuilder, err error) *DiameterMsg {
+	var ansErr *answerError
+	if !errors.As(err, &ansErr) {
+		ansErr = &answerError{code: ResultCode_UnableToComply, msg: err.Error()}
+	}
+	if ansErr.experimental {
+		builder.AddAVP(experimentalResultAVP(VendorID_3GPP, ansErr.code))
+	} else {
+		if ansErr.code >= 3000 && ansErr.code < 4000 {
+			builder.SetFlags(FlagResponse | FlagError)
+		}
+		builder.AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(ansErr.code).Build())
+	}
+	return builder.AddAVP(NewAVPBuilder(AVP_ErrorMessage, 0).SetStringData(ansErr.msg).Build()).Build()
+}
+
+// 请求中的IMSI(User-Name)和Visited-PLMN-Id
+func s6aRequestUser(msg *DiameterMsg) (imsi string, plmn []byte) {
+	if userAVP, _ := msg.FindAVPByCode(AVP_UserName); userAVP != nil {
+		imsi = userAVP.GetStringData()
+	}
+	if plmnAVP, _ := msg.FindAVPByCode(AVP_VisitedPLMNId); plmnAVP != nil {
+		plmn = plmnAVP.GetRawData()
+	}
+	return imsi, plmn
+}
+
+// 处理AIR，按Milenage为用户生成E-UTRAN鉴权向量，TS 29.272 5.2.3.1
+func handleAIR(session *Session, msg *DiameterMsg) (*DiameterMsg, error) {
+	imsi, plmn := s6aRequestUser(msg)
+	builder := newS6aAnswerBuilder(msg)
+	if session.State() != StateEstablished {
+		return s6aReject(session, "AIR", imsi, builder, newResultError(ResultCode_UnableToDeliver, "session not established, send CER first")), nil
+	}
+	if len(plmn) != 3 {
+		return s6aReject(session, "AIR", imsi, builder, newResultError(ResultCode_InvalidAVPValue, "invalid Visited-PLMN-Id")), nil
+	}
+	infoAVP, _ := msg.FindAVPByCode(AVP_RequestedEUTRANAuthenticationInfo)
+	if infoAVP == nil {
+		return s6aReject(session, "AIR", imsi, builder, newExperimentalError(ExperimentalResult_AuthDataUnavailable, "only E-UTRAN authentication vectors supported")), nil
+	}
+	n := 1
+	if numAVP := infoAVP.FindGroupedAVP(AVP_NumberOfRequestedVectors); numAVP != nil && numAVP.GetDataLength() >= 4 && numAVP.GetIntData() > 0 {
+		n = int(numAVP.GetIntData())
+	}
+	if n > config.S6a.maxVectors() {
+		n = config.S6a.maxVectors()
+	}
+	var resyncInfo []byte
+	if resyncAVP := infoAVP.FindGroupedAVP(AVP_ReSynchronizationInfo); resyncAVP != nil {
+		resyncInfo = resyncAVP.GetRawData()
+	}
+	log.Printf("主机%v AIR IMSI: %v Visited-PLMN-Id: %x 向量数: %v 重同步: %v", session.PeerHost, imsi, plmn, n, resyncInfo != nil)
+
+	vectors, err := hss.vectors(imsi, plmn, n, resyncInfo)
+	if err != nil {
+		return s6aReject(session, "AIR", imsi, builder, err), nil
+	}
+	vectorAVPs := make([]*AVPMsg, 0, len(vectors))
+	for i, v := range vectors {
+		vectorAVPs = append(vectorAVPs, New3GPPAVPBuilder(AVP_EUTRANVector, AVPFlag_Mandatory).SetGroupedData(
+			New3GPPAVPBuilder(AVP_ItemNumber, AVPFlag_Mandatory).SetIntData(uint32(i+1)).Build(),
+			New3GPPAVPBuilder(AVP_RAND, AVPFlag_Mandatory).SetData(v.RAND).Build(),
+			New3GPPAVPBuilder(AVP_XRES, AVPFlag_Mandatory).SetData(v.XRES).Build(),
+			New3GPPAVPBuilder(AVP_AUTN, AVPFlag_Mandatory).SetData(v.AUTN).Build(),
+			New3GPPAVPBuilder(AVP_KASME, AVPFlag_Mandatory).SetData(v.KASME).Build(),
+		).Build())
+	}
+	return builder.
+		AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(ResultCode_Success).Build()).
+		AddAVP(New3GPPAVPBuilder(AVP_AuthenticationInfo, AVPFlag_Mandatory).SetGroupedData(vectorAVPs...).Build()).
+		Build(), nil
+}
+
+// 处理ULR，登记MME/SGSN并返回签约数据，登记的节点变化时向旧节点发CLR，TS 29.272 5.2.1.1
+func handleULR(session *Session, msg *DiameterMsg) (*DiameterMsg, error) {
+	imsi, plmn := s6aRequestUser(msg)
+	builder := newS6aAnswerBuilder(msg)
+	if session.State() != StateEstablished {
+		return s6aReject(session, "ULR", imsi, builder, newResultError(ResultCode_UnableToDeliver, "session not established, send CER first")), nil
+	}
+	if len(plmn) != 3 {
+		return s6aReject(session, "ULR", imsi, builder, newResultError(ResultCode_InvalidAVPValue, "invalid Visited-PLMN-Id")), nil
+	}
+	flags := avpIntData(msg, AVP_ULRFlags)
+	reg := S6aRegistration{
+		Host:         session.PeerHost,
+		Realm:        session.PeerRealm,
+		RATType:      avpIntData(msg, AVP_RATType),
+		VisitedPLMN:  hex.EncodeToString(plmn),
+		RegisteredAt: time.Now(),
+	}
+	if hostAVP, _ := msg.FindAVPByCode(AVP_OriginHost); hostAVP != nil {
+		reg.Host = hostAVP.GetStringData()
+	}
+	if realmAVP, _ := msg.FindAVPByCode(AVP_OriginRealm); realmAVP != nil {
+		reg.Realm = realmAVP.GetStringData()
+	}
+	log.Printf("主机%v ULR IMSI: %v RAT-Type: %v ULR-Flags: %#x", session.PeerHost, imsi, reg.RATType, flags)
+
+	profile, cancels, err := hss.update(imsi, reg, flags)
+	if err != nil {
+		return s6aReject(session, "ULR", imsi, builder, err), nil
+	}
+	builder.
+		AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(ResultCode_Success).Build()).
+		AddAVP(New3GPPAVPBuilder(AVP_ULAFlags, AVPFlag_Mandatory).SetIntData(ULAFlagSeparationIndication).Build())
+	if flags&ULRFlagSkipSubscriberData == 0 {
+		builder.AddAVP(subscriptionDataAVP(profile))
+	}
+	for _, cancel := range cancels {
+		go func(cancel s6aCancel) {
+			if _, err := sendCancelLocation(imsi, cancel); err != nil {
+				log.Printf("IMSI %v 向主机%v 发出CLR失败: %v", imsi, cancel.node.Host, err)
+			}
+		}(cancel)
+	}
+	return builder.Build(), nil
+}
+
+// 处理PUR，标记服务节点已清除用户，TS 29.272 5.2.1.3
+func handlePUR(session *Session, msg *DiameterMsg) (*DiameterMsg, error) {
+	imsi, _ := s6aRequestUser(msg)
+	builder := newS6aAnswerBuilder(msg)
+	if session.State() != StateEstablished {
+		return s6aReject(session, "PUR", imsi, builder, newResultError(ResultCode_UnableToDeliver, "session not established, send CER first")), nil
+	}
+	host := session.PeerHost
+	if hostAVP, _ := msg.FindAVPByCode(AVP_OriginHost); hostAVP != nil {
+		host = hostAVP.GetStringData()
+	}
+	log.Printf("主机%v PUR IMSI: %v", session.PeerHost, imsi)
+	flags, err := hss.purge(imsi, host)
+	if err != nil {
+		return s6aReject(session, "PUR", imsi, builder, err), nil
+	}
+	return builder.
+		AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(ResultCode_Success).Build()).
+		AddAVP(New3GPPAVPBuilder(AVP_PUAFlags, AVPFlag_Mandatory).SetIntData(flags).Build()).
+		Build(), nil
+}
+
+// HSS发给服务节点的请求，每次新生成Session-Id
+func newS6aRequest(command uint32, imsi string, node S6aRegistration) *DiameterMsgBuilder {
+	return NewDiameterMsgBuilder().
+		SetCommandCode(command).
+		SetAppID(AppID_S6a).
+		SetFlags(FlagRequest | FlagProxiable).
+		SetHopByHopID(nextHopByHopID()).
+		SetEndToEndID(nextEndToEndID()).
+		AddAVP(NewAVPBuilder(AVP_SessionId, AVPFlag_Mandatory).SetStringData(generateSessionID(config.OriginHost)).Build()).
+		AddAVP(vendorApplicationAVP(AppID_S6a)).
+		AddAVP(NewAVPBuilder(AVP_AuthSessionState, AVPFlag_Mandatory).SetIntData(AuthSessionNoStateMaintained).Build()).
+		AddAVP(NewAVPBuilder(AVP_OriginHost, AVPFlag_Mandatory).SetStringData(config.OriginHost).Build()).
+		AddAVP(NewAVPBuilder(AVP_OriginRealm, AVPFlag_Mandatory).SetStringData(config.OriginRealm).Build()).
+		AddAVP(NewAVPBuilder(AVP_DestinationHost, AVPFlag_Mandatory).SetStringData(node.Host).Build()).
+		AddAVP(NewAVPBuilder(AVP_DestinationRealm, AVPFlag_Mandatory).SetStringData(node.Realm).Build()).
+		AddAVP(NewAVPBuilder(AVP_UserName, AVPFlag_Mandatory).SetStringData(imsi).Build())
+}
+
+// 经RouteRequest向服务节点发出请求并等待应答(没有直连时按Destination-Realm路由)，返回Result-Code或Experimental-Result-Code
+func sendS6aRequest(imsi, name string, node S6aRegistration, req *DiameterMsg) (uint32, error) {
+	log.Printf("主机%v 发出%v IMSI: %v End-to-End: %v", node.Host, name, imsi, req.GetEndToEndID())
+	rsp, err := RouteRequest(req)
+	if err != nil {
+		return 0, err
+	}
+	resultCode := answerResultCode(rsp)
+	log.Printf("主机%v %v应答 IMSI: %v Result-Code: %v", node.Host, name, imsi, resultCode)
+	return resultCode, nil
+}
+
+// 向服务节点发出CLR，成功后删除该节点的登记
+func sendCancelLocation(imsi string, cancel s6aCancel) (uint32, error) {
+	req := newS6aRequest(Cmd_CL, imsi, cancel.node).
+		AddAVP(New3GPPAVPBuilder(AVP_CancellationType, AVPFlag_Mandatory).SetIntData(cancel.cancellationType).Build()).
+		Build()
+	resultCode, err := sendS6aRequest(imsi, "CLR", cancel.node, req)
+	if err == nil && resultCode == ResultCode_Success {
+		hss.unregister(imsi, cancel.node.Host)
+	}
+	return resultCode, err
+}
+
+// 向用户登记的每个服务节点发出请求，返回各节点的应答结果，有节点失败时同时返回错误
+func sendToRegisteredNodes(nodes []S6aRegistration, send func(node S6aRegistration) (uint32, error)) (map[string]uint32, error) {
+	results := make(map[string]uint32, len(nodes))
+	var firstErr error
+	for _, node := range nodes {
+		resultCode, err := send(node)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%v: %w", node.Host, err)
+			}
+			continue
+		}
+		results[node.Host] = resultCode
+	}
+	return results, firstErr
+}
+
+// SendCancelLocation 向用户登记的MME/SGSN发出CLR，成功的节点删除登记，返回各节点CLA的结果
+func SendCancelLocation(imsi string, cancellationType uint32) (map[string]uint32, error) {
+	nodes, _, err := hss.registrations(imsi)
+	if err != nil {
+		return nil, err
+	}
+	return sendToRegisteredNodes(nodes, func(node S6aRegistration) (uint32, error) {
+		return sendCancelLocation(imsi, s6aCancel{node, cancellationType})
+	})
+}
+
+// SendInsertSubscriberData 向用户登记的MME/SGSN发出IDR，下发当前的签约数据，返回各节点IDA的结果
+func SendInsertSubscriberData(imsi string) (map[string]uint32, error) {
+	nodes, profile, err := hss.registrations(imsi)
+	if err != nil {
+		return nil, err
+	}
+	return sendToRegisteredNodes(nodes, func(node S6aRegistration) (uint32, error) {
+		req := newS6aRequest(Cmd_ID, imsi, node).AddAVP(subscriptionDataAVP(profile)).Build()
+		return sendS6aRequest(imsi, "IDR", node, req)
+	})
+}
+
+// SendDeleteSubscriberData 向用户登记的MME/SGSN发出DSR删除APN签约，contextIDs为空时删除全部APN，
+// 所有节点都成功时HSS中也删除，返回各节点DSA的结果
+func SendDeleteSubscriberData(imsi string, contextIDs []uint32) (map[string]uint32, error) {
+	nodes, _, err := hss.registrations(imsi)
+	if err != nil {
+		return nil, err
+	}
+	results, err := sendToRegisteredNodes(nodes, func(node S6aRegistration) (uint32, error) {
+		builder := newS6aRequest(Cmd_DS, imsi, node)
+		if len(contextIDs) == 0 {
+			builder.AddAVP(New3GPPAVPBuilder(AVP_DSRFlags, AVPFlag_Mandatory).SetIntData(DSRFlagCompleteAPNWithdrawal).Build())
+		} else {
+			builder.AddAVP(New3GPPAVPBuilder(AVP_DSRFlags, AVPFlag_Mandatory).SetIntData(DSRFlagPDNContextsWithdrawal).Build())
+			for _, id := range contextIDs {
+				builder.AddAVP(New3GPPAVPBuilder(AVP_ContextIdentifier, AVPFlag_Mandatory).SetIntData(id).Build())
+			}
+		}
+		return sendS6aRequest(imsi, "DSR", node, builder.Build())
+	})
+	if err != nil {
+		return results, err
+	}
+	for _, resultCode := range results {
+		if resultCode != ResultCode_Success {
+			return results, nil
+		}
+	}
+	hss.deleteAPNs(imsi, contextIDs)
+	return results, nil
+}
@@ -9,6 +9,17 @@ import (
 )
 
 func StartServer(port *int) {
+	loadFiles()
+	if config.AdminAddr != "" {
+		startAdmin(config.AdminAddr)
+	}
+	if config.DOIC.Enabled {
+		startOverloadMonitor()
+	}
+	startSessionTimers()
+	// 主动连接配置了connect_to的对端
+	startConnectors()
+
 	// 开始监听
 	addr := fmt.Sprintf(":%d", *port)
 	ln, err := net.Listen("tcp", addr)
@@ -24,6 +35,10 @@ func StartServer(port *int) {
 			log.Printf("Accept error: %v", err)
 			continue
 		}
+		if err := connections.acquire(conn.RemoteAddr()); err != nil {
+			shedConnection(conn, err)
+			continue
+		}
 		go handleConnection(conn)
 	}
 }
@@ -31,77 +46,285 @@ func StartServer(port *int) {
 // 单个会话处理
 func handleConnection(conn net.Conn) {
 	defer recover()
+	defer connections.release(conn.RemoteAddr())
 	defer conn.Close()
 	defer log.Printf("Closed Connection from %v", conn.RemoteAddr())
 	log.Printf("Accepted connection from %v", conn.RemoteAddr())
-	// 目前用不到，类似挑战-验证这种二阶段的认证需要用到。
-	session := &Session{}
+	// 连接状态，TESTR二阶段挑战认证时挑战绑定到会话中的对端
+	session := newSession(conn)
+	defer peerTable.unregister(session)
+	serveSession(session)
+}
+
+// 连接上的读循环，应答交给等待中的请求，请求按DRMP优先级排队后由处理协程处理
+// 被动接入和主动发起的连接共用
+func serveSession(session *Session) {
+	defer session.closePending()
+	queue := newRequestQueue(config.DRMP.queueSize())
+	defer queue.close()
+	go session.processRequests(queue)
+
+	conn := session.conn
 	for {
-		var diameterMsg DiameterMsg
-		diameterMsg.body = make([]*AVPMsg, 0, 10)
-		// 客户端30s发一次保活，这里设置40s超时时间，需要考虑半包/空连接攻击
-		conn.SetReadDeadline(time.Now().Add(40 * time.Second))
-		if _, err := io.ReadFull(conn, diameterMsg.head[:]); err != nil {
-			log.Printf("dropDiameter for read diameter header error: %v", err)
-			return
+		// 客户端30s发一次保活，默认40s超时，对端表中可按对端覆盖，需要考虑半包/空连接攻击
+		conn.SetReadDeadline(time.Now().Add(session.Peer.idleTimeout()))
+		diameterMsg, err := readDiameterMsg(conn)
+		if limitErr, ok := err.(*limitError); ok {
+			log.Printf("dropDiameter for %v", limitErr)
+			metrics.inc(MetricOversizedMessages)
+			if limitErr.head[4]&FlagRequest != 0 {
+				session.Send(newLimitErrorAnswer(limitErr))
+			}
+			if limitErr.fatal {
+				return
+			}
+			continue
 		}
-		// 已经收到报头的情况下，1s内收不完剩余数据，不属于正常情况，断开即可。
-		conn.SetReadDeadline(time.Now().Add(1 * time.Second))
-		if err := diameterMsg.Validate(); err != nil {
-			log.Printf("dropDiameter for parse diameter header error: %v", err)
+		if err != nil {
+			log.Printf("dropDiameter for %v", err)
 			return
 		}
 
-		bodyLen := diameterMsg.GetBodyLength()
-		readBodyLen := 0
-
-		for readBodyLen < bodyLen {
-			var avpMsg AVPMsg
+		if !diameterMsg.IsRequest() {
+			session.dispatchAnswer(diameterMsg)
+			continue
+		}
 
-			if _, err := io.ReadFull(conn, avpMsg.head[:]); err != nil {
-				log.Printf("dropDiameter for read avp header error: %v", err)
-				return
+		// 重复请求直接重放之前的应答，原请求还在处理中时等它的应答
+		if rsp, duplicate := requestCache.lookup(session, diameterMsg); duplicate {
+			log.Printf("主机%v 重复请求，不再处理 Command: %v End-to-End: %v", session.PeerHost, diameterMsg.GetCommandCode(), diameterMsg.GetEndToEndID())
+			metrics.inc(MetricDuplicateSuppressed)
+			if rsp != nil {
+				session.Send(rsp)
 			}
-			readBodyLen += len(avpMsg.head)
+			continue
+		}
 
-			if err := avpMsg.Validate(); err != nil {
-				log.Printf("dropDiameter for parse avp header error: %v", err)
+		// 能力交换、保活、断连等基础命令不排队，不受业务过载影响
+		if diameterMsg.GetApplicationID() == AppID_Common {
+			if !session.handleRequest(diameterMsg) {
 				return
 			}
+			continue
+		}
 
-			otherLen := avpMsg.GetOtherLen()
-			avpMsg.other = make([]byte, otherLen)
-			if readBodyLen+otherLen > bodyLen {
-				log.Printf("dropDiameter for read more bytes than body length error: %d > %d", readBodyLen, bodyLen)
-				return
-			}
-			if _, err := io.ReadFull(conn, avpMsg.other); err != nil {
-				log.Printf("dropDiameter for read avp body error: %v", err)
-				return
-			}
-			readBodyLen += otherLen
-			diameterMsg.body = append(diameterMsg.body, &avpMsg)
+		// 队列已满时优先级最低的请求回复3004，不缓存，请求方重传时可能已经不忙
+		if dropped := queue.push(diameterMsg); dropped != nil {
+			rsp := newTooBusyAnswer(dropped)
+			requestCache.release(dropped, rsp)
+			session.Send(rsp)
 		}
+	}
+}
 
-		if readBodyLen != bodyLen {
-			log.Printf("dropDiameter for avp length mismatch error: read %d, expect %d", readBodyLen, bodyLen)
+// 按优先级依次处理排队的请求，需要断开连接时关闭连接，读循环随之退出
+func (s *Session) processRequests(queue *requestQueue) {
+	for {
+		msg := queue.pop()
+		if msg == nil {
+			return
+		}
+		if !s.handleRequest(msg) {
+			s.Close()
 			return
 		}
+	}
+}
 
-		// 处理diameterMsg，err是要断开连接的，不想断开连接的不要返回err，业务err在rsp中返回
-		// log.Printf("handleDiameter req:\n %s\n\n\n\n", diameterMsg.toString())
-		rsp, err := handleDiameter(session, &diameterMsg)
-		if rsp != nil {
-			conn.Write(rsp.ToBytes())
-			// log.Printf("handleDiameter rsp:\n %s\n\n\n\n", rsp.toString())
+// 处理一个请求并发送应答，返回false表示需要断开连接
+func (s *Session) handleRequest(msg *DiameterMsg) bool {
+	// 处理diameterMsg，err是要断开连接的，不想断开连接的不要返回err，业务err在rsp中返回
+	// log.Printf("handleDiameter req:\n %s\n\n\n\n", msg.toString())
+	rsp, err := handleDiameter(s, msg)
+	if rsp != nil {
+		copyDRMP(msg, rsp)
+		addOverloadReport(msg, rsp)
+		requestCache.store(msg, rsp)
+		s.Send(rsp)
+		// log.Printf("handleDiameter rsp:\n %s\n\n\n\n", rsp.toString())
+	}
+	if err != nil {
+		if rsp == nil {
+			requestCache.release(msg, nil)
 		}
-		if err != nil {
-			log.Printf("handleDiameter err\n %v", err)
-			return
+		log.Printf("handleDiameter err\n %v", err)
+		return false
+	}
+	if s.NeedClose() {
+		log.Print("handleDiameter finish\n")
+		return false
+	}
+	return true
+}
+
+// 从连接上读取一条完整的Diameter消息
+func readDiameterMsg(conn net.Conn) (*DiameterMsg, error) {
+	var diameterMsg DiameterMsg
+	diameterMsg.body = make([]*AVPMsg, 0, 10)
+	if _, err := io.ReadFull(conn, diameterMsg.head[:]); err != nil {
+		return nil, fmt.Errorf("read diameter header error: %w", err)
+	}
+	// 已经收到报头的情况下，超时(默认1s)内收不完剩余数据，不属于正常情况，断开即可。
+	conn.SetReadDeadline(time.Now().Add(config.Limits.bodyTimeout()))
+	if err := diameterMsg.Validate(); err != nil {
+		return nil, fmt.Errorf("parse diameter header error: %w", err)
+	}
+
+	bodyLen := diameterMsg.GetBodyLength()
+	readBodyLen := 0
+
+	if maxSize := config.Limits.maxMessageSize(); int(diameterMsg.GetMessageLength()) > maxSize {
+		limitErr := &limitError{
+			head:       diameterMsg.head,
+			resultCode: ResultCode_InvalidMessageLength,
+			reason:     fmt.Sprintf("message length %d exceeds limit %d", diameterMsg.GetMessageLength(), maxSize),
 		}
-		if session.NeedClose {
-			log.Print("handleDiameter finish\n")
-			return
+		return nil, discardBody(conn, limitErr, bodyLen)
+	}
+
+	for readBodyLen < bodyLen {
+		var avpMsg AVPMsg
+
+		if len(diameterMsg.body) >= config.Limits.maxAVPs() {
+			limitErr := &limitError{
+				head:       diameterMsg.head,
+				resultCode: ResultCode_InvalidMessageLength,
+				reason:     fmt.Sprintf("too many AVPs, limit %d", config.Limits.maxAVPs()),
+			}
+			return nil, discardBody(conn, limitErr, bodyLen-readBodyLen)
+		}
+
+		if _, err := io.ReadFull(conn, avpMsg.head[:]); err != nil {
+			return nil, fmt.Errorf("read avp header error: %w", err)
+		}
+		readBodyLen += len(avpMsg.head)
+
+		if err := avpMsg.Validate(); err != nil {
+			return nil, fmt.Errorf("parse avp header error: %w", err)
+		}
+
+		otherLen := avpMsg.GetOtherLen()
+		avpMsg.other = make([]byte, otherLen)
+		if readBodyLen+otherLen > bodyLen {
+			return nil, fmt.Errorf("read more bytes than body length error: %d > %d", readBodyLen+otherLen, bodyLen)
+		}
+		if _, err := io.ReadFull(conn, avpMsg.other); err != nil {
+			return nil, fmt.Errorf("read avp body error: %w", err)
 		}
+		readBodyLen += otherLen
+		diameterMsg.body = append(diameterMsg.body, &avpMsg)
+	}
+
+	if readBodyLen != bodyLen {
+		return nil, fmt.Errorf("avp length mismatch error: read %d, expect %d", readBodyLen, bodyLen)
+	}
+	return &diameterMsg, nil
+}
+
+// 本端发出、等待应答的请求
+type pendingRequest struct {
+	req      *DiameterMsg
+	sentAt   time.Time
+	callback func(rsp *DiameterMsg) // 连接断开时以nil回调
+}
+
+func newSession(conn net.Conn) *Session {
+	return &Session{
+		RemoteAddr: conn.RemoteAddr(),
+		conn:       conn,
+		pending:    make(map[uint32]*pendingRequest),
+		done:       make(chan struct{}),
+	}
+}
+
+// 等待应答的请求数，负载均衡时使用
+func (s *Session) outstanding() int {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	return len(s.pending)
+}
+
+// 发送消息，多个goroutine可能同时写同一连接
+func (s *Session) Send(msg *DiameterMsg) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_, err := s.conn.Write(msg.ToBytes())
+	return err
+}
+
+// 异步发送请求，应答按Hop-by-Hop ID匹配后回调
+func (s *Session) SendRequestAsync(req *DiameterMsg, callback func(rsp *DiameterMsg)) error {
+	hopByHopID := req.GetHopByHopID()
+	s.pendingMu.Lock()
+	if s.pending == nil {
+		s.pendingMu.Unlock()
+		return fmt.Errorf("connection to %v closed", s.PeerHost)
+	}
+	s.pending[hopByHopID] = &pendingRequest{req: req, sentAt: time.Now(), callback: callback}
+	s.pendingMu.Unlock()
+
+	if err := s.Send(req); err != nil {
+		s.pendingMu.Lock()
+		delete(s.pending, hopByHopID)
+		s.pendingMu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// 发送请求并等待应答
+func (s *Session) SendRequest(req *DiameterMsg, timeout time.Duration) (*DiameterMsg, error) {
+	ch := make(chan *DiameterMsg, 1)
+	if err := s.SendRequestAsync(req, func(rsp *DiameterMsg) { ch <- rsp }); err != nil {
+		return nil, err
+	}
+	select {
+	case rsp := <-ch:
+		if rsp == nil {
+			return nil, fmt.Errorf("connection to %v closed", s.PeerHost)
+		}
+		return rsp, nil
+	case <-time.After(timeout):
+		s.pendingMu.Lock()
+		delete(s.pending, req.GetHopByHopID())
+		s.pendingMu.Unlock()
+		return nil, fmt.Errorf("wait answer from %v timeout", s.PeerHost)
+	}
+}
+
+// 取消等待应答，返回false说明应答已经到了或连接已断开
+func (s *Session) cancelPending(hopByHopID uint32) bool {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	if _, ok := s.pending[hopByHopID]; !ok {
+		return false
+	}
+	delete(s.pending, hopByHopID)
+	return true
+}
+
+// 收到应答，交给对应的请求
+func (s *Session) dispatchAnswer(rsp *DiameterMsg) {
+	hopByHopID := rsp.GetHopByHopID()
+	s.pendingMu.Lock()
+	pending, ok := s.pending[hopByHopID]
+	delete(s.pending, hopByHopID)
+	s.pendingMu.Unlock()
+	if !ok {
+		log.Printf("主机%v 收到未知应答，丢弃 Command: %v Hop-by-Hop: %v", s.PeerHost, rsp.GetCommandCode(), hopByHopID)
+		return
+	}
+	pending.callback(rsp)
+}
+
+// 连接断开，通知所有等待应答的请求
+func (s *Session) closePending() {
+	s.pendingMu.Lock()
+	pending := s.pending
+	s.pending = nil
+	s.pendingMu.Unlock()
+	close(s.done)
+	for _, p := range pending {
+		p.callback(nil)
 	}
 }
@@ -0,0 +1,97 @@
+package diameter
+
+import (
+	"log"
+	"strconv"
+	"time"
+)
+
+const sessionTimerInterval = time.Second
+
+// SessionLimits 会话的授权有效期和最长时间，秒，0表示不限制
+type SessionLimits struct {
+	AuthorizationLifetime int `json:"authorization_lifetime"` // 授权有效期，到期前对端需重新认证/授权
+	AuthGracePeriod       int `json:"auth_grace_period"`      // 授权到期后的宽限时间
+	SessionTimeout        int `json:"session_timeout"`        // 会话最长时间，重新授权也不延长
+}
+
+// 按字段合并，override中非0的字段覆盖
+func (l SessionLimits) merge(override SessionLimits) SessionLimits {
+	if override.AuthorizationLifetime > 0 {
+		l.AuthorizationLifetime = override.AuthorizationLifetime
+	}
+	if override.AuthGracePeriod > 0 {
+		l.AuthGracePeriod = override.AuthGracePeriod
+	}
+	if override.SessionTimeout > 0 {
+		l.SessionTimeout = override.SessionTimeout
+	}
+	return l
+}
+
+// 用户会话的限制：全局默认值，按应用覆盖，再按用户覆盖
+func sessionLimits(appID uint32, userName string) SessionLimits {
+	limits := config.Sessions.SessionLimits
+	limits = limits.merge(config.Sessions.Applications[strconv.FormatUint(uint64(appID), 10)])
+	if profile, ok := config.UserProfiles[userName]; ok {
+		limits = limits.merge(SessionLimits{
+			AuthorizationLifetime: int(profile.AuthorizationLifetime),
+			AuthGracePeriod:       int(profile.AuthGracePeriod),
+			SessionTimeout:        int(profile.SessionTimeout),
+		})
+	}
+	return limits
+}
+
+// 在认证/授权应答中带上Authorization-Lifetime、Auth-Grace-Period、Session-Timeout
+func addSessionLimitAVPs(builder *DiameterMsgBuilder, limits SessionLimits) {
+	if limits.AuthorizationLifetime > 0 {
+		builder.AddAVP(NewAVPBuilder(AVP_AuthorizationLifetime, AVPFlag_Mandatory).SetIntData(uint32(limits.AuthorizationLifetime)).Build())
+		if limits.AuthGracePeriod > 0 {
+			builder.AddAVP(NewAVPBuilder(AVP_AuthGracePeriod, AVPFlag_Mandatory).SetIntData(uint32(limits.AuthGracePeriod)).Build())
+		}
+	}
+	if limits.SessionTimeout > 0 {
+		builder.AddAVP(NewAVPBuilder(AVP_SessionTimeout, AVPFlag_Mandatory).SetIntData(uint32(limits.SessionTimeout)).Build())
+	}
+}
+
+// 认证类命令可以在已过期的会话上重新认证，其他命令在过期的会话上回复5002
+var sessionAuthCommands = map[uint32]bool{Cmd_AA: true, Cmd_DE: true, Cmd_TEST: true}
+
+// 定时检查用户会话：授权到期前按配置发RAR，授权过了宽限期或超过Session-Timeout时结束会话，按配置发ASR
+func startSessionTimers() {
+	go func() {
+		ticker := time.NewTicker(sessionTimerInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			checkSessionTimers(time.Now())
+		}
+	}()
+}
+
+func checkSessionTimers(now time.Time) {
+	reauth, expired := userSessions.due(now, time.Duration(config.Sessions.ReAuthBefore)*time.Second)
+	for _, sessionID := range reauth {
+		log.Printf("会话%v授权即将到期，发出RAR", sessionID)
+		go func(sessionID string) {
+			if _, err := SendReAuth(sessionID, ReAuthAuthorizeOnly); err != nil {
+				log.Printf("会话%v发出RAR失败: %v", sessionID, err)
+			}
+		}(sessionID)
+	}
+	for sessionID, cause := range expired {
+		log.Printf("会话%v已过期: %v", sessionID, terminationCauseNames[cause])
+		if !config.Sessions.AbortExpired {
+			userSessions.terminate(sessionID, cause)
+			continue
+		}
+		go func(sessionID string, cause uint32) {
+			if _, err := SendAbortSession(sessionID); err != nil {
+				log.Printf("会话%v发出ASR失败: %v", sessionID, err)
+			}
+			// ASA不成功时本端也结束会话
+			userSessions.terminate(sessionID, cause)
+		}(sessionID, cause)
+	}
+}
@@ -0,0 +1,134 @@
+package diameter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionLimits(t *testing.T) {
+	savedSessions, savedProfiles := config.Sessions, config.UserProfiles
+	defer func() { config.Sessions, config.UserProfiles = savedSessions, savedProfiles }()
+	config.Sessions = SessionConfig{
+		SessionLimits: SessionLimits{AuthorizationLifetime: 60, AuthGracePeriod: 10, SessionTimeout: 3600},
+		Applications:  map[string]SessionLimits{"1": {AuthorizationLifetime: 120}},
+	}
+	config.UserProfiles = map[string]UserProfile{"alice": {SessionTimeout: 600}}
+
+	tests := []struct {
+		name     string
+		appID    uint32
+		userName string
+		want     SessionLimits
+	}{
+		{"全局默认值", AppID_Test, "bob", SessionLimits{60, 10, 3600}},
+		{"按应用覆盖", 1, "bob", SessionLimits{120, 10, 3600}},
+		{"按用户覆盖", AppID_Test, "alice", SessionLimits{60, 10, 600}},
+		{"应用和用户都覆盖", 1, "alice", SessionLimits{120, 10, 600}},
+	}
+	for _, tt := range tests {
+		if got := sessionLimits(tt.appID, tt.userName); got != tt.want {
+			t.Errorf("%v: sessionLimits = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUserSessionDue(t *testing.T) {
+	type step struct {
+		at     time.Duration // 相对会话建立的时间
+		reauth bool
+		cause  uint32 // 过期的结束原因，0表示未过期
+	}
+	tests := []struct {
+		name    string
+		limits  SessionLimits
+		pending string
+		before  time.Duration
+		steps   []step
+	}{
+		{
+			name:  "不限制",
+			steps: []step{{at: 24 * time.Hour}},
+		},
+		{
+			name:   "授权到期前发一次RAR",
+			limits: SessionLimits{AuthorizationLifetime: 60, AuthGracePeriod: 10},
+			before: 10 * time.Second,
+			steps:  []step{{at: 49 * time.Second}, {at: 50 * time.Second, reauth: true}, {at: 55 * time.Second}},
+		},
+		{
+			name:   "未配置reauth_before不发RAR",
+			limits: SessionLimits{AuthorizationLifetime: 60, AuthGracePeriod: 10},
+			steps:  []step{{at: 59 * time.Second}},
+		},
+		{
+			name:    "有未完成的请求时不发RAR",
+			limits:  SessionLimits{AuthorizationLifetime: 60, AuthGracePeriod: 10},
+			pending: "ASR",
+			before:  10 * time.Second,
+			steps:   []step{{at: 55 * time.Second}},
+		},
+		{
+			name:   "宽限期结束后过期，只报告一次",
+			limits: SessionLimits{AuthorizationLifetime: 60, AuthGracePeriod: 10},
+			steps:  []step{{at: 69 * time.Second}, {at: 70 * time.Second, cause: TerminationCauseAuthExpired}, {at: 80 * time.Second}},
+		},
+		{
+			name:   "Session-Timeout优先于授权到期",
+			limits: SessionLimits{AuthorizationLifetime: 60, SessionTimeout: 60},
+			before: 10 * time.Second,
+			steps:  []step{{at: 60 * time.Second, cause: TerminationCauseSessionTimeout}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &userSessionStore{sessions: make(map[string]*UserSession)}
+			s.open(UserSession{SessionID: "client.local;1;1", UserName: "alice", PeerHost: "client.local"}, tt.limits)
+			s.sessions["client.local;1;1"].Pending = tt.pending
+			openedAt := s.sessions["client.local;1;1"].CreatedAt
+			for _, st := range tt.steps {
+				reauth, expired := s.due(openedAt.Add(st.at), tt.before)
+				if got := len(reauth) == 1; got != st.reauth {
+					t.Errorf("at %v: reauth = %v, want %v", st.at, reauth, st.reauth)
+				}
+				if got := expired["client.local;1;1"]; got != st.cause {
+					t.Errorf("at %v: expired cause = %v, want %v", st.at, got, st.cause)
+				}
+			}
+		})
+	}
+}
+
+func TestUserSessionExpired(t *testing.T) {
+	tests := []struct {
+		name   string
+		update func(s *userSessionStore, sessionID string)
+		want   bool
+	}{
+		{"会话正常", func(s *userSessionStore, sessionID string) {}, false},
+		{"会话正在结束", func(s *userSessionStore, sessionID string) {
+			s.sessions[sessionID].expiring = TerminationCauseAuthExpired
+		}, true},
+		{"授权到期结束", func(s *userSessionStore, sessionID string) {
+			s.terminate(sessionID, TerminationCauseAuthExpired)
+		}, true},
+		{"Session-Timeout结束", func(s *userSessionStore, sessionID string) {
+			s.terminate(sessionID, TerminationCauseSessionTimeout)
+		}, true},
+		{"用户下线", func(s *userSessionStore, sessionID string) {
+			s.terminate(sessionID, TerminationCauseLogout)
+		}, false},
+		{"会话不存在", func(s *userSessionStore, sessionID string) {
+			delete(s.sessions, sessionID)
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &userSessionStore{sessions: make(map[string]*UserSession)}
+			s.open(UserSession{SessionID: "client.local;1;1", UserName: "alice", PeerHost: "client.local"}, SessionLimits{})
+			tt.update(s, "client.local;1;1")
+			if got := s.expired("client.local;1;1"); got != tt.want {
+				t.Errorf("expired = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package diameter
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTestChallengeTimeout = 30 // 秒
+	testChallengeLen            = 16
+)
+
+// TestAuthConfig TESTR二阶段挑战认证配置
+type TestAuthConfig struct {
+	// 为true时不再接受一轮明文密码认证，必须先取挑战
+	RequireChallenge bool `json:"require_challenge"`
+	// 挑战的有效期，秒，默认30
+	ChallengeTimeout int `json:"challenge_timeout"`
+}
+
+func (c *TestAuthConfig) challengeTimeout() time.Duration {
+	if c.ChallengeTimeout <= 0 {
+		return defaultTestChallengeTimeout * time.Second
+	}
+	return time.Duration(c.ChallengeTimeout) * time.Second
+}
+
+// 发出的挑战，绑定Session-Id、对端和用户，只能使用一次
+type testChallenge struct {
+	challenge []byte
+	peerHost  string
+	userID    uint32
+	expireAt  time.Time
+}
+
+type testChallengeStore struct {
+	mu         sync.Mutex
+	challenges map[string]*testChallenge // 按Session-Id索引
+}
+
+var testChallenges = &testChallengeStore{challenges: make(map[string]*testChallenge)}
+
+// 为会话生成新的挑战，同一Session-Id之前未使用的挑战作废
+func (s *testChallengeStore) issue(sessionID, peerHost string, userID uint32) []byte {
+	challenge := randomBytes(testChallengeLen)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for id, c := range s.challenges {
+		if now.After(c.expireAt) {
+			delete(s.challenges, id)
+		}
+	}
+	s.challenges[sessionID] = &testChallenge{
+		challenge: challenge,
+		peerHost:  peerHost,
+		userID:    userID,
+		expireAt:  now.Add(config.TestAuth.challengeTimeout()),
+	}
+	return challenge
+}
+
+// 取出并删除会话的挑战，校验State、对端、用户和有效期，无论结果如何挑战都不能再用
+func (s *testChallengeStore) take(sessionID, peerHost string, userID uint32, state []byte) ([]byte, error) {
+	s.mu.Lock()
+	c, ok := s.challenges[sessionID]
+	delete(s.challenges, sessionID)
+	s.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no challenge for Session-Id %v or already used", sessionID)
+	}
+	if time.Now().After(c.expireAt) {
+		return nil, fmt.Errorf("challenge expired")
+	}
+	if !hmac.Equal(c.challenge, state) {
+		return nil, fmt.Errorf("State does not match challenge")
+	}
+	if c.peerHost != peerHost {
+		return nil, fmt.Errorf("challenge issued to %v, not %v", c.peerHost, peerHost)
+	}
+	if c.userID != userID {
+		return nil, fmt.Errorf("challenge issued for user %v, not %v", c.userID, userID)
+	}
+	return c.challenge, nil
+}
+
+// 第二轮的应答值：HMAC-SHA256(密码, Session-Id + 挑战)
+func testChallengeResponse(password, sessionID string, challenge []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write([]byte(sessionID))
+	mac.Write(challenge)
+	return mac.Sum(nil)
+}
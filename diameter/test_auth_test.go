@@ -0,0 +1,97 @@
+package diameter
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestTestChallengeTake(t *testing.T) {
+	tests := []struct {
+		name      string
+		sessionID string
+		peerHost  string
+		userID    uint32
+		state     []byte // nil表示使用发出的挑战
+		expired   bool
+		ok        bool
+	}{
+		{"挑战匹配", "client.local;1;1", "client.local", 1, nil, false, true},
+		{"Session-Id不同", "client.local;1;2", "client.local", 1, nil, false, false},
+		{"对端不同", "client.local;1;1", "other.local", 1, nil, false, false},
+		{"用户不同", "client.local;1;1", "client.local", 2, nil, false, false},
+		{"State不是发出的挑战", "client.local;1;1", "client.local", 1, []byte("0123456789abcdef"), false, false},
+		{"挑战已过期", "client.local;1;1", "client.local", 1, nil, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &testChallengeStore{challenges: make(map[string]*testChallenge)}
+			challenge := s.issue("client.local;1;1", "client.local", 1)
+			if len(challenge) != testChallengeLen {
+				t.Fatalf("challenge length = %v, want %v", len(challenge), testChallengeLen)
+			}
+			if tt.expired {
+				s.challenges["client.local;1;1"].expireAt = time.Now().Add(-time.Second)
+			}
+			state := tt.state
+			if state == nil {
+				state = challenge
+			}
+			got, err := s.take(tt.sessionID, tt.peerHost, tt.userID, state)
+			if (err == nil) != tt.ok {
+				t.Fatalf("take err = %v, want ok %v", err, tt.ok)
+			}
+			if err == nil && !bytes.Equal(got, challenge) {
+				t.Errorf("take = %x, want %x", got, challenge)
+			}
+			// 取过一次后挑战不能再用，校验失败也一样
+			if tt.sessionID == "client.local;1;1" {
+				if _, err := s.take("client.local;1;1", "client.local", 1, challenge); err == nil {
+					t.Error("challenge should be single use")
+				}
+			}
+		})
+	}
+}
+
+// 同一Session-Id重新取挑战时之前的挑战作废，过期的挑战在发出新挑战时清理
+func TestTestChallengeIssue(t *testing.T) {
+	s := &testChallengeStore{challenges: make(map[string]*testChallenge)}
+	first := s.issue("client.local;1;1", "client.local", 1)
+	latest := s.issue("client.local;1;1", "client.local", 1)
+	if got := s.challenges["client.local;1;1"].challenge; !bytes.Equal(got, latest) || bytes.Equal(got, first) {
+		t.Error("reissue should replace the previous challenge")
+	}
+	if _, err := s.take("client.local;1;1", "client.local", 1, first); err == nil {
+		t.Error("replaced challenge should not be accepted")
+	}
+
+	s.issue("client.local;1;2", "client.local", 1)
+	s.challenges["client.local;1;2"].expireAt = time.Now().Add(-time.Second)
+	s.issue("client.local;1;3", "client.local", 1)
+	if _, ok := s.challenges["client.local;1;2"]; ok {
+		t.Error("expired challenge should be removed")
+	}
+}
+
+func TestTestChallengeResponse(t *testing.T) {
+	challenge := []byte("0123456789abcdef")
+	want := testChallengeResponse("secret", "client.local;1;1", challenge)
+	tests := []struct {
+		name      string
+		password  string
+		sessionID string
+		challenge []byte
+		equal     bool
+	}{
+		{"相同输入", "secret", "client.local;1;1", challenge, true},
+		{"密码不同", "wrong", "client.local;1;1", challenge, false},
+		{"Session-Id不同", "secret", "client.local;1;2", challenge, false},
+		{"挑战不同", "secret", "client.local;1;1", []byte("fedcba9876543210"), false},
+	}
+	for _, tt := range tests {
+		if got := testChallengeResponse(tt.password, tt.sessionID, tt.challenge); bytes.Equal(got, want) != tt.equal {
+			t.Errorf("%v: response equal = %v, want %v", tt.name, !tt.equal, tt.equal)
+		}
+	}
+}
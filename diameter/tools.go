@@ -2,8 +2,11 @@ package diameter
 
 import (
 	"fmt"
+	"math/rand"
 	"net"
 	"strconv"
+	"sync/atomic"
+	"time"
 )
 
 func GetLocalIPv4() net.IP {
@@ -66,3 +69,24 @@ func intersect(a, b []uint32) []uint32 {
 	}
 	return result
 }
+
+// 本端的Origin-State-Id，每次启动时变化
+var originStateID = uint32(time.Now().Unix())
+
+var hopByHopSeq = rand.Uint32()
+
+// 按RFC 6733，End-to-End ID高12位取启动时间低位，低20位递增
+var endToEndSeq = uint32(time.Now().Unix())<<20 | rand.Uint32()&0xfffff
+
+func nextHopByHopID() uint32 {
+	return atomic.AddUint32(&hopByHopSeq, 1)
+}
+
+func nextEndToEndID() uint32 {
+	return atomic.AddUint32(&endToEndSeq, 1)
+}
+
+// 应答、超时可能同时发生，只处理一次
+func markAnswered(flag *int32) bool {
+	return atomic.CompareAndSwapInt32(flag, 0, 1)
+}
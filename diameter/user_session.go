@@ -0,0 +1,342 @@
+package diameter
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 管理接口发起请求时会话不存在(或已结束)、会话上已有未完成的请求
+var (
+	errSessionNotFound = errors.New("session not found")
+	errSessionPending  = errors.New("session has a pending request")
+)
+
+// Termination-Cause，RFC 6733 8.15
+const (
+	TerminationCauseLogout             = 1
+	TerminationCauseServiceNotProvided = 2
+	TerminationCauseBadAnswer          = 3
+	TerminationCauseAdministrative     = 4
+	TerminationCauseLinkBroken         = 5
+	TerminationCauseAuthExpired        = 6
+	TerminationCauseUserMoved          = 7
+	TerminationCauseSessionTimeout     = 8
+)
+
+var terminationCauseNames = map[uint32]string{
+	TerminationCauseLogout:             "DIAMETER_LOGOUT",
+	TerminationCauseServiceNotProvided: "DIAMETER_SERVICE_NOT_PROVIDED",
+	TerminationCauseBadAnswer:          "DIAMETER_BAD_ANSWER",
+	TerminationCauseAdministrative:     "DIAMETER_ADMINISTRATIVE",
+	TerminationCauseLinkBroken:         "DIAMETER_LINK_BROKEN",
+	TerminationCauseAuthExpired:        "DIAMETER_AUTH_EXPIRED",
+	TerminationCauseUserMoved:          "DIAMETER_USER_MOVED",
+	TerminationCauseSessionTimeout:     "DIAMETER_SESSION_TIMEOUT",
+}
+
+// 用户会话状态
+const (
+	UserSessionOpen       = "open"
+	UserSessionTerminated = "terminated"
+)
+
+const defaultSessionRetention = 3600 // 秒
+
+// SessionConfig 用户会话表配置
+type SessionConfig struct {
+	Retention int `json:"retention"` // 已结束的会话保留时间，秒，默认3600
+	// 全局默认的授权有效期、宽限期和Session-Timeout
+	SessionLimits
+	// 按应用覆盖会话限制，键为应用ID
+	Applications map[string]SessionLimits `json:"applications"`
+	// 大于0时在授权到期前这么多秒向对端发RAR
+	ReAuthBefore int `json:"reauth_before"`
+	// 为true时会话过期后向对端发ASR，否则只在本端结束会话
+	AbortExpired bool `json:"abort_expired"`
+}
+
+func (c *SessionConfig) retention() time.Duration {
+	if c.Retention <= 0 {
+		return defaultSessionRetention * time.Second
+	}
+	return time.Duration(c.Retention) * time.Second
+}
+
+// UserSession 认证/授权通过的用户会话，按Session-Id索引
+type UserSession struct {
+	SessionID        string    `json:"session_id"`
+	UserName         string    `json:"user_name"`
+	PeerHost         string    `json:"peer_host"`
+	AppID            uint32    `json:"application_id"`
+	AuthMethod       string    `json:"auth_method,omitempty"`
+	RequestType      uint32    `json:"auth_request_type,omitempty"`
+	Token            string    `json:"token,omitempty"` // 认证通过后授予的令牌
+	State            string    `json:"state"`
+	TerminationCause string    `json:"termination_cause,omitempty"`
+	Pending          string    `json:"pending,omitempty"`        // 本端发出、等待应答的RAR/ASR
+	ReAuthPending    bool      `json:"reauth_pending,omitempty"` // RAA成功后等待对端重新认证
+	LastRequest      string    `json:"last_request,omitempty"`   // 本端最近发出的RAR/ASR及应答结果
+	LastResultCode   uint32    `json:"last_result_code,omitempty"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+	TerminatedAt     time.Time `json:"terminated_at,omitempty"`
+	AuthExpiresAt    time.Time `json:"auth_expires_at,omitempty"`    // 授权到期时间，重新授权时延后
+	GraceExpiresAt   time.Time `json:"grace_expires_at,omitempty"`   // 授权宽限期结束时间
+	SessionExpiresAt time.Time `json:"session_expires_at,omitempty"` // Session-Timeout到期时间
+
+	reauthSent bool   // 本次授权到期前已发过RAR
+	expiring   uint32 // 已过期、正在发ASR的会话，值为结束原因
+}
+
+type userSessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*UserSession
+}
+
+var userSessions = &userSessionStore{sessions: make(map[string]*UserSession)}
+
+// 记录认证/授权通过的会话，同一Session-Id再次认证时更新，已结束的会话重新打开
+// 只授权时method为AuthMethodNone，保留之前的认证方式；授权有效期从本次认证开始计算，Session-Timeout从会话建立开始计算
+func (s *userSessionStore) open(update UserSession, limits SessionLimits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.expire(now)
+	session, ok := s.sessions[update.SessionID]
+	if !ok || session.State != UserSessionOpen {
+		session = &UserSession{SessionID: update.SessionID, CreatedAt: now}
+		if limits.SessionTimeout > 0 {
+			session.SessionExpiresAt = now.Add(time.Duration(limits.SessionTimeout) * time.Second)
+		}
+		s.sessions[update.SessionID] = session
+	}
+	session.AuthExpiresAt = time.Time{}
+	session.GraceExpiresAt = time.Time{}
+	if limits.AuthorizationLifetime > 0 {
+		session.AuthExpiresAt = now.Add(time.Duration(limits.AuthorizationLifetime) * time.Second)
+		session.GraceExpiresAt = session.AuthExpiresAt.Add(time.Duration(limits.AuthGracePeriod) * time.Second)
+	}
+	session.reauthSent = false
+	session.expiring = 0
+	session.UserName = update.UserName
+	session.PeerHost = update.PeerHost
+	session.AppID = update.AppID
+	if update.AuthMethod != AuthMethodNone || session.AuthMethod == "" {
+		session.AuthMethod = update.AuthMethod
+	}
+	session.RequestType = update.RequestType
+	if update.Token != "" {
+		session.Token = update.Token
+	}
+	session.State = UserSessionOpen
+	session.ReAuthPending = false
+	session.UpdatedAt = now
+}
+
+// 本端向会话发出RAR/ASR，同一会话同时只能有一个，返回false表示会话不存在或有未完成的请求
+func (s *userSessionStore) beginRequest(sessionID, command string) (UserSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[sessionID]
+	if !ok || session.State != UserSessionOpen {
+		return UserSession{}, fmt.Errorf("%w: %v", errSessionNotFound, sessionID)
+	}
+	if session.Pending != "" {
+		return UserSession{}, fmt.Errorf("%w: %v %v", errSessionPending, sessionID, session.Pending)
+	}
+	session.Pending = command
+	session.UpdatedAt = time.Now()
+	return *session, nil
+}
+
+// 记录RAR/ASR的应答结果，resultCode为0表示没有收到应答
+func (s *userSessionStore) endRequest(sessionID string, resultCode uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[sessionID]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	command := session.Pending
+	session.Pending = ""
+	session.LastRequest = command
+	session.LastResultCode = resultCode
+	session.UpdatedAt = now
+	if session.State != UserSessionOpen {
+		return
+	}
+	switch {
+	case resultCode == ResultCode_UnknownSessionID:
+		// 对端已经没有这个会话
+		s.terminateLocked(session, TerminationCauseAdministrative, now)
+	case command == "ASR" && resultCode == ResultCode_Success:
+		cause := uint32(TerminationCauseAdministrative)
+		if session.expiring != 0 {
+			cause = session.expiring
+		}
+		s.terminateLocked(session, cause, now)
+	case command == "RAR" && resultCode == ResultCode_Success:
+		session.ReAuthPending = true
+	}
+}
+
+// 找出需要发RAR(授权在before之内到期)和已过期(超过宽限期或Session-Timeout)的会话，已过期的标记为正在结束
+func (s *userSessionStore) due(now time.Time, before time.Duration) (reauth []string, expired map[string]uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expired = make(map[string]uint32)
+	for id, session := range s.sessions {
+		if session.State != UserSessionOpen || session.expiring != 0 {
+			continue
+		}
+		switch {
+		case !session.SessionExpiresAt.IsZero() && !now.Before(session.SessionExpiresAt):
+			session.expiring = TerminationCauseSessionTimeout
+			expired[id] = session.expiring
+		case !session.GraceExpiresAt.IsZero() && !now.Before(session.GraceExpiresAt):
+			session.expiring = TerminationCauseAuthExpired
+			expired[id] = session.expiring
+		case before > 0 && !session.AuthExpiresAt.IsZero() && !session.reauthSent && session.Pending == "" &&
+			!now.Before(session.AuthExpiresAt.Add(-before)):
+			session.reauthSent = true
+			reauth = append(reauth, id)
+		}
+	}
+	return reauth, expired
+}
+
+// 会话是否因授权到期或Session-Timeout已结束(或正在结束)
+func (s *userSessionStore) expired(sessionID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[sessionID]
+	if !ok {
+		return false
+	}
+	if session.State == UserSessionOpen {
+		return session.expiring != 0
+	}
+	return session.TerminationCause == terminationCauseNames[TerminationCauseAuthExpired] ||
+		session.TerminationCause == terminationCauseNames[TerminationCauseSessionTimeout]
+}
+
+// 查询进行中的会话，没有或已结束时返回nil
+func (s *userSessionStore) get(sessionID string) *UserSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[sessionID]
+	if !ok || session.State != UserSessionOpen {
+		return nil
+	}
+	copied := *session
+	return &copied
+}
+
+// 结束会话，会话不存在或已结束时返回false
+func (s *userSessionStore) terminate(sessionID string, cause uint32) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[sessionID]
+	if !ok || session.State != UserSessionOpen {
+		return false
+	}
+	s.terminateLocked(session, cause, time.Now())
+	return true
+}
+
+// 对端重启或下线时结束该对端的所有会话，返回结束的个数
+func (s *userSessionStore) terminatePeer(peerHost string, cause uint32) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	count := 0
+	for _, session := range s.sessions {
+		if session.PeerHost == peerHost && session.State == UserSessionOpen {
+			s.terminateLocked(session, cause, now)
+			count++
+		}
+	}
+	return count
+}
+
+func (s *userSessionStore) terminateLocked(session *UserSession, cause uint32, now time.Time) {
+	session.State = UserSessionTerminated
+	session.TerminationCause = terminationCauseNames[cause]
+	if session.TerminationCause == "" {
+		session.TerminationCause = "UNKNOWN"
+	}
+	session.TerminatedAt = now
+	session.UpdatedAt = now
+	peerTable.unbindSession(session.PeerHost, session.SessionID)
+}
+
+// 清理超过保留时间的已结束会话，调用方持有锁
+func (s *userSessionStore) expire(now time.Time) {
+	retention := config.Sessions.retention()
+	for id, session := range s.sessions {
+		if session.State != UserSessionOpen && now.Sub(session.TerminatedAt) > retention {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+// UserSessions 返回所有用户会话的快照，按创建时间排序
+func UserSessions() []UserSession {
+	userSessions.mu.Lock()
+	defer userSessions.mu.Unlock()
+	userSessions.expire(time.Now())
+	sessions := make([]UserSession, 0, len(userSessions.sessions))
+	for _, session := range userSessions.sessions {
+		sessions = append(sessions, *session)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].CreatedAt.Before(sessions[j].CreatedAt) })
+	return sessions
+}
+
+// GetUserSession 按Session-Id查询用户会话
+func GetUserSession(sessionID string) (UserSession, bool) {
+	userSessions.mu.Lock()
+	defer userSessions.mu.Unlock()
+	session, ok := userSessions.sessions[sessionID]
+	if !ok {
+		return UserSession{}, false
+	}
+	return *session, true
+}
+
+// 处理STR，结束会话并回复STA，会话不存在或已结束时回复5002
+func handleSTR(session *Session, msg *DiameterMsg) (*DiameterMsg, error) {
+	sessionID := msg.GetSessionID()
+	cause := avpIntData(msg, AVP_TerminationCause)
+	log.Printf("主机%v 会话结束请求 Session-Id: %v Termination-Cause: %v", session.PeerHost, sessionID, terminationCauseNames[cause])
+
+	builder := newAnswerBuilder(msg)
+	if session.State() != StateEstablished {
+		return builder.
+			AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(ResultCode_UnableToDeliver).Build()).
+			AddAVP(NewAVPBuilder(AVP_ErrorMessage, 0).SetStringData("session not established, send CER first").Build()).
+			Build(), nil
+	}
+
+	// 只有建立会话的对端可以结束会话
+	userSession := userSessions.get(sessionID)
+	if userSession == nil || userSession.PeerHost != session.PeerHost || !userSessions.terminate(sessionID, cause) {
+		log.Printf("主机%v 会话%v不存在或已结束", session.PeerHost, sessionID)
+		return builder.
+			AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(ResultCode_UnknownSessionID).Build()).
+			AddAVP(NewAVPBuilder(AVP_ErrorMessage, 0).SetStringData("unknown session").Build()).
+			Build(), nil
+	}
+	log.Printf("主机%v 用户%v 会话%v已结束", session.PeerHost, userSession.UserName, sessionID)
+	if userSession.UserName != "" {
+		builder.AddAVP(NewAVPBuilder(AVP_UserName, AVPFlag_Mandatory).SetStringData(userSession.UserName).Build())
+	}
+	return builder.
+		AddAVP(NewAVPBuilder(AVP_ResultCode, AVPFlag_Mandatory).SetIntData(ResultCode_Success).Build()).
+		Build(), nil
+}